@@ -1,6 +1,7 @@
 package bench
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"encoding/json"
@@ -352,7 +353,7 @@ func (c *Checker) Play(ctx context.Context, a *CheckAction) error {
 	var req *http.Request
 	var err error
 
-	if strings.ToUpper(a.Method) == "POST" {
+	if method := strings.ToUpper(a.Method); method == "POST" || method == "PUT" {
 		if a.PostBody != nil {
 			req, err = c.NewRequest(a.Method, a.Path, a.PostBody)
 			if req != nil {
@@ -412,7 +413,7 @@ func (c *Checker) Play(ctx context.Context, a *CheckAction) error {
 		timeout = a.Timeout
 	} else {
 		timeout = GetTimeout
-		if req.Method == http.MethodPost {
+		if req.Method == http.MethodPost || req.Method == http.MethodPut {
 			timeout = PostTimeout
 		} else if req.Method == http.MethodDelete {
 			timeout = DeleteTimeout
@@ -512,3 +513,155 @@ func (c *Checker) Play(ctx context.Context, a *CheckAction) error {
 	counter.IncKey(a.Method + "|" + a.Path)
 	return nil
 }
+
+// An event pushed by Server-Sent Events
+type StreamEvent struct {
+	ID    string
+	Event string
+	Data  string
+}
+
+type StreamAction struct {
+	Path    string
+	Headers map[string]string
+
+	ExpectedStatusCode int
+	Description        string
+	// Called on every pushed event. Reading the stream stops when it returns true.
+	EventFunc func(*StreamEvent) (bool, error)
+
+	// Timeout of the whole stream. Reaching it before EventFunc returns true is an error.
+	Timeout time.Duration
+}
+
+func (c *Checker) Stream(ctx context.Context, a *StreamAction) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	select {
+	case token := <-c.chRequestToken:
+		defer func() {
+			c.chRequestToken <- token
+		}()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	ca := &CheckAction{Method: "GET", Path: a.Path, Description: a.Description}
+
+	req, err := c.NewRequest("GET", a.Path, nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return c.OnError(ca, req, fmt.Errorf("リクエストに失敗しました (主催者に連絡してください)"))
+	}
+
+	if DebugMode {
+		for k, v := range c.debugHeaders {
+			req.Header.Set(k, v)
+		}
+		cnt := atomic.AddInt32(&checkerRequestCounter, 1)
+		req.Header.Set("X-Request-ID", fmt.Sprint(cnt))
+	}
+
+	req.Header.Set("User-Agent", UserAgent)
+	req.Header.Set("Accept", "text/event-stream")
+	for key, val := range a.Headers {
+		req.Header.Add(key, val)
+	}
+
+	timeout := GetTimeout
+	if a.Timeout > 0 {
+		timeout = a.Timeout
+	}
+	streamCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	req = req.WithContext(streamCtx)
+
+	res, err := c.Client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if streamCtx.Err() == context.DeadlineExceeded {
+			return c.OnError(ca, req, RequestTimeoutError)
+		}
+		if e, ok := err.(net.Error); ok && e.Timeout() {
+			return c.OnError(ca, req, RequestTimeoutError)
+		}
+		return c.OnError(ca, req, fmt.Errorf("リクエストに失敗しました %v", err))
+	}
+	defer res.Body.Close()
+
+	if 500 <= res.StatusCode {
+		return c.OnError(ca, res.Request, fmt.Errorf("サーバエラーが発生しました。%s", res.Status))
+	}
+	expected := a.ExpectedStatusCode
+	if expected == 0 {
+		expected = 200
+	}
+	if res.StatusCode != expected {
+		return c.OnError(ca, res.Request, fmt.Errorf("Response code should be %d, got %d", expected, res.StatusCode))
+	}
+	if !strings.HasPrefix(res.Header.Get("Content-Type"), "text/event-stream") {
+		return c.OnError(ca, res.Request, fmt.Errorf("ストリームのContent-Typeが正しくありません"))
+	}
+
+	reader := bufio.NewReader(res.Body)
+	ev := &StreamEvent{}
+	var data []string
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if streamCtx.Err() == context.DeadlineExceeded {
+				return c.OnError(ca, res.Request, RequestTimeoutError)
+			}
+			return c.OnError(ca, res.Request, fmt.Errorf("ストリームが切断されました %v", err))
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		if line == "" {
+			// Dispatch the event
+			if data == nil {
+				ev = &StreamEvent{}
+				continue
+			}
+			ev.Data = strings.Join(data, "\n")
+			if ev.Event == "" {
+				ev.Event = "message"
+			}
+			done, err := a.EventFunc(ev)
+			if err != nil {
+				return c.OnError(ca, res.Request, err)
+			}
+			if done {
+				break
+			}
+			ev = &StreamEvent{}
+			data = nil
+			continue
+		}
+		if strings.HasPrefix(line, ":") {
+			continue // heartbeat or comment
+		}
+
+		field, value := line, ""
+		if i := strings.IndexByte(line, ':'); i >= 0 {
+			field, value = line[:i], strings.TrimPrefix(line[i+1:], " ")
+		}
+		switch field {
+		case "id":
+			ev.ID = value
+		case "event":
+			ev.Event = value
+		case "data":
+			data = append(data, value)
+		}
+	}
+
+	counter.IncKey("GET|" + a.Path)
+	return nil
+}
@@ -11,12 +11,16 @@ import (
 	"math/rand"
 	"os"
 	"path/filepath"
+	"runtime"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"bench/parameter"
+
+	"golang.org/x/crypto/bcrypt"
 )
 
 var (
@@ -24,8 +28,47 @@ var (
 	DataSet  BenchDataSet
 	Rng      = rand.New(rand.NewSource(42))
 	JST      = time.FixedZone("Asia/Tokyo", 9*60*60)
+
+	// PassHashFormat is the format of pass_hash written by GenerateInitialDataSetSQL
+	PassHashFormat = PassHashSHA256
 )
 
+const (
+	PassHashSHA256 = "sha256" // hex digest without prefix, which the webapp re-hashes on login
+	PassHashBcrypt = "bcrypt"
+)
+
+// Hashes the passwords in PassHashFormat. bcrypt is slow, so that they are hashed in parallel.
+func passHashes(passwords []string) []string {
+	hashes := make([]string, len(passwords))
+	if PassHashFormat != PassHashBcrypt {
+		for i, password := range passwords {
+			hashes[i] = fmt.Sprintf("%x", sha256.Sum256([]byte(password)))
+		}
+		return hashes
+	}
+
+	var wg sync.WaitGroup
+	indexes := make(chan int)
+	for n := 0; n < runtime.NumCPU(); n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				hash, err := bcrypt.GenerateFromPassword([]byte(passwords[i]), bcrypt.DefaultCost)
+				must(err)
+				hashes[i] = string(hash)
+			}
+		}()
+	}
+	for i := range passwords {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+	return hashes
+}
+
 func reverse(s string) string {
 	r := []rune(s)
 	for i, j := 0, len(r)-1; i < len(r)/2; i, j = i+1, j-1 {
@@ -130,14 +173,8 @@ func prepareEventDataSet() {
 		if remains == 0 {
 			event.ReserveRequestedCount = DataSet.SheetTotal
 			event.ReserveCompletedCount = DataSet.SheetTotal
-			event.ReserveRequestedRT.S = DataSet.SheetKindMap["S"].Total
-			event.ReserveRequestedRT.A = DataSet.SheetKindMap["A"].Total
-			event.ReserveRequestedRT.B = DataSet.SheetKindMap["B"].Total
-			event.ReserveRequestedRT.C = DataSet.SheetKindMap["C"].Total
-			event.ReserveCompletedRT.S = DataSet.SheetKindMap["S"].Total
-			event.ReserveCompletedRT.A = DataSet.SheetKindMap["A"].Total
-			event.ReserveCompletedRT.B = DataSet.SheetKindMap["B"].Total
-			event.ReserveCompletedRT.C = DataSet.SheetKindMap["C"].Total
+			event.ReserveRequestedRT.FillAll()
+			event.ReserveCompletedRT.FillAll()
 		}
 
 		DataSet.Events = append(DataSet.Events, event)
@@ -156,19 +193,9 @@ func prepareEventDataSet() {
 			Price:    uint(1000 + i/priceStrides*1000),
 			ReserveRequestedCount: DataSet.SheetTotal,
 			ReserveCompletedCount: DataSet.SheetTotal,
-			ReserveRequestedRT: ReservationTickets{
-				DataSet.SheetKindMap["S"].Total,
-				DataSet.SheetKindMap["A"].Total,
-				DataSet.SheetKindMap["B"].Total,
-				DataSet.SheetKindMap["C"].Total,
-			},
-			ReserveCompletedRT: ReservationTickets{
-				DataSet.SheetKindMap["S"].Total,
-				DataSet.SheetKindMap["A"].Total,
-				DataSet.SheetKindMap["B"].Total,
-				DataSet.SheetKindMap["C"].Total,
-			},
 		}
+		event.ReserveRequestedRT.FillAll()
+		event.ReserveCompletedRT.FillAll()
 		DataSet.ClosedEvents = append(DataSet.ClosedEvents, event)
 		nextID++
 	}
@@ -345,12 +372,14 @@ func GenerateInitialDataSetSQL(outputPath string) {
 	fbadf(w, "BEGIN;")
 
 	// user
+	passwords := make([]string, len(DataSet.Users))
+	for i, user := range DataSet.Users {
+		passwords[i] = user.Password
+	}
+	passDigests := passHashes(passwords)
 	fbadf(w, "INSERT INTO users (id, nickname, login_name, pass_hash) VALUES ")
 	for i, user := range DataSet.Users {
-		passDigest := fmt.Sprintf("%x", sha256.Sum256([]byte(user.Password)))
-		must(err)
-
-		fbadf(w, "(%s, %s, %s, %s)", user.ID, user.Nickname, user.LoginName, passDigest)
+		fbadf(w, "(%s, %s, %s, %s)", user.ID, user.Nickname, user.LoginName, passDigests[i])
 		if i == len(DataSet.Users)-1 {
 			fbadf(w, ";")
 		} else {
@@ -359,12 +388,14 @@ func GenerateInitialDataSetSQL(outputPath string) {
 	}
 
 	// administrator
+	passwords = make([]string, len(DataSet.Administrators))
+	for i, administrator := range DataSet.Administrators {
+		passwords[i] = administrator.Password
+	}
+	passDigests = passHashes(passwords)
 	fbadf(w, "INSERT INTO administrators (id, nickname, login_name, pass_hash) VALUES ")
 	for i, administrator := range DataSet.Administrators {
-		passDigest := fmt.Sprintf("%x", sha256.Sum256([]byte(administrator.Password)))
-		must(err)
-
-		fbadf(w, "(%s, %s, %s, %s)", administrator.ID, administrator.Nickname, administrator.LoginName, passDigest)
+		fbadf(w, "(%s, %s, %s, %s)", administrator.ID, administrator.Nickname, administrator.LoginName, passDigests[i])
 		if i == len(DataSet.Administrators)-1 {
 			fbadf(w, ";")
 		} else {
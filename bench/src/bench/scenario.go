@@ -3,6 +3,7 @@ package bench
 import (
 	"bench/counter"
 	"bench/parameter"
+	"bufio"
 	"bytes"
 	"context"
 	"crypto/md5"
@@ -17,9 +18,12 @@ import (
 	"math"
 	"math/rand"
 	"net/http"
+	"net/url"
 	"os"
 	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/PuerkitoBio/goquery"
@@ -60,6 +64,30 @@ func checkJsonErrorResponse(errorCode string) func(res *http.Response, body *byt
 	}
 }
 
+func checkRemains(
+	eventID uint,
+	total uint,
+	cancelCompletedCountBeforeRequest uint,
+	reserveRequestedCountAfterResponse uint,
+	remains uint,
+	cancelRequestedCountAfterResponse uint,
+	reserveCompletedCountBeforeResponse uint) error {
+	log.Printf("debug: EventID:%d total:%d+cancelCompletedCountBeforeRequest:%d-reserveRequestedCountAfterResponse:%d <= remains:%d <= total:%d+cancelRequestedCountAfterResponse:%d-reserveCompletedCountBeforeResponse:%d",
+		eventID,
+		total,
+		cancelCompletedCountBeforeRequest,
+		reserveRequestedCountAfterResponse,
+		remains,
+		total,
+		cancelRequestedCountAfterResponse,
+		reserveCompletedCountBeforeResponse)
+	if int32(total)+int32(cancelCompletedCountBeforeRequest)-int32(reserveRequestedCountAfterResponse) <= int32(remains) &&
+		int32(remains) <= int32(total)+int32(cancelRequestedCountAfterResponse)-int32(reserveCompletedCountBeforeResponse) {
+		return nil
+	}
+	return &fatalError{}
+}
+
 func checkEventList(state *State, eventsBeforeRequest []*Event, events []JsonEvent, eventsAfterResponse []*Event) error {
 	eventsMap := map[uint]JsonEvent{}
 	for _, e := range events {
@@ -73,30 +101,6 @@ func checkEventList(state *State, eventsBeforeRequest []*Event, events []JsonEve
 
 	msg := "正しいイベント一覧を取得できません"
 
-	checkRemains := func(
-		eventID uint,
-		total uint,
-		cancelCompletedCountBeforeRequest uint,
-		reserveRequestedCountAfterResponse uint,
-		remains uint,
-		cancelRequestedCountAfterResponse uint,
-		reserveCompletedCountBeforeResponse uint) error {
-		log.Printf("debug: EventID:%d total:%d+cancelCompletedCountBeforeRequest:%d-reserveRequestedCountAfterResponse:%d <= remains:%d <= total:%d+cancelRequestedCountAfterResponse:%d-reserveCompletedCountBeforeResponse:%d",
-			eventID,
-			total,
-			cancelCompletedCountBeforeRequest,
-			reserveRequestedCountAfterResponse,
-			remains,
-			total,
-			cancelRequestedCountAfterResponse,
-			reserveCompletedCountBeforeResponse)
-		if int32(total)+int32(cancelCompletedCountBeforeRequest)-int32(reserveRequestedCountAfterResponse) <= int32(remains) &&
-			int32(remains) <= int32(total)+int32(cancelRequestedCountAfterResponse)-int32(reserveCompletedCountBeforeResponse) {
-			return nil
-		}
-		return &fatalError{}
-	}
-
 	for _, eventBeforeRequest := range eventsBeforeRequest {
 		e, ok := eventsMap[eventBeforeRequest.ID]
 		if !ok {
@@ -118,7 +122,7 @@ func checkEventList(state *State, eventsBeforeRequest []*Event, events []JsonEve
 			if e.Sheets[rank].Total != sheetKind.Total {
 				return fatalErrorf("イベント(id:%d)の%s席の総座席数が正しくありません", e.ID, rank)
 			}
-			if expected := eventBeforeRequest.Price + sheetKind.Price; e.Sheets[rank].Price != expected {
+			if expected := eventBeforeRequest.RankPrice(rank); e.Sheets[rank].Price != expected {
 				return fatalErrorf("イベント(id:%d)の%s席の価格が正しくありません", e.ID, rank)
 			}
 		}
@@ -446,6 +450,39 @@ func LoadReserveSheet(ctx context.Context, state *State) error {
 	return nil
 }
 
+// 友達の分もまとめて複数席を一度に予約するユーザがいる
+func LoadReserveSheets(ctx context.Context, state *State) error {
+	user, userChecker, userPush := state.PopRandomUser()
+	if user == nil {
+		return nil
+	}
+	defer userPush()
+
+	err := loginAppUser(ctx, userChecker, user)
+	if err != nil {
+		return err
+	}
+
+	eventSheets, eventSheetsPush, err := popOrCreateEventSheets(ctx, state, 2+rand.Intn(3))
+	if err != nil {
+		return err
+	}
+	if eventSheets == nil {
+		return nil
+	}
+
+	reservations, err := reserveSheets(ctx, state, userChecker, user, eventSheets)
+	if reservations == nil && err == nil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer eventSheetsPush() // NOTE: push only after reserve succeeds
+
+	return nil
+}
+
 // 売り切れたイベントをひたすらF5してキャンセルが出るのを待つユーザがいる
 func LoadGetEvent(ctx context.Context, state *State) error {
 	// LoadGetEvent() can run concurrently, but CheckCancelReserveSheet() can not
@@ -573,6 +610,188 @@ func CheckGetEvent(ctx context.Context, state *State) error {
 	return nil
 }
 
+// Checks remains of the rank pushed by the stream is included in the range expected from the state.
+func checkStreamRemains(beforeEvent *Event, afterEvent *Event, rank string, remains uint) error {
+	afterEvent.reservationMtx.RLock()
+	defer afterEvent.reservationMtx.RUnlock()
+
+	return checkRemains(
+		beforeEvent.ID,
+		DataSet.SheetKindMap[rank].Total,
+		beforeEvent.CancelCompletedRT.Get(rank),
+		afterEvent.ReserveRequestedRT.Get(rank),
+		remains,
+		afterEvent.CancelRequestedRT.Get(rank),
+		beforeEvent.ReserveCompletedRT.Get(rank))
+}
+
+// 残座席数の変化がストリームで配信されること
+func CheckEventStream(ctx context.Context, state *State) error {
+	eventSheet, eventSheetPush, err := popOrCreateEventSheet(ctx, state)
+	if err != nil {
+		return err
+	}
+	if eventSheet == nil {
+		return nil
+	}
+	defer eventSheetPush()
+
+	eventID := eventSheet.EventID
+	rank := eventSheet.Rank
+
+	user, checker, userPush := state.PopRandomUser()
+	if user == nil {
+		return nil
+	}
+	defer userPush()
+
+	err = loginAppUser(ctx, checker, user)
+	if err != nil {
+		return err
+	}
+
+	event := state.GetEventByID(eventID)
+	path := fmt.Sprintf("/api/events/%d/stream", eventID)
+
+	beforeStream := CopyEvent(event)
+	streamCtx, cancelStream := context.WithCancel(ctx)
+	opened := make(chan struct{})
+	reflected := make(chan *StreamEvent, 1)
+	streamErr := make(chan error, 1)
+
+	// Guarded by mtx as EventFunc runs in another goroutine
+	var mtx sync.Mutex
+	var snapshotID string
+	var latest *StreamEvent
+	var latestRemains uint
+	var afterReserve *Event
+
+	defer cancelStream()
+
+	// Must be called with mtx locked
+	notifyReflected := func(ev *StreamEvent, remains uint) bool {
+		if afterReserve == nil || checkStreamRemains(afterReserve, event, rank, remains) != nil {
+			return false
+		}
+		select {
+		case reflected <- ev:
+		default:
+		}
+		return true
+	}
+
+	go func() {
+		streamErr <- checker.Stream(streamCtx, &StreamAction{
+			Path:               path,
+			ExpectedStatusCode: 200,
+			Description:        "残座席数をストリームで取得できること",
+			EventFunc: func(ev *StreamEvent) (bool, error) {
+				mtx.Lock()
+				defer mtx.Unlock()
+
+				switch ev.Event {
+				case "snapshot":
+					var snapshot JsonStreamSnapshot
+					if err := json.Unmarshal([]byte(ev.Data), &snapshot); err != nil {
+						return false, fatalErrorf("Jsonのデコードに失敗 %s %v", ev.Data, err)
+					}
+					for _, sheetKind := range DataSet.SheetKinds {
+						remains, ok := snapshot.Remains[sheetKind.Rank]
+						if !ok || checkStreamRemains(beforeStream, event, sheetKind.Rank, remains) != nil {
+							return false, fatalErrorf("ストリームで配信されたイベント(id:%d)の%s席の残座席数が正しくありません", eventID, sheetKind.Rank)
+						}
+					}
+					if snapshotID == "" {
+						snapshotID = ev.ID
+						close(opened)
+					}
+				case "remains":
+					var pushed JsonStreamRemains
+					if err := json.Unmarshal([]byte(ev.Data), &pushed); err != nil {
+						return false, fatalErrorf("Jsonのデコードに失敗 %s %v", ev.Data, err)
+					}
+					if _, ok := DataSet.SheetKindMap[pushed.SheetRank]; !ok {
+						return false, fatalErrorf("ストリームで配信された席種が正しくありません(id:%d rank:%s)", eventID, pushed.SheetRank)
+					}
+					if checkStreamRemains(beforeStream, event, pushed.SheetRank, pushed.Remains) != nil {
+						return false, fatalErrorf("ストリームで配信されたイベント(id:%d)の%s席の残座席数が正しくありません", eventID, pushed.SheetRank)
+					}
+					if pushed.SheetRank == rank {
+						latest = ev
+						latestRemains = pushed.Remains
+						if notifyReflected(ev, pushed.Remains) {
+							return true, nil
+						}
+					}
+				}
+				return false, nil
+			},
+		})
+	}()
+
+	select {
+	case <-opened:
+	case err := <-streamErr:
+		return err
+	case <-ctx.Done():
+		return nil
+	}
+
+	_, err = reserveSheet(ctx, state, checker, user, eventSheet)
+	if err != nil {
+		return err
+	}
+
+	mtx.Lock()
+	afterReserve = CopyEvent(event)
+	if latest != nil {
+		notifyReflected(latest, latestRemains)
+	}
+	mtx.Unlock()
+
+	var reflectedEvent *StreamEvent
+	select {
+	case reflectedEvent = <-reflected:
+	case err := <-streamErr:
+		if err != nil {
+			return err
+		}
+		return fatalErrorf("予約がストリームに配信されていません(id:%d rank:%s)", eventID, rank)
+	case <-time.After(parameter.AllowableDelay):
+		return fatalErrorf("予約が%s以内にストリームに配信されていません(id:%d rank:%s)", parameter.AllowableDelay, eventID, rank)
+	}
+	cancelStream()
+
+	// Resuming from the snapshot replays the missed events
+	err = checker.Stream(ctx, &StreamAction{
+		Path:               path,
+		Headers:            map[string]string{"Last-Event-ID": snapshotID},
+		ExpectedStatusCode: 200,
+		Description:        "Last-Event-IDを指定してストリームを再開できること",
+		EventFunc: func(ev *StreamEvent) (bool, error) {
+			switch ev.Event {
+			case "snapshot":
+				// Too many events have been pushed since the snapshot
+				log.Printf("warn: CheckEventStream: stream of event:%d was not resumed from %s\n", eventID, snapshotID)
+				return true, nil
+			case "remains":
+				if ev.ID == reflectedEvent.ID {
+					if ev.Data != reflectedEvent.Data {
+						return false, fatalErrorf("再開したストリームで配信された内容が正しくありません(id:%d event-id:%s)", eventID, ev.ID)
+					}
+					return true, nil
+				}
+			}
+			return false, nil
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
 func LoadReport(ctx context.Context, state *State) error {
 	admin, checker, push := state.PopRandomAdministrator()
 	if admin == nil {
@@ -832,6 +1051,118 @@ func CheckLogin(ctx context.Context, state *State) error {
 	return nil
 }
 
+// Another device logs out all the devices, including the one the user or the administrator is logged in.
+func CheckLogoutAllDevices(ctx context.Context, state *State) error {
+	user, checker, push := state.PopRandomUser()
+	if user == nil {
+		return nil
+	}
+	defer push()
+
+	err := loginAppUser(ctx, checker, user)
+	if err != nil {
+		return err
+	}
+
+	device := NewChecker()
+	err = device.Play(ctx, &CheckAction{
+		Method:             "POST",
+		Path:               "/api/actions/login",
+		ExpectedStatusCode: 200,
+		PostJSON: map[string]interface{}{
+			"login_name": user.LoginName,
+			"password":   user.Password,
+		},
+		Description: "別の端末からログインできること",
+		CheckFunc:   checkJsonUserResponse(user),
+	})
+	if err != nil {
+		return err
+	}
+
+	err = device.Play(ctx, &CheckAction{
+		Method:             "POST",
+		Path:               "/api/actions/logout_all",
+		ExpectedStatusCode: 204,
+		Description:        "全端末からログアウトできること",
+	})
+	if err != nil {
+		return err
+	}
+	user.Status.Online = false
+
+	for _, c := range []*Checker{checker, device} {
+		err = c.Play(ctx, &CheckAction{
+			Method:             "GET",
+			Path:               fmt.Sprintf("/api/users/%d", user.ID),
+			ExpectedStatusCode: 401,
+			Description:        "全端末からログアウトした場合ログインが必要になること",
+			CheckFunc:          checkJsonErrorResponse("login_required"),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	err = loginAppUser(ctx, checker, user)
+	if err != nil {
+		return err
+	}
+
+	admin, adminChecker, adminPush := state.PopRandomAdministrator()
+	if admin == nil {
+		return nil
+	}
+	defer adminPush()
+
+	err = loginAdministrator(ctx, adminChecker, admin)
+	if err != nil {
+		return err
+	}
+
+	adminDevice := NewChecker()
+	err = adminDevice.Play(ctx, &CheckAction{
+		Method:             "POST",
+		Path:               "/admin/api/actions/login",
+		ExpectedStatusCode: 200,
+		PostJSON: map[string]interface{}{
+			"login_name": admin.LoginName,
+			"password":   admin.Password,
+		},
+		Description: "別の端末から管理者でログインできること",
+		CheckFunc:   checkJsonAdministratorResponse(admin),
+	})
+	if err != nil {
+		return err
+	}
+
+	err = adminDevice.Play(ctx, &CheckAction{
+		Method:             "POST",
+		Path:               "/admin/api/actions/logout_all",
+		ExpectedStatusCode: 204,
+		Description:        "管理者が全端末からログアウトできること",
+	})
+	if err != nil {
+		return err
+	}
+	admin.Status.Online = false
+
+	for _, c := range []*Checker{adminChecker, adminDevice} {
+		err = c.Play(ctx, &CheckAction{
+			Method:             "GET",
+			Path:               "/admin/api/events",
+			ExpectedStatusCode: 401,
+			Description:        "管理者が全端末からログアウトした場合ログインが必要になること",
+			CheckFunc:          checkJsonErrorResponse("admin_login_required"),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return loginAdministrator(ctx, adminChecker, admin)
+}
+
 func CheckTopPage(ctx context.Context, state *State) error {
 	user, checker, push := state.PopRandomUser()
 	if user == nil {
@@ -1073,60 +1404,205 @@ func CheckAdminTopPage(ctx context.Context, state *State) error {
 		return err
 	}
 
-	return nil
-}
+	// The dashboard is loaded by admin.js after the page.
+	timeBefore = time.Now().Add(-1 * parameter.AllowableDelay)
+	eventsBeforeRequest = FilterEventsToAllowDelay(state.GetCopiedEvents(), timeBefore)
 
-func CheckMyPage(ctx context.Context, state *State) error {
-	user, checker, push := state.PopRandomUser()
-	if user == nil {
-		return nil
-	}
-	defer push()
+	err = checker.Play(ctx, &CheckAction{
+		Method:             "GET",
+		Path:               "/admin/api/dashboard",
+		ExpectedStatusCode: 200,
+		Description:        "ダッシュボードを取得できること",
+		CheckFunc: func(res *http.Response, body *bytes.Buffer) error {
+			dec := json.NewDecoder(body)
+			var dashboard []JsonDashboardEvent
+			err := dec.Decode(&dashboard)
+			if err != nil {
+				return fatalErrorf("ダッシュボードのJsonデコードに失敗 %v", err)
+			}
 
-	err := loginAppUser(ctx, checker, user)
+			eventsAfterResponse := state.GetEvents()
+			return checkDashboard(eventsBeforeRequest, dashboard, eventsAfterResponse)
+		},
+	})
 	if err != nil {
 		return err
 	}
 
-	// Assume that public events are not modified (closed or private)
-	timeBefore := time.Now().Add(-1 * parameter.AllowableDelay)
-	eventsBeforeRequestOrig := FilterEventsToAllowDelay(state.GetCopiedEvents(), timeBefore)
-
-	err = checker.Play(ctx, &CheckAction{
-		Method:             "GET",
-		Path:               fmt.Sprintf("/api/users/%d", user.ID),
-		ExpectedStatusCode: 200,
-		Description:        "ページが表示されること",
-		CheckFunc: checkJsonFullUserResponse(user, func(fullUser *JsonFullUser) error {
-			// check total price range
-			if !(user.Status.NegativeTotalPrice <= fullUser.TotalPrice || fullUser.TotalPrice <= user.Status.PositiveTotalPrice) {
-				log.Printf("warn: miss match user total price expected=%s got=%d userID=%d\n", user.Status.TotalPriceString(), fullUser.TotalPrice, fullUser.ID)
-				return fatalErrorf("予約総額が最新の状態ではありません userID=%d", fullUser.ID)
-			}
+	return nil
+}
 
-			// check duplicate and filter expected events
-			var eventsBeforeRequest []*Event
-			var eventsAfterResponse []*Event
-			{
-				seen := map[uint]struct{}{}
-				for _, r := range fullUser.RecentReservations {
-					_, exists := seen[r.ReservationID]
-					if exists {
-						return fatalErrorf("最近予約した席が重複しています userID=%d", fullUser.ID)
-					}
+// Checks the sales of the dashboard are included in the range expected from the state.
+func checkDashboard(eventsBeforeRequest []*Event, dashboard []JsonDashboardEvent, eventsAfterResponse []*Event) error {
+	dashboardMap := map[uint]JsonDashboardEvent{}
+	for _, e := range dashboard {
+		dashboardMap[e.ID] = e
+	}
 
-					seen[r.ReservationID] = struct{}{}
-				}
+	eventsAfterResponseMap := map[uint]*Event{}
+	for _, e := range eventsAfterResponse {
+		eventsAfterResponseMap[e.ID] = e
+	}
 
-				seen = map[uint]struct{}{}
-				for _, e := range fullUser.RecentEvents {
-					_, exists := seen[e.ID]
-					if exists {
-						return fatalErrorf("最近予約したイベントが重複しています userID=%d", fullUser.ID)
-					}
+	for _, eventBeforeRequest := range eventsBeforeRequest {
+		// Closed events are not on the dashboard
+		if eventBeforeRequest.ClosedFg {
+			if _, ok := dashboardMap[eventBeforeRequest.ID]; ok {
+				return fatalErrorf("ダッシュボードに終了したイベント(id:%d)があります", eventBeforeRequest.ID)
+			}
+			continue
+		}
 
-					seen[e.ID] = struct{}{}
-				}
+		eventAfterResponse, ok := eventsAfterResponseMap[eventBeforeRequest.ID]
+		if !ok { // should never happen
+			log.Printf("debug: checkDashboard: eventAfterResponse did not exist (eventID:%d)\n", eventBeforeRequest.ID)
+			continue
+		}
+
+		e, ok := dashboardMap[eventBeforeRequest.ID]
+		if !ok {
+			// The event may have been closed after the request
+			if eventAfterResponse.ClosedFg {
+				continue
+			}
+			log.Printf("debug: checkDashboard: event id=%d is not found\n", eventBeforeRequest.ID)
+			return fatalErrorf("ダッシュボードにイベント(id:%d)がありません", eventBeforeRequest.ID)
+		}
+
+		eventAfterResponse.reservationMtx.RLock()
+		err := checkDashboardEvent(e, eventBeforeRequest, eventAfterResponse)
+		eventAfterResponse.reservationMtx.RUnlock()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func checkDashboardEvent(e JsonDashboardEvent, eventBeforeRequest *Event, eventAfterResponse *Event) error {
+	if e.Sold < eventBeforeRequest.ReserveCompletedCount || eventAfterResponse.ReserveRequestedCount < e.Sold {
+		log.Printf("debug: eventID=%d sold=%d is not included in count range (%d-%d)\n", e.ID, e.Sold, eventBeforeRequest.ReserveCompletedCount, eventAfterResponse.ReserveRequestedCount)
+		return fatalErrorf("ダッシュボードのイベント(id:%d)の販売数が正しくありません", e.ID)
+	}
+	if e.Canceled < eventBeforeRequest.CancelCompletedCount || eventAfterResponse.CancelRequestedCount < e.Canceled {
+		log.Printf("debug: eventID=%d canceled=%d is not included in count range (%d-%d)\n", e.ID, e.Canceled, eventBeforeRequest.CancelCompletedCount, eventAfterResponse.CancelRequestedCount)
+		return fatalErrorf("ダッシュボードのイベント(id:%d)のキャンセル数が正しくありません", e.ID)
+	}
+	err := checkRemains(
+		e.ID,
+		DataSet.SheetTotal,
+		eventBeforeRequest.CancelCompletedCount,
+		eventAfterResponse.ReserveRequestedCount,
+		e.Remains,
+		eventAfterResponse.CancelRequestedCount,
+		eventBeforeRequest.ReserveCompletedCount)
+	if err != nil {
+		return fatalErrorf("ダッシュボードのイベント(id:%d)の残座席数が正しくありません", e.ID)
+	}
+
+	for _, sheetKind := range DataSet.SheetKinds {
+		rank := sheetKind.Rank
+		sales, ok := e.Ranks[rank]
+		if !ok {
+			return fatalErrorf("ダッシュボードのイベント(id:%d)に%s席がありません", e.ID, rank)
+		}
+
+		// Sheets canceled in the initial data are not counted per rank, but
+		// they are reserved again, so that only the net sales can be checked.
+		net := int32(sales.Sold) - int32(sales.Canceled)
+		min := int32(eventBeforeRequest.ReserveCompletedRT.Get(rank)) - int32(eventAfterResponse.CancelRequestedRT.Get(rank))
+		max := int32(eventAfterResponse.ReserveRequestedRT.Get(rank)) - int32(eventBeforeRequest.CancelCompletedRT.Get(rank))
+		if net < min || max < net {
+			log.Printf("debug: eventID=%d rank=%s net=%d is not included in count range (%d-%d)\n", e.ID, rank, net, min, max)
+			return fatalErrorf("ダッシュボードのイベント(id:%d)の%s席の販売数が正しくありません", e.ID, rank)
+		}
+
+		err := checkRemains(
+			e.ID,
+			sheetKind.Total,
+			eventBeforeRequest.CancelCompletedRT.Get(rank),
+			eventAfterResponse.ReserveRequestedRT.Get(rank),
+			sales.Remains,
+			eventAfterResponse.CancelRequestedRT.Get(rank),
+			eventBeforeRequest.ReserveCompletedRT.Get(rank))
+		if err != nil {
+			return fatalErrorf("ダッシュボードのイベント(id:%d)の%s席の残座席数が正しくありません", e.ID, rank)
+		}
+	}
+
+	// Each figure is aggregated apart, so that they are compared with the state rather than each other.
+	if !(e.Velocity["1m"] <= e.Velocity["5m"] && e.Velocity["5m"] <= e.Velocity["1h"] && e.Velocity["1h"] <= eventAfterResponse.ReserveRequestedCount) {
+		log.Printf("debug: eventID=%d velocity=%v reserveRequestedCount=%d\n", e.ID, e.Velocity, eventAfterResponse.ReserveRequestedCount)
+		return fatalErrorf("ダッシュボードのイベント(id:%d)の販売速度が正しくありません", e.ID)
+	}
+
+	var buyerSheets uint
+	for i, buyer := range e.TopBuyers {
+		if i > 0 && e.TopBuyers[i-1].Sheets < buyer.Sheets {
+			return fatalErrorf("ダッシュボードのイベント(id:%d)の購入上位の順番が正しくありません", e.ID)
+		}
+		buyerSheets += buyer.Sheets
+	}
+	if len(e.TopBuyers) > 5 || buyerSheets > eventAfterResponse.ReserveRequestedCount-eventBeforeRequest.CancelCompletedCount {
+		log.Printf("debug: eventID=%d top buyers=%d sheets=%d\n", e.ID, len(e.TopBuyers), buyerSheets)
+		return fatalErrorf("ダッシュボードのイベント(id:%d)の購入上位が正しくありません", e.ID)
+	}
+
+	return nil
+}
+
+func CheckMyPage(ctx context.Context, state *State) error {
+	user, checker, push := state.PopRandomUser()
+	if user == nil {
+		return nil
+	}
+	defer push()
+
+	err := loginAppUser(ctx, checker, user)
+	if err != nil {
+		return err
+	}
+
+	// Assume that public events are not modified (closed or private)
+	timeBefore := time.Now().Add(-1 * parameter.AllowableDelay)
+	eventsBeforeRequestOrig := FilterEventsToAllowDelay(state.GetCopiedEvents(), timeBefore)
+
+	err = checker.Play(ctx, &CheckAction{
+		Method:             "GET",
+		Path:               fmt.Sprintf("/api/users/%d", user.ID),
+		ExpectedStatusCode: 200,
+		Description:        "ページが表示されること",
+		CheckFunc: checkJsonFullUserResponse(user, func(fullUser *JsonFullUser) error {
+			// check total price range
+			if !(user.Status.NegativeTotalPrice <= fullUser.TotalPrice || fullUser.TotalPrice <= user.Status.PositiveTotalPrice) {
+				log.Printf("warn: miss match user total price expected=%s got=%d userID=%d\n", user.Status.TotalPriceString(), fullUser.TotalPrice, fullUser.ID)
+				return fatalErrorf("予約総額が最新の状態ではありません userID=%d", fullUser.ID)
+			}
+
+			// check duplicate and filter expected events
+			var eventsBeforeRequest []*Event
+			var eventsAfterResponse []*Event
+			{
+				seen := map[uint]struct{}{}
+				for _, r := range fullUser.RecentReservations {
+					_, exists := seen[r.ReservationID]
+					if exists {
+						return fatalErrorf("最近予約した席が重複しています userID=%d", fullUser.ID)
+					}
+
+					seen[r.ReservationID] = struct{}{}
+				}
+
+				seen = map[uint]struct{}{}
+				for _, e := range fullUser.RecentEvents {
+					_, exists := seen[e.ID]
+					if exists {
+						return fatalErrorf("最近予約したイベントが重複しています userID=%d", fullUser.ID)
+					}
+
+					seen[e.ID] = struct{}{}
+				}
 
 				// filter events
 				for _, e := range eventsBeforeRequestOrig {
@@ -1326,6 +1802,238 @@ func CheckMyPage(ctx context.Context, state *State) error {
 		return err
 	}
 
+	err = checkUserReservationHistory(ctx, state, checker, user)
+	if err != nil {
+		return err
+	}
+
+	return checkUserEventHistory(ctx, state, checker, user)
+}
+
+var userHistoryStatuses = []string{"", "active", "canceled"}
+
+// The user is popped, so that no reservation of the user changes while the history is walked.
+func userHistoryReservations(state *State, user *AppUser, status string) (map[uint]*Reservation, time.Time) {
+	timeBefore := time.Now().Add(-1 * parameter.AllowableDelay)
+	reservations := FilterReservationsToAllowDelay(FilterReservationsByUserID(state.GetReservations(), user.ID), timeBefore)
+
+	// expected are those which must be in the history
+	expected := map[uint]*Reservation{}
+	for id, r := range reservations {
+		switch status {
+		case "active":
+			if !r.CancelRequestedAt.IsZero() {
+				continue
+			}
+		case "canceled":
+			if !r.Canceled(timeBefore) {
+				continue
+			}
+		}
+		expected[id] = r
+	}
+	return expected, timeBefore
+}
+
+func checkUserReservationHistory(ctx context.Context, state *State, checker *Checker, user *AppUser) error {
+	status := userHistoryStatuses[rand.Intn(len(userHistoryStatuses))]
+	limit := 20 + rand.Intn(81)
+	expected, timeBefore := userHistoryReservations(state, user, status)
+	reservationMap := state.GetReservations()
+
+	seen := map[uint]struct{}{}
+	var lastID uint
+	var cursor *uint
+	for {
+		query := url.Values{}
+		query.Set("limit", strconv.Itoa(limit))
+		if status != "" {
+			query.Set("status", status)
+		}
+		if cursor != nil {
+			query.Set("cursor", strconv.FormatUint(uint64(*cursor), 10))
+		}
+
+		var page JsonUserReservations
+		err := checker.Play(ctx, &CheckAction{
+			Method:             "GET",
+			Path:               fmt.Sprintf("/api/users/%d/reservations?%s", user.ID, query.Encode()),
+			ExpectedStatusCode: 200,
+			Description:        "予約履歴が取得できること",
+			CheckFunc: func(res *http.Response, body *bytes.Buffer) error {
+				bytes := body.Bytes()
+				dec := json.NewDecoder(body)
+				err := dec.Decode(&page)
+				if err != nil {
+					return fatalErrorf("Jsonのデコードに失敗 %s %v", string(bytes), err)
+				}
+				if page.Reservations == nil {
+					return fatalErrorf("予約履歴を取得できません userID=%d", user.ID)
+				}
+				if len(page.Reservations) > limit || (page.NextCursor != nil && len(page.Reservations) != limit) {
+					return fatalErrorf("予約履歴の件数が正しくありません userID=%d", user.ID)
+				}
+
+				for _, r := range page.Reservations {
+					if r == nil || r.Event == nil {
+						return fatalErrorf("予約履歴の予約がnullです userID=%d", user.ID)
+					}
+					if _, exists := seen[r.ReservationID]; exists {
+						return fatalErrorf("予約履歴の予約が重複しています userID=%d reservationID=%d", user.ID, r.ReservationID)
+					}
+					seen[r.ReservationID] = struct{}{}
+					if lastID != 0 && lastID < r.ReservationID {
+						return fatalErrorf("予約履歴の順番が正しくありません userID=%d", user.ID)
+					}
+					lastID = r.ReservationID
+
+					if (status == "active" && r.CanceledAt != 0) || (status == "canceled" && r.CanceledAt == 0) {
+						return fatalErrorf("予約履歴の絞り込みが正しくありません userID=%d reservationID=%d", user.ID, r.ReservationID)
+					}
+
+					reservation, ok := reservationMap[r.ReservationID]
+					if !ok {
+						// skip
+						log.Printf("warn: skip unknown reservation id:%d userID=%d\n", r.ReservationID, user.ID)
+						continue
+					}
+					if reservation.UserID != user.ID {
+						return fatalErrorf("予約履歴に他のユーザーの予約が含まれています userID=%d reservationID=%d", user.ID, r.ReservationID)
+					}
+					if e := state.GetEventByID(r.Event.ID); e == nil || r.Event.ID != reservation.EventID {
+						log.Printf("info: miss match reservation event id got=%d expected=%d\n", r.Event.ID, reservation.EventID)
+						return fatalErrorf("予約履歴のイベントが正しくありません userID=%d reservationID=%d", user.ID, reservation.ID)
+					} else if r.Event.Title != e.Title {
+						return fatalErrorf("予約履歴のイベント情報(title)が正しくありません userID=%d reservationID=%d", user.ID, reservation.ID)
+					}
+					if r.SheetRank != reservation.SheetRank || r.SheetNum != reservation.SheetNum {
+						log.Printf("info: miss match reservation sheet got=%s-%d expected=%s-%d\n", r.SheetRank, r.SheetNum, reservation.SheetRank, reservation.SheetNum)
+						return fatalErrorf("予約履歴の席が正しくありません userID=%d reservationID=%d", user.ID, reservation.ID)
+					}
+					if r.Price != reservation.Price {
+						log.Printf("info: miss match reservation price got=%d expected=%d\n", r.Price, reservation.Price)
+						return fatalErrorf("予約履歴の価格が正しくありません userID=%d reservationID=%d", user.ID, reservation.ID)
+					}
+					if r.ReservedAt == 0 {
+						return fatalErrorf("予約履歴の予約時刻が正しくありません userID=%d reservationID=%d", user.ID, reservation.ID)
+					}
+					if r.CanceledAt == 0 && reservation.Canceled(timeBefore) {
+						log.Printf("warn: miss match reservation cancellation status expected=canceled userID=%d reservationID=%d\n", user.ID, reservation.ID)
+						return fatalErrorf("予約履歴のキャンセル状態が正しくありません userID=%d reservationID=%d", user.ID, reservation.ID)
+					}
+					if r.CanceledAt != 0 && reservation.CancelRequestedAt.IsZero() {
+						log.Printf("warn: miss match reservation cancellation status expected=not-canceled userID=%d reservationID=%d\n", user.ID, reservation.ID)
+						return fatalErrorf("予約履歴のキャンセル状態が正しくありません userID=%d reservationID=%d", user.ID, reservation.ID)
+					}
+				}
+
+				if page.NextCursor != nil && *page.NextCursor != lastID {
+					return fatalErrorf("予約履歴の次のカーソルが正しくありません userID=%d", user.ID)
+				}
+				return nil
+			},
+		})
+		if err != nil {
+			return err
+		}
+
+		if page.NextCursor == nil {
+			break
+		}
+		cursor = page.NextCursor
+	}
+
+	for id := range expected {
+		if _, ok := seen[id]; !ok {
+			log.Printf("warn: missing reservation in history status=%q userID=%d reservationID=%d\n", status, user.ID, id)
+			return fatalErrorf("予約履歴に予約が含まれていません userID=%d reservationID=%d", user.ID, id)
+		}
+	}
+
+	return nil
+}
+
+func checkUserEventHistory(ctx context.Context, state *State, checker *Checker, user *AppUser) error {
+	status := userHistoryStatuses[rand.Intn(len(userHistoryStatuses))]
+	limit := 1 + rand.Intn(20)
+	expected, _ := userHistoryReservations(state, user, status)
+
+	seen := map[uint]struct{}{}
+	var lastID uint
+	var cursor *uint
+	for {
+		query := url.Values{}
+		query.Set("limit", strconv.Itoa(limit))
+		if status != "" {
+			query.Set("status", status)
+		}
+		if cursor != nil {
+			query.Set("cursor", strconv.FormatUint(uint64(*cursor), 10))
+		}
+
+		var page JsonUserEvents
+		err := checker.Play(ctx, &CheckAction{
+			Method:             "GET",
+			Path:               fmt.Sprintf("/api/users/%d/events?%s", user.ID, query.Encode()),
+			ExpectedStatusCode: 200,
+			Description:        "予約したイベントの履歴が取得できること",
+			CheckFunc: func(res *http.Response, body *bytes.Buffer) error {
+				bytes := body.Bytes()
+				dec := json.NewDecoder(body)
+				err := dec.Decode(&page)
+				if err != nil {
+					return fatalErrorf("Jsonのデコードに失敗 %s %v", string(bytes), err)
+				}
+				if page.Events == nil {
+					return fatalErrorf("予約したイベントの履歴を取得できません userID=%d", user.ID)
+				}
+				if len(page.Events) > limit || (page.NextCursor != nil && len(page.Events) != limit) {
+					return fatalErrorf("予約したイベントの履歴の件数が正しくありません userID=%d", user.ID)
+				}
+
+				for _, re := range page.Events {
+					if re == nil {
+						return fatalErrorf("予約したイベントの履歴のイベントがnullです userID=%d", user.ID)
+					}
+					if _, exists := seen[re.ID]; exists {
+						return fatalErrorf("予約したイベントの履歴が重複しています userID=%d eventID=%d", user.ID, re.ID)
+					}
+					seen[re.ID] = struct{}{}
+					if lastID != 0 && lastID < re.ID {
+						return fatalErrorf("予約したイベントの履歴の順番が正しくありません userID=%d", user.ID)
+					}
+					lastID = re.ID
+
+					if e := state.GetEventByID(re.ID); e == nil {
+						return fatalErrorf("予約したイベントの履歴のイベント情報(id)が正しくありません userID=%d", user.ID)
+					} else if re.Title != e.Title {
+						return fatalErrorf("予約したイベントの履歴のイベント情報(title)が正しくありません userID=%d eventID=%d", user.ID, re.ID)
+					}
+				}
+
+				if page.NextCursor != nil && *page.NextCursor != lastID {
+					return fatalErrorf("予約したイベントの履歴の次のカーソルが正しくありません userID=%d", user.ID)
+				}
+				return nil
+			},
+		})
+		if err != nil {
+			return err
+		}
+
+		if page.NextCursor == nil {
+			break
+		}
+		cursor = page.NextCursor
+	}
+
+	for _, r := range expected {
+		if _, ok := seen[r.EventID]; !ok {
+			log.Printf("warn: missing event in history status=%q userID=%d eventID=%d\n", status, user.ID, r.EventID)
+			return fatalErrorf("予約したイベントの履歴にイベントが含まれていません userID=%d eventID=%d", user.ID, r.EventID)
+		}
+	}
+
 	return nil
 }
 
@@ -1376,7 +2084,7 @@ func CheckCancelReserveSheet(ctx context.Context, state *State) error {
 	}
 
 	// For simplicity, s.reservedEventSheets are not modified in this method.
-	eventSheet := &EventSheet{eventID, rank, NonReservedNum, event.Price + DataSet.SheetKindMap[rank].Price}
+	eventSheet := &EventSheet{eventID, rank, NonReservedNum, event.SheetPrice(rank, reservation.SheetNum)}
 
 	already_locked, err := cancelSheet(ctx, state, cacnelChecker, cancelUser, eventSheet, reservation)
 	if err != nil {
@@ -1411,39 +2119,114 @@ func CheckCancelReserveSheet(ctx context.Context, state *State) error {
 	return nil
 }
 
-func CheckReserveSheet(ctx context.Context, state *State) error {
-	user, userChecker, userPush := state.PopRandomUser()
-	if user == nil {
+// 売り切れたイベントのキャンセル待ちには先着順で席が回ってくること
+func CheckWaitlist(ctx context.Context, state *State) error {
+	// Waiters take over sheets canceled by CheckCancelReserveSheet(), so do not run them concurrently
+	state.getRandomPublicSoldOutEventRWMtx.Lock()
+	defer state.getRandomPublicSoldOutEventRWMtx.Unlock()
+
+	event := state.GetRandomPublicSoldOutEvent()
+	if event == nil {
+		log.Printf("warn: CheckWaitlist: no public and sold-out event")
+		return nil
+	}
+	reservation := state.GetRandomNonCanceledReservationInEventID(event.ID)
+	if reservation == nil {
+		log.Printf("warn: CheckWaitlist: no reservation which is not canceled in event:%d\n", event.ID)
 		return nil
 	}
-	defer userPush()
 
-	err := loginAppUser(ctx, userChecker, user)
+	eventID := event.ID
+	rank := reservation.SheetRank
+
+	cancelUser, cancelChecker, cancelUserPush := state.PopUserByID(reservation.UserID)
+	if cancelUser == nil {
+		return nil
+	}
+	defer cancelUserPush()
+
+	err := loginAppUser(ctx, cancelChecker, cancelUser)
 	if err != nil {
 		return err
 	}
 
-	eventSheet, eventSheetPush, err := popOrCreateEventSheet(ctx, state)
+	waiters := make([]*AppUser, 0, 2)
+	waiterCheckers := make([]*Checker, 0, 2)
+	for i := 0; i < 2; i++ {
+		user, checker, push := state.PopRandomUser()
+		if user == nil {
+			return nil
+		}
+		defer push()
+
+		err := loginAppUser(ctx, checker, user)
+		if err != nil {
+			return err
+		}
+		waiters = append(waiters, user)
+		waiterCheckers = append(waiterCheckers, checker)
+	}
+
+	// The event is sold out by an optimistic prediction, make sure that the rank is actually sold out.
+	soldOut := false
+	err = waiterCheckers[0].Play(ctx, &CheckAction{
+		Method:             "GET",
+		Path:               fmt.Sprintf("/api/events/%d", eventID),
+		ExpectedStatusCode: 200,
+		Description:        "公開イベントを取得できること",
+		CheckFunc: checkJsonEventResponse(event, func(event JsonEvent) error {
+			soldOut = event.Sheets[rank].Remains == 0
+			return nil
+		}),
+	})
 	if err != nil {
 		return err
 	}
-	if eventSheet == nil {
+	if !soldOut {
+		log.Printf("warn: CheckWaitlist: rank %s of event:%d is not sold out\n", rank, eventID)
 		return nil
 	}
 
-	eventID := eventSheet.EventID
-	rank := eventSheet.Rank
+	waiting := make([]bool, len(waiters))
+	defer func() {
+		// Do not leave anybody in the waitlist, otherwise the sheet canceled by others is taken by the waiter.
+		for i, waiter := range waiters {
+			if waiting[i] {
+				leaveWaitlist(ctx, waiterCheckers[i], waiter, eventID, rank)
+			}
+		}
+	}()
+
+	for i := range waiters {
+		entry := &JsonWaitlistEntry{}
+		err = waiterCheckers[i].Play(ctx, &CheckAction{
+			Method:             "POST",
+			Path:               fmt.Sprintf("/api/events/%d/sheets/%s/waitlist", eventID, rank),
+			ExpectedStatusCode: 202,
+			Description:        "売り切れたイベントのキャンセル待ちができること",
+			CheckFunc: func(res *http.Response, body *bytes.Buffer) error {
+				dec := json.NewDecoder(body)
+				err := dec.Decode(entry)
+				if err != nil {
+					return fatalErrorf("Jsonのデコードに失敗 %v", err)
+				}
+				return nil
+			},
+		})
+		if err != nil {
+			return err
+		}
+		waiting[i] = true
 
-	reservation, err := reserveSheet(ctx, state, userChecker, user, eventSheet)
-	if reservation == nil && err == nil {
-		return nil
-	}
-	if err != nil {
-		return err
+		if entry.Position != uint(i+1) {
+			return fatalErrorf("キャンセル待ちの順番が正しくありません(event:%d rank:%s expected:%d got:%d)", eventID, rank, i+1, entry.Position)
+		}
 	}
-	defer eventSheetPush() // NOTE: push only after reserve succeeds
 
-	already_locked, err := cancelSheet(ctx, state, userChecker, user, eventSheet, reservation)
+	// For simplicity, s.reservedEventSheets are not modified in this method.
+	eventSheet := &EventSheet{eventID, rank, NonReservedNum, event.SheetPrice(rank, reservation.SheetNum)}
+
+	already_locked, err := cancelSheet(ctx, state, cancelChecker, cancelUser, eventSheet, reservation)
 	if err != nil {
 		return err
 	}
@@ -1451,8 +2234,117 @@ func CheckReserveSheet(ctx context.Context, state *State) error {
 		return nil
 	}
 
-	// TODO(sonots): Fix race conditions that following error occurs
-	// Response code should be 400, got 403, data: <nil> (DELETE /api/events/11/sheets/C/498/reservation )
+	// The canceled sheet must be offered to the first waiter
+	var hold *JsonHold
+	err = waiterCheckers[0].Play(ctx, &CheckAction{
+		Method:             "GET",
+		Path:               fmt.Sprintf("/api/users/%d", waiters[0].ID),
+		ExpectedStatusCode: 200,
+		Description:        "キャンセル待ちの席を確認できること",
+		CheckFunc: checkJsonFullUserResponse(waiters[0], func(user *JsonFullUser) error {
+			entry := findWaitlistEntry(user.Waitlist, eventID, rank)
+			if entry == nil || entry.Hold == nil {
+				return fatalErrorf("キャンセルされた席が先頭のキャンセル待ちユーザーに割り当てられていません(event:%d rank:%s)", eventID, rank)
+			}
+			hold = entry.Hold
+			return nil
+		}),
+	})
+	if err != nil {
+		return err
+	}
+	waiting[0] = false
+
+	err = waiterCheckers[1].Play(ctx, &CheckAction{
+		Method:             "GET",
+		Path:               fmt.Sprintf("/api/users/%d", waiters[1].ID),
+		ExpectedStatusCode: 200,
+		Description:        "キャンセル待ちの順番を確認できること",
+		CheckFunc: checkJsonFullUserResponse(waiters[1], func(user *JsonFullUser) error {
+			entry := findWaitlistEntry(user.Waitlist, eventID, rank)
+			if entry == nil {
+				return fatalErrorf("キャンセル待ちが取得できません(event:%d rank:%s)", eventID, rank)
+			}
+			if entry.Hold != nil {
+				return fatalErrorf("キャンセルされた席が先着順に割り当てられていません(event:%d rank:%s)", eventID, rank)
+			}
+			if entry.Position != 1 {
+				return fatalErrorf("キャンセル待ちの順番が正しくありません(event:%d rank:%s expected:%d got:%d)", eventID, rank, 1, entry.Position)
+			}
+			return nil
+		}),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = confirmHold(ctx, state, waiterCheckers[0], waiters[0], eventSheet, hold)
+	if err != nil {
+		return err
+	}
+
+	err = leaveWaitlist(ctx, waiterCheckers[1], waiters[1], eventID, rank)
+	if err != nil {
+		return err
+	}
+	waiting[1] = false
+
+	err = waiterCheckers[1].Play(ctx, &CheckAction{
+		Method:             "DELETE",
+		Path:               fmt.Sprintf("/api/events/%d/sheets/%s/waitlist", eventID, rank),
+		ExpectedStatusCode: 400,
+		Description:        "キャンセル待ちしていない場合エラーになること",
+		CheckFunc:          checkJsonErrorResponse("not_waiting"),
+	})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func CheckReserveSheet(ctx context.Context, state *State) error {
+	user, userChecker, userPush := state.PopRandomUser()
+	if user == nil {
+		return nil
+	}
+	defer userPush()
+
+	err := loginAppUser(ctx, userChecker, user)
+	if err != nil {
+		return err
+	}
+
+	eventSheet, eventSheetPush, err := popOrCreateEventSheet(ctx, state)
+	if err != nil {
+		return err
+	}
+	if eventSheet == nil {
+		return nil
+	}
+
+	eventID := eventSheet.EventID
+	rank := eventSheet.Rank
+
+	reservation, err := reserveSheet(ctx, state, userChecker, user, eventSheet)
+	if reservation == nil && err == nil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer eventSheetPush() // NOTE: push only after reserve succeeds
+
+	already_locked, err := cancelSheet(ctx, state, userChecker, user, eventSheet, reservation)
+	if err != nil {
+		return err
+	}
+	if already_locked {
+		return nil
+	}
+
+	// TODO(sonots): Fix race conditions that following error occurs
+	// Response code should be 400, got 403, data: <nil> (DELETE /api/events/11/sheets/C/498/reservation )
 	// It is caused if somebody else reserves the canceled sheet before calling the following 2nd cancelation.
 	// err = userChecker.Play(ctx, &CheckAction{
 	// 	Method:             "DELETE",
@@ -1573,6 +2465,247 @@ func CheckReserveSheet(ctx context.Context, state *State) error {
 	return nil
 }
 
+func CheckReserveSheets(ctx context.Context, state *State) error {
+	user, userChecker, userPush := state.PopRandomUser()
+	if user == nil {
+		return nil
+	}
+	defer userPush()
+
+	err := loginAppUser(ctx, userChecker, user)
+	if err != nil {
+		return err
+	}
+
+	eventSheets, eventSheetsPush, err := popOrCreateEventSheets(ctx, state, 2+rand.Intn(3))
+	if err != nil {
+		return err
+	}
+	if eventSheets == nil {
+		return nil
+	}
+
+	eventID := eventSheets[0].EventID
+	rank := eventSheets[0].Rank
+
+	reservations, err := reserveSheets(ctx, state, userChecker, user, eventSheets)
+	if reservations == nil && err == nil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer eventSheetsPush() // NOTE: push only after reserve succeeds
+
+	event := state.GetEventByID(eventID)
+	err = userChecker.Play(ctx, &CheckAction{
+		Method:             "GET",
+		Path:               fmt.Sprintf("/api/events/%d", eventID),
+		ExpectedStatusCode: 200,
+		Description:        "まとめて予約した席をイベントから取得できること",
+		CheckFunc: checkJsonEventResponse(event, func(event JsonEvent) error {
+			for _, reservation := range reservations {
+				sheet := event.Sheets[reservation.SheetRank].Details[reservation.SheetNum-1]
+				if !sheet.Reserved {
+					return fatalErrorf("まとめて予約したシート(%s-%d)が予約されていません(id:%d)", reservation.SheetRank, reservation.SheetNum, event.ID)
+				}
+				if !sheet.Mine {
+					return fatalErrorf("まとめて予約したシート(%s-%d)の保有者がユーザー(id:%d)ではありません(id:%d)", reservation.SheetRank, reservation.SheetNum, user.ID, event.ID)
+				}
+			}
+			return nil
+		}),
+	})
+	if err != nil {
+		return err
+	}
+
+	for i, reservation := range reservations {
+		already_locked, err := cancelSheet(ctx, state, userChecker, user, eventSheets[i], reservation)
+		if err != nil {
+			return err
+		}
+		if already_locked {
+			return nil
+		}
+	}
+
+	err = userChecker.Play(ctx, &CheckAction{
+		Method:             "POST",
+		Path:               fmt.Sprintf("/api/events/%d/actions/reserve", eventID),
+		ExpectedStatusCode: 400,
+		Description:        "一度に予約できる枚数を超える場合エラーになること",
+		CheckFunc:          checkJsonErrorResponse("invalid_quantity"),
+		PostJSON: map[string]interface{}{
+			"sheet_rank": rank,
+			"quantity":   MaxReserveQuantity + 1,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	err = userChecker.Play(ctx, &CheckAction{
+		Method:             "POST",
+		Path:               fmt.Sprintf("/api/events/%d/actions/reserve", eventID),
+		ExpectedStatusCode: 400,
+		Description:        "存在しないランクを含む場合まとめて予約できないこと",
+		CheckFunc:          checkJsonErrorResponse("invalid_rank"),
+		PostJSON: map[string]interface{}{
+			"sheets": []map[string]interface{}{
+				{"sheet_rank": rank, "quantity": 1},
+				{"sheet_rank": "N", "quantity": 1},
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// 人気の席を狙って複数のユーザが同時に同じ席を指定して予約する
+// 予約できるのはちょうど1人だけでなければならない
+func CheckReserveSelectedSheet(ctx context.Context, state *State) error {
+	eventSheet, eventSheetPush, err := popOrCreateEventSheet(ctx, state)
+	if err != nil {
+		return err
+	}
+	if eventSheet == nil {
+		return nil
+	}
+	defer eventSheetPush()
+
+	eventID := eventSheet.EventID
+	rank := eventSheet.Rank
+
+	numUsers := 3 + rand.Intn(3)
+	users := make([]*AppUser, 0, numUsers)
+	checkers := make([]*Checker, 0, numUsers)
+	for i := 0; i < numUsers; i++ {
+		user, checker, push := state.PopRandomUser()
+		if user == nil {
+			break
+		}
+		defer push()
+
+		err := loginAppUser(ctx, checker, user)
+		if err != nil {
+			return err
+		}
+		users = append(users, user)
+		checkers = append(checkers, checker)
+	}
+	if len(users) < 2 {
+		return nil
+	}
+
+	// Find a sheet which is not reserved yet
+	var sheetNum uint
+	event := state.GetEventByID(eventID)
+	err = checkers[0].Play(ctx, &CheckAction{
+		Method:             "GET",
+		Path:               fmt.Sprintf("/api/events/%d", eventID),
+		ExpectedStatusCode: 200,
+		Description:        "公開イベントを取得できること",
+		CheckFunc: checkJsonEventResponse(event, func(event JsonEvent) error {
+			var nums []uint
+			for _, sheet := range event.Sheets[rank].Details {
+				if !sheet.Reserved {
+					nums = append(nums, sheet.Num)
+				}
+			}
+			if len(nums) > 0 {
+				sheetNum = nums[rand.Intn(len(nums))]
+			}
+			return nil
+		}),
+	})
+	if err != nil {
+		return err
+	}
+	if sheetNum == 0 {
+		log.Printf("warn: CheckReserveSelectedSheet: no free sheet in event:%d rank:%s\n", eventID, rank)
+		return nil
+	}
+
+	reservations := make([]*Reservation, len(users))
+	errs := make([]error, len(users))
+	var wg sync.WaitGroup
+	for i := range users {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			reservations[i], errs[i] = reserveSelectedSheet(ctx, state, checkers[i], users[i], eventSheet, sheetNum)
+		}(i)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	var winner int
+	var won []*Reservation
+	for i, reservation := range reservations {
+		if reservation != nil {
+			winner = i
+			won = append(won, reservation)
+		}
+	}
+	if len(won) > 1 {
+		return fatalErrorf("同じ席(%s-%d)を複数のユーザーが予約できています(id:%d)", rank, sheetNum, eventID)
+	}
+	if len(won) == 0 {
+		// Somebody else reserved the sheet in the meantime.
+		log.Printf("warn: CheckReserveSelectedSheet: sheet %s-%d of event:%d was taken by somebody else\n", rank, sheetNum, eventID)
+		return nil
+	}
+
+	reservation := won[0]
+	err = checkers[winner].Play(ctx, &CheckAction{
+		Method:             "GET",
+		Path:               fmt.Sprintf("/api/events/%d", eventID),
+		ExpectedStatusCode: 200,
+		Description:        "指定して予約した席をイベントから取得できること",
+		CheckFunc: checkJsonEventResponse(event, func(event JsonEvent) error {
+			sheet := event.Sheets[rank].Details[sheetNum-1]
+			if !sheet.Reserved {
+				return fatalErrorf("指定して予約したシート(%s-%d)が予約されていません(id:%d)", rank, sheetNum, event.ID)
+			}
+			if !sheet.Mine {
+				return fatalErrorf("指定して予約したシート(%s-%d)の保有者がユーザー(id:%d)ではありません(id:%d)", rank, sheetNum, users[winner].ID, event.ID)
+			}
+			return nil
+		}),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = cancelSheet(ctx, state, checkers[winner], users[winner], eventSheet, reservation)
+	if err != nil {
+		return err
+	}
+
+	unknownNum := 1 + GetSheetKindByRank(rank).Total
+	err = checkers[winner].Play(ctx, &CheckAction{
+		Method:             "POST",
+		Path:               fmt.Sprintf("/api/events/%d/sheets/%s/%d/reservation", eventID, rank, unknownNum),
+		ExpectedStatusCode: 404,
+		Description:        "存在しないシートを指定して予約しようとするとエラーになること",
+		CheckFunc:          checkJsonErrorResponse("invalid_sheet"),
+	})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
 func checkJsonAdministratorResponse(admin *Administrator) func(res *http.Response, body *bytes.Buffer) error {
 	return func(res *http.Response, body *bytes.Buffer) error {
 		bytes := body.Bytes()
@@ -1673,30 +2806,327 @@ func CheckAdminLogin(ctx context.Context, state *State) error {
 	return nil
 }
 
-func checkJsonFullEventCreateResponse(event *Event) func(res *http.Response, body *bytes.Buffer) error {
-	return func(res *http.Response, body *bytes.Buffer) error {
-		bytes := body.Bytes()
-		dec := json.NewDecoder(body)
-		jsonEvent := JsonFullEvent{}
-		err := dec.Decode(&jsonEvent)
-		if err != nil {
-			return fatalErrorf("Jsonのデコードに失敗 %s %v", string(bytes), err)
-		}
-		if jsonEvent.Title != event.Title || jsonEvent.Price != event.Price || jsonEvent.Public != event.PublicFg || jsonEvent.Closed != event.ClosedFg {
-			return fatalErrorf("正しいイベントを取得できません")
-		}
-		// Set created time and auto incremented ID from response
-		event.ID = jsonEvent.ID
-		event.CreatedAt = time.Now()
+// Creates an administrator of a role, checks what it may do, and deletes it.
+func CheckAdministratorRoles(ctx context.Context, state *State) error {
+	admin, adminChecker, adminPush := state.PopRandomAdministrator()
+	if admin == nil {
 		return nil
 	}
-}
+	defer adminPush()
 
-func checkJsonFullEventResponse(event *Event) func(res *http.Response, body *bytes.Buffer) error {
-	return func(res *http.Response, body *bytes.Buffer) error {
-		bytes := body.Bytes()
-		dec := json.NewDecoder(body)
-		jsonEvent := JsonFullEvent{}
+	err := loginAdministrator(ctx, adminChecker, admin)
+	if err != nil {
+		return err
+	}
+
+	newAdmin := &Administrator{
+		Nickname:  RandomAlphabetString(16),
+		LoginName: RandomAlphabetString(16),
+		Password:  RandomAlphabetString(16),
+	}
+
+	err = adminChecker.Play(ctx, &CheckAction{
+		Method:             "POST",
+		Path:               "/admin/api/administrators",
+		ExpectedStatusCode: 400,
+		Description:        "不正な権限の管理者を作成できないこと",
+		PostJSON: map[string]interface{}{
+			"nickname":   newAdmin.Nickname,
+			"login_name": newAdmin.LoginName,
+			"password":   newAdmin.Password,
+			"role":       "root",
+		},
+		CheckFunc: checkJsonErrorResponse("invalid_role"),
+	})
+	if err != nil {
+		return err
+	}
+
+	err = adminChecker.Play(ctx, &CheckAction{
+		Method:             "POST",
+		Path:               "/admin/api/administrators",
+		ExpectedStatusCode: 201,
+		Description:        "管理者を作成できること",
+		PostJSON: map[string]interface{}{
+			"nickname":   newAdmin.Nickname,
+			"login_name": newAdmin.LoginName,
+			"password":   newAdmin.Password,
+			"role":       "viewer",
+		},
+		CheckFunc: func(res *http.Response, body *bytes.Buffer) error {
+			jsonAdmin := JsonAdministrator{}
+			if err := json.NewDecoder(body).Decode(&jsonAdmin); err != nil {
+				return fatalErrorf("Jsonのデコードに失敗 %v", err)
+			}
+			if jsonAdmin.ID == 0 || jsonAdmin.Nickname != newAdmin.Nickname || jsonAdmin.LoginName != newAdmin.LoginName || jsonAdmin.Role != "viewer" {
+				return fatalErrorf("作成した管理者の情報が正しくありません")
+			}
+			newAdmin.ID = jsonAdmin.ID
+			return nil
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	err = adminChecker.Play(ctx, &CheckAction{
+		Method:             "POST",
+		Path:               "/admin/api/administrators",
+		ExpectedStatusCode: 409,
+		Description:        "同じログイン名の管理者を作成できないこと",
+		PostJSON: map[string]interface{}{
+			"nickname":   newAdmin.Nickname,
+			"login_name": newAdmin.LoginName,
+			"password":   newAdmin.Password,
+			"role":       "viewer",
+		},
+		CheckFunc: checkJsonErrorResponse("duplicated"),
+	})
+	if err != nil {
+		return err
+	}
+
+	checker := NewChecker()
+	err = loginAdministrator(ctx, checker, newAdmin)
+	if err != nil {
+		return err
+	}
+
+	err = checker.Play(ctx, &CheckAction{
+		Method:             "GET",
+		Path:               "/admin/api/events",
+		ExpectedStatusCode: 200,
+		Description:        "閲覧者がイベント一覧を取得できること",
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, action := range []*CheckAction{
+		{
+			Method:      "POST",
+			Path:        "/admin/api/events",
+			Description: "閲覧者がイベントを作成できないこと",
+			PostJSON: map[string]interface{}{
+				"title":  RandomAlphabetString(16),
+				"public": false,
+				"price":  1000,
+			},
+		},
+		{
+			Method:      "GET",
+			Path:        "/admin/api/reports/sales/summary",
+			Description: "閲覧者が売上レポートを取得できないこと",
+		},
+		{
+			Method:      "GET",
+			Path:        "/admin/api/administrators",
+			Description: "閲覧者が管理者一覧を取得できないこと",
+		},
+	} {
+		action.ExpectedStatusCode = 403
+		action.CheckFunc = checkJsonErrorResponse("forbidden")
+		err = checker.Play(ctx, action)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Changing the role logs the administrator out everywhere
+	err = adminChecker.Play(ctx, &CheckAction{
+		Method:             "POST",
+		Path:               fmt.Sprintf("/admin/api/administrators/%d/actions/edit", newAdmin.ID),
+		ExpectedStatusCode: 200,
+		Description:        "管理者の権限を変更できること",
+		PostJSON: map[string]interface{}{
+			"role": "finance",
+		},
+		CheckFunc: func(res *http.Response, body *bytes.Buffer) error {
+			jsonAdmin := JsonAdministrator{}
+			if err := json.NewDecoder(body).Decode(&jsonAdmin); err != nil {
+				return fatalErrorf("Jsonのデコードに失敗 %v", err)
+			}
+			if jsonAdmin.ID != newAdmin.ID || jsonAdmin.Role != "finance" {
+				return fatalErrorf("変更した管理者の情報が正しくありません")
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	err = checker.Play(ctx, &CheckAction{
+		Method:             "GET",
+		Path:               "/admin/api/events",
+		ExpectedStatusCode: 401,
+		Description:        "権限を変更された管理者がログアウトされること",
+		CheckFunc:          checkJsonErrorResponse("admin_login_required"),
+	})
+	if err != nil {
+		return err
+	}
+
+	err = adminChecker.Play(ctx, &CheckAction{
+		Method:             "DELETE",
+		Path:               fmt.Sprintf("/admin/api/administrators/%d", newAdmin.ID),
+		ExpectedStatusCode: 204,
+		Description:        "管理者を削除できること",
+	})
+	if err != nil {
+		return err
+	}
+
+	return checker.Play(ctx, &CheckAction{
+		Method:             "POST",
+		Path:               "/admin/api/actions/login",
+		ExpectedStatusCode: 401,
+		Description:        "削除した管理者でログインできないこと",
+		PostJSON: map[string]interface{}{
+			"login_name": newAdmin.LoginName,
+			"password":   newAdmin.Password,
+		},
+		CheckFunc: checkJsonErrorResponse("authentication_failed"),
+	})
+}
+
+// The latest entries of the administrator, who is not used by others meanwhile, are the logout and the login just made.
+func CheckAuditLog(ctx context.Context, state *State) error {
+	admin, checker, push := state.PopRandomAdministrator()
+	if admin == nil {
+		return nil
+	}
+	defer push()
+
+	err := loginAdministrator(ctx, checker, admin)
+	if err != nil {
+		return err
+	}
+	err = logoutAdministrator(ctx, checker, admin)
+	if err != nil {
+		return err
+	}
+	err = loginAdministrator(ctx, checker, admin)
+	if err != nil {
+		return err
+	}
+
+	var logoutID uint
+	err = checker.Play(ctx, &CheckAction{
+		Method:             "GET",
+		Path:               fmt.Sprintf("/admin/api/audit?administrator_id=%d&limit=2", admin.ID),
+		ExpectedStatusCode: 200,
+		Description:        "監査ログが取得できること",
+		CheckFunc: checkJsonAuditLogsResponse(func(logs *JsonAuditLogs) error {
+			if len(logs.Entries) != 2 {
+				return fatalErrorf("監査ログの件数が正しくありません administratorID=%d", admin.ID)
+			}
+			for i, entry := range logs.Entries {
+				expected := []struct {
+					action string
+					status int
+				}{{"POST /admin/api/actions/login", 200}, {"POST /admin/api/actions/logout", 204}}[i]
+				if entry.Action != expected.action || entry.Status != expected.status || entry.Path != strings.Fields(expected.action)[1] {
+					log.Printf("warn: miss match audit log got=%s(%d) expected=%s(%d)\n", entry.Action, entry.Status, expected.action, expected.status)
+					return fatalErrorf("監査ログの操作が正しくありません administratorID=%d", admin.ID)
+				}
+				if entry.AdministratorID == nil || *entry.AdministratorID != admin.ID {
+					return fatalErrorf("監査ログの管理者が正しくありません administratorID=%d", admin.ID)
+				}
+				if entry.RemoteIP == "" || entry.CreatedAt == 0 {
+					return fatalErrorf("監査ログの接続元または時刻が記録されていません administratorID=%d", admin.ID)
+				}
+			}
+			if logs.Entries[0].ID <= logs.Entries[1].ID {
+				return fatalErrorf("監査ログの順番が正しくありません administratorID=%d", admin.ID)
+			}
+			if logs.NextCursor != nil && *logs.NextCursor != logs.Entries[1].ID {
+				return fatalErrorf("監査ログの次のカーソルが正しくありません administratorID=%d", admin.ID)
+			}
+			logoutID = logs.Entries[1].ID
+			return nil
+		}),
+	})
+	if err != nil {
+		return err
+	}
+
+	query := url.Values{}
+	query.Set("administrator_id", strconv.Itoa(int(admin.ID)))
+	query.Set("action", "POST /admin/api/actions/logout")
+	query.Set("limit", "1")
+	err = checker.Play(ctx, &CheckAction{
+		Method:             "GET",
+		Path:               "/admin/api/audit?" + query.Encode(),
+		ExpectedStatusCode: 200,
+		Description:        "監査ログを操作で絞り込めること",
+		CheckFunc: checkJsonAuditLogsResponse(func(logs *JsonAuditLogs) error {
+			if len(logs.Entries) != 1 || logs.Entries[0].ID != logoutID {
+				return fatalErrorf("監査ログの絞り込みが正しくありません administratorID=%d", admin.ID)
+			}
+			return nil
+		}),
+	})
+	if err != nil {
+		return err
+	}
+
+	return checker.Play(ctx, &CheckAction{
+		Method:             "GET",
+		Path:               "/admin/api/audit?limit=0",
+		ExpectedStatusCode: 400,
+		Description:        "監査ログの件数が不正な場合エラーになること",
+		CheckFunc:          checkJsonErrorResponse("invalid_limit"),
+	})
+}
+
+func checkJsonAuditLogsResponse(check func(*JsonAuditLogs) error) func(res *http.Response, body *bytes.Buffer) error {
+	return func(res *http.Response, body *bytes.Buffer) error {
+		bytes := body.Bytes()
+		dec := json.NewDecoder(body)
+
+		var v JsonAuditLogs
+		err := dec.Decode(&v)
+		if err != nil {
+			return fatalErrorf("Jsonのデコードに失敗 %s %v", string(bytes), err)
+		}
+		if v.Entries == nil {
+			return fatalErrorf("監査ログを取得できません")
+		}
+		for _, entry := range v.Entries {
+			if entry == nil {
+				return fatalErrorf("監査ログがnullです")
+			}
+		}
+
+		return check(&v)
+	}
+}
+
+func checkJsonFullEventCreateResponse(event *Event) func(res *http.Response, body *bytes.Buffer) error {
+	return func(res *http.Response, body *bytes.Buffer) error {
+		bytes := body.Bytes()
+		dec := json.NewDecoder(body)
+		jsonEvent := JsonFullEvent{}
+		err := dec.Decode(&jsonEvent)
+		if err != nil {
+			return fatalErrorf("Jsonのデコードに失敗 %s %v", string(bytes), err)
+		}
+		if jsonEvent.Title != event.Title || jsonEvent.Price != event.Price || jsonEvent.Public != event.PublicFg || jsonEvent.Closed != event.ClosedFg {
+			return fatalErrorf("正しいイベントを取得できません")
+		}
+		// Set created time and auto incremented ID from response
+		event.ID = jsonEvent.ID
+		event.CreatedAt = time.Now()
+		return nil
+	}
+}
+
+func checkJsonFullEventResponse(event *Event) func(res *http.Response, body *bytes.Buffer) error {
+	return func(res *http.Response, body *bytes.Buffer) error {
+		bytes := body.Bytes()
+		dec := json.NewDecoder(body)
+		jsonEvent := JsonFullEvent{}
 		err := dec.Decode(&jsonEvent)
 		if err != nil {
 			return fatalErrorf("Jsonのデコードに失敗 %s %v", string(bytes), err)
@@ -1810,6 +3240,21 @@ func CheckCreateEvent(ctx context.Context, state *State) error {
 	// Create as a private event
 	event.PublicFg = false
 
+	invalidSchedule := eventPostJSON(event)
+	invalidSchedule["sales_open_at"] = time.Now().Add(2 * time.Hour).Unix()
+	invalidSchedule["sales_close_at"] = time.Now().Add(1 * time.Hour).Unix()
+	err = adminChecker.Play(ctx, &CheckAction{
+		Method:             "POST",
+		Path:               "/admin/api/events",
+		ExpectedStatusCode: 400,
+		Description:        "販売終了が販売開始より前のイベントを作成できないこと",
+		PostJSON:           invalidSchedule,
+		CheckFunc:          checkJsonErrorResponse("invalid_schedule"),
+	})
+	if err != nil {
+		return err
+	}
+
 	err = adminChecker.Play(ctx, &CheckAction{
 		Method:             "POST",
 		Path:               "/admin/api/events",
@@ -1942,272 +3387,2558 @@ func CheckCreateEvent(ctx context.Context, state *State) error {
 	return nil
 }
 
-func checkReportHeader(reader *csv.Reader) error {
-	// reservation_id,event_id,rank,num,price,user_id,sold_at,canceled_at
-	row, err := reader.Read()
-	if err == io.EOF ||
-		len(row) != 8 ||
-		row[0] != "reservation_id" ||
-		row[1] != "event_id" ||
-		row[2] != "rank" ||
-		row[3] != "num" ||
-		row[4] != "price" ||
-		row[5] != "user_id" ||
-		row[6] != "sold_at" ||
-		row[7] != "canceled_at" {
-		return fatalErrorf("正しいCSVヘッダを取得できません")
+func checkEditedEventInList(event *Event, events []JsonEvent) error {
+	for _, e := range events {
+		if e.ID != event.ID {
+			continue
+		}
+		if e.Title != event.Title {
+			return fatalErrorf("編集したイベント(id:%d)のタイトルが反映されていません", event.ID)
+		}
+		for _, sheetKind := range DataSet.SheetKinds {
+			if e.Sheets[sheetKind.Rank].Price != event.RankPrice(sheetKind.Rank) {
+				return fatalErrorf("編集したイベント(id:%d)の価格が反映されていません", event.ID)
+			}
+		}
+		return nil
 	}
-	return nil
+	return fatalErrorf("編集したイベント(id:%d)がイベント一覧に含まれていません", event.ID)
 }
 
-func getReportRecords(s *State, reader *csv.Reader) (map[uint]*ReportRecord, error) {
-	// reservation_id,event_id,rank,num,price,user_id,sold_at,canceled_at
-	// 1,1,S,36,8000,1002,2018-08-17T04:55:30Z,2018-08-17T04:58:31Z
-	// 2,1,S,36,8000,1002,2018-08-17T04:55:32Z,
-	// 3,1,B,149,4000,1002,2018-08-17T04:55:33Z,
-	// 4,1,C,317,3000,1002,2018-08-17T04:55:34Z,
-	// 5,1,B,27,4000,1002,2018-08-17T04:55:36Z,
-	// 6,3,A,15,6000,1002,2018-08-17T04:55:38Z,
-	// 7,3,S,10,8000,1002,2018-08-17T04:55:41Z,2018-08-17T04:58:29Z
-
-	records := map[uint]*ReportRecord{}
+func CheckEditEvent(ctx context.Context, state *State) error {
+	checker := NewChecker()
 
-	line := 0
-	for {
-		row, err := reader.Read()
-		if err == io.EOF {
-			break
-		}
-		line++
+	admin, adminChecker, adminPush := state.PopRandomAdministrator()
+	if admin == nil {
+		return nil
+	}
+	defer adminPush()
 
-		msg := "正しいCSVレポートを取得できません"
+	err := loginAdministrator(ctx, adminChecker, admin)
+	if err != nil {
+		return err
+	}
 
-		if len(row) != 8 {
-			return nil, fatalErrorf(msg)
-		}
+	event, newEventPush := state.CreateNewEvent()
+	event.PublicFg = false
 
-		reservationID, err := strconv.Atoi(row[0])
-		if err != nil {
-			log.Printf("debug: invalid reservationID (line:%d) error:%v\n", line, err)
+	err = adminChecker.Play(ctx, &CheckAction{
+		Method:             "POST",
+		Path:               "/admin/api/events",
+		ExpectedStatusCode: 200,
+		Description:        "管理者がイベントを作成できること",
+		PostJSON:           eventPostJSON(event),
+		CheckFunc:          checkJsonFullEventCreateResponse(event),
+	})
+	if err != nil {
+		return err
+	}
+
+	err = adminChecker.Play(ctx, &CheckAction{
+		Method:             "POST",
+		Path:               fmt.Sprintf("/admin/api/events/%d/actions/edit", event.ID),
+		ExpectedStatusCode: 400,
+		Description:        "イベントのタイトルを空にできないこと",
+		PostJSON:           map[string]interface{}{"title": ""},
+		CheckFunc:          checkJsonErrorResponse("invalid_title"),
+	})
+	if err != nil {
+		return err
+	}
+
+	err = adminChecker.Play(ctx, &CheckAction{
+		Method:             "POST",
+		Path:               fmt.Sprintf("/admin/api/events/%d/actions/edit", event.ID),
+		ExpectedStatusCode: 400,
+		Description:        "イベントの価格を負にできないこと",
+		PostJSON:           map[string]interface{}{"price": -1},
+		CheckFunc:          checkJsonErrorResponse("invalid_price"),
+	})
+	if err != nil {
+		return err
+	}
+
+	// Edit and publish the event before the state knows it, so that other checks see only the edited one
+	event.Title = RandomAlphabetString(32)
+	event.Price = 1000 + uint(rand.Intn(10)*1000)
+	event.PublicFg = true
+
+	err = adminChecker.Play(ctx, &CheckAction{
+		Method:             "POST",
+		Path:               fmt.Sprintf("/admin/api/events/%d/actions/edit", event.ID),
+		ExpectedStatusCode: 200,
+		Description:        "管理者が販売前のイベントのタイトルと価格を編集できること",
+		PostJSON: map[string]interface{}{
+			"title":  event.Title,
+			"price":  event.Price,
+			"public": event.PublicFg,
+		},
+		CheckFunc: checkJsonFullEventResponse(event),
+	})
+	if err != nil {
+		return err
+	}
+	newEventPush("CheckEditEvent")
+
+	err = checker.Play(ctx, &CheckAction{
+		Method:             "GET",
+		Path:               "/api/events",
+		ExpectedStatusCode: 200,
+		Description:        "編集したイベントがイベント一覧に反映されること",
+		CheckFunc: func(res *http.Response, body *bytes.Buffer) error {
+			var events []JsonEvent
+			err := json.NewDecoder(body).Decode(&events)
+			if err != nil {
+				return fatalErrorf("Jsonのデコードに失敗 %v", err)
+			}
+			return checkEditedEventInList(event, events)
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	err = checker.Play(ctx, &CheckAction{
+		Method:             "GET",
+		Path:               "/",
+		ExpectedStatusCode: 200,
+		Description:        "編集したイベントがトップページに反映されること",
+		CheckFunc: checkHTML(func(res *http.Response, doc *goquery.Document) error {
+			val, ok := doc.Find("#app-wrapper").Attr("data-events")
+			if !ok {
+				return fatalErrorf("app-wrapperにdata-eventsがありません")
+			}
+			var events []JsonEvent
+			err := json.Unmarshal([]byte(val), &events)
+			if err != nil {
+				return fatalErrorf("トップページのイベント一覧のJsonデコードに失敗 %s %v", val, err)
+			}
+			return checkEditedEventInList(event, events)
+		}),
+	})
+	if err != nil {
+		return err
+	}
+
+	err = adminChecker.Play(ctx, &CheckAction{
+		Method:             "DELETE",
+		Path:               fmt.Sprintf("/admin/api/events/%d", event.ID),
+		ExpectedStatusCode: 400,
+		Description:        "公開中のイベントを削除できないこと",
+		CheckFunc:          checkJsonErrorResponse("cannot_delete_public_event"),
+	})
+	if err != nil {
+		return err
+	}
+
+	if soldOutEvent := state.GetRandomPublicSoldOutEvent(); soldOutEvent != nil {
+		err = adminChecker.Play(ctx, &CheckAction{
+			Method:             "POST",
+			Path:               fmt.Sprintf("/admin/api/events/%d/actions/edit", soldOutEvent.ID),
+			ExpectedStatusCode: 400,
+			Description:        "販売済みのイベントの価格を編集できないこと",
+			PostJSON:           map[string]interface{}{"price": soldOutEvent.Price + 1000},
+			CheckFunc:          checkJsonErrorResponse("cannot_edit_sold_event"),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// The deleted event is never pushed to the state
+	deleted, _ := state.CreateNewEvent()
+	deleted.PublicFg = false
+
+	err = adminChecker.Play(ctx, &CheckAction{
+		Method:             "POST",
+		Path:               "/admin/api/events",
+		ExpectedStatusCode: 200,
+		Description:        "管理者がイベントを作成できること",
+		PostJSON:           eventPostJSON(deleted),
+		CheckFunc:          checkJsonFullEventCreateResponse(deleted),
+	})
+	if err != nil {
+		return err
+	}
+
+	err = adminChecker.Play(ctx, &CheckAction{
+		Method:             "DELETE",
+		Path:               fmt.Sprintf("/admin/api/events/%d", deleted.ID),
+		ExpectedStatusCode: 204,
+		Description:        "管理者が非公開イベントを削除できること",
+	})
+	if err != nil {
+		return err
+	}
+
+	err = adminChecker.Play(ctx, &CheckAction{
+		Method:             "GET",
+		Path:               fmt.Sprintf("/admin/api/events/%d", deleted.ID),
+		ExpectedStatusCode: 404,
+		Description:        "削除したイベントを取得できないこと",
+		CheckFunc:          checkJsonErrorResponse("not_found"),
+	})
+	if err != nil {
+		return err
+	}
+
+	err = adminChecker.Play(ctx, &CheckAction{
+		Method:             "DELETE",
+		Path:               fmt.Sprintf("/admin/api/events/%d", deleted.ID),
+		ExpectedStatusCode: 404,
+		Description:        "削除したイベントを再度削除できないこと",
+		CheckFunc:          checkJsonErrorResponse("not_found"),
+	})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func CheckPriceOverrides(ctx context.Context, state *State) error {
+	admin, adminChecker, adminPush := state.PopRandomAdministrator()
+	if admin == nil {
+		return nil
+	}
+	defer adminPush()
+
+	user, userChecker, userPush := state.PopRandomUser()
+	if user == nil {
+		return nil
+	}
+	defer userPush()
+
+	err := loginAdministrator(ctx, adminChecker, admin)
+	if err != nil {
+		return err
+	}
+
+	err = loginAppUser(ctx, userChecker, user)
+	if err != nil {
+		return err
+	}
+
+	event, newEventPush := state.CreateNewEvent()
+	event.PublicFg = false
+
+	err = adminChecker.Play(ctx, &CheckAction{
+		Method:             "POST",
+		Path:               "/admin/api/events",
+		ExpectedStatusCode: 200,
+		Description:        "管理者がイベントを作成できること",
+		PostJSON:           eventPostJSON(event),
+		CheckFunc:          checkJsonFullEventCreateResponse(event),
+	})
+	if err != nil {
+		return err
+	}
+
+	rank := GetRandomSheetRank()
+	sheetKind := GetSheetKindByRank(rank)
+	sheetNum := uint(1 + rand.Intn(int(sheetKind.Total)))
+
+	err = adminChecker.Play(ctx, &CheckAction{
+		Method:             "PUT",
+		Path:               fmt.Sprintf("/admin/api/events/%d/prices", event.ID),
+		ExpectedStatusCode: 400,
+		Description:        "存在しない席の価格を設定できないこと",
+		PostJSON: map[string]interface{}{
+			"sheets": []map[string]interface{}{
+				{"sheet_rank": rank, "sheet_num": sheetKind.Total + 1, "price": 1000},
+			},
+		},
+		CheckFunc: checkJsonErrorResponse("invalid_sheet"),
+	})
+	if err != nil {
+		return err
+	}
+
+	event.RankPrices = map[string]uint{
+		rank: event.Price + sheetKind.Price + uint(1+rand.Intn(10))*500,
+	}
+	event.SheetPrices = map[SheetKey]uint{
+		{rank, sheetNum}: uint(rand.Intn(100)) * 100,
+	}
+
+	err = adminChecker.Play(ctx, &CheckAction{
+		Method:             "PUT",
+		Path:               fmt.Sprintf("/admin/api/events/%d/prices", event.ID),
+		ExpectedStatusCode: 200,
+		Description:        "管理者が席種と席の価格を設定できること",
+		PostJSON: map[string]interface{}{
+			"ranks": []map[string]interface{}{
+				{"sheet_rank": rank, "price": event.RankPrices[rank]},
+			},
+			"sheets": []map[string]interface{}{
+				{"sheet_rank": rank, "sheet_num": sheetNum, "price": event.SheetPrices[SheetKey{rank, sheetNum}]},
+			},
+		},
+		CheckFunc: func(res *http.Response, body *bytes.Buffer) error {
+			jsonEvent := JsonFullEvent{}
+			err := json.NewDecoder(body).Decode(&jsonEvent)
+			if err != nil {
+				return fatalErrorf("Jsonのデコードに失敗 %v", err)
+			}
+			for _, sheetKind := range DataSet.SheetKinds {
+				if jsonEvent.Sheets[sheetKind.Rank].Price != event.RankPrice(sheetKind.Rank) {
+					return fatalErrorf("イベント(id:%d)の%s席の価格が正しくありません", event.ID, sheetKind.Rank)
+				}
+			}
+			details := jsonEvent.Sheets[rank].Details
+			if uint(len(details)) < sheetNum || details[sheetNum-1].Price != event.SheetPrice(rank, sheetNum) {
+				return fatalErrorf("イベント(id:%d)の席(%s-%d)の価格が正しくありません", event.ID, rank, sheetNum)
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	event.PublicFg = true
+	err = adminChecker.Play(ctx, &CheckAction{
+		Method:             "POST",
+		Path:               fmt.Sprintf("/admin/api/events/%d/actions/edit", event.ID),
+		ExpectedStatusCode: 200,
+		Description:        "管理者がイベントを編集できること",
+		PostJSON:           eventEditJSON(event),
+		CheckFunc:          checkJsonFullEventResponse(event),
+	})
+	if err != nil {
+		return err
+	}
+	newEventPush("CheckPriceOverrides")
+
+	selectedSheet, selectedSheetPush := state.PopEventSheetByEventIDAndRank(event.ID, rank)
+	if selectedSheet == nil {
+		log.Printf("warn: CheckPriceOverrides: no sheet of event:%d rank:%s\n", event.ID, rank)
+		return nil
+	}
+	defer selectedSheetPush()
+
+	selected, err := reserveSelectedSheet(ctx, state, userChecker, user, selectedSheet, sheetNum)
+	if err != nil {
+		return err
+	}
+	if selected == nil {
+		log.Printf("warn: CheckPriceOverrides: sheet %s-%d of event:%d was taken by somebody else\n", rank, sheetNum, event.ID)
+		return nil
+	}
+
+	randomSheet, randomSheetPush := state.PopEventSheetByEventIDAndRank(event.ID, rank)
+	if randomSheet == nil {
+		log.Printf("warn: CheckPriceOverrides: no sheet of event:%d rank:%s\n", event.ID, rank)
+		return nil
+	}
+	defer randomSheetPush()
+
+	random, err := reserveSheet(ctx, state, userChecker, user, randomSheet)
+	if err != nil {
+		return err
+	}
+
+	reservations := map[uint]*Reservation{selected.ID: selected, random.ID: random}
+
+	err = userChecker.Play(ctx, &CheckAction{
+		Method:             "GET",
+		Path:               fmt.Sprintf("/api/users/%d", user.ID),
+		ExpectedStatusCode: 200,
+		Description:        "予約した席の価格が設定された価格であること",
+		CheckFunc: func(res *http.Response, body *bytes.Buffer) error {
+			fullUser := JsonFullUser{}
+			err := json.NewDecoder(body).Decode(&fullUser)
+			if err != nil {
+				return fatalErrorf("Jsonのデコードに失敗 %v", err)
+			}
+			found := 0
+			for _, r := range fullUser.RecentReservations {
+				reservation, ok := reservations[r.ReservationID]
+				if !ok {
+					continue
+				}
+				if r.Price != reservation.Price {
+					return fatalErrorf("予約(id:%d)の価格が正しくありません", r.ReservationID)
+				}
+				found++
+			}
+			if found != len(reservations) {
+				return fatalErrorf("最近予約した席に予約した席が含まれていません")
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	err = adminChecker.Play(ctx, &CheckAction{
+		Method:             "GET",
+		Path:               fmt.Sprintf("/admin/api/reports/events/%d/sales", event.ID),
+		ExpectedStatusCode: 200,
+		Description:        "レポートの価格が設定された価格であること",
+		CheckFunc:          checkEventReportResponse(state, event, time.Now(), reservations),
+	})
+	if err != nil {
+		return err
+	}
+
+	err = adminChecker.Play(ctx, &CheckAction{
+		Method:             "PUT",
+		Path:               fmt.Sprintf("/admin/api/events/%d/prices", event.ID),
+		ExpectedStatusCode: 400,
+		Description:        "販売済みのイベントの価格を設定できないこと",
+		PostJSON:           map[string]interface{}{},
+		CheckFunc:          checkJsonErrorResponse("cannot_edit_sold_event"),
+	})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func checkJsonOrderResponse(reservation *Reservation, status string, refundedAmount uint) func(res *http.Response, body *bytes.Buffer) error {
+	return func(res *http.Response, body *bytes.Buffer) error {
+		order := JsonOrder{}
+		err := json.NewDecoder(body).Decode(&order)
+		if err != nil {
+			return fatalErrorf("Jsonのデコードに失敗 %v", err)
+		}
+		if order.ID != reservation.OrderID || order.Status != status {
+			return fatalErrorf("注文(id:%d)の状態が正しくありません", reservation.OrderID)
+		}
+		if order.Amount != reservation.Price || order.RefundedAmount != refundedAmount {
+			return fatalErrorf("注文(id:%d)の金額が正しくありません", reservation.OrderID)
+		}
+		if len(order.Reservations) != 1 {
+			return fatalErrorf("注文(id:%d)の予約が正しくありません", reservation.OrderID)
+		}
+		r := order.Reservations[0]
+		if r.ReservationID != reservation.ID || r.SheetRank != reservation.SheetRank || r.SheetNum != reservation.SheetNum || r.Price != reservation.Price {
+			return fatalErrorf("注文(id:%d)の予約が正しくありません", reservation.OrderID)
+		}
+		if (status == "refunded") != (r.CanceledAt != 0) {
+			return fatalErrorf("注文(id:%d)の予約のキャンセル状態が正しくありません", reservation.OrderID)
+		}
+		return nil
+	}
+}
+
+func CheckOrder(ctx context.Context, state *State) error {
+	user, userChecker, userPush := state.PopRandomUser()
+	if user == nil {
+		return nil
+	}
+	defer userPush()
+
+	other, otherChecker, otherPush := state.PopRandomUser()
+	if other == nil {
+		return nil
+	}
+	defer otherPush()
+
+	err := loginAppUser(ctx, userChecker, user)
+	if err != nil {
+		return err
+	}
+
+	err = loginAppUser(ctx, otherChecker, other)
+	if err != nil {
+		return err
+	}
+
+	eventSheet, eventSheetPush := state.PopEventSheet()
+	if eventSheet == nil {
+		return nil
+	}
+	defer eventSheetPush()
+
+	reservation, err := reserveSheet(ctx, state, userChecker, user, eventSheet)
+	if err != nil {
+		return err
+	}
+
+	err = userChecker.Play(ctx, &CheckAction{
+		Method:             "GET",
+		Path:               fmt.Sprintf("/api/orders/%d", reservation.OrderID),
+		ExpectedStatusCode: 200,
+		Description:        "予約の注文が支払い済みであること",
+		CheckFunc:          checkJsonOrderResponse(reservation, "paid", 0),
+	})
+	if err != nil {
+		return err
+	}
+
+	err = otherChecker.Play(ctx, &CheckAction{
+		Method:             "GET",
+		Path:               fmt.Sprintf("/api/orders/%d", reservation.OrderID),
+		ExpectedStatusCode: 403,
+		Description:        "他のユーザの注文を参照できないこと",
+		CheckFunc:          checkJsonErrorResponse("forbidden"),
+	})
+	if err != nil {
+		return err
+	}
+
+	alreadyLocked, err := cancelSheet(ctx, state, userChecker, user, eventSheet, reservation)
+	if err != nil {
+		return err
+	}
+	if alreadyLocked {
+		return nil
+	}
+
+	err = userChecker.Play(ctx, &CheckAction{
+		Method:             "GET",
+		Path:               fmt.Sprintf("/api/orders/%d", reservation.OrderID),
+		ExpectedStatusCode: 200,
+		Description:        "キャンセルした予約の注文が返金済みであること",
+		CheckFunc:          checkJsonOrderResponse(reservation, "refunded", reservation.Price),
+	})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func couponPostJSON(coupon *Coupon, expiresAt int64) map[string]interface{} {
+	return map[string]interface{}{
+		"code":           coupon.Code,
+		"kind":           coupon.Kind,
+		"amount":         coupon.Amount,
+		"per_user_limit": coupon.PerUserLimit,
+		"expires_at":     expiresAt,
+	}
+}
+
+func checkJsonCouponCreateResponse(coupon *Coupon, expiresAt int64) func(res *http.Response, body *bytes.Buffer) error {
+	return func(res *http.Response, body *bytes.Buffer) error {
+		jsonCoupon := JsonCoupon{}
+		err := json.NewDecoder(body).Decode(&jsonCoupon)
+		if err != nil {
+			return fatalErrorf("Jsonのデコードに失敗 %v", err)
+		}
+		if jsonCoupon.ID == 0 {
+			return fatalErrorf("クーポンIDが正しくありません")
+		}
+		if jsonCoupon.Code != coupon.Code || jsonCoupon.Kind != coupon.Kind || jsonCoupon.Amount != coupon.Amount || jsonCoupon.PerUserLimit != coupon.PerUserLimit || jsonCoupon.ExpiresAt != expiresAt {
+			return fatalErrorf("作成したクーポンの内容が正しくありません")
+		}
+		return nil
+	}
+}
+
+func CheckCoupon(ctx context.Context, state *State) error {
+	admin, adminChecker, adminPush := state.PopRandomAdministrator()
+	if admin == nil {
+		return nil
+	}
+	defer adminPush()
+
+	user, userChecker, userPush := state.PopRandomUser()
+	if user == nil {
+		return nil
+	}
+	defer userPush()
+
+	err := loginAdministrator(ctx, adminChecker, admin)
+	if err != nil {
+		return err
+	}
+
+	err = loginAppUser(ctx, userChecker, user)
+	if err != nil {
+		return err
+	}
+
+	coupon := &Coupon{
+		Code:         RandomAlphabetString(32),
+		Kind:         "percent",
+		Amount:       uint(1 + rand.Intn(100)),
+		PerUserLimit: 1,
+	}
+	if rand.Intn(2) == 0 {
+		coupon.Kind = "fixed"
+		coupon.Amount = uint(1+rand.Intn(50)) * 100
+	}
+	expiresAt := time.Now().Add(1 * time.Hour).Unix()
+
+	err = adminChecker.Play(ctx, &CheckAction{
+		Method:             "POST",
+		Path:               "/admin/api/coupons",
+		ExpectedStatusCode: 400,
+		Description:        "不正な種類のクーポンを作成できないこと",
+		PostJSON:           couponPostJSON(&Coupon{Code: RandomAlphabetString(32), Kind: "free", Amount: 100}, expiresAt),
+		CheckFunc:          checkJsonErrorResponse("invalid_kind"),
+	})
+	if err != nil {
+		return err
+	}
+
+	err = adminChecker.Play(ctx, &CheckAction{
+		Method:             "POST",
+		Path:               "/admin/api/coupons",
+		ExpectedStatusCode: 201,
+		Description:        "管理者がクーポンを作成できること",
+		PostJSON:           couponPostJSON(coupon, expiresAt),
+		CheckFunc:          checkJsonCouponCreateResponse(coupon, expiresAt),
+	})
+	if err != nil {
+		return err
+	}
+
+	err = adminChecker.Play(ctx, &CheckAction{
+		Method:             "POST",
+		Path:               "/admin/api/coupons",
+		ExpectedStatusCode: 409,
+		Description:        "同じコードのクーポンを作成できないこと",
+		PostJSON:           couponPostJSON(coupon, expiresAt),
+		CheckFunc:          checkJsonErrorResponse("duplicated"),
+	})
+	if err != nil {
+		return err
+	}
+
+	expired := &Coupon{Code: RandomAlphabetString(32), Kind: "fixed", Amount: 1000}
+	expiredAt := time.Now().Add(-1 * time.Hour).Unix()
+	err = adminChecker.Play(ctx, &CheckAction{
+		Method:             "POST",
+		Path:               "/admin/api/coupons",
+		ExpectedStatusCode: 201,
+		Description:        "管理者がクーポンを作成できること",
+		PostJSON:           couponPostJSON(expired, expiredAt),
+		CheckFunc:          checkJsonCouponCreateResponse(expired, expiredAt),
+	})
+	if err != nil {
+		return err
+	}
+
+	eventSheet, eventSheetPush := state.PopEventSheet()
+	if eventSheet == nil {
+		return nil
+	}
+	defer eventSheetPush()
+
+	// Coupons are checked only when there is a free sheet, which is the one we hold.
+	for _, c := range []struct {
+		code        string
+		status      int
+		errorCode   string
+		description string
+	}{
+		{RandomAlphabetString(32), 400, "invalid_coupon", "存在しないクーポンで予約できないこと"},
+		{expired.Code, 400, "coupon_expired", "有効期限切れのクーポンで予約できないこと"},
+	} {
+		err = userChecker.Play(ctx, &CheckAction{
+			Method:             "POST",
+			Path:               fmt.Sprintf("/api/events/%d/actions/reserve", eventSheet.EventID),
+			ExpectedStatusCode: c.status,
+			Description:        c.description,
+			PostJSON: map[string]interface{}{
+				"sheet_rank":  eventSheet.Rank,
+				"coupon_code": c.code,
+			},
+			CheckFunc: checkJsonErrorResponse(c.errorCode),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	reservation, err := reserveSheetWithCoupon(ctx, state, userChecker, user, eventSheet, coupon)
+	if err != nil {
+		return err
+	}
+
+	err = userChecker.Play(ctx, &CheckAction{
+		Method:             "GET",
+		Path:               fmt.Sprintf("/api/users/%d", user.ID),
+		ExpectedStatusCode: 200,
+		Description:        "クーポンで割引された価格で予約されること",
+		CheckFunc: func(res *http.Response, body *bytes.Buffer) error {
+			fullUser := JsonFullUser{}
+			err := json.NewDecoder(body).Decode(&fullUser)
+			if err != nil {
+				return fatalErrorf("Jsonのデコードに失敗 %v", err)
+			}
+			for _, r := range fullUser.RecentReservations {
+				if r.ReservationID != reservation.ID {
+					continue
+				}
+				if r.Price != reservation.Price {
+					return fatalErrorf("予約(id:%d)の価格が正しくありません", r.ReservationID)
+				}
+				return nil
+			}
+			return fatalErrorf("最近予約した席に予約した席が含まれていません")
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	otherSheet, otherSheetPush := state.PopEventSheetByEventIDAndRank(eventSheet.EventID, eventSheet.Rank)
+	if otherSheet == nil {
+		log.Printf("warn: CheckCoupon: no sheet of event:%d rank:%s\n", eventSheet.EventID, eventSheet.Rank)
+		return nil
+	}
+	defer otherSheetPush()
+
+	err = userChecker.Play(ctx, &CheckAction{
+		Method:             "POST",
+		Path:               fmt.Sprintf("/api/events/%d/actions/reserve", otherSheet.EventID),
+		ExpectedStatusCode: 409,
+		Description:        "利用回数の上限を超えてクーポンを使えないこと",
+		PostJSON: map[string]interface{}{
+			"sheet_rank":  otherSheet.Rank,
+			"coupon_code": coupon.Code,
+		},
+		CheckFunc: checkJsonErrorResponse("coupon_limit_exceeded"),
+	})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+func purchaseLimitsJSON(limits *JsonPurchaseLimits) map[string]interface{} {
+	return map[string]interface{}{
+		"max_sheets":         limits.MaxSheets,
+		"max_reservations":   limits.MaxReservations,
+		"reservation_window": limits.ReservationWindow,
+		"max_cancels":        limits.MaxCancels,
+		"cancel_cooldown":    limits.CancelCooldown,
+	}
+}
+
+// Reserves a sheet of the rank in an event with purchase limits.
+// Returns the error code without error if the webapp refuses it by the limits.
+// Calls to the state are serialized by mtx, so that the user can reserve concurrently.
+func reserveSheetWithinLimits(ctx context.Context, state *State, checker *Checker, user *AppUser, eventSheet *EventSheet, mtx *sync.Mutex) (*Reservation, string, error) {
+	eventID := eventSheet.EventID
+	rank := eventSheet.Rank
+
+	reserved := &JsonReservation{ReservationID: 0, SheetRank: rank, SheetNum: 0}
+	reservation := &Reservation{ID: 0, EventID: eventID, UserID: user.ID, SheetRank: rank, Price: eventSheet.Price, SheetNum: 0}
+	mtx.Lock()
+	logID := state.BeginReservation(user, reservation)
+	mtx.Unlock()
+
+	var errorCode string
+	err := checker.Play(ctx, &CheckAction{
+		Method:      "POST",
+		Path:        fmt.Sprintf("/api/events/%d/actions/reserve", eventID),
+		Description: "購入上限の範囲で席の予約ができること",
+		PostJSON: map[string]interface{}{
+			"sheet_rank": rank,
+		},
+		CheckFunc: func(res *http.Response, body *bytes.Buffer) error {
+			switch res.StatusCode {
+			case 202:
+				return checkJsonReservationResponse(reserved)(res, body)
+			case 409, 429:
+				jsonError := JsonError{}
+				err := json.NewDecoder(body).Decode(&jsonError)
+				if err != nil {
+					return fatalErrorf("Jsonのデコードに失敗 %v", err)
+				}
+				errorCode = jsonError.Error
+				return nil
+			}
+			return fmt.Errorf("期待していないステータスコード %d Expected 202, 409 or 429", res.StatusCode)
+		},
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	mtx.Lock()
+	defer mtx.Unlock()
+
+	if errorCode != "" {
+		state.AbortReservation(logID, user, reservation)
+		return nil, errorCode, nil
+	}
+
+	reservation.ID = reserved.ReservationID
+	reservation.SheetNum = reserved.SheetNum
+	reservation.OrderID = reserved.OrderID
+	err = state.CommitReservation(logID, user, reservation)
+	if err != nil {
+		return nil, "", err
+	}
+	eventSheet.Num = reserved.SheetNum
+
+	log.Printf("debug: reserve within limits userID:%d eventID:%d reservedID:%d(%s-%d)\n", user.ID, eventID, reserved.ReservationID, reserved.SheetRank, reserved.SheetNum)
+	return reservation, "", nil
+}
+
+// Reserves n sheets at once, and checks that the expected number of them are reserved and that
+// the others are refused with the error code.
+func reserveSheetsWithinLimits(ctx context.Context, state *State, checker *Checker, user *AppUser, eventSheets []*EventSheet, expected int, errorCode string) ([]*Reservation, error) {
+	var mtx sync.Mutex
+	reservations := make([]*Reservation, len(eventSheets))
+	errorCodes := make([]string, len(eventSheets))
+	errs := make([]error, len(eventSheets))
+	var wg sync.WaitGroup
+	for i := range eventSheets {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			reservations[i], errorCodes[i], errs[i] = reserveSheetWithinLimits(ctx, state, checker, user, eventSheets[i], &mtx)
+		}(i)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var won []*Reservation
+	for i, reservation := range reservations {
+		if reservation != nil {
+			won = append(won, reservation)
+		} else if errorCodes[i] != errorCode {
+			log.Printf("debug: error code %s is not expected:%s (eventID:%d)\n", errorCodes[i], errorCode, eventSheets[i].EventID)
+			return nil, fatalErrorf("購入上限のエラーコードが正しくありません %s", errorCodes[i])
+		}
+	}
+	if len(won) > expected {
+		return nil, fatalErrorf("購入上限を超えて予約できています(id:%d)", eventSheets[0].EventID)
+	}
+	if len(won) < expected {
+		return nil, fatalErrorf("購入上限まで予約できません(id:%d)", eventSheets[0].EventID)
+	}
+	return won, nil
+}
+
+// 同じユーザーが同時に予約や席の確保をしても購入上限を超えないこと
+func CheckPurchaseLimits(ctx context.Context, state *State) error {
+	admin, adminChecker, adminPush := state.PopRandomAdministrator()
+	if admin == nil {
+		return nil
+	}
+	defer adminPush()
+
+	user, userChecker, userPush := state.PopRandomUser()
+	if user == nil {
+		return nil
+	}
+	defer userPush()
+
+	err := loginAdministrator(ctx, adminChecker, admin)
+	if err != nil {
+		return err
+	}
+
+	err = loginAppUser(ctx, userChecker, user)
+	if err != nil {
+		return err
+	}
+
+	// The event is kept private in the state, so that the load never reserves it beyond the limits.
+	event, newEventPush := state.CreateNewEvent()
+	event.PublicFg = false
+
+	err = adminChecker.Play(ctx, &CheckAction{
+		Method:             "POST",
+		Path:               "/admin/api/events",
+		ExpectedStatusCode: 200,
+		Description:        "管理者がイベントを作成できること",
+		PostJSON:           eventPostJSON(event),
+		CheckFunc:          checkJsonFullEventCreateResponse(event),
+	})
+	if err != nil {
+		return err
+	}
+	newEventPush("CheckPurchaseLimits")
+
+	err = adminChecker.Play(ctx, &CheckAction{
+		Method:             "PUT",
+		Path:               fmt.Sprintf("/admin/api/events/%d/limits", event.ID),
+		ExpectedStatusCode: 400,
+		Description:        "期間のない予約数の上限を設定できないこと",
+		PostJSON:           map[string]interface{}{"max_reservations": 3},
+		CheckFunc:          checkJsonErrorResponse("invalid_limits"),
+	})
+	if err != nil {
+		return err
+	}
+
+	// Up to 2 sheets at a time, 3 reservations an hour, and an hour of cooldown after 2 cancellations
+	limits := &JsonPurchaseLimits{
+		MaxSheets:         2,
+		MaxReservations:   3,
+		ReservationWindow: 3600,
+		MaxCancels:        2,
+		CancelCooldown:    3600,
+	}
+	err = adminChecker.Play(ctx, &CheckAction{
+		Method:             "PUT",
+		Path:               fmt.Sprintf("/admin/api/events/%d/limits", event.ID),
+		ExpectedStatusCode: 200,
+		Description:        "管理者が購入上限を設定できること",
+		PostJSON:           purchaseLimitsJSON(limits),
+		CheckFunc: func(res *http.Response, body *bytes.Buffer) error {
+			var got JsonPurchaseLimits
+			err := json.NewDecoder(body).Decode(&got)
+			if err != nil {
+				return fatalErrorf("Jsonのデコードに失敗 %v", err)
+			}
+			if got != *limits {
+				return fatalErrorf("イベント(id:%d)の購入上限が正しくありません", event.ID)
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	err = adminChecker.Play(ctx, &CheckAction{
+		Method:             "POST",
+		Path:               fmt.Sprintf("/admin/api/events/%d/actions/edit", event.ID),
+		ExpectedStatusCode: 200,
+		Description:        "管理者がイベントを公開できること",
+		PostJSON:           map[string]bool{"public": true, "closed": false},
+	})
+	if err != nil {
+		return err
+	}
+
+	rank := GetRandomSheetRank()
+	newEventSheets := func(n int) []*EventSheet {
+		eventSheets := make([]*EventSheet, n)
+		for i := range eventSheets {
+			eventSheets[i] = &EventSheet{EventID: event.ID, Rank: rank, Num: NonReservedNum, Price: event.SheetPrice(rank, NonReservedNum)}
+		}
+		return eventSheets
+	}
+
+	// A hold counts toward the sheets as a reservation does
+	heldSheet := newEventSheets(1)[0]
+	hold := &JsonHold{}
+	err = userChecker.Play(ctx, &CheckAction{
+		Method:             "POST",
+		Path:               fmt.Sprintf("/api/events/%d/actions/hold", event.ID),
+		ExpectedStatusCode: 202,
+		Description:        "購入上限の範囲で席を確保できること",
+		PostJSON: map[string]interface{}{
+			"sheet_rank": rank,
+		},
+		CheckFunc: func(res *http.Response, body *bytes.Buffer) error {
+			err := json.NewDecoder(body).Decode(hold)
+			if err != nil {
+				return fatalErrorf("Jsonのデコードに失敗 %v", err)
+			}
+			if hold.SheetRank != rank || hold.SheetNum == 0 {
+				return fatalErrorf("確保された席が正しくありません")
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	eventSheets := newEventSheets(4)
+	reserved, err := reserveSheetsWithinLimits(ctx, state, userChecker, user, eventSheets, 1, "sheet_limit_exceeded")
+	if err != nil {
+		return err
+	}
+
+	err = userChecker.Play(ctx, &CheckAction{
+		Method:             "POST",
+		Path:               fmt.Sprintf("/api/events/%d/actions/hold", event.ID),
+		ExpectedStatusCode: 409,
+		Description:        "購入上限を超えて席を確保できないこと",
+		PostJSON: map[string]interface{}{
+			"sheet_rank": rank,
+		},
+		CheckFunc: checkJsonErrorResponse("sheet_limit_exceeded"),
+	})
+	if err != nil {
+		return err
+	}
+
+	confirmed, err := confirmHold(ctx, state, userChecker, user, heldSheet, hold)
+	if err != nil {
+		return err
+	}
+	reserved = append(reserved, confirmed)
+
+	_, err = cancelSheet(ctx, state, userChecker, user, newEventSheets(1)[0], reserved[0])
+	if err != nil {
+		return err
+	}
+
+	// 2 of the 3 reservations an hour are made, though one of them is canceled
+	eventSheets = newEventSheets(3)
+	_, err = reserveSheetsWithinLimits(ctx, state, userChecker, user, eventSheets, 1, "reservation_rate_limited")
+	if err != nil {
+		return err
+	}
+
+	_, err = cancelSheet(ctx, state, userChecker, user, newEventSheets(1)[0], reserved[1])
+	if err != nil {
+		return err
+	}
+
+	err = userChecker.Play(ctx, &CheckAction{
+		Method:             "POST",
+		Path:               fmt.Sprintf("/api/events/%d/actions/reserve", event.ID),
+		ExpectedStatusCode: 429,
+		Description:        "キャンセルを繰り返したユーザーが予約できないこと",
+		PostJSON: map[string]interface{}{
+			"sheet_rank": rank,
+		},
+		CheckFunc: checkJsonErrorResponse("cancel_cooldown"),
+	})
+	if err != nil {
+		return err
+	}
+
+	err = adminChecker.Play(ctx, &CheckAction{
+		Method:             "POST",
+		Path:               fmt.Sprintf("/admin/api/events/%d/actions/edit", event.ID),
+		ExpectedStatusCode: 200,
+		Description:        "管理者がイベントの公開を停止できること",
+		PostJSON:           eventEditJSON(event),
+	})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func CheckTicketCheckIn(ctx context.Context, state *State) error {
+	admin, adminChecker, adminPush := state.PopRandomAdministrator()
+	if admin == nil {
+		return nil
+	}
+	defer adminPush()
+
+	user, userChecker, userPush := state.PopRandomUser()
+	if user == nil {
+		return nil
+	}
+	defer userPush()
+
+	err := loginAdministrator(ctx, adminChecker, admin)
+	if err != nil {
+		return err
+	}
+
+	err = loginAppUser(ctx, userChecker, user)
+	if err != nil {
+		return err
+	}
+
+	// The event is kept private in the state, so that the load never cancels the checked-in reservation.
+	event, newEventPush := state.CreateNewEvent()
+	event.PublicFg = false
+
+	err = adminChecker.Play(ctx, &CheckAction{
+		Method:             "POST",
+		Path:               "/admin/api/events",
+		ExpectedStatusCode: 200,
+		Description:        "管理者がイベントを作成できること",
+		PostJSON:           eventPostJSON(event),
+		CheckFunc:          checkJsonFullEventCreateResponse(event),
+	})
+	if err != nil {
+		return err
+	}
+	newEventPush("CheckTicketCheckIn")
+
+	err = adminChecker.Play(ctx, &CheckAction{
+		Method:             "POST",
+		Path:               fmt.Sprintf("/admin/api/events/%d/actions/edit", event.ID),
+		ExpectedStatusCode: 200,
+		Description:        "管理者がイベントを公開できること",
+		PostJSON:           map[string]bool{"public": true, "closed": false},
+	})
+	if err != nil {
+		return err
+	}
+
+	rank := GetRandomSheetRank()
+	eventSheet := &EventSheet{EventID: event.ID, Rank: rank, Num: NonReservedNum, Price: event.SheetPrice(rank, NonReservedNum)}
+	reservation, err := reserveSheet(ctx, state, userChecker, user, eventSheet)
+	if err != nil {
+		return err
+	}
+
+	ticket := &JsonTicket{}
+	err = userChecker.Play(ctx, &CheckAction{
+		Method:             "GET",
+		Path:               fmt.Sprintf("/api/reservations/%d/ticket", reservation.ID),
+		ExpectedStatusCode: 200,
+		Description:        "予約のチケットを取得できること",
+		CheckFunc: func(res *http.Response, body *bytes.Buffer) error {
+			err := json.NewDecoder(body).Decode(ticket)
+			if err != nil {
+				return fatalErrorf("Jsonのデコードに失敗 %v", err)
+			}
+			if ticket.ReservationID != reservation.ID || ticket.EventID != event.ID || ticket.SheetRank != reservation.SheetRank || ticket.SheetNum != reservation.SheetNum {
+				return fatalErrorf("チケットの内容が正しくありません")
+			}
+			if ticket.Token == "" {
+				return fatalErrorf("チケットのトークンがありません")
+			}
+			if ticket.CheckedInAt != nil {
+				return fatalErrorf("入場前のチケットに入場時刻があります")
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	err = userChecker.Play(ctx, &CheckAction{
+		Method:             "GET",
+		Path:               fmt.Sprintf("/api/reservations/%d/ticket.png", reservation.ID),
+		ExpectedStatusCode: 200,
+		Description:        "チケットのQRコードを取得できること",
+		CheckFunc: func(res *http.Response, body *bytes.Buffer) error {
+			if !bytes.HasPrefix(body.Bytes(), []byte("\x89PNG\r\n\x1a\n")) {
+				return fatalErrorf("チケットのQRコードがPNGではありません")
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	otherUser, otherChecker, otherPush := state.PopRandomUser()
+	if otherUser != nil {
+		defer otherPush()
+
+		err = loginAppUser(ctx, otherChecker, otherUser)
+		if err != nil {
+			return err
+		}
+
+		err = otherChecker.Play(ctx, &CheckAction{
+			Method:             "GET",
+			Path:               fmt.Sprintf("/api/reservations/%d/ticket", reservation.ID),
+			ExpectedStatusCode: 403,
+			Description:        "他のユーザーの予約のチケットを取得できないこと",
+			CheckFunc:          checkJsonErrorResponse("forbidden"),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	err = adminChecker.Play(ctx, &CheckAction{
+		Method:             "POST",
+		Path:               fmt.Sprintf("/admin/api/events/%d/checkins", event.ID),
+		ExpectedStatusCode: 400,
+		Description:        "改ざんされたチケットで入場できないこと",
+		PostJSON:           map[string]string{"token": tamperTicketToken(ticket.Token)},
+		CheckFunc:          checkJsonErrorResponse("invalid_ticket"),
+	})
+	if err != nil {
+		return err
+	}
+
+	err = adminChecker.Play(ctx, &CheckAction{
+		Method:             "POST",
+		Path:               fmt.Sprintf("/admin/api/events/%d/checkins", event.ID),
+		ExpectedStatusCode: 200,
+		Description:        "スタッフがチケットで入場を受け付けられること",
+		PostJSON:           map[string]string{"token": ticket.Token},
+		CheckFunc: func(res *http.Response, body *bytes.Buffer) error {
+			var checkedIn JsonTicket
+			err := json.NewDecoder(body).Decode(&checkedIn)
+			if err != nil {
+				return fatalErrorf("Jsonのデコードに失敗 %v", err)
+			}
+			if checkedIn.ReservationID != reservation.ID || checkedIn.CheckedInAt == nil {
+				return fatalErrorf("入場したチケットの内容が正しくありません")
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	err = adminChecker.Play(ctx, &CheckAction{
+		Method:             "POST",
+		Path:               fmt.Sprintf("/admin/api/events/%d/checkins", event.ID),
+		ExpectedStatusCode: 409,
+		Description:        "入場済みのチケットで再び入場できないこと",
+		PostJSON:           map[string]string{"token": ticket.Token},
+		CheckFunc:          checkJsonErrorResponse("already_checked_in"),
+	})
+	if err != nil {
+		return err
+	}
+
+	err = userChecker.Play(ctx, &CheckAction{
+		Method:             "DELETE",
+		Path:               fmt.Sprintf("/api/events/%d/sheets/%s/%d/reservation", event.ID, reservation.SheetRank, reservation.SheetNum),
+		ExpectedStatusCode: 409,
+		Description:        "入場済みの予約をキャンセルできないこと",
+		CheckFunc:          checkJsonErrorResponse("already_checked_in"),
+	})
+	if err != nil {
+		return err
+	}
+
+	err = adminChecker.Play(ctx, &CheckAction{
+		Method:             "POST",
+		Path:               fmt.Sprintf("/admin/api/events/%d/actions/edit", event.ID),
+		ExpectedStatusCode: 200,
+		Description:        "管理者がイベントの公開を停止できること",
+		PostJSON:           eventEditJSON(event),
+	})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Flips the first character of the signature of the token.
+func tamperTicketToken(token string) string {
+	i := strings.LastIndex(token, ".") + 1
+	if i >= len(token) {
+		return token + "A"
+	}
+	c := byte('A')
+	if token[i] == c {
+		c = 'B'
+	}
+	return token[:i] + string(c) + token[i+1:]
+}
+
+func CheckTicketTransfer(ctx context.Context, state *State) error {
+	admin, adminChecker, adminPush := state.PopRandomAdministrator()
+	if admin == nil {
+		return nil
+	}
+	defer adminPush()
+
+	sender, senderChecker, senderPush := state.PopRandomUser()
+	if sender == nil {
+		return nil
+	}
+	defer senderPush()
+
+	recipient, recipientChecker, recipientPush := state.PopRandomUser()
+	if recipient == nil {
+		return nil
+	}
+	defer recipientPush()
+
+	err := loginAdministrator(ctx, adminChecker, admin)
+	if err != nil {
+		return err
+	}
+
+	err = loginAppUser(ctx, senderChecker, sender)
+	if err != nil {
+		return err
+	}
+
+	err = loginAppUser(ctx, recipientChecker, recipient)
+	if err != nil {
+		return err
+	}
+
+	// The event is kept private in the state, so that the load never cancels the reservation being transferred.
+	event, newEventPush := state.CreateNewEvent()
+	event.PublicFg = false
+
+	err = adminChecker.Play(ctx, &CheckAction{
+		Method:             "POST",
+		Path:               "/admin/api/events",
+		ExpectedStatusCode: 200,
+		Description:        "管理者がイベントを作成できること",
+		PostJSON:           eventPostJSON(event),
+		CheckFunc:          checkJsonFullEventCreateResponse(event),
+	})
+	if err != nil {
+		return err
+	}
+	newEventPush("CheckTicketTransfer")
+
+	err = adminChecker.Play(ctx, &CheckAction{
+		Method:             "POST",
+		Path:               fmt.Sprintf("/admin/api/events/%d/actions/edit", event.ID),
+		ExpectedStatusCode: 200,
+		Description:        "管理者がイベントを公開できること",
+		PostJSON:           map[string]bool{"public": true, "closed": false},
+	})
+	if err != nil {
+		return err
+	}
+
+	rank := GetRandomSheetRank()
+	eventSheet := &EventSheet{EventID: event.ID, Rank: rank, Num: NonReservedNum, Price: event.SheetPrice(rank, NonReservedNum)}
+	reservation, err := reserveSheet(ctx, state, senderChecker, sender, eventSheet)
+	if err != nil {
+		return err
+	}
+
+	err = senderChecker.Play(ctx, &CheckAction{
+		Method:             "POST",
+		Path:               fmt.Sprintf("/api/reservations/%d/transfer", reservation.ID),
+		ExpectedStatusCode: 400,
+		Description:        "自分自身にチケットを譲渡できないこと",
+		PostJSON:           map[string]string{"login_name": sender.LoginName},
+		CheckFunc:          checkJsonErrorResponse("invalid_recipient"),
+	})
+	if err != nil {
+		return err
+	}
+
+	transfer := &JsonTransfer{}
+	err = senderChecker.Play(ctx, &CheckAction{
+		Method:             "POST",
+		Path:               fmt.Sprintf("/api/reservations/%d/transfer", reservation.ID),
+		ExpectedStatusCode: 200,
+		Description:        "チケットの譲渡を申し込めること",
+		PostJSON:           map[string]string{"login_name": recipient.LoginName},
+		CheckFunc:          checkJsonTransferResponse(transfer, reservation, sender, recipient, "pending"),
+	})
+	if err != nil {
+		return err
+	}
+
+	err = senderChecker.Play(ctx, &CheckAction{
+		Method:             "POST",
+		Path:               fmt.Sprintf("/api/reservations/%d/transfer", reservation.ID),
+		ExpectedStatusCode: 409,
+		Description:        "譲渡の申し込み中に重ねて申し込めないこと",
+		PostJSON:           map[string]string{"login_name": recipient.LoginName},
+		CheckFunc:          checkJsonErrorResponse("transfer_pending"),
+	})
+	if err != nil {
+		return err
+	}
+
+	err = senderChecker.Play(ctx, &CheckAction{
+		Method:             "POST",
+		Path:               fmt.Sprintf("/api/transfers/%d/actions/accept", transfer.ID),
+		ExpectedStatusCode: 403,
+		Description:        "譲渡の受け取りは譲渡先のユーザーしかできないこと",
+		CheckFunc:          checkJsonErrorResponse("forbidden"),
+	})
+	if err != nil {
+		return err
+	}
+
+	err = recipientChecker.Play(ctx, &CheckAction{
+		Method:             "GET",
+		Path:               fmt.Sprintf("/api/users/%d", recipient.ID),
+		ExpectedStatusCode: 200,
+		Description:        "受け取り待ちの譲渡がマイページに表示されること",
+		CheckFunc: checkJsonFullUserResponse(recipient, func(fullUser *JsonFullUser) error {
+			return checkRecentTransfer(fullUser, transfer.ID, "pending")
+		}),
+	})
+	if err != nil {
+		return err
+	}
+
+	state.BeginTransfer(sender, recipient, reservation)
+	err = recipientChecker.Play(ctx, &CheckAction{
+		Method:             "POST",
+		Path:               fmt.Sprintf("/api/transfers/%d/actions/accept", transfer.ID),
+		ExpectedStatusCode: 200,
+		Description:        "譲渡されたチケットを受け取れること",
+		CheckFunc:          checkJsonTransferResponse(&JsonTransfer{}, reservation, sender, recipient, "accepted"),
+	})
+	if err != nil {
+		return err
+	}
+	state.CommitTransfer(sender, recipient, reservation)
+
+	err = recipientChecker.Play(ctx, &CheckAction{
+		Method:             "POST",
+		Path:               fmt.Sprintf("/api/transfers/%d/actions/accept", transfer.ID),
+		ExpectedStatusCode: 409,
+		Description:        "受け取り済みの譲渡を再び受け取れないこと",
+		CheckFunc:          checkJsonErrorResponse("transfer_closed"),
+	})
+	if err != nil {
+		return err
+	}
+
+	err = senderChecker.Play(ctx, &CheckAction{
+		Method:             "GET",
+		Path:               fmt.Sprintf("/api/users/%d", sender.ID),
+		ExpectedStatusCode: 200,
+		Description:        "譲渡したチケットがマイページの譲渡履歴に表示されること",
+		CheckFunc: checkJsonFullUserResponse(sender, func(fullUser *JsonFullUser) error {
+			for _, r := range fullUser.RecentReservations {
+				if r.ReservationID == reservation.ID {
+					return fatalErrorf("譲渡した席が最近予約した席に表示されています userID=%d", sender.ID)
+				}
+			}
+			return checkRecentTransfer(fullUser, transfer.ID, "accepted")
+		}),
+	})
+	if err != nil {
+		return err
+	}
+
+	err = recipientChecker.Play(ctx, &CheckAction{
+		Method:             "GET",
+		Path:               fmt.Sprintf("/api/users/%d", recipient.ID),
+		ExpectedStatusCode: 200,
+		Description:        "受け取ったチケットがマイページに表示されること",
+		CheckFunc: checkJsonFullUserResponse(recipient, func(fullUser *JsonFullUser) error {
+			if fullUser.TotalPrice < recipient.Status.NegativeTotalPrice || recipient.Status.PositiveTotalPrice < fullUser.TotalPrice {
+				log.Printf("warn: miss match user total price expected=%s got=%d userID=%d\n", recipient.Status.TotalPriceString(), fullUser.TotalPrice, recipient.ID)
+				return fatalErrorf("譲渡後の予約総額が正しくありません userID=%d", recipient.ID)
+			}
+			found := false
+			for _, r := range fullUser.RecentReservations {
+				if r.ReservationID == reservation.ID {
+					found = true
+				}
+			}
+			if !found {
+				return fatalErrorf("受け取った席が最近予約した席に表示されていません userID=%d", recipient.ID)
+			}
+			return checkRecentTransfer(fullUser, transfer.ID, "accepted")
+		}),
+	})
+	if err != nil {
+		return err
+	}
+
+	err = senderChecker.Play(ctx, &CheckAction{
+		Method:             "DELETE",
+		Path:               fmt.Sprintf("/api/events/%d/sheets/%s/%d/reservation", event.ID, reservation.SheetRank, reservation.SheetNum),
+		ExpectedStatusCode: 403,
+		Description:        "譲渡した席をキャンセルできないこと",
+		CheckFunc:          checkJsonErrorResponse("not_permitted"),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = cancelSheet(ctx, state, recipientChecker, recipient, eventSheet, reservation)
+	if err != nil {
+		return err
+	}
+
+	err = adminChecker.Play(ctx, &CheckAction{
+		Method:             "POST",
+		Path:               fmt.Sprintf("/admin/api/events/%d/actions/edit", event.ID),
+		ExpectedStatusCode: 200,
+		Description:        "管理者がイベントの公開を停止できること",
+		PostJSON:           eventEditJSON(event),
+	})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func checkJsonTransferResponse(transfer *JsonTransfer, reservation *Reservation, from *AppUser, to *AppUser, status string) func(res *http.Response, body *bytes.Buffer) error {
+	return func(res *http.Response, body *bytes.Buffer) error {
+		err := json.NewDecoder(body).Decode(transfer)
+		if err != nil {
+			return fatalErrorf("Jsonのデコードに失敗 %v", err)
+		}
+		if transfer.ID == 0 || transfer.ReservationID != reservation.ID || transfer.Status != status {
+			log.Printf("debug: transfer id=%d reservationID=%d status=%s expected reservationID=%d status=%s\n", transfer.ID, transfer.ReservationID, transfer.Status, reservation.ID, status)
+			return fatalErrorf("譲渡の内容が正しくありません")
+		}
+		if transfer.Event.ID != reservation.EventID || transfer.SheetRank != reservation.SheetRank || transfer.SheetNum != reservation.SheetNum {
+			return fatalErrorf("譲渡する席が正しくありません")
+		}
+		if transfer.From.ID != from.ID || transfer.To.ID != to.ID {
+			return fatalErrorf("譲渡元または譲渡先のユーザーが正しくありません")
+		}
+		return nil
+	}
+}
+
+func checkRecentTransfer(fullUser *JsonFullUser, transferID uint, status string) error {
+	if len(fullUser.RecentTransfers) > 5 {
+		return fatalErrorf("最近の譲渡が多すぎます userID=%d", fullUser.ID)
+	}
+	for _, t := range fullUser.RecentTransfers {
+		if t.ID != transferID {
+			continue
+		}
+		if t.Status != status {
+			return fatalErrorf("最近の譲渡の状態が正しくありません userID=%d", fullUser.ID)
+		}
+		return nil
+	}
+	return fatalErrorf("最近の譲渡が表示されていません userID=%d", fullUser.ID)
+}
+
+func checkJsonWebhookCreateResponse(webhook *JsonWebhook) func(res *http.Response, body *bytes.Buffer) error {
+	return func(res *http.Response, body *bytes.Buffer) error {
+		jsonWebhook := JsonWebhook{}
+		err := json.NewDecoder(body).Decode(&jsonWebhook)
+		if err != nil {
+			return fatalErrorf("Jsonのデコードに失敗 %v", err)
+		}
+		if jsonWebhook.ID == 0 {
+			return fatalErrorf("WebhookのIDが正しくありません")
+		}
+		if jsonWebhook.Secret != "" {
+			return fatalErrorf("Webhookのシークレットが表示されています (webhook_id=%d)", jsonWebhook.ID)
+		}
+		if jsonWebhook.URL != webhook.URL || strings.Join(jsonWebhook.EventTypes, ",") != strings.Join(webhook.EventTypes, ",") || jsonWebhook.CreatedAt == 0 {
+			return fatalErrorf("作成したWebhookの内容が正しくありません (webhook_id=%d)", jsonWebhook.ID)
+		}
+		webhook.ID = jsonWebhook.ID
+		return nil
+	}
+}
+
+func checkJsonWebhookDeliveriesResponse(check func(*JsonWebhookDeliveries) error) func(res *http.Response, body *bytes.Buffer) error {
+	return func(res *http.Response, body *bytes.Buffer) error {
+		bytes := body.Bytes()
+		dec := json.NewDecoder(body)
+
+		var v JsonWebhookDeliveries
+		err := dec.Decode(&v)
+		if err != nil {
+			return fatalErrorf("Jsonのデコードに失敗 %s %v", string(bytes), err)
+		}
+		if v.Deliveries == nil {
+			return fatalErrorf("Webhookの配信履歴を取得できません")
+		}
+		for _, delivery := range v.Deliveries {
+			if delivery == nil || delivery.History == nil {
+				return fatalErrorf("Webhookの配信履歴がnullです")
+			}
+		}
+
+		return check(&v)
+	}
+}
+
+func CheckWebhooks(ctx context.Context, state *State) error {
+	admin, adminChecker, adminPush := state.PopRandomAdministrator()
+	if admin == nil {
+		return nil
+	}
+	defer adminPush()
+
+	err := loginAdministrator(ctx, adminChecker, admin)
+	if err != nil {
+		return err
+	}
+
+	// The address is reserved for documentation and unreachable, so that deliveries are left pending for retries.
+	webhook := &JsonWebhook{
+		URL:        "http://192.0.2.1:9/" + RandomAlphabetString(16),
+		EventTypes: []string{"event.created"},
+	}
+	secret := RandomAlphabetString(32)
+
+	for _, c := range []struct {
+		url        string
+		eventTypes []string
+		errCode    string
+	}{
+		{"ftp://192.0.2.1/" + RandomAlphabetString(16), webhook.EventTypes, "invalid_url"},
+		// Private addresses are never called
+		{"http://127.0.0.1/" + RandomAlphabetString(16), webhook.EventTypes, "invalid_url"},
+		{"http://169.254.169.254/latest/meta-data/", webhook.EventTypes, "invalid_url"},
+		{"http://10.0.0.1:8080/" + RandomAlphabetString(16), webhook.EventTypes, "invalid_url"},
+		{webhook.URL, []string{"event.deleted"}, "invalid_event_type"},
+	} {
+		err = adminChecker.Play(ctx, &CheckAction{
+			Method:             "POST",
+			Path:               "/admin/api/webhooks",
+			ExpectedStatusCode: 400,
+			Description:        "不正なWebhookを登録できないこと",
+			PostJSON: map[string]interface{}{
+				"url":         c.url,
+				"secret":      secret,
+				"event_types": c.eventTypes,
+			},
+			CheckFunc: checkJsonErrorResponse(c.errCode),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	err = adminChecker.Play(ctx, &CheckAction{
+		Method:             "POST",
+		Path:               "/admin/api/webhooks",
+		ExpectedStatusCode: 201,
+		Description:        "管理者がWebhookを登録できること",
+		PostJSON: map[string]interface{}{
+			"url":         webhook.URL,
+			"secret":      secret,
+			"event_types": webhook.EventTypes,
+		},
+		CheckFunc: checkJsonWebhookCreateResponse(webhook),
+	})
+	if err != nil {
+		return err
+	}
+
+	// The event is kept private in the state, since it is only for the webhook.
+	event, newEventPush := state.CreateNewEvent()
+	event.PublicFg = false
+
+	err = adminChecker.Play(ctx, &CheckAction{
+		Method:             "POST",
+		Path:               "/admin/api/events",
+		ExpectedStatusCode: 200,
+		Description:        "管理者がイベントを作成できること",
+		PostJSON:           eventPostJSON(event),
+		CheckFunc:          checkJsonFullEventCreateResponse(event),
+	})
+	if err != nil {
+		return err
+	}
+	newEventPush("CheckWebhooks")
+
+	var deliveryID uint
+	err = adminChecker.Play(ctx, &CheckAction{
+		Method:             "GET",
+		Path:               fmt.Sprintf("/admin/api/webhooks/%d/deliveries?limit=1000", webhook.ID),
+		ExpectedStatusCode: 200,
+		Description:        "Webhookの配信履歴が取得できること",
+		CheckFunc: checkJsonWebhookDeliveriesResponse(func(v *JsonWebhookDeliveries) error {
+			for _, delivery := range v.Deliveries {
+				if delivery.EndpointID != webhook.ID || delivery.Type != "event.created" {
+					return fatalErrorf("購読していないWebhookが配信されています (webhook_id=%d)", webhook.ID)
+				}
+				if id, ok := delivery.Data["id"].(float64); ok && uint(id) == event.ID {
+					deliveryID = delivery.ID
+				}
+			}
+			if deliveryID == 0 {
+				return fatalErrorf("イベント作成のWebhookが配信されていません (webhook_id=%d, event_id=%d)", webhook.ID, event.ID)
+			}
+			return nil
+		}),
+	})
+	if err != nil {
+		return err
+	}
+
+	err = adminChecker.Play(ctx, &CheckAction{
+		Method:             "POST",
+		Path:               fmt.Sprintf("/admin/api/webhooks/%d/deliveries/%d/actions/replay", webhook.ID, deliveryID),
+		ExpectedStatusCode: 409,
+		Description:        "失敗していないWebhookを再送できないこと",
+		CheckFunc:          checkJsonErrorResponse("not_failed"),
+	})
+	if err != nil {
+		return err
+	}
+
+	err = adminChecker.Play(ctx, &CheckAction{
+		Method:             "DELETE",
+		Path:               fmt.Sprintf("/admin/api/webhooks/%d", webhook.ID),
+		ExpectedStatusCode: 204,
+		Description:        "管理者がWebhookを削除できること",
+	})
+	if err != nil {
+		return err
+	}
+
+	return adminChecker.Play(ctx, &CheckAction{
+		Method:             "GET",
+		Path:               fmt.Sprintf("/admin/api/webhooks/%d/deliveries", webhook.ID),
+		ExpectedStatusCode: 404,
+		Description:        "削除したWebhookの配信履歴が取得できないこと",
+		CheckFunc:          checkJsonErrorResponse("not_found"),
+	})
+}
+
+func checkReportHeader(reader *csv.Reader) error {
+	// reservation_id,event_id,rank,num,price,user_id,sold_at,canceled_at,refund,fee,net
+	row, err := reader.Read()
+	if err == io.EOF ||
+		len(row) != 11 ||
+		row[0] != "reservation_id" ||
+		row[1] != "event_id" ||
+		row[2] != "rank" ||
+		row[3] != "num" ||
+		row[4] != "price" ||
+		row[5] != "user_id" ||
+		row[6] != "sold_at" ||
+		row[7] != "canceled_at" ||
+		row[8] != "refund" ||
+		row[9] != "fee" ||
+		row[10] != "net" {
+		return fatalErrorf("正しいCSVヘッダを取得できません")
+	}
+	return nil
+}
+
+// Parses the report in JSON Lines or CSV, according to the Content-Type, in the order of rows.
+func readReportRecords(res *http.Response, body *bytes.Buffer) ([]*ReportRecord, error) {
+	if strings.HasPrefix(res.Header.Get("Content-Type"), "application/x-ndjson") {
+		return readJSONLinesReportRecords(body)
+	}
+
+	reader := csv.NewReader(body)
+	err := checkReportHeader(reader)
+	if err != nil {
+		return nil, err
+	}
+	return readCSVReportRecords(reader)
+}
+
+func getReportRecords(s *State, res *http.Response, body *bytes.Buffer) (map[uint]*ReportRecord, error) {
+	list, err := readReportRecords(res, body)
+	if err != nil {
+		return nil, err
+	}
+
+	records := make(map[uint]*ReportRecord, len(list))
+	for _, record := range list {
+		records[record.ReservationID] = record
+	}
+	return records, nil
+}
+
+func readJSONLinesReportRecords(body *bytes.Buffer) ([]*ReportRecord, error) {
+	// {"reservation_id":1,"event_id":1,"rank":"S","num":36,"price":8000,"user_id":1002,"sold_at":"2018-08-17T04:55:30Z","canceled_at":"2018-08-17T04:58:31Z","refund":8000,"fee":0,"net":0}
+	// {"reservation_id":2,"event_id":1,"rank":"S","num":36,"price":8000,"user_id":1002,"sold_at":"2018-08-17T04:55:32Z","refund":0,"fee":240,"net":7760}
+	records := []*ReportRecord{}
+
+	msg := "正しいJSON Linesレポートを取得できません"
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 4096), 1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+
+		row := JsonReportRecord{}
+		err := json.Unmarshal(scanner.Bytes(), &row)
+		if err != nil {
+			log.Printf("debug: invalid json (line:%d) error:%v\n", line, err)
+			return nil, fatalErrorf(msg)
+		}
+
+		record, err := parseJsonReportRecord(&row)
+		if err != nil {
+			log.Printf("debug: invalid record (line:%d) error:%v\n", line, err)
+			return nil, fatalErrorf(msg)
+		}
+		records = append(records, record)
+	}
+	if err := scanner.Err(); err != nil {
+		log.Printf("debug: failed to read json lines (line:%d) error:%v\n", line, err)
+		return nil, fatalErrorf(msg)
+	}
+
+	return records, nil
+}
+
+func parseJsonReportRecord(row *JsonReportRecord) (*ReportRecord, error) {
+	_, err := time.Parse(time.RFC3339, row.SoldAt)
+	if err != nil {
+		return nil, err
+	}
+
+	var canceledAt time.Time
+	if row.CanceledAt != "" {
+		canceledAt, err = time.Parse(time.RFC3339, row.CanceledAt)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &ReportRecord{
+		ReservationID: row.ReservationID,
+		EventID:       row.EventID,
+		SheetRank:     row.Rank,
+		SheetNum:      row.Num,
+		SheetPrice:    row.Price,
+		UserID:        row.UserID,
+		CanceledAt:    canceledAt,
+		Refund:        row.Refund,
+		Fee:           row.Fee,
+		Net:           row.Net,
+	}, nil
+}
+
+func readCSVReportRecords(reader *csv.Reader) ([]*ReportRecord, error) {
+	// reservation_id,event_id,rank,num,price,user_id,sold_at,canceled_at,refund,fee,net
+	// 1,1,S,36,8000,1002,2018-08-17T04:55:30Z,2018-08-17T04:58:31Z,8000,0,0
+	// 2,1,S,36,8000,1002,2018-08-17T04:55:32Z,,0,240,7760
+	// 3,1,B,149,4000,1002,2018-08-17T04:55:33Z,,0,120,3880
+	// 4,1,C,317,3000,1002,2018-08-17T04:55:34Z,,0,3000
+	// 5,1,B,27,4000,1002,2018-08-17T04:55:36Z,,0,4000
+	// 6,3,A,15,6000,1002,2018-08-17T04:55:38Z,,0,6000
+	// 7,3,S,10,8000,1002,2018-08-17T04:55:41Z,2018-08-17T04:58:29Z,8000,0
+
+	records := []*ReportRecord{}
+
+	line := 0
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		line++
+
+		msg := "正しいCSVレポートを取得できません"
+
+		if len(row) != 11 {
+			return nil, fatalErrorf(msg)
+		}
+
+		reservationID, err := strconv.Atoi(row[0])
+		if err != nil {
+			log.Printf("debug: invalid reservationID (line:%d) error:%v\n", line, err)
+			return nil, fatalErrorf(msg)
+		}
+		eventID, err := strconv.Atoi(row[1])
+		if err != nil {
+			log.Printf("debug: invalid eventID (line:%d) error:%v\n", line, err)
+			return nil, fatalErrorf(msg)
+		}
+		sheetRank := row[2]
+
+		sheetNum, err := strconv.Atoi(row[3])
+		if err != nil {
+			log.Printf("debug: invalid sheetNum (line:%d) error:%v\n", line, err)
+			return nil, fatalErrorf(msg)
+		}
+
+		sheetPrice, err := strconv.Atoi(row[4])
+		if err != nil {
+			log.Printf("debug: invalid price (line:%d) error:%v\n", line, err)
+			return nil, fatalErrorf(msg)
+		}
+
+		userID, err := strconv.Atoi(row[5])
+		if err != nil {
+			log.Printf("debug: invalid userID (line:%d) error:%v\n", line, err)
+			return nil, fatalErrorf(msg)
+		}
+
+		_, err = time.Parse(time.RFC3339, row[6])
+		if err != nil {
+			log.Printf("debug: invalid soldAt (line:%d) error:%v\n", line, err)
 			return nil, fatalErrorf(msg)
 		}
-		eventID, err := strconv.Atoi(row[1])
+
+		var canceledAt time.Time
+		if row[7] != "" {
+			canceledAt, err = time.Parse(time.RFC3339, row[7])
+			if err != nil {
+				log.Printf("debug: invalid canceledAt (line:%d) error:%v\n", line, err)
+				return nil, fatalErrorf(msg)
+			}
+		}
+
+		refund, err := strconv.Atoi(row[8])
 		if err != nil {
-			log.Printf("debug: invalid eventID (line:%d) error:%v\n", line, err)
+			log.Printf("debug: invalid refund (line:%d) error:%v\n", line, err)
 			return nil, fatalErrorf(msg)
 		}
-		sheetRank := row[2]
 
-		sheetNum, err := strconv.Atoi(row[3])
+		fee, err := strconv.Atoi(row[9])
 		if err != nil {
-			log.Printf("debug: invalid sheetNum (line:%d) error:%v\n", line, err)
+			log.Printf("debug: invalid fee (line:%d) error:%v\n", line, err)
+			return nil, fatalErrorf(msg)
+		}
+
+		net, err := strconv.Atoi(row[10])
+		if err != nil {
+			log.Printf("debug: invalid net (line:%d) error:%v\n", line, err)
 			return nil, fatalErrorf(msg)
 		}
 
-		sheetPrice, err := strconv.Atoi(row[4])
-		if err != nil {
-			log.Printf("debug: invalid price (line:%d) error:%v\n", line, err)
-			return nil, fatalErrorf(msg)
-		}
+		record := &ReportRecord{
+			ReservationID: uint(reservationID),
+			EventID:       uint(eventID),
+			SheetRank:     sheetRank,
+			SheetNum:      uint(sheetNum),
+			SheetPrice:    uint(sheetPrice),
+			UserID:        uint(userID),
+			CanceledAt:    canceledAt,
+			Refund:        uint(refund),
+			Fee:           uint(fee),
+			Net:           uint(net),
+		}
+
+		records = append(records, record)
+	}
+
+	return records, nil
+}
+
+func checkReportRecord(s *State, records map[uint]*ReportRecord, timeBefore time.Time,
+	reservationsBeforeRequest map[uint]*Reservation) error {
+
+	for reservationID, reservationBeforeRequest := range reservationsBeforeRequest {
+		// All elements in reservationsBeforeRequest must exist in records
+		record, ok := records[reservationID]
+		if !ok {
+			log.Printf("debug: should exist (reservationID:%d)\n", reservationID)
+			return fatalErrorf("レポートに予約id:%dの行が存在しません", reservationID)
+		}
+
+		event := s.FindEventByID(record.EventID)
+		if event == nil {
+			log.Printf("debug: event id=%d is not found (reservationID:%d)\n", record.EventID, reservationID)
+			return fatalErrorf("レポート(予約id:%d)のイベントidが正しくありません", reservationID)
+		}
+		if expected := reservationBeforeRequest.Price; record.SheetPrice != expected {
+			log.Printf("debug: price:%d is not expected:%d (reservationID:%d)\n", record.SheetPrice, expected, reservationID)
+			return fatalErrorf("レポート(予約id:%d)のシート価格が正しくありません", reservationID)
+		}
+
+		if reservationBeforeRequest.EventID != record.EventID {
+			log.Printf("debug: event id=%d is not expected:%d (reservationID:%d)\n", record.EventID, reservationBeforeRequest.EventID, reservationID)
+			return fatalErrorf("レポート(予約id:%d)のイベントidが正しくありません", reservationID)
+		}
+		// The reservation may have been transferred after the request
+		if reservationBeforeRequest.UserID != record.UserID && !s.ReservationMaybeOwnedBy(reservationID, record.UserID) {
+			log.Printf("debug: user id=%d is not expected:%d (reservationID:%d)\n", record.UserID, reservationBeforeRequest.UserID, reservationID)
+			return fatalErrorf("レポート(予約id:%d)のユーザidが正しくありません", reservationID)
+		}
+		if reservationBeforeRequest.SheetRank != record.SheetRank {
+			log.Printf("debug: sheet rank=%s is not expected:%s (reservationID:%d)\n", record.SheetRank, reservationBeforeRequest.SheetRank, reservationID)
+			return fatalErrorf("レポート(予約id:%d)のシートランクが正しくありません", reservationID)
+		}
+		if reservationBeforeRequest.SheetNum != record.SheetNum {
+			log.Printf("debug: sheet num=%d is not expected:%d (reservationID:%d)\n", record.SheetNum, reservationBeforeRequest.SheetNum, reservationID)
+			return fatalErrorf("レポート(予約id:%d)のシート番号が正しくありません", reservationID)
+		}
+
+		if reservationBeforeRequest.Canceled(timeBefore) {
+			if record.CanceledAt.IsZero() {
+				log.Printf("debug: should have canceledAt (reservationID:%d)\n", reservationID)
+				return fatalErrorf("レポート(予約id:%d)のキャンセル時刻が正しくありません", reservationID)
+			}
+		} else if reservationBeforeRequest.MaybeCanceled(timeBefore) {
+			if record.CanceledAt.IsZero() {
+				log.Printf("warn: should have canceledAt (reservationID:%d) but ignored (race condition)\n", reservationID)
+			}
+		}
+
+		// A canceled reservation is refunded in full along with the fee, while
+		// a reservation whose payment is still pending yields nothing yet
+		expectedRefund, expectedFee := uint(0), uint(0)
+		if !record.CanceledAt.IsZero() {
+			expectedRefund = record.SheetPrice
+		} else if record.Fee == 0 && record.Net == 0 && record.SheetPrice != 0 {
+			log.Printf("warn: payment of reservationID:%d is pending\n", reservationID)
+			continue
+		} else {
+			expectedFee = record.SheetPrice * PaymentFeePercent / 100
+		}
+		if record.Refund != expectedRefund {
+			log.Printf("debug: refund:%d is not expected:%d (reservationID:%d)\n", record.Refund, expectedRefund, reservationID)
+			return fatalErrorf("レポート(予約id:%d)の返金額が正しくありません", reservationID)
+		}
+		if record.Fee != expectedFee {
+			log.Printf("debug: fee:%d is not expected:%d (reservationID:%d)\n", record.Fee, expectedFee, reservationID)
+			return fatalErrorf("レポート(予約id:%d)の手数料が正しくありません", reservationID)
+		}
+		if expected := record.SheetPrice - record.Refund - record.Fee; record.Net != expected {
+			log.Printf("debug: net:%d is not expected:%d (reservationID:%d)\n", record.Net, expected, reservationID)
+			return fatalErrorf("レポート(予約id:%d)の売上額が正しくありません", reservationID)
+		}
+	}
+
+	return nil
+}
+
+func checkReportCount(
+	reserveCompletedCountBeforeRequest int,
+	reportCount int,
+	reserveRequestedCountAfterResponse uint) error {
+	log.Printf("debug: reserveCompletedCountBeforeRequest:%d <= reportCount:%d <= reserveRequestedCountAfterResponse:%d\n",
+		reserveCompletedCountBeforeRequest,
+		reportCount,
+		reserveRequestedCountAfterResponse)
+	if reserveCompletedCountBeforeRequest <= reportCount &&
+		reportCount <= int(reserveRequestedCountAfterResponse) {
+		return nil
+	}
+	return fatalErrorf("レポートの数が正しくありません")
+}
+
+func checkReportResponse(s *State, timeBefore time.Time, reservationsBeforeRequest map[uint]*Reservation) func(res *http.Response, body *bytes.Buffer) error {
+	return func(res *http.Response, body *bytes.Buffer) error {
+		reserveRequestedCountAfterResponse := s.GetReserveRequestedCount()
+
+		log.Println("debug:", body)
+		records, err := getReportRecords(s, res, body)
+		if err != nil {
+			return err
+		}
+
+		err = checkReportRecord(s, records, timeBefore, reservationsBeforeRequest)
+		if err != nil {
+			return err
+		}
+
+		err = checkReportCount(len(reservationsBeforeRequest), len(records), reserveRequestedCountAfterResponse)
+		if err != nil {
+			return err
+		}
+
+		return nil
+	}
+}
+
+func checkEventReportResponse(s *State, event *Event, timeBefore time.Time, reservationsBeforeRequest map[uint]*Reservation) func(res *http.Response, body *bytes.Buffer) error {
+	return func(res *http.Response, body *bytes.Buffer) error {
+		reserveRequestedCountAfterResponse := event.GetReserveRequestedCount()
+
+		log.Printf("debug: checkEventReport %d\n", event.ID)
+		log.Println("debug:", body)
+		records, err := getReportRecords(s, res, body)
+		if err != nil {
+			return err
+		}
+
+		msg := "正しいレポートを取得できません"
+		for _, record := range records {
+			if record.EventID != event.ID {
+				log.Printf("debug: event id=%d does not match with id=%d (reservationID:%d)\n", record.EventID, event.ID, record.ReservationID)
+				return fatalErrorf(msg)
+			}
+		}
+
+		err = checkReportRecord(s, records, timeBefore, reservationsBeforeRequest)
+		if err != nil {
+			return err
+		}
+
+		err = checkReportCount(len(reservationsBeforeRequest), len(records), reserveRequestedCountAfterResponse)
+		if err != nil {
+			return err
+		}
+
+		return nil
+	}
+}
+
+func checkJsonVenue(expected *JsonVenue, actual *JsonVenue) error {
+	if expected.ID != 0 && actual.ID != expected.ID {
+		return fatalErrorf("会場のIDが正しくありません (venue_id=%d)", actual.ID)
+	}
+	if actual.Name != expected.Name {
+		return fatalErrorf("会場の名前が正しくありません (venue_id=%d)", actual.ID)
+	}
+	if len(actual.Ranks) != len(expected.Ranks) {
+		return fatalErrorf("会場の席種の数が正しくありません (venue_id=%d)", actual.ID)
+	}
+	// Ranks are ordered by price desc
+	for i, rank := range expected.Ranks {
+		if *actual.Ranks[i] != *rank {
+			return fatalErrorf("会場の席種 %s が正しくありません (venue_id=%d)", rank.Rank, actual.ID)
+		}
+	}
+	return nil
+}
+
+func CheckVenues(ctx context.Context, state *State) error {
+	admin, adminChecker, adminPush := state.PopRandomAdministrator()
+	if admin == nil {
+		return nil
+	}
+	defer adminPush()
+
+	user, userChecker, userPush := state.PopRandomUser()
+	if user == nil {
+		return nil
+	}
+	defer userPush()
+
+	err := loginAdministrator(ctx, adminChecker, admin)
+	if err != nil {
+		return err
+	}
+
+	err = loginAppUser(ctx, userChecker, user)
+	if err != nil {
+		return err
+	}
+
+	err = userChecker.Play(ctx, &CheckAction{
+		Method:             "GET",
+		Path:               "/admin/api/venues",
+		ExpectedStatusCode: 401,
+		Description:        "一般ユーザが会場一覧を取得できないこと",
+		CheckFunc:          checkJsonErrorResponse("admin_login_required"),
+	})
+	if err != nil {
+		return err
+	}
+
+	rows := uint(1 + rand.Intn(5))
+	columns := uint(1 + rand.Intn(10))
+	venue := &JsonVenue{
+		Name: RandomAlphabetString(16),
+		Ranks: []*JsonVenueRank{
+			{Rank: "P", Price: 8000, Count: rows * columns, Rows: rows, Columns: columns},
+			{Rank: "F", Price: 0, Count: uint(1 + rand.Intn(50))},
+		},
+	}
+
+	err = adminChecker.Play(ctx, &CheckAction{
+		Method:             "POST",
+		Path:               "/admin/api/venues",
+		ExpectedStatusCode: 400,
+		Description:        "重複した席種の会場を作成できないこと",
+		PostJSON: map[string]interface{}{
+			"name":  venue.Name,
+			"ranks": []*JsonVenueRank{venue.Ranks[1], venue.Ranks[1]},
+		},
+		CheckFunc: checkJsonErrorResponse("invalid_rank"),
+	})
+	if err != nil {
+		return err
+	}
+
+	err = adminChecker.Play(ctx, &CheckAction{
+		Method:             "POST",
+		Path:               "/admin/api/venues",
+		ExpectedStatusCode: 201,
+		Description:        "管理者が会場を作成できること",
+		PostJSON: map[string]interface{}{
+			"name":  venue.Name,
+			"ranks": []*JsonVenueRank{venue.Ranks[1], venue.Ranks[0]},
+		},
+		CheckFunc: func(res *http.Response, body *bytes.Buffer) error {
+			created := &JsonVenue{}
+			err := json.NewDecoder(body).Decode(created)
+			if err != nil {
+				return fatalErrorf("Jsonのデコードに失敗 %v", err)
+			}
+			err = checkJsonVenue(venue, created)
+			if err != nil {
+				return err
+			}
+			venue.ID = created.ID
+			return nil
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	defaultVenue := &JsonVenue{ID: 1, Name: "Default"}
+	for _, sheetKind := range DataSet.SheetKinds {
+		defaultVenue.Ranks = append(defaultVenue.Ranks, &JsonVenueRank{
+			Rank:  sheetKind.Rank,
+			Price: sheetKind.Price,
+			Count: sheetKind.Total,
+		})
+	}
+
+	err = adminChecker.Play(ctx, &CheckAction{
+		Method:             "GET",
+		Path:               "/admin/api/venues",
+		ExpectedStatusCode: 200,
+		Description:        "管理者が会場一覧を取得できること",
+		CheckFunc: func(res *http.Response, body *bytes.Buffer) error {
+			venues := []*JsonVenue{}
+			err := json.NewDecoder(body).Decode(&venues)
+			if err != nil {
+				return fatalErrorf("Jsonのデコードに失敗 %v", err)
+			}
+			found := 0
+			for _, v := range venues {
+				switch v.ID {
+				case defaultVenue.ID:
+					err = checkJsonVenue(defaultVenue, v)
+				case venue.ID:
+					err = checkJsonVenue(venue, v)
+				default:
+					continue
+				}
+				if err != nil {
+					return err
+				}
+				found++
+			}
+			if found != 2 {
+				return fatalErrorf("会場一覧に作成した会場が含まれていません")
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
 
-		userID, err := strconv.Atoi(row[5])
-		if err != nil {
-			log.Printf("debug: invalid userID (line:%d) error:%v\n", line, err)
-			return nil, fatalErrorf(msg)
-		}
+// Requests the report in JSON Lines or CSV at random.
+func randomReportHeaders() map[string]string {
+	if rand.Intn(2) == 0 {
+		return map[string]string{"Accept": "application/x-ndjson"}
+	}
+	return nil
+}
 
-		_, err = time.Parse(time.RFC3339, row[6])
-		if err != nil {
-			log.Printf("debug: invalid soldAt (line:%d) error:%v\n", line, err)
-			return nil, fatalErrorf(msg)
-		}
+func CheckReport(ctx context.Context, state *State) error {
+	admin, checker, push := state.PopRandomAdministrator()
+	if admin == nil {
+		return nil
+	}
+	defer push()
 
-		var canceledAt time.Time
-		if row[7] != "" {
-			canceledAt, err = time.Parse(time.RFC3339, row[7])
-			if err != nil {
-				log.Printf("debug: invalid canceledAt (line:%d) error:%v\n", line, err)
-				return nil, fatalErrorf(msg)
-			}
-		}
+	err := loginAdministratorWithTimeout(ctx, checker, admin, parameter.PostTestLoginTimeout)
+	if err != nil {
+		return err
+	}
 
-		record := &ReportRecord{
-			ReservationID: uint(reservationID),
-			EventID:       uint(eventID),
-			SheetRank:     sheetRank,
-			SheetNum:      uint(sheetNum),
-			SheetPrice:    uint(sheetPrice),
-			UserID:        uint(userID),
-			CanceledAt:    canceledAt,
-		}
+	timeBefore := time.Now().Add(-1 * parameter.AllowableDelay)
+	reservationsBeforeRequest := FilterReservationsToAllowDelay(state.GetCopiedReservations(), timeBefore)
 
-		records[record.ReservationID] = record
+	err = checker.Play(ctx, &CheckAction{
+		Method:             "GET",
+		Path:               "/admin/api/reports/sales",
+		Headers:            randomReportHeaders(),
+		ExpectedStatusCode: 200,
+		Description:        "レポートを正しく取得できること",
+		CheckFunc:          checkReportResponse(state, timeBefore, reservationsBeforeRequest),
+		Timeout:            parameter.PostTestReportTimeout,
+	})
+	if err != nil {
+		return err
 	}
 
-	return records, nil
+	return nil
 }
 
-func checkReportRecord(s *State, records map[uint]*ReportRecord, timeBefore time.Time,
-	reservationsBeforeRequest map[uint]*Reservation) error {
+// Replays the changes feed from the beginning, as an accounting system would,
+// and checks that it ends up with the same state as the full report.
+func CheckReportChanges(ctx context.Context, state *State) error {
+	admin, checker, push := state.PopRandomAdministrator()
+	if admin == nil {
+		return nil
+	}
+	defer push()
 
-	for reservationID, reservationBeforeRequest := range reservationsBeforeRequest {
-		// All elements in reservationsBeforeRequest must exist in records
-		record, ok := records[reservationID]
-		if !ok {
-			log.Printf("debug: should exist (reservationID:%d)\n", reservationID)
-			return fatalErrorf("レポートに予約id:%dの行が存在しません", reservationID)
-		}
+	err := loginAdministratorWithTimeout(ctx, checker, admin, parameter.PostTestLoginTimeout)
+	if err != nil {
+		return err
+	}
 
-		event := s.FindEventByID(record.EventID)
-		if event == nil {
-			log.Printf("debug: event id=%d is not found (reservationID:%d)\n", record.EventID, reservationID)
-			return fatalErrorf("レポート(予約id:%d)のイベントidが正しくありません", reservationID)
-		}
-		if expected := event.Price + GetSheetKindByRank(record.SheetRank).Price; record.SheetPrice != expected {
-			log.Printf("debug: price:%d is not expected:%d (reservationID:%d)\n", record.SheetPrice, expected, reservationID)
-			return fatalErrorf("レポート(予約id:%d)のシート価格が正しくありません", reservationID)
-		}
+	err = checker.Play(ctx, &CheckAction{
+		Method:             "GET",
+		Path:               "/admin/api/reports/sales/changes?since=x",
+		ExpectedStatusCode: 400,
+		Description:        "不正なカーソルで変更履歴を取得できないこと",
+		CheckFunc:          checkJsonErrorResponse("invalid_cursor"),
+	})
+	if err != nil {
+		return err
+	}
 
-		if reservationBeforeRequest.EventID != record.EventID {
-			log.Printf("debug: event id=%d is not expected:%d (reservationID:%d)\n", record.EventID, reservationBeforeRequest.EventID, reservationID)
-			return fatalErrorf("レポート(予約id:%d)のイベントidが正しくありません", reservationID)
-		}
-		if reservationBeforeRequest.UserID != record.UserID {
-			log.Printf("debug: user id=%d is not expected:%d (reservationID:%d)\n", record.UserID, reservationBeforeRequest.UserID, reservationID)
-			return fatalErrorf("レポート(予約id:%d)のユーザidが正しくありません", reservationID)
+	timeBefore := time.Now().Add(-1 * parameter.AllowableDelay)
+	reservationsBeforeRequest := FilterReservationsToAllowDelay(state.GetCopiedReservations(), timeBefore)
+
+	records := map[uint]*ReportRecord{}
+	cursor := ""
+	for {
+		changes := JsonReportChanges{}
+		err := checker.Play(ctx, &CheckAction{
+			Method:             "GET",
+			Path:               "/admin/api/reports/sales/changes?limit=10000&since=" + url.QueryEscape(cursor),
+			ExpectedStatusCode: 200,
+			Description:        "変更履歴を正しく取得できること",
+			CheckFunc: func(res *http.Response, body *bytes.Buffer) error {
+				dec := json.NewDecoder(body)
+				err := dec.Decode(&changes)
+				if err != nil {
+					return fatalErrorf("変更履歴のJSONのデコードに失敗しました %v", err)
+				}
+				return nil
+			},
+			Timeout: parameter.PostTestReportTimeout,
+		})
+		if err != nil {
+			return err
 		}
-		if reservationBeforeRequest.SheetRank != record.SheetRank {
-			log.Printf("debug: sheet rank=%s is not expected:%s (reservationID:%d)\n", record.SheetRank, reservationBeforeRequest.SheetRank, reservationID)
-			return fatalErrorf("レポート(予約id:%d)のシートランクが正しくありません", reservationID)
+
+		if len(changes.Changes) == 0 {
+			if changes.NextCursor != cursor && cursor != "" {
+				log.Printf("debug: next cursor:%s is not expected:%s\n", changes.NextCursor, cursor)
+				return fatalErrorf("変更履歴の次のカーソルが正しくありません")
+			}
+			break
 		}
-		if reservationBeforeRequest.SheetNum != record.SheetNum {
-			log.Printf("debug: sheet num=%d is not expected:%d (reservationID:%d)\n", record.SheetNum, reservationBeforeRequest.SheetNum, reservationID)
-			return fatalErrorf("レポート(予約id:%d)のシート番号が正しくありません", reservationID)
+		if changes.NextCursor == "" || changes.NextCursor == cursor {
+			log.Printf("debug: next cursor:%s does not advance from:%s\n", changes.NextCursor, cursor)
+			return fatalErrorf("変更履歴の次のカーソルが正しくありません")
 		}
 
-		if reservationBeforeRequest.Canceled(timeBefore) {
-			if record.CanceledAt.IsZero() {
-				log.Printf("debug: should have canceledAt (reservationID:%d)\n", reservationID)
-				return fatalErrorf("レポート(予約id:%d)のキャンセル時刻が正しくありません", reservationID)
-			}
-		} else if reservationBeforeRequest.MaybeCanceled(timeBefore) {
-			if record.CanceledAt.IsZero() {
-				log.Printf("warn: should have canceledAt (reservationID:%d) but ignored (race condition)\n", reservationID)
+		// A later change of the same reservation overrides the earlier one.
+		for i := range changes.Changes {
+			record, err := parseJsonReportRecord(&changes.Changes[i])
+			if err != nil {
+				log.Printf("debug: invalid record (cursor:%s) error:%v\n", cursor, err)
+				return fatalErrorf("正しい変更履歴を取得できません")
 			}
+			records[record.ReservationID] = record
 		}
+		cursor = changes.NextCursor
 	}
 
-	return nil
+	reserveRequestedCountAfterResponse := state.GetReserveRequestedCount()
+
+	err = checkReportRecord(state, records, timeBefore, reservationsBeforeRequest)
+	if err != nil {
+		return err
+	}
+
+	return checkReportCount(len(reservationsBeforeRequest), len(records), reserveRequestedCountAfterResponse)
 }
 
-func checkReportCount(
-	reserveCompletedCountBeforeRequest int,
-	reportCount int,
-	reserveRequestedCountAfterResponse uint) error {
-	log.Printf("debug: reserveCompletedCountBeforeRequest:%d <= reportCount:%d <= reserveRequestedCountAfterResponse:%d\n",
-		reserveCompletedCountBeforeRequest,
-		reportCount,
-		reserveRequestedCountAfterResponse)
-	if reserveCompletedCountBeforeRequest <= reportCount &&
-		reportCount <= int(reserveRequestedCountAfterResponse) {
+func CheckEventReport(ctx context.Context, state *State) error {
+	admin, checker, push := state.PopRandomAdministrator()
+	if admin == nil {
 		return nil
 	}
-	return fatalErrorf("レポートの数が正しくありません")
-}
+	defer push()
 
-func checkReportResponse(s *State, timeBefore time.Time, reservationsBeforeRequest map[uint]*Reservation) func(res *http.Response, body *bytes.Buffer) error {
-	return func(res *http.Response, body *bytes.Buffer) error {
-		reserveRequestedCountAfterResponse := s.GetReserveRequestedCount()
+	err := loginAdministrator(ctx, checker, admin)
+	if err != nil {
+		return err
+	}
 
-		log.Println("debug:", body)
-		reader := csv.NewReader(body)
+	// We want to let webapp to lock reservations.
+	// Since no reserve/cancel occurs for closed events, we ignore closed events.
+	// Notice that webapp locks to update reservations (cancel),
+	// but it does not lock to create reservations (reserve).
+	event := state.GetRandomPublicEvent()
+	if event == nil {
+		return nil
+	}
 
-		err := checkReportHeader(reader)
-		if err != nil {
-			return err
-		}
+	timeBefore := time.Now().Add(-1 * parameter.AllowableDelay)
+	reservationsBeforeRequest := FilterReservationsToAllowDelay(state.GetCopiedReservationsInEventID(event.ID), timeBefore)
 
-		records, err := getReportRecords(s, reader)
-		if err != nil {
-			return err
+	err = checker.Play(ctx, &CheckAction{
+		Method:             "GET",
+		Path:               fmt.Sprintf("/admin/api/reports/events/%d/sales", event.ID),
+		Headers:            randomReportHeaders(),
+		ExpectedStatusCode: 200,
+		Description:        "レポートを正しく取得できること",
+		CheckFunc:          checkEventReportResponse(state, event, timeBefore, reservationsBeforeRequest),
+	})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func getReportSummaryRecords(reader *csv.Reader) (map[ReportSummaryKey]*ReportSummaryRecord, error) {
+	// event_id,rank,sold,canceled,gross,refund,fee,net
+	// 1,A,30,3,150000,15000,4050,130950
+	msg := "正しいCSVレポートを取得できません"
+
+	row, err := reader.Read()
+	if err == io.EOF ||
+		len(row) != 8 ||
+		row[0] != "event_id" ||
+		row[1] != "rank" ||
+		row[2] != "sold" ||
+		row[3] != "canceled" ||
+		row[4] != "gross" ||
+		row[5] != "refund" ||
+		row[6] != "fee" ||
+		row[7] != "net" {
+		return nil, fatalErrorf("正しいCSVヘッダを取得できません")
+	}
+
+	records := map[ReportSummaryKey]*ReportSummaryRecord{}
+	line := 0
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
 		}
+		line++
 
-		err = checkReportRecord(s, records, timeBefore, reservationsBeforeRequest)
-		if err != nil {
-			return err
+		if len(row) != 8 {
+			return nil, fatalErrorf(msg)
+		}
+		values := make([]uint, 0, 7)
+		for i, col := range row {
+			if i == 1 {
+				continue
+			}
+			v, err := strconv.Atoi(col)
+			if err != nil || v < 0 {
+				log.Printf("debug: invalid summary column %d (line:%d) error:%v\n", i, line, err)
+				return nil, fatalErrorf(msg)
+			}
+			values = append(values, uint(v))
 		}
 
-		err = checkReportCount(len(reservationsBeforeRequest), len(records), reserveRequestedCountAfterResponse)
-		if err != nil {
-			return err
+		key := ReportSummaryKey{EventID: values[0], Rank: row[1]}
+		if _, ok := records[key]; ok {
+			log.Printf("debug: duplicated summary (line:%d)\n", line)
+			return nil, fatalErrorf(msg)
+		}
+		records[key] = &ReportSummaryRecord{
+			Sold:     values[1],
+			Canceled: values[2],
+			Gross:    values[3],
+			Refund:   values[4],
+			Fee:      values[5],
+			Net:      values[6],
 		}
+	}
+	return records, nil
+}
 
+func CheckReportSummary(ctx context.Context, state *State) error {
+	admin, checker, push := state.PopRandomAdministrator()
+	if admin == nil {
 		return nil
 	}
-}
+	defer push()
 
-func checkEventReportResponse(s *State, event *Event, timeBefore time.Time, reservationsBeforeRequest map[uint]*Reservation) func(res *http.Response, body *bytes.Buffer) error {
-	return func(res *http.Response, body *bytes.Buffer) error {
-		reserveRequestedCountAfterResponse := event.GetReserveRequestedCount()
+	err := loginAdministrator(ctx, checker, admin)
+	if err != nil {
+		return err
+	}
 
-		log.Printf("debug: checkEventReport %d\n", event.ID)
-		log.Println("debug:", body)
-		reader := csv.NewReader(body)
+	err = checker.Play(ctx, &CheckAction{
+		Method:             "GET",
+		Path:               "/admin/api/reports/sales?from=2000000000&to=1000000000",
+		ExpectedStatusCode: 400,
+		Description:        "不正な期間のレポートを取得できないこと",
+		CheckFunc:          checkJsonErrorResponse("invalid_range"),
+	})
+	if err != nil {
+		return err
+	}
 
-		err := checkReportHeader(reader)
-		if err != nil {
-			return err
-		}
+	// Reservations of closed events never change, so that we can expect the exact report.
+	event := state.GetRandomClosedEvent()
+	if event == nil {
+		return nil
+	}
+	reservations := state.GetCopiedReservationsInEventID(event.ID)
+	if len(reservations) == 0 {
+		return nil
+	}
 
-		records, err := getReportRecords(s, reader)
-		if err != nil {
-			return err
-		}
+	// sold_at is truncated to seconds in initial reservations
+	times := make([]int64, 0, len(reservations))
+	for _, r := range reservations {
+		times = append(times, r.ReservedAt)
+	}
+	from, to := times[rand.Intn(len(times))], times[rand.Intn(len(times))]
+	if from > to {
+		from, to = to, from
+	}
+	if from == to {
+		to++
+	}
 
-		msg := "正しいレポートを取得できません"
-		for _, record := range records {
-			if record.EventID != event.ID {
-				log.Printf("debug: event id=%d does not match with id=%d (reservationID:%d)\n", record.EventID, event.ID, record.ReservationID)
-				return fatalErrorf(msg)
-			}
+	inRange := map[uint]*Reservation{}
+	expected := map[ReportSummaryKey]*ReportSummaryRecord{}
+	for id, r := range reservations {
+		if r.ReservedAt < from || to <= r.ReservedAt {
+			continue
 		}
+		inRange[id] = r
 
-		err = checkReportRecord(s, records, timeBefore, reservationsBeforeRequest)
-		if err != nil {
-			return err
+		key := ReportSummaryKey{EventID: event.ID, Rank: r.SheetRank}
+		summary, ok := expected[key]
+		if !ok {
+			summary = &ReportSummaryRecord{}
+			expected[key] = summary
 		}
-
-		err = checkReportCount(len(reservationsBeforeRequest), len(records), reserveRequestedCountAfterResponse)
-		if err != nil {
-			return err
+		summary.Sold++
+		summary.Gross += r.Price
+		if r.CanceledAt != 0 {
+			summary.Canceled++
+			summary.Refund += r.Price
+		} else {
+			fee := r.Price * PaymentFeePercent / 100
+			summary.Fee += fee
+			summary.Net += r.Price - fee
 		}
-
-		return nil
 	}
-}
 
-func CheckReport(ctx context.Context, state *State) error {
-	admin, checker, push := state.PopRandomAdministrator()
-	if admin == nil {
-		return nil
-	}
-	defer push()
+	timeBefore := time.Now()
+	err = checker.Play(ctx, &CheckAction{
+		Method:             "GET",
+		Path:               fmt.Sprintf("/admin/api/reports/events/%d/sales?from=%d&to=%d", event.ID, from, to),
+		ExpectedStatusCode: 200,
+		Description:        "期間を指定したレポートを正しく取得できること",
+		CheckFunc: func(res *http.Response, body *bytes.Buffer) error {
+			records, err := getReportRecords(state, res, body)
+			if err != nil {
+				return err
+			}
 
-	err := loginAdministratorWithTimeout(ctx, checker, admin, parameter.PostTestLoginTimeout)
+			for id := range records {
+				if _, ok := inRange[id]; !ok {
+					log.Printf("debug: should not exist (reservationID:%d)\n", id)
+					return fatalErrorf("レポートに期間外の予約id:%dの行が含まれています", id)
+				}
+			}
+			return checkReportRecord(state, records, timeBefore, inRange)
+		},
+	})
 	if err != nil {
 		return err
 	}
 
-	timeBefore := time.Now().Add(-1 * parameter.AllowableDelay)
-	reservationsBeforeRequest := FilterReservationsToAllowDelay(state.GetCopiedReservations(), timeBefore)
-
 	err = checker.Play(ctx, &CheckAction{
 		Method:             "GET",
-		Path:               "/admin/api/reports/sales",
+		Path:               fmt.Sprintf("/admin/api/reports/sales/summary?from=%d&to=%d", from, to),
 		ExpectedStatusCode: 200,
-		Description:        "レポートを正しく取得できること",
-		CheckFunc:          checkReportResponse(state, timeBefore, reservationsBeforeRequest),
-		Timeout:            parameter.PostTestReportTimeout,
+		Description:        "期間を指定した集計レポートを正しく取得できること",
+		CheckFunc: func(res *http.Response, body *bytes.Buffer) error {
+			records, err := getReportSummaryRecords(csv.NewReader(body))
+			if err != nil {
+				return err
+			}
+
+			for key, record := range records {
+				if record.Gross != record.Refund+record.Fee+record.Net {
+					return fatalErrorf("集計レポート(イベントid:%d, 席種:%s)の売上額が正しくありません", key.EventID, key.Rank)
+				}
+				if key.EventID != event.ID {
+					continue
+				}
+				e, ok := expected[key]
+				if !ok || *e != *record {
+					log.Printf("debug: summary %+v is not expected %+v (eventID:%d rank:%s)\n", record, e, key.EventID, key.Rank)
+					return fatalErrorf("集計レポート(イベントid:%d, 席種:%s)が正しくありません", key.EventID, key.Rank)
+				}
+			}
+			for key := range expected {
+				if _, ok := records[key]; !ok {
+					return fatalErrorf("集計レポートにイベントid:%d, 席種:%sの行が存在しません", key.EventID, key.Rank)
+				}
+			}
+			return nil
+		},
 	})
 	if err != nil {
 		return err
@@ -2216,7 +5947,7 @@ func CheckReport(ctx context.Context, state *State) error {
 	return nil
 }
 
-func CheckEventReport(ctx context.Context, state *State) error {
+func CheckReportCursor(ctx context.Context, state *State) error {
 	admin, checker, push := state.PopRandomAdministrator()
 	if admin == nil {
 		return nil
@@ -2228,30 +5959,92 @@ func CheckEventReport(ctx context.Context, state *State) error {
 		return err
 	}
 
-	// We want to let webapp to lock reservations.
-	// Since no reserve/cancel occurs for closed events, we ignore closed events.
-	// Notice that webapp locks to update reservations (cancel),
-	// but it does not lock to create reservations (reserve).
-	event := state.GetRandomPublicEvent()
-	if event == nil {
-		return nil
-	}
-
-	timeBefore := time.Now().Add(-1 * parameter.AllowableDelay)
-	reservationsBeforeRequest := FilterReservationsToAllowDelay(state.GetCopiedReservationsInEventID(event.ID), timeBefore)
-
 	err = checker.Play(ctx, &CheckAction{
 		Method:             "GET",
-		Path:               fmt.Sprintf("/admin/api/reports/events/%d/sales", event.ID),
-		ExpectedStatusCode: 200,
-		Description:        "レポートを正しく取得できること",
-		CheckFunc:          checkEventReportResponse(state, event, timeBefore, reservationsBeforeRequest),
+		Path:               "/admin/api/reports/sales?cursor=-1",
+		ExpectedStatusCode: 400,
+		Description:        "不正なカーソルでレポートを取得できないこと",
+		CheckFunc:          checkJsonErrorResponse("invalid_cursor"),
 	})
 	if err != nil {
 		return err
 	}
 
-	return nil
+	// Reservations of closed events never change, so that we can expect the exact pages.
+	event := state.GetRandomClosedEvent()
+	if event == nil {
+		return nil
+	}
+	reservations := state.GetCopiedReservationsInEventID(event.ID)
+	if len(reservations) == 0 {
+		return nil
+	}
+
+	ids := make([]uint, 0, len(reservations))
+	for id := range reservations {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	// Exports all reservations page by page, starting at a random cursor.
+	start := rand.Intn(len(ids))
+	cursor := uint(0)
+	if start > 0 {
+		cursor = ids[start-1]
+	}
+	expected := ids[start:]
+	// At most about 10 pages
+	limit := len(ids)/10 + 1 + rand.Intn(len(ids))
+
+	timeBefore := time.Now()
+	for {
+		var page []*ReportRecord
+		err := checker.Play(ctx, &CheckAction{
+			Method:             "GET",
+			Path:               fmt.Sprintf("/admin/api/reports/events/%d/sales?cursor=%d&limit=%d", event.ID, cursor, limit),
+			Headers:            randomReportHeaders(),
+			ExpectedStatusCode: 200,
+			Description:        "カーソルを指定してレポートを正しく取得できること",
+			CheckFunc: func(res *http.Response, body *bytes.Buffer) error {
+				var err error
+				page, err = readReportRecords(res, body)
+				return err
+			},
+		})
+		if err != nil {
+			return err
+		}
+
+		n := limit
+		if len(expected) < n {
+			n = len(expected)
+		}
+		if len(page) != n {
+			log.Printf("debug: page has %d rows but expected %d (eventID:%d cursor:%d)\n", len(page), n, event.ID, cursor)
+			return fatalErrorf("カーソルを指定したレポートの行数が正しくありません")
+		}
+
+		records := map[uint]*ReportRecord{}
+		inPage := map[uint]*Reservation{}
+		for i, record := range page {
+			if record.ReservationID != expected[i] {
+				log.Printf("debug: reservation id=%d is not expected:%d (eventID:%d cursor:%d)\n", record.ReservationID, expected[i], event.ID, cursor)
+				return fatalErrorf("カーソルを指定したレポートの順序が正しくありません")
+			}
+			records[record.ReservationID] = record
+			inPage[record.ReservationID] = reservations[record.ReservationID]
+		}
+		err = checkReportRecord(state, records, timeBefore, inPage)
+		if err != nil {
+			return err
+		}
+
+		if len(page) == 0 {
+			return nil
+		}
+		expected = expected[len(page):]
+		cursor = page[len(page)-1].ReservationID
+	}
 }
 
 func CheckSheetReservationEntropy(ctx context.Context, state *State) error {
@@ -2288,6 +6081,10 @@ func CheckSheetReservationEntropy(ctx context.Context, state *State) error {
 		if reservation.MaybeCanceled(now) {
 			continue
 		}
+		if reservation.Selected {
+			// sheets chosen by users are not random by nature
+			continue
+		}
 		reservationsMap[reservation.SheetRank] = append(reservationsMap[reservation.SheetRank], reservation)
 	}
 	for _, reservations := range reservationsMap {
@@ -2432,8 +6229,32 @@ func popOrCreateEventSheet(ctx context.Context, state *State) (*EventSheet, func
 		return eventSheet, eventSheetPush, nil
 	}
 
-	// Create a new event if no sheet is available
+	created, err := createEventForEventSheets(ctx, state)
+	if err != nil || !created {
+		return nil, nil, err
+	}
+
+	eventSheet, eventSheetPush = state.PopEventSheet()
+	return eventSheet, eventSheetPush, nil
+}
+
+func popOrCreateEventSheets(ctx context.Context, state *State, n int) ([]*EventSheet, func(), error) {
+	eventSheets, eventSheetsPush := state.PopEventSheets(n)
+	if eventSheets != nil {
+		return eventSheets, eventSheetsPush, nil
+	}
+
+	created, err := createEventForEventSheets(ctx, state)
+	if err != nil || !created {
+		return nil, nil, err
+	}
+
+	eventSheets, eventSheetsPush = state.PopEventSheets(n)
+	return eventSheets, eventSheetsPush, nil
+}
 
+// Create a new event if no sheet is available
+func createEventForEventSheets(ctx context.Context, state *State) (bool, error) {
 	ok := state.newEventMtx.TryLock()
 	if ok {
 		defer state.newEventMtx.Unlock()
@@ -2441,18 +6262,18 @@ func popOrCreateEventSheet(ctx context.Context, state *State) (*EventSheet, func
 		log.Println("debug: Somebody else is trying to create a new event. Exit.")
 		// NOTE: We immediately return rather than waiting somebody else finishes to create a new event
 		// because probably the waiting strategy makes benchmarker work faster.
-		return nil, nil, nil
+		return false, nil
 	}
 
 	admin, adminChecker, adminPush := state.PopRandomAdministrator()
 	if admin == nil {
-		return nil, nil, nil
+		return false, nil
 	}
 	defer adminPush()
 
 	err := loginAdministrator(ctx, adminChecker, admin)
 	if err != nil {
-		return nil, nil, err
+		return false, err
 	}
 
 	event, newEventPush := state.CreateNewEvent()
@@ -2465,12 +6286,11 @@ func popOrCreateEventSheet(ctx context.Context, state *State) (*EventSheet, func
 		CheckFunc:          checkJsonFullEventCreateResponse(event),
 	})
 	if err != nil {
-		return nil, nil, err
+		return false, err
 	}
 	newEventPush("popOrCreateEventSheet")
 
-	eventSheet, eventSheetPush = state.PopEventSheet()
-	return eventSheet, eventSheetPush, nil
+	return true, nil
 }
 
 func checkJsonReservationResponse(reserved *JsonReservation) func(res *http.Response, body *bytes.Buffer) error {
@@ -2485,45 +6305,269 @@ func checkJsonReservationResponse(reserved *JsonReservation) func(res *http.Resp
 		if resReserved.SheetRank != reserved.SheetRank {
 			return fatalErrorf("正しい予約情報を取得できません")
 		}
-		// Set reserved ID and Sheet Number from response
+		if resReserved.OrderID == 0 || resReserved.OrderStatus != "paid" {
+			return fatalErrorf("予約の注文情報が正しくありません")
+		}
+		// Set reserved ID, Sheet Number and Order ID from response
 		reserved.ReservationID = resReserved.ReservationID
 		reserved.SheetNum = resReserved.SheetNum
+		reserved.OrderID = resReserved.OrderID
 		return nil
 	}
 }
 
 func reserveSheet(ctx context.Context, state *State, checker *Checker, user *AppUser, eventSheet *EventSheet) (*Reservation, error) {
+	return reserveSheetWithCoupon(ctx, state, checker, user, eventSheet, nil)
+}
+
+// Reserves a sheet of the rank, with the coupon if it is not nil.
+func reserveSheetWithCoupon(ctx context.Context, state *State, checker *Checker, user *AppUser, eventSheet *EventSheet, coupon *Coupon) (*Reservation, error) {
 	eventID := eventSheet.EventID
 	rank := eventSheet.Rank
 
 	reserved := &JsonReservation{ReservationID: 0, SheetRank: rank, SheetNum: 0}
-	reservation := &Reservation{ID: 0, EventID: eventID, UserID: user.ID, SheetRank: rank, Price: eventSheet.Price, SheetNum: 0}
+	reservation := &Reservation{ID: 0, EventID: eventID, UserID: user.ID, SheetRank: rank, Price: eventSheet.Price, SheetNum: 0, Coupon: coupon}
 	logID := state.BeginReservation(user, reservation)
 
+	postJSON := map[string]interface{}{
+		"sheet_rank": rank,
+	}
+	if coupon != nil {
+		postJSON["coupon_code"] = coupon.Code
+	}
+
 	err := checker.Play(ctx, &CheckAction{
 		Method:             "POST",
 		Path:               fmt.Sprintf("/api/events/%d/actions/reserve", eventID),
 		ExpectedStatusCode: 202,
 		Description:        "席の予約ができること",
-		PostJSON: map[string]interface{}{
+		PostJSON:           postJSON,
+		CheckFunc:          checkJsonReservationResponse(reserved),
+	})
+	if err != nil {
+		user.Status.PositiveTotalPrice += eventSheet.Price
+		return nil, err
+	}
+
+	reservation.ID = reserved.ReservationID
+	reservation.SheetNum = reserved.SheetNum
+	reservation.OrderID = reserved.OrderID
+	err = state.CommitReservation(logID, user, reservation)
+	if err != nil {
+		return nil, err
+	}
+	eventSheet.Num = reserved.SheetNum
+
+	log.Printf("debug: reserve userID:%d(total-price:%s) eventID:%d reservedID:%d(%s-%d) price:%d\n", user.ID, user.Status.TotalPriceString(), eventID, reserved.ReservationID, reserved.SheetRank, reserved.SheetNum, reservation.Price)
+	return reservation, nil
+}
+
+// Reserves the sheet specified by rank and num.
+// Returns nil reservation without error if somebody else already holds the sheet.
+func reserveSelectedSheet(ctx context.Context, state *State, checker *Checker, user *AppUser, eventSheet *EventSheet, sheetNum uint) (*Reservation, error) {
+	eventID := eventSheet.EventID
+	rank := eventSheet.Rank
+
+	reserved := &JsonReservation{ReservationID: 0, SheetRank: rank, SheetNum: 0}
+	reservation := &Reservation{ID: 0, EventID: eventID, UserID: user.ID, SheetRank: rank, Price: eventSheet.Price, SheetNum: sheetNum, Selected: true}
+	logID := state.BeginReservation(user, reservation)
+
+	alreadyReserved := false
+	err := checker.Play(ctx, &CheckAction{
+		Method:      "POST",
+		Path:        fmt.Sprintf("/api/events/%d/sheets/%s/%d/reservation", eventID, rank, sheetNum),
+		Description: "席を指定して予約できること",
+		CheckFunc: func(res *http.Response, body *bytes.Buffer) error {
+			switch res.StatusCode {
+			case 202:
+				err := checkJsonReservationResponse(reserved)(res, body)
+				if err != nil {
+					return err
+				}
+				if reserved.SheetNum != sheetNum {
+					return fatalErrorf("指定した席(%s-%d)とは異なる席(%s-%d)が予約されました", rank, sheetNum, reserved.SheetRank, reserved.SheetNum)
+				}
+				return nil
+			case 409:
+				alreadyReserved = true
+				return checkJsonErrorResponse("already_reserved")(res, body)
+			}
+			return fmt.Errorf("期待していないステータスコード %d Expected 202 or 409", res.StatusCode)
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if alreadyReserved {
+		state.AbortReservation(logID, user, reservation)
+		return nil, nil
+	}
+
+	reservation.ID = reserved.ReservationID
+	reservation.OrderID = reserved.OrderID
+	err = state.CommitReservation(logID, user, reservation)
+	if err != nil {
+		return nil, err
+	}
+	eventSheet.Num = sheetNum
+
+	log.Printf("debug: reserve selected userID:%d(total-price:%s) eventID:%d reservedID:%d(%s-%d) price:%d\n", user.ID, user.Status.TotalPriceString(), eventID, reserved.ReservationID, rank, sheetNum, eventSheet.Price)
+	return reservation, nil
+}
+
+func checkJsonReservationsResponse(reserved []*JsonReservation) func(res *http.Response, body *bytes.Buffer) error {
+	return func(res *http.Response, body *bytes.Buffer) error {
+		bytes := body.Bytes()
+		dec := json.NewDecoder(body)
+		resReserved := JsonReservations{}
+		err := dec.Decode(&resReserved)
+		if err != nil {
+			return fatalErrorf("Jsonのデコードに失敗 %s %v", string(bytes), err)
+		}
+		if len(resReserved.Reservations) != len(reserved) {
+			return fatalErrorf("まとめて予約した席の数が正しくありません")
+		}
+
+		expected := map[string][]*JsonReservation{}
+		for _, r := range reserved {
+			expected[r.SheetRank] = append(expected[r.SheetRank], r)
+		}
+
+		seenIDs := map[uint]bool{}
+		seenSheets := map[string]bool{}
+		for _, r := range resReserved.Reservations {
+			if r == nil {
+				return fatalErrorf("まとめて予約した席がnullです")
+			}
+			queue := expected[r.SheetRank]
+			if len(queue) == 0 {
+				return fatalErrorf("正しい予約情報を取得できません")
+			}
+			sheetKind := GetSheetKindByRank(r.SheetRank)
+			if r.SheetNum < 1 || sheetKind.Total < r.SheetNum {
+				return fatalErrorf("まとめて予約した席の席番号が正しくありません")
+			}
+			sheetKey := fmt.Sprintf("%s-%d", r.SheetRank, r.SheetNum)
+			if seenIDs[r.ReservationID] || seenSheets[sheetKey] {
+				return fatalErrorf("まとめて予約した席が重複しています")
+			}
+			seenIDs[r.ReservationID] = true
+			seenSheets[sheetKey] = true
+
+			// Set reserved ID and Sheet Number from response
+			queue[0].ReservationID = r.ReservationID
+			queue[0].SheetNum = r.SheetNum
+			expected[r.SheetRank] = queue[1:]
+		}
+		return nil
+	}
+}
+
+// Reserves all eventSheets, which must belong to the same event, in a single request.
+func reserveSheets(ctx context.Context, state *State, checker *Checker, user *AppUser, eventSheets []*EventSheet) ([]*Reservation, error) {
+	eventID := eventSheets[0].EventID
+
+	quantities := map[string]int{}
+	reserved := make([]*JsonReservation, len(eventSheets))
+	reservations := make([]*Reservation, len(eventSheets))
+	logIDs := make([]uint64, len(eventSheets))
+	for i, eventSheet := range eventSheets {
+		assert(eventSheet.EventID == eventID)
+		rank := eventSheet.Rank
+		quantities[rank]++
+
+		reserved[i] = &JsonReservation{ReservationID: 0, SheetRank: rank, SheetNum: 0}
+		reservations[i] = &Reservation{ID: 0, EventID: eventID, UserID: user.ID, SheetRank: rank, Price: eventSheet.Price, SheetNum: 0}
+		logIDs[i] = state.BeginReservation(user, reservations[i])
+	}
+
+	sheets := []map[string]interface{}{}
+	for rank, quantity := range quantities {
+		sheets = append(sheets, map[string]interface{}{
 			"sheet_rank": rank,
+			"quantity":   quantity,
+		})
+	}
+
+	err := checker.Play(ctx, &CheckAction{
+		Method:             "POST",
+		Path:               fmt.Sprintf("/api/events/%d/actions/reserve", eventID),
+		ExpectedStatusCode: 202,
+		Description:        "複数の席をまとめて予約できること",
+		PostJSON: map[string]interface{}{
+			"sheets": sheets,
 		},
-		CheckFunc: checkJsonReservationResponse(reserved),
+		CheckFunc: checkJsonReservationsResponse(reserved),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i, reservation := range reservations {
+		reservation.ID = reserved[i].ReservationID
+		reservation.SheetNum = reserved[i].SheetNum
+		err = state.CommitReservation(logIDs[i], user, reservation)
+		if err != nil {
+			return nil, err
+		}
+		eventSheets[i].Num = reserved[i].SheetNum
+	}
+
+	log.Printf("debug: reserve sheets userID:%d(total-price:%s) eventID:%d count:%d\n", user.ID, user.Status.TotalPriceString(), eventID, len(reservations))
+	return reservations, nil
+}
+
+func findWaitlistEntry(entries []*JsonWaitlistEntry, eventID uint, rank string) *JsonWaitlistEntry {
+	for _, entry := range entries {
+		if entry != nil && entry.EventID == eventID && entry.SheetRank == rank {
+			return entry
+		}
+	}
+	return nil
+}
+
+func leaveWaitlist(ctx context.Context, checker *Checker, user *AppUser, eventID uint, rank string) error {
+	return checker.Play(ctx, &CheckAction{
+		Method:             "DELETE",
+		Path:               fmt.Sprintf("/api/events/%d/sheets/%s/waitlist", eventID, rank),
+		ExpectedStatusCode: 204,
+		Description:        "キャンセル待ちを取り消せること",
+	})
+}
+
+// Turns the hold offered to the user into a reservation.
+func confirmHold(ctx context.Context, state *State, checker *Checker, user *AppUser, eventSheet *EventSheet, hold *JsonHold) (*Reservation, error) {
+	eventID := eventSheet.EventID
+	rank := eventSheet.Rank
+
+	reserved := &JsonReservation{ReservationID: 0, SheetRank: rank, SheetNum: 0}
+	reservation := &Reservation{ID: 0, EventID: eventID, UserID: user.ID, SheetRank: rank, Price: eventSheet.Price, SheetNum: hold.SheetNum}
+	logID := state.BeginReservation(user, reservation)
+
+	err := checker.Play(ctx, &CheckAction{
+		Method:             "POST",
+		Path:               fmt.Sprintf("/api/holds/%d/actions/confirm", hold.HoldID),
+		ExpectedStatusCode: 202,
+		Description:        "確保された席を予約できること",
+		CheckFunc:          checkJsonReservationResponse(reserved),
 	})
 	if err != nil {
 		user.Status.PositiveTotalPrice += eventSheet.Price
 		return nil, err
 	}
+	if reserved.SheetNum != hold.SheetNum {
+		return nil, fatalErrorf("確保された席(%s-%d)とは異なる席(%s-%d)が予約されました", rank, hold.SheetNum, reserved.SheetRank, reserved.SheetNum)
+	}
 
 	reservation.ID = reserved.ReservationID
-	reservation.SheetNum = reserved.SheetNum
+	reservation.OrderID = reserved.OrderID
 	err = state.CommitReservation(logID, user, reservation)
 	if err != nil {
 		return nil, err
 	}
 	eventSheet.Num = reserved.SheetNum
 
-	log.Printf("debug: reserve userID:%d(total-price:%s) eventID:%d reservedID:%d(%s-%d) price:%d\n", user.ID, user.Status.TotalPriceString(), eventID, reserved.ReservationID, reserved.SheetRank, reserved.SheetNum, eventSheet.Price)
+	log.Printf("debug: confirm hold userID:%d(total-price:%s) eventID:%d reservedID:%d(%s-%d) price:%d\n", user.ID, user.Status.TotalPriceString(), eventID, reserved.ReservationID, reserved.SheetRank, reserved.SheetNum, eventSheet.Price)
 	return reservation, nil
 }
 
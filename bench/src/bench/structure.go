@@ -23,11 +23,31 @@ type JsonFullUser struct {
 	TotalPrice         uint                   `json:"total_price"`
 	RecentEvents       []*JsonFullEvent       `json:"recent_events"`
 	RecentReservations []*JsonFullReservation `json:"recent_reservations"`
+	Waitlist           []*JsonWaitlistEntry   `json:"waitlist"`
+	RecentTransfers    []*JsonTransfer        `json:"recent_transfers"`
 }
 
 type JsonAdministrator struct {
-	ID       uint   `json:"id"`
-	Nickname string `json:"nickname"`
+	ID        uint   `json:"id"`
+	Nickname  string `json:"nickname"`
+	LoginName string `json:"login_name"`
+	Role      string `json:"role"`
+}
+
+type JsonAuditLog struct {
+	ID              uint                   `json:"id"`
+	AdministratorID *uint                  `json:"administrator_id"`
+	Action          string                 `json:"action"`
+	Path            string                 `json:"path"`
+	Status          int                    `json:"status"`
+	Diff            map[string]interface{} `json:"diff"`
+	RemoteIP        string                 `json:"remote_ip"`
+	CreatedAt       int64                  `json:"created_at"`
+}
+
+type JsonAuditLogs struct {
+	Entries    []*JsonAuditLog `json:"entries"`
+	NextCursor *uint           `json:"next_cursor"`
 }
 
 // [{"remains":999,"id":1,"title":"「風邪をひいたなう」しか","sheets":{"S":{"price":8000,"total":50,"remains":49},"A":{"total":150,"price":6000,"remains":150},"C":{"remains":0,"total":0},"c":{"remains":500,"price":3000,"total":500},"B":{"total":300,"price":4000,"remains":300}},"total":1000}];
@@ -44,6 +64,7 @@ type JsonSheetDetail struct {
 	Mine       bool `json:"mine"`
 	Reserved   bool `json:"reserved"`
 	ReservedAt uint `json:"reserved_at"`
+	Price      uint `json:"price"` // set only if overridden
 }
 
 type JsonEvent struct {
@@ -62,10 +83,86 @@ type JsonFullEvent struct {
 	Closed bool `json:"closed"`
 }
 
+type JsonDashboardSales struct {
+	Sold     uint `json:"sold"`
+	Canceled uint `json:"canceled"`
+	Remains  uint `json:"remains"`
+	Revenue  uint `json:"revenue"`
+}
+
+type JsonDashboardBuyer struct {
+	UserID   uint   `json:"user_id"`
+	Nickname string `json:"nickname"`
+	Sheets   uint   `json:"sheets"`
+	Amount   uint   `json:"amount"`
+}
+
+type JsonDashboardEvent struct {
+	JsonDashboardSales
+
+	ID        uint                          `json:"id"`
+	Title     string                        `json:"title"`
+	Public    bool                          `json:"public"`
+	Closed    bool                          `json:"closed"`
+	Ranks     map[string]JsonDashboardSales `json:"ranks"`
+	Velocity  map[string]uint               `json:"velocity"`
+	TopBuyers []JsonDashboardBuyer          `json:"top_buyers"`
+}
+
+type JsonPurchaseLimits struct {
+	MaxSheets         uint `json:"max_sheets"`
+	MaxReservations   uint `json:"max_reservations"`
+	ReservationWindow uint `json:"reservation_window"`
+	MaxCancels        uint `json:"max_cancels"`
+	CancelCooldown    uint `json:"cancel_cooldown"`
+}
+
 type JsonReservation struct {
 	ReservationID uint   `json:"id"`
 	SheetRank     string `json:"sheet_rank"`
 	SheetNum      uint   `json:"sheet_num"`
+	OrderID       uint   `json:"order_id"`
+	OrderStatus   string `json:"order_status"`
+}
+
+type JsonOrder struct {
+	ID             uint                    `json:"id"`
+	Status         string                  `json:"status"`
+	Amount         uint                    `json:"amount"`
+	RefundedAmount uint                    `json:"refunded_amount"`
+	Reservations   []*JsonOrderReservation `json:"reservations"`
+}
+
+type JsonOrderReservation struct {
+	ReservationID uint   `json:"id"`
+	SheetRank     string `json:"sheet_rank"`
+	SheetNum      uint   `json:"sheet_num"`
+	Price         uint   `json:"price"`
+	CanceledAt    int64  `json:"canceled_at"`
+}
+
+type JsonTicket struct {
+	ReservationID uint   `json:"reservation_id"`
+	EventID       uint   `json:"event_id"`
+	SheetRank     string `json:"sheet_rank"`
+	SheetNum      uint   `json:"sheet_num"`
+	Token         string `json:"token"`
+	CheckedInAt   *int64 `json:"checked_in_at"`
+}
+
+type JsonTransfer struct {
+	ID            uint      `json:"id"`
+	ReservationID uint      `json:"reservation_id"`
+	Status        string    `json:"status"`
+	Event         JsonEvent `json:"event"`
+	SheetRank     string    `json:"sheet_rank"`
+	SheetNum      uint      `json:"sheet_num"`
+	From          JsonUser  `json:"from"`
+	To            JsonUser  `json:"to"`
+}
+
+type JsonReservations struct {
+	Reservations []*JsonReservation `json:"reservations"`
 }
 
 type JsonFullReservation struct {
@@ -84,6 +181,89 @@ type JsonEventInFullReservation struct {
 	Closed bool   `json:"closed"`
 }
 
+type JsonUserReservations struct {
+	Reservations []*JsonFullReservation `json:"reservations"`
+	NextCursor   *uint                  `json:"next_cursor"`
+}
+
+type JsonUserEvents struct {
+	Events     []*JsonFullEvent `json:"events"`
+	NextCursor *uint            `json:"next_cursor"`
+}
+
+type JsonHold struct {
+	HoldID    uint   `json:"id"`
+	SheetRank string `json:"sheet_rank"`
+	SheetNum  uint   `json:"sheet_num"`
+	ExpiresAt uint   `json:"expires_at"`
+}
+
+type JsonWaitlistEntry struct {
+	ID        uint      `json:"id"`
+	EventID   uint      `json:"event_id"`
+	SheetRank string    `json:"sheet_rank"`
+	Position  uint      `json:"position"`
+	Hold      *JsonHold `json:"hold"`
+}
+
+// Pushed by /api/events/:id/stream
+type JsonStreamSnapshot struct {
+	Remains map[string]uint `json:"remains"`
+}
+
+type JsonStreamRemains struct {
+	SheetRank string `json:"sheet_rank"`
+	Remains   uint   `json:"remains"`
+	Delta     int    `json:"delta"`
+}
+
+type JsonCoupon struct {
+	ID           uint   `json:"id"`
+	Code         string `json:"code"`
+	Kind         string `json:"kind"`
+	Amount       uint   `json:"amount"`
+	PerUserLimit uint   `json:"per_user_limit"`
+	ExpiresAt    int64  `json:"expires_at"`
+}
+
+type JsonVenue struct {
+	ID    uint             `json:"id"`
+	Name  string           `json:"name"`
+	Ranks []*JsonVenueRank `json:"ranks"`
+}
+
+type JsonVenueRank struct {
+	Rank    string `json:"rank"`
+	Price   uint   `json:"price"`
+	Count   uint   `json:"count"`
+	Rows    uint   `json:"rows,omitempty"`
+	Columns uint   `json:"columns,omitempty"`
+}
+
+type JsonWebhook struct {
+	ID         uint     `json:"id"`
+	URL        string   `json:"url"`
+	Secret     string   `json:"secret"`
+	EventTypes []string `json:"event_types"`
+	CreatedAt  int64    `json:"created_at"`
+}
+
+type JsonWebhookDelivery struct {
+	ID         uint                   `json:"id"`
+	EndpointID uint                   `json:"endpoint_id"`
+	Type       string                 `json:"type"`
+	Data       map[string]interface{} `json:"data"`
+	Status     string                 `json:"status"`
+	Attempts   uint                   `json:"attempts"`
+	CreatedAt  int64                  `json:"created_at"`
+	History    []interface{}          `json:"history"`
+}
+
+type JsonWebhookDeliveries struct {
+	Deliveries []*JsonWebhookDelivery `json:"deliveries"`
+	NextCursor *uint                  `json:"next_cursor"`
+}
+
 type JsonError struct {
 	Error string `json:"error"`
 }
@@ -162,6 +342,10 @@ type Event struct {
 	Price     uint
 	CreatedAt time.Time
 
+	// Overridden prices, which must be set before the event is pushed
+	RankPrices  map[string]uint
+	SheetPrices map[SheetKey]uint
+
 	reservationMtx        sync.RWMutex
 	ReserveRequestedCount uint
 	ReserveCompletedCount uint
@@ -173,8 +357,37 @@ type Event struct {
 	CancelCompletedRT     ReservationTickets
 }
 
-type ReservationTickets struct {
-	S, A, B, C uint
+// ReservationTickets counts tickets per rank, indexed in the order of
+// DataSet.SheetKinds, so that it does not depend on the rank names.
+type ReservationTickets [MaxSheetKinds]uint
+
+type SheetKey struct {
+	Rank string
+	Num  uint
+}
+
+func (e *Event) RankPrice(rank string) uint {
+	if price, ok := e.RankPrices[rank]; ok {
+		return price
+	}
+	return e.Price + GetSheetKindByRank(rank).Price
+}
+
+// Returns the price of the sheet, or the highest price in the rank if num is NonReservedNum.
+func (e *Event) SheetPrice(rank string, num uint) uint {
+	price := e.RankPrice(rank)
+	if num != NonReservedNum {
+		if p, ok := e.SheetPrices[SheetKey{rank, num}]; ok {
+			return p
+		}
+		return price
+	}
+	for key, p := range e.SheetPrices {
+		if key.Rank == rank && p > price {
+			price = p
+		}
+	}
+	return price
 }
 
 // Returns an optimistic sold-out prediction, I mean that,
@@ -184,15 +397,10 @@ func (e *Event) IsSoldOut() bool {
 }
 
 func (rt *ReservationTickets) getPointer(rank string) *uint {
-	switch rank {
-	case "S":
-		return &rt.S
-	case "A":
-		return &rt.A
-	case "B":
-		return &rt.B
-	case "C":
-		return &rt.C
+	for i, sheetKind := range DataSet.SheetKinds {
+		if sheetKind.Rank == rank {
+			return &rt[i]
+		}
 	}
 	assert(false)
 	return nil
@@ -202,6 +410,13 @@ func (rt *ReservationTickets) Get(rank string) uint {
 	return *rt.getPointer(rank)
 }
 
+// FillAll sets the counts to the total sheets of every rank.
+func (rt *ReservationTickets) FillAll() {
+	for i, sheetKind := range DataSet.SheetKinds {
+		rt[i] = sheetKind.Total
+	}
+}
+
 type SheetKind struct {
 	Rank  string
 	Total uint
@@ -223,6 +438,63 @@ type ReportRecord struct {
 	SheetPrice    uint
 	UserID        uint
 	CanceledAt    time.Time
+	Refund        uint
+	Fee           uint
+	Net           uint
+}
+
+type JsonReportRecord struct {
+	ReservationID uint   `json:"reservation_id"`
+	EventID       uint   `json:"event_id"`
+	Rank          string `json:"rank"`
+	Num           uint   `json:"num"`
+	Price         uint   `json:"price"`
+	UserID        uint   `json:"user_id"`
+	SoldAt        string `json:"sold_at"`
+	CanceledAt    string `json:"canceled_at"`
+	Refund        uint   `json:"refund"`
+	Fee           uint   `json:"fee"`
+	Net           uint   `json:"net"`
+}
+
+type JsonReportChanges struct {
+	Changes    []JsonReportRecord `json:"changes"`
+	NextCursor string             `json:"next_cursor"`
+}
+
+type ReportSummaryKey struct {
+	EventID uint
+	Rank    string
+}
+
+type ReportSummaryRecord struct {
+	Sold     uint
+	Canceled uint
+	Gross    uint
+	Refund   uint
+	Fee      uint
+	Net      uint
+}
+
+type Coupon struct {
+	Code         string
+	Kind         string // "percent" or "fixed"
+	Amount       uint
+	PerUserLimit uint
+}
+
+// Returns the discounted price, rounded down for percent coupons.
+func (c *Coupon) Apply(price uint) uint {
+	switch c.Kind {
+	case "percent":
+		return price * (100 - c.Amount) / 100
+	case "fixed":
+		if price < c.Amount {
+			return 0
+		}
+		return price - c.Amount
+	}
+	return price
 }
 
 type Reservation struct {
@@ -235,6 +507,11 @@ type Reservation struct {
 	Price      uint
 	ReservedAt int64 // Used only in initial reservations. 0 is set for rest because reserve API does not return it
 	CanceledAt int64 // Used only in initial reservations. 0 is set for rest because reserve API does not return it
+	Selected   bool  // Reserved by specifying rank and num, i.e., not randomly assigned
+	Coupon     *Coupon
+	OrderID    uint // 0 is set for initial reservations, which are made without orders
+
+	TransferToUserID uint // Set while the reservation is being transferred
 
 	// ReserveRequestedAt time.Time
 	ReserveCompletedAt time.Time
@@ -291,6 +568,16 @@ type BenchDataSet struct {
 
 var NonReservedNum = uint(0)
 
+// Max number of sheets which can be reserved by a single reserve request
+const MaxReserveQuantity = 10
+
+// Max number of ranks of a venue counted by ReservationTickets
+const MaxSheetKinds = 16
+
+// Percentage of a sale kept by the payment gateway, which is returned with a refund.
+// It must be the same as PAYMENT_FEE_PERCENT of the webapp, where no fee is taken by default.
+var PaymentFeePercent uint
+
 // Represents a sheet within an event
 type EventSheet struct {
 	EventID uint
@@ -600,7 +887,7 @@ func (s *State) pushNewEventLocked(event *Event, createdAt time.Time, caller str
 				EventID: event.ID,
 				Rank:    sheetKind.Rank,
 				Num:     NonReservedNum,
-				Price:   event.Price + sheetKind.Price,
+				Price:   event.SheetPrice(sheetKind.Rank, NonReservedNum),
 			}
 			newEventSheets = append(newEventSheets, eventSheet)
 		}
@@ -726,6 +1013,20 @@ func (s *State) GetRandomPublicEvent() *Event {
 	return events[uint(rand.Intn(len(events)))]
 }
 
+// Closed events are never reserved or canceled, so their reports never change.
+func (s *State) GetRandomClosedEvent() *Event {
+	events := []*Event{}
+	for _, e := range s.GetEvents() {
+		if e.ClosedFg {
+			events = append(events, e)
+		}
+	}
+	if len(events) == 0 {
+		return nil
+	}
+	return events[rand.Intn(len(events))]
+}
+
 func (s *State) GetRandomPublicSoldOutEvent() *Event {
 	events := FilterPublicEvents(FilterSoldOutEvents(s.GetEvents()))
 	if len(events) == 0 {
@@ -750,6 +1051,52 @@ func (s *State) PopEventSheet() (*EventSheet, func()) {
 	return es, func() { s.PushEventSheet(es) }
 }
 
+// Pops at most n sheets of the same event.
+// Sheets of an event are pushed together, so we only look at the tail run.
+func (s *State) PopEventSheets(n int) ([]*EventSheet, func()) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	m := len(s.eventSheets)
+	if m == 0 {
+		log.Println("debug: Empty eventSheets, will create a new event.")
+		return nil, nil
+	}
+
+	eventID := s.eventSheets[m-1].EventID
+	i := m
+	for i > 0 && m-i < n && s.eventSheets[i-1].EventID == eventID {
+		i--
+	}
+
+	eventSheets := make([]*EventSheet, m-i)
+	copy(eventSheets, s.eventSheets[i:])
+	for j := i; j < m; j++ {
+		s.eventSheets[j] = nil
+	}
+	s.eventSheets = s.eventSheets[:i]
+
+	return eventSheets, func() {
+		for _, es := range eventSheets {
+			s.PushEventSheet(es)
+		}
+	}
+}
+
+// Pops a non-reserved sheet of the event and rank.
+func (s *State) PopEventSheetByEventIDAndRank(eventID uint, rank string) (*EventSheet, func()) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for i, es := range s.eventSheets {
+		if es.EventID == eventID && es.Rank == rank {
+			s.eventSheets = append(s.eventSheets[:i], s.eventSheets[i+1:]...)
+			return es, func() { s.PushEventSheet(es) }
+		}
+	}
+	return nil, nil
+}
+
 func (s *State) PushEventSheet(eventSheet *EventSheet) {
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
@@ -942,6 +1289,16 @@ func (s *State) CommitReservation(logID uint64, lockedUser *AppUser, reservation
 			return fatalErrorf("予約IDが重複しています")
 		}
 
+		// The price of a sheet is known only after it is reserved
+		price := s.FindEventByID(reservation.EventID).SheetPrice(reservation.SheetRank, reservation.SheetNum)
+		if reservation.Coupon != nil {
+			price = reservation.Coupon.Apply(price)
+		}
+		if price != reservation.Price {
+			lockedUser.Status.PositiveTotalPrice = lockedUser.Status.PositiveTotalPrice - reservation.Price + price
+			reservation.Price = price
+		}
+
 		reservation.ReserveCompletedAt = time.Now()
 		s.reservations[reservation.ID] = reservation
 		s.reserveCompletedCount++
@@ -970,6 +1327,31 @@ func (s *State) CommitReservation(logID uint64, lockedUser *AppUser, reservation
 	return nil
 }
 
+// Call AbortReservation only when the webapp told that the reservation definitely failed,
+// e.g., the sheet is already reserved by somebody else.
+func (s *State) AbortReservation(logID uint64, lockedUser *AppUser, reservation *Reservation) {
+	func() {
+		s.reservationMtx.Lock()
+		defer s.reservationMtx.Unlock()
+
+		s.reserveRequestedCount--
+	}()
+	func() {
+		event := s.FindEventByID(reservation.EventID)
+		rank := reservation.SheetRank
+
+		event.reservationMtx.Lock()
+		defer event.reservationMtx.Unlock()
+
+		event.ReserveRequestedCount--
+		*event.ReserveRequestedRT.getPointer(rank)--
+	}()
+	{
+		lockedUser.Status.PositiveTotalPrice -= reservation.Price
+	}
+	s.deleteReserveLog(logID, reservation)
+}
+
 func (s *State) BeginCancelation(lockedUser *AppUser, reservation *Reservation) (logID uint64) {
 	func() {
 		s.reservationMtx.Lock()
@@ -1026,6 +1408,68 @@ func (s *State) CommitCancelation(logID uint64, lockedUser *AppUser, reservation
 	return
 }
 
+// The total prices of both users are ranges until the transfer is done, as the
+// reservation may belong to either of them.
+func (s *State) BeginTransfer(lockedFrom *AppUser, lockedTo *AppUser, reservation *Reservation) {
+	func() {
+		s.reservationMtx.Lock()
+		defer s.reservationMtx.Unlock()
+
+		reservation.TransferToUserID = lockedTo.ID
+	}()
+	{
+		lockedFrom.Status.NegativeTotalPrice -= reservation.Price
+		lockedTo.Status.PositiveTotalPrice += reservation.Price
+	}
+}
+
+func (s *State) CommitTransfer(lockedFrom *AppUser, lockedTo *AppUser, reservation *Reservation) {
+	func() {
+		s.reservationMtx.Lock()
+		defer s.reservationMtx.Unlock()
+
+		reservation.UserID = lockedTo.ID
+		reservation.TransferToUserID = 0
+	}()
+	{
+		lockedFrom.Status.PositiveTotalPrice -= reservation.Price
+		lockedTo.Status.NegativeTotalPrice += reservation.Price
+
+		// The transferred reservation keeps its reserved time, so that the
+		// latest reservations of both users are unknown until they reserve again.
+		lockedFrom.Status.LastReservation.SetID(0)
+		lockedFrom.Status.LastReservedEvent.SetID(0)
+		lockedTo.Status.LastReservation.SetID(0)
+		lockedTo.Status.LastReservedEvent.SetID(0)
+	}
+}
+
+// Call AbortTransfer only when the webapp told that the transfer definitely failed.
+func (s *State) AbortTransfer(lockedFrom *AppUser, lockedTo *AppUser, reservation *Reservation) {
+	func() {
+		s.reservationMtx.Lock()
+		defer s.reservationMtx.Unlock()
+
+		reservation.TransferToUserID = 0
+	}()
+	{
+		lockedFrom.Status.NegativeTotalPrice += reservation.Price
+		lockedTo.Status.PositiveTotalPrice -= reservation.Price
+	}
+}
+
+// Reports whether the reservation belongs to the user now, or is being transferred to the user.
+func (s *State) ReservationMaybeOwnedBy(reservationID uint, userID uint) bool {
+	s.reservationMtx.Lock()
+	defer s.reservationMtx.Unlock()
+
+	reservation, ok := s.reservations[reservationID]
+	if !ok {
+		return false
+	}
+	return reservation.UserID == userID || reservation.TransferToUserID == userID
+}
+
 func (s *State) appendReserveLog(reservation *Reservation) uint64 {
 	s.reserveLogMtx.Lock()
 	defer s.reserveLogMtx.Unlock()
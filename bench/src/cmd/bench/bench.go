@@ -400,23 +400,43 @@ func startBenchmark(remoteAddrs []string) *BenchResult {
 	addLoadAndLevelUpFunc(30, benchFunc{"LoadTopPage", bench.LoadTopPage})
 	addLoadAndLevelUpFunc(10, benchFunc{"LoadReserveCancelSheet", bench.LoadReserveCancelSheet})
 	addLoadAndLevelUpFunc(20, benchFunc{"LoadReserveSheet", bench.LoadReserveSheet})
+	addLoadAndLevelUpFunc(5, benchFunc{"LoadReserveSheets", bench.LoadReserveSheets})
 	addLoadAndLevelUpFunc(30, benchFunc{"LoadGetEvent", bench.LoadGetEvent})
 
 	addCheckFunc(benchFunc{"CheckStaticFiles", bench.CheckStaticFiles})
 	addCheckFunc(benchFunc{"CheckCreateUser", bench.CheckCreateUser})
 	addCheckFunc(benchFunc{"CheckLogin", bench.CheckLogin})
+	addCheckFunc(benchFunc{"CheckLogoutAllDevices", bench.CheckLogoutAllDevices})
 	addCheckFunc(benchFunc{"CheckTopPage", bench.CheckTopPage})
 	addCheckFunc(benchFunc{"CheckAdminTopPage", bench.CheckAdminTopPage})
 	addCheckFunc(benchFunc{"CheckReserveSheet", bench.CheckReserveSheet})
+	addCheckFunc(benchFunc{"CheckReserveSheets", bench.CheckReserveSheets})
+	addCheckFunc(benchFunc{"CheckReserveSelectedSheet", bench.CheckReserveSelectedSheet})
 	addCheckFunc(benchFunc{"CheckAdminLogin", bench.CheckAdminLogin})
+	addCheckFunc(benchFunc{"CheckAdministratorRoles", bench.CheckAdministratorRoles})
+	addCheckFunc(benchFunc{"CheckAuditLog", bench.CheckAuditLog})
 	addCheckFunc(benchFunc{"CheckCreateEvent", bench.CheckCreateEvent})
+	addCheckFunc(benchFunc{"CheckEditEvent", bench.CheckEditEvent})
+	addCheckFunc(benchFunc{"CheckPriceOverrides", bench.CheckPriceOverrides})
+	addCheckFunc(benchFunc{"CheckCoupon", bench.CheckCoupon})
+	addCheckFunc(benchFunc{"CheckOrder", bench.CheckOrder})
+	addCheckFunc(benchFunc{"CheckPurchaseLimits", bench.CheckPurchaseLimits})
+	addCheckFunc(benchFunc{"CheckTicketCheckIn", bench.CheckTicketCheckIn})
+	addCheckFunc(benchFunc{"CheckTicketTransfer", bench.CheckTicketTransfer})
+	addCheckFunc(benchFunc{"CheckWebhooks", bench.CheckWebhooks})
+	addCheckFunc(benchFunc{"CheckReportSummary", bench.CheckReportSummary})
+	addCheckFunc(benchFunc{"CheckReportCursor", bench.CheckReportCursor})
+	addCheckFunc(benchFunc{"CheckVenues", bench.CheckVenues})
 	addCheckFunc(benchFunc{"CheckMyPage", bench.CheckMyPage})
 	addCheckFunc(benchFunc{"CheckCancelReserveSheet", bench.CheckCancelReserveSheet})
+	addCheckFunc(benchFunc{"CheckWaitlist", bench.CheckWaitlist})
 	addCheckFunc(benchFunc{"CheckGetEvent", bench.CheckGetEvent})
+	addCheckFunc(benchFunc{"CheckEventStream", bench.CheckEventStream})
 
 	addEveryCheckFunc(benchFunc{"CheckSheetReservationEntropy", bench.CheckSheetReservationEntropy})
 
 	addPostTestFunc(benchFunc{"CheckReport", bench.CheckReport})
+	addPostTestFunc(benchFunc{"CheckReportChanges", bench.CheckReportChanges})
 
 	result := new(BenchResult)
 	result.StartTime = time.Now()
@@ -561,6 +581,7 @@ func main() {
 	flag.BoolVar(&debugLog, "debug-log", false, "print debug log")
 	flag.DurationVar(&duration, "duration", time.Minute, "benchamrk duration")
 	flag.BoolVar(&nolevelup, "nolevelup", false, "dont increase load level")
+	flag.UintVar(&bench.PaymentFeePercent, "payment-fee-percent", 0, "percentage of a sale kept by the payment gateway of the webapp")
 	flag.Parse()
 
 	if debugLog {
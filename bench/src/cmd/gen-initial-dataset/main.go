@@ -3,12 +3,22 @@ package main
 import (
 	"bench"
 	"flag"
+	"log"
 )
 
-var dataPath = flag.String("data", "./data", "path to data directory")
+var (
+	dataPath = flag.String("data", "./data", "path to data directory")
+	passHash = flag.String("pass-hash", bench.PassHashSHA256, "format of password hashes (sha256 or bcrypt)")
+)
 
 func main() {
+	flag.Parse()
+	if *passHash != bench.PassHashSHA256 && *passHash != bench.PassHashBcrypt {
+		log.Fatalf("unknown pass-hash: %s", *passHash)
+	}
+
 	bench.DataPath = *dataPath
+	bench.PassHashFormat = *passHash
 	bench.PrepareDataSet()
 	bench.GenerateInitialDataSetSQL("../db/isucon8q-initial-dataset.sql.gz")
 }
@@ -3,6 +3,8 @@
 cat <<'EOF' | mysql -uroot
 CREATE USER 'isucon'@'%' IDENTIFIED BY 'isucon';
 GRANT ALL ON torb.* TO 'isucon'@'%';
+GRANT PROCESS ON *.* TO 'isucon'@'%';
 CREATE USER 'isucon'@'localhost' IDENTIFIED BY 'isucon';
 GRANT ALL ON torb.* TO 'isucon'@'localhost';
+GRANT PROCESS ON *.* TO 'isucon'@'localhost';
 EOF
@@ -11,15 +11,55 @@ CREATE TABLE IF NOT EXISTS events (
     title       VARCHAR(128)     NOT NULL,
     public_fg   TINYINT(1)       NOT NULL,
     closed_fg   TINYINT(1)       NOT NULL,
-    price       INTEGER UNSIGNED NOT NULL
+    price       INTEGER UNSIGNED NOT NULL,
+    venue_id    INTEGER UNSIGNED NOT NULL DEFAULT 1,
+    start_at       DATETIME(6)      DEFAULT NULL,
+    sales_open_at  DATETIME(6)      DEFAULT NULL,
+    sales_close_at DATETIME(6)      DEFAULT NULL,
+    deleted_at     DATETIME(6)      DEFAULT NULL,
+    KEY sales_open_at_idx (closed_fg, sales_open_at),
+    KEY sales_close_at_idx (closed_fg, sales_close_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS event_sales_openings (
+    event_id      INTEGER UNSIGNED PRIMARY KEY,
+    sales_open_at DATETIME(6)      NOT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS venues (
+    id          INTEGER UNSIGNED PRIMARY KEY AUTO_INCREMENT,
+    name        VARCHAR(128)     NOT NULL
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
 
+INSERT INTO venues (id, name) VALUES (1, 'Default');
+
 CREATE TABLE IF NOT EXISTS sheets (
     id          INTEGER UNSIGNED PRIMARY KEY AUTO_INCREMENT,
     `rank`      VARCHAR(128)     NOT NULL,
     num         INTEGER UNSIGNED NOT NULL,
     price       INTEGER UNSIGNED NOT NULL,
-    UNIQUE KEY rank_num_uniq (`rank`, num)
+    venue_id    INTEGER UNSIGNED NOT NULL DEFAULT 1,
+    seat_row    INTEGER UNSIGNED NOT NULL DEFAULT 0,
+    seat_column INTEGER UNSIGNED NOT NULL DEFAULT 0,
+    UNIQUE KEY venue_id_rank_num_uniq (venue_id, `rank`, num)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS event_price_overrides (
+    id          INTEGER UNSIGNED PRIMARY KEY AUTO_INCREMENT,
+    event_id    INTEGER UNSIGNED NOT NULL,
+    sheet_rank  VARCHAR(128)     NOT NULL,
+    sheet_id    INTEGER UNSIGNED NOT NULL DEFAULT 0,
+    price       INTEGER UNSIGNED NOT NULL,
+    UNIQUE KEY event_id_rank_sheet_id_uniq (event_id, sheet_rank, sheet_id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS event_purchase_limits (
+    event_id           INTEGER UNSIGNED PRIMARY KEY,
+    max_sheets         INTEGER UNSIGNED NOT NULL DEFAULT 0,
+    max_reservations   INTEGER UNSIGNED NOT NULL DEFAULT 0,
+    reservation_window INTEGER UNSIGNED NOT NULL DEFAULT 0,
+    max_cancels        INTEGER UNSIGNED NOT NULL DEFAULT 0,
+    cancel_cooldown    INTEGER UNSIGNED NOT NULL DEFAULT 0
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
 
 CREATE TABLE IF NOT EXISTS reservations (
@@ -29,7 +69,101 @@ CREATE TABLE IF NOT EXISTS reservations (
     user_id     INTEGER UNSIGNED NOT NULL,
     reserved_at DATETIME(6)      NOT NULL,
     canceled_at DATETIME(6)      DEFAULT NULL,
-    KEY event_id_and_sheet_id_idx (event_id, sheet_id)
+    checked_in_at DATETIME(6)    DEFAULT NULL,
+    price       INTEGER UNSIGNED DEFAULT NULL,
+    coupon_id   INTEGER UNSIGNED DEFAULT NULL,
+    order_id    INTEGER UNSIGNED DEFAULT NULL,
+    change_seq  BIGINT UNSIGNED  NOT NULL DEFAULT 0,
+    KEY event_id_and_sheet_id_idx (event_id, sheet_id),
+    KEY user_id_idx (user_id),
+    KEY user_id_and_event_id_idx (user_id, event_id),
+    KEY coupon_id_and_user_id_idx (coupon_id, user_id),
+    KEY order_id_idx (order_id),
+    KEY change_seq_idx (change_seq),
+    KEY reserved_at_idx (reserved_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS reservation_changes (
+    id         BIGINT UNSIGNED PRIMARY KEY AUTO_INCREMENT,
+    changed_at DATETIME(6)     NOT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS orders (
+    id              INTEGER UNSIGNED PRIMARY KEY AUTO_INCREMENT,
+    user_id         INTEGER UNSIGNED NOT NULL,
+    status          VARCHAR(16)      NOT NULL,
+    amount          INTEGER UNSIGNED NOT NULL,
+    refunded_amount INTEGER UNSIGNED NOT NULL DEFAULT 0,
+    payment_id      VARCHAR(128)     DEFAULT NULL,
+    created_at      DATETIME(6)      NOT NULL,
+    updated_at      DATETIME(6)      NOT NULL,
+    UNIQUE KEY payment_id_uniq (payment_id),
+    KEY user_id_idx (user_id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS refunds (
+    id             INTEGER UNSIGNED PRIMARY KEY AUTO_INCREMENT,
+    order_id       INTEGER UNSIGNED NOT NULL,
+    reservation_id INTEGER UNSIGNED NOT NULL,
+    amount         INTEGER UNSIGNED NOT NULL,
+    status         VARCHAR(16)      NOT NULL,
+    attempts       INTEGER UNSIGNED NOT NULL DEFAULT 0,
+    last_error     VARCHAR(255)     DEFAULT NULL,
+    created_at     DATETIME(6)      NOT NULL,
+    updated_at     DATETIME(6)      NOT NULL,
+    KEY order_id_idx (order_id),
+    KEY status_and_updated_at_idx (status, updated_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS coupons (
+    id             INTEGER UNSIGNED PRIMARY KEY AUTO_INCREMENT,
+    code           VARCHAR(64)      NOT NULL,
+    kind           VARCHAR(16)      NOT NULL,
+    amount         INTEGER UNSIGNED NOT NULL,
+    per_user_limit INTEGER UNSIGNED NOT NULL DEFAULT 0,
+    expires_at     DATETIME(6)      DEFAULT NULL,
+    created_at     DATETIME(6)      NOT NULL,
+    UNIQUE KEY code_uniq (code)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS holds (
+    id             INTEGER UNSIGNED PRIMARY KEY AUTO_INCREMENT,
+    event_id       INTEGER UNSIGNED NOT NULL,
+    sheet_id       INTEGER UNSIGNED NOT NULL,
+    user_id        INTEGER UNSIGNED NOT NULL,
+    held_at        DATETIME(6)      NOT NULL,
+    expires_at     DATETIME(6)      NOT NULL,
+    released_at    DATETIME(6)      DEFAULT NULL,
+    reservation_id INTEGER UNSIGNED DEFAULT NULL,
+    KEY event_id_and_sheet_id_idx (event_id, sheet_id),
+    KEY released_at_and_expires_at_idx (released_at, expires_at),
+    KEY user_id_and_event_id_idx (user_id, event_id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS waitlist_entries (
+    id          INTEGER UNSIGNED PRIMARY KEY AUTO_INCREMENT,
+    event_id    INTEGER UNSIGNED NOT NULL,
+    sheet_rank  VARCHAR(128)     NOT NULL,
+    user_id     INTEGER UNSIGNED NOT NULL,
+    created_at  DATETIME(6)      NOT NULL,
+    offered_at  DATETIME(6)      DEFAULT NULL,
+    hold_id     INTEGER UNSIGNED DEFAULT NULL,
+    canceled_at DATETIME(6)      DEFAULT NULL,
+    KEY event_id_and_sheet_rank_idx (event_id, sheet_rank),
+    KEY user_id_idx (user_id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS reservation_transfers (
+    id             INTEGER UNSIGNED PRIMARY KEY AUTO_INCREMENT,
+    reservation_id INTEGER UNSIGNED NOT NULL,
+    from_user_id   INTEGER UNSIGNED NOT NULL,
+    to_user_id     INTEGER UNSIGNED NOT NULL,
+    status         VARCHAR(16)      NOT NULL,
+    created_at     DATETIME(6)      NOT NULL,
+    updated_at     DATETIME(6)      NOT NULL,
+    KEY reservation_id_and_status_idx (reservation_id, status),
+    KEY from_user_id_idx (from_user_id),
+    KEY to_user_id_idx (to_user_id)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
 
 CREATE TABLE IF NOT EXISTS administrators (
@@ -37,5 +171,82 @@ CREATE TABLE IF NOT EXISTS administrators (
     nickname    VARCHAR(128) NOT NULL,
     login_name  VARCHAR(128) NOT NULL,
     pass_hash   VARCHAR(128) NOT NULL,
+    role        VARCHAR(16)  NOT NULL DEFAULT 'superadmin',
     UNIQUE KEY login_name_uniq (login_name)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS sessions (
+    id                     VARCHAR(64)      PRIMARY KEY,
+    user_id                INTEGER UNSIGNED DEFAULT NULL,
+    user_nickname          VARCHAR(128)     DEFAULT NULL,
+    administrator_id       INTEGER UNSIGNED DEFAULT NULL,
+    administrator_nickname VARCHAR(128)     DEFAULT NULL,
+    administrator_role     VARCHAR(16)      DEFAULT NULL,
+    expires_at             DATETIME(6)      NOT NULL,
+    KEY user_id_idx (user_id),
+    KEY administrator_id_idx (administrator_id),
+    KEY expires_at_idx (expires_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS audit_logs (
+    id               BIGINT UNSIGNED   PRIMARY KEY AUTO_INCREMENT,
+    administrator_id INTEGER UNSIGNED  DEFAULT NULL,
+    action           VARCHAR(255)      NOT NULL,
+    path             VARCHAR(255)      NOT NULL,
+    status           SMALLINT UNSIGNED NOT NULL,
+    diff             TEXT              NOT NULL,
+    remote_ip        VARCHAR(64)       NOT NULL,
+    created_at       DATETIME(6)       NOT NULL,
+    KEY administrator_id_idx (administrator_id),
+    KEY action_idx (action),
+    KEY created_at_idx (created_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS notifications (
+    id              BIGINT UNSIGNED   PRIMARY KEY AUTO_INCREMENT,
+    user_id         INTEGER UNSIGNED  NOT NULL,
+    kind            VARCHAR(32)       NOT NULL,
+    payload         TEXT              NOT NULL,
+    attempts        INTEGER UNSIGNED  NOT NULL DEFAULT 0,
+    next_attempt_at DATETIME(6)       NOT NULL,
+    last_error      VARCHAR(255)      DEFAULT NULL,
+    delivered_at    DATETIME(6)       DEFAULT NULL,
+    failed_at       DATETIME(6)       DEFAULT NULL,
+    created_at      DATETIME(6)       NOT NULL,
+    KEY user_id_idx (user_id),
+    KEY delivered_at_and_next_attempt_at_idx (delivered_at, next_attempt_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS webhook_endpoints (
+    id          INTEGER UNSIGNED PRIMARY KEY AUTO_INCREMENT,
+    url         VARCHAR(255)     NOT NULL,
+    secret      VARCHAR(255)     NOT NULL,
+    event_types VARCHAR(255)     NOT NULL,
+    created_at  DATETIME(6)      NOT NULL,
+    deleted_at  DATETIME(6)      DEFAULT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+    id              BIGINT UNSIGNED  PRIMARY KEY AUTO_INCREMENT,
+    endpoint_id     INTEGER UNSIGNED NOT NULL,
+    event_type      VARCHAR(32)      NOT NULL,
+    payload         TEXT             NOT NULL,
+    status          VARCHAR(16)      NOT NULL,
+    attempts        INTEGER UNSIGNED NOT NULL DEFAULT 0,
+    next_attempt_at DATETIME(6)      NOT NULL,
+    last_error      VARCHAR(255)     DEFAULT NULL,
+    delivered_at    DATETIME(6)      DEFAULT NULL,
+    created_at      DATETIME(6)      NOT NULL,
+    KEY endpoint_id_and_status_idx (endpoint_id, status),
+    KEY status_and_next_attempt_at_idx (status, next_attempt_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS webhook_attempts (
+    id           BIGINT UNSIGNED   PRIMARY KEY AUTO_INCREMENT,
+    delivery_id  BIGINT UNSIGNED   NOT NULL,
+    status_code  SMALLINT UNSIGNED DEFAULT NULL,
+    error        VARCHAR(255)      DEFAULT NULL,
+    duration_ms  INTEGER UNSIGNED  NOT NULL,
+    attempted_at DATETIME(6)       NOT NULL,
+    KEY delivery_id_idx (delivery_id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/labstack/echo"
+)
+
+// Administrator roles. A superadmin may do everything, including managing
+// administrators, while the others may read events and the dashboard plus
+// what their role is for.
+const (
+	adminRoleViewer       = "viewer"
+	adminRoleEventManager = "event_manager"
+	adminRoleFinance      = "finance"
+	adminRoleSuperadmin   = "superadmin"
+)
+
+var adminRoles = map[string]bool{
+	adminRoleViewer:       true,
+	adminRoleEventManager: true,
+	adminRoleFinance:      true,
+	adminRoleSuperadmin:   true,
+}
+
+var (
+	errAdministratorNotFound   = errors.New("administrator not found")
+	errAdministratorDuplicated = errors.New("administrator duplicated")
+)
+
+// adminRoleRequired allows the administrators of the roles, and superadmins.
+// With no roles, only superadmins are allowed.
+func adminRoleRequired(roles ...string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			administrator, err := getLoginAdministrator(c)
+			if err != nil {
+				return resError(c, "admin_login_required", 401)
+			}
+			if administrator.Role == adminRoleSuperadmin {
+				return next(c)
+			}
+			for _, role := range roles {
+				if administrator.Role == role {
+					return next(c)
+				}
+			}
+			return resError(c, "forbidden", 403)
+		}
+	}
+}
+
+func getAdministrators() ([]*Administrator, error) {
+	rows, err := db.Query("SELECT id, nickname, login_name, role FROM administrators ORDER BY id ASC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	administrators := []*Administrator{}
+	for rows.Next() {
+		var administrator Administrator
+		if err := rows.Scan(&administrator.ID, &administrator.Nickname, &administrator.LoginName, &administrator.Role); err != nil {
+			return nil, err
+		}
+		administrators = append(administrators, &administrator)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return administrators, nil
+}
+
+// createAdministrator inserts the administrator with the password. It returns
+// errAdministratorDuplicated if the login name is taken.
+func createAdministrator(administrator *Administrator, password string) error {
+	passHash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	res, err := db.Exec("INSERT INTO administrators (nickname, login_name, pass_hash, role) VALUES (?, ?, ?, ?)", administrator.Nickname, administrator.LoginName, passHash, administrator.Role)
+	if err != nil {
+		if merr, ok := err.(*mysql.MySQLError); ok && merr.Number == 1062 {
+			return errAdministratorDuplicated
+		}
+		return err
+	}
+	administrator.ID, err = res.LastInsertId()
+	return err
+}
+
+// editAdministrator changes the nickname, the role and the password if given,
+// and logs the administrator out everywhere, so that sessions never keep an
+// old role.
+func editAdministrator(administratorID int64, nickname, role, password *string) (*Administrator, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	var administrator Administrator
+	if err := tx.QueryRow("SELECT id, nickname, login_name, role FROM administrators WHERE id = ? FOR UPDATE", administratorID).Scan(&administrator.ID, &administrator.Nickname, &administrator.LoginName, &administrator.Role); err != nil {
+		tx.Rollback()
+		if err == sql.ErrNoRows {
+			return nil, errAdministratorNotFound
+		}
+		return nil, err
+	}
+	if nickname != nil {
+		administrator.Nickname = *nickname
+	}
+	if role != nil {
+		administrator.Role = *role
+	}
+	if _, err := tx.Exec("UPDATE administrators SET nickname = ?, role = ? WHERE id = ?", administrator.Nickname, administrator.Role, administrator.ID); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if password != nil {
+		passHash, err := hashPassword(*password)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		if _, err := tx.Exec("UPDATE administrators SET pass_hash = ? WHERE id = ?", passHash, administrator.ID); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	if err := sessionBackend.RevokeAdministrator(administrator.ID); err != nil {
+		return nil, err
+	}
+	return &administrator, nil
+}
+
+// deleteAdministrator deletes the administrator and logs it out everywhere.
+// The audit log keeps its id.
+func deleteAdministrator(administratorID int64) error {
+	res, err := db.Exec("DELETE FROM administrators WHERE id = ?", administratorID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errAdministratorNotFound
+	}
+	return sessionBackend.RevokeAdministrator(administratorID)
+}
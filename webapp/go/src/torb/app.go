@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bytes"
 	"database/sql"
 	"encoding/json"
 	"errors"
@@ -13,14 +12,15 @@ import (
 	"os/exec"
 	"sort"
 	"strconv"
-	"strings"
 	"time"
+	"unicode/utf8"
 
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/gorilla/sessions"
 	"github.com/labstack/echo"
 	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/middleware"
+	"rsc.io/qr"
 )
 
 type User struct {
@@ -36,38 +36,56 @@ type Event struct {
 	PublicFg bool   `json:"public,omitempty"`
 	ClosedFg bool   `json:"closed,omitempty"`
 	Price    int64  `json:"price,omitempty"`
+	VenueID  int64  `json:"venue_id,omitempty"`
+
+	StartAt          *time.Time `json:"-"`
+	SalesOpenAt      *time.Time `json:"-"`
+	SalesCloseAt     *time.Time `json:"-"`
+	DeletedAt        *time.Time `json:"-"`
+	StartAtUnix      int64      `json:"start_at,omitempty"`
+	SalesOpenAtUnix  int64      `json:"sales_open_at,omitempty"`
+	SalesCloseAtUnix int64      `json:"sales_close_at,omitempty"`
 
 	Total   int                `json:"total"`
 	Remains int                `json:"remains"`
+	Held    int                `json:"held"`
 	Sheets  map[string]*Sheets `json:"sheets,omitempty"`
 }
 
 type Sheets struct {
 	Total   int      `json:"total"`
 	Remains int      `json:"remains"`
+	Held    int      `json:"held"`
 	Detail  []*Sheet `json:"detail,omitempty"`
 	Price   int64    `json:"price"`
 }
 
 type Sheet struct {
-	ID    int64  `json:"-"`
-	Rank  string `json:"-"`
-	Num   int64  `json:"num"`
-	Price int64  `json:"-"`
+	ID      int64  `json:"-"`
+	VenueID int64  `json:"-"`
+	Rank    string `json:"-"`
+	Num     int64  `json:"num"`
+	Price   int64  `json:"-"`
+	Row     int64  `json:"row,omitempty"`
+	Column  int64  `json:"column,omitempty"`
 
 	Mine           bool       `json:"mine,omitempty"`
 	Reserved       bool       `json:"reserved,omitempty"`
+	Held           bool       `json:"held,omitempty"`
+	SeatPrice      *int64     `json:"price,omitempty"`
 	ReservedAt     *time.Time `json:"-"`
 	ReservedAtUnix int64      `json:"reserved_at,omitempty"`
 }
 
 type Reservation struct {
-	ID         int64      `json:"id"`
-	EventID    int64      `json:"-"`
-	SheetID    int64      `json:"-"`
-	UserID     int64      `json:"-"`
-	ReservedAt *time.Time `json:"-"`
-	CanceledAt *time.Time `json:"-"`
+	ID          int64      `json:"id"`
+	EventID     int64      `json:"-"`
+	SheetID     int64      `json:"-"`
+	UserID      int64      `json:"-"`
+	ReservedAt  *time.Time `json:"-"`
+	CanceledAt  *time.Time `json:"-"`
+	CheckedInAt *time.Time `json:"-"`
+	OrderID     *int64     `json:"-"`
 
 	Event          *Event `json:"event,omitempty"`
 	SheetRank      string `json:"sheet_rank,omitempty"`
@@ -82,6 +100,7 @@ type Administrator struct {
 	Nickname  string `json:"nickname,omitempty"`
 	LoginName string `json:"login_name,omitempty"`
 	PassHash  string `json:"pass_hash,omitempty"`
+	Role      string `json:"role,omitempty"`
 }
 
 func sessUserID(c echo.Context) int64 {
@@ -93,14 +112,28 @@ func sessUserID(c echo.Context) int64 {
 	return userID
 }
 
-func sessSetUserID(c echo.Context, id int64) {
+// rotateSession gives the session a new id on login and logout, so that an id
+// planted or leaked before is of no use.
+func rotateSession(sess *sessions.Session) {
+	if sess.ID == "" {
+		return
+	}
+	if err := sessionBackend.Delete(sess.ID); err != nil {
+		log.Println("failed to delete session:", err)
+	}
+	sess.ID = ""
+}
+
+func sessSetUserID(c echo.Context, id int64, nickname string) {
 	sess, _ := session.Get("session", c)
 	sess.Options = &sessions.Options{
 		Path:     "/",
 		MaxAge:   3600,
 		HttpOnly: true,
 	}
+	rotateSession(sess)
 	sess.Values["user_id"] = id
+	sess.Values["user_nickname"] = nickname
 	sess.Save(c.Request(), c.Response())
 }
 
@@ -111,7 +144,9 @@ func sessDeleteUserID(c echo.Context) {
 		MaxAge:   3600,
 		HttpOnly: true,
 	}
+	rotateSession(sess)
 	delete(sess.Values, "user_id")
+	delete(sess.Values, "user_nickname")
 	sess.Save(c.Request(), c.Response())
 }
 
@@ -124,14 +159,17 @@ func sessAdministratorID(c echo.Context) int64 {
 	return administratorID
 }
 
-func sessSetAdministratorID(c echo.Context, id int64) {
+func sessSetAdministratorID(c echo.Context, id int64, nickname, role string) {
 	sess, _ := session.Get("session", c)
 	sess.Options = &sessions.Options{
 		Path:     "/",
 		MaxAge:   3600,
 		HttpOnly: true,
 	}
+	rotateSession(sess)
 	sess.Values["administrator_id"] = id
+	sess.Values["administrator_nickname"] = nickname
+	sess.Values["administrator_role"] = role
 	sess.Save(c.Request(), c.Response())
 }
 
@@ -142,7 +180,10 @@ func sessDeleteAdministratorID(c echo.Context) {
 		MaxAge:   3600,
 		HttpOnly: true,
 	}
+	rotateSession(sess)
 	delete(sess.Values, "administrator_id")
+	delete(sess.Values, "administrator_nickname")
+	delete(sess.Values, "administrator_role")
 	sess.Save(c.Request(), c.Response())
 }
 
@@ -155,6 +196,8 @@ func loginRequired(next echo.HandlerFunc) echo.HandlerFunc {
 	}
 }
 
+// adminLoginRequired allows administrators of any role, for what they all may
+// do. See adminRoleRequired for the rest.
 func adminLoginRequired(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		if _, err := getLoginAdministrator(c); err != nil {
@@ -164,11 +207,17 @@ func adminLoginRequired(next echo.HandlerFunc) echo.HandlerFunc {
 	}
 }
 
+// getLoginUser reads the user from the session, which keeps the nickname
+// since login.
 func getLoginUser(c echo.Context) (*User, error) {
 	userID := sessUserID(c)
 	if userID == 0 {
 		return nil, errors.New("not logged in")
 	}
+	sess, _ := session.Get("session", c)
+	if nickname, ok := sess.Values["user_nickname"].(string); ok {
+		return &User{ID: userID, Nickname: nickname}, nil
+	}
 	var user User
 	err := db.QueryRow("SELECT id, nickname FROM users WHERE id = ?", userID).Scan(&user.ID, &user.Nickname)
 	return &user, err
@@ -179,8 +228,14 @@ func getLoginAdministrator(c echo.Context) (*Administrator, error) {
 	if administratorID == 0 {
 		return nil, errors.New("not logged in")
 	}
+	sess, _ := session.Get("session", c)
+	nickname, ok := sess.Values["administrator_nickname"].(string)
+	role, _ := sess.Values["administrator_role"].(string)
+	if ok && role != "" {
+		return &Administrator{ID: administratorID, Nickname: nickname, Role: role}, nil
+	}
 	var administrator Administrator
-	err := db.QueryRow("SELECT id, nickname FROM administrators WHERE id = ?", administratorID).Scan(&administrator.ID, &administrator.Nickname)
+	err := db.QueryRow("SELECT id, nickname, role FROM administrators WHERE id = ?", administratorID).Scan(&administrator.ID, &administrator.Nickname, &administrator.Role)
 	return &administrator, err
 }
 
@@ -191,7 +246,7 @@ func getEvents(all bool) ([]*Event, error) {
 	}
 	defer tx.Commit()
 
-	rows, err := tx.Query("SELECT * FROM events ORDER BY id ASC")
+	rows, err := tx.Query("SELECT * FROM events WHERE deleted_at IS NULL ORDER BY id ASC")
 	if err != nil {
 		return nil, err
 	}
@@ -200,69 +255,29 @@ func getEvents(all bool) ([]*Event, error) {
 	var events []*Event
 	for rows.Next() {
 		var event Event
-		if err := rows.Scan(&event.ID, &event.Title, &event.PublicFg, &event.ClosedFg, &event.Price); err != nil {
+		if err := rows.Scan(&event.ID, &event.Title, &event.PublicFg, &event.ClosedFg, &event.Price, &event.VenueID, &event.StartAt, &event.SalesOpenAt, &event.SalesCloseAt, &event.DeletedAt); err != nil {
 			return nil, err
 		}
 		if !all && !event.PublicFg {
 			continue
 		}
-		events = append(events, &event)
-	}
-	for i, v := range events {
-		event, err := getEvent(v.ID, -1)
-		if err != nil {
-			return nil, err
-		}
+		event.setScheduleUnix()
+		availability.fillSheets(&event, -1)
 		for k := range event.Sheets {
 			event.Sheets[k].Detail = nil
 		}
-		events[i] = event
+		events = append(events, &event)
 	}
 	return events, nil
 }
 
 func getEvent(eventID, loginUserID int64) (*Event, error) {
 	var event Event
-	if err := db.QueryRow("SELECT * FROM events WHERE id = ?", eventID).Scan(&event.ID, &event.Title, &event.PublicFg, &event.ClosedFg, &event.Price); err != nil {
-		return nil, err
-	}
-	event.Sheets = map[string]*Sheets{
-		"S": &Sheets{},
-		"A": &Sheets{},
-		"B": &Sheets{},
-		"C": &Sheets{},
-	}
-
-	rows, err := db.Query("SELECT * FROM sheets ORDER BY `rank`, num")
-	if err != nil {
+	if err := db.QueryRow("SELECT * FROM events WHERE id = ? AND deleted_at IS NULL", eventID).Scan(&event.ID, &event.Title, &event.PublicFg, &event.ClosedFg, &event.Price, &event.VenueID, &event.StartAt, &event.SalesOpenAt, &event.SalesCloseAt, &event.DeletedAt); err != nil {
 		return nil, err
 	}
-	defer rows.Close()
-
-	for rows.Next() {
-		var sheet Sheet
-		if err := rows.Scan(&sheet.ID, &sheet.Rank, &sheet.Num, &sheet.Price); err != nil {
-			return nil, err
-		}
-		event.Sheets[sheet.Rank].Price = event.Price + sheet.Price
-		event.Total++
-		event.Sheets[sheet.Rank].Total++
-
-		var reservation Reservation
-		err := db.QueryRow("SELECT * FROM reservations WHERE event_id = ? AND sheet_id = ? AND canceled_at IS NULL GROUP BY event_id, sheet_id HAVING reserved_at = MIN(reserved_at)", event.ID, sheet.ID).Scan(&reservation.ID, &reservation.EventID, &reservation.SheetID, &reservation.UserID, &reservation.ReservedAt, &reservation.CanceledAt)
-		if err == nil {
-			sheet.Mine = reservation.UserID == loginUserID
-			sheet.Reserved = true
-			sheet.ReservedAtUnix = reservation.ReservedAt.Unix()
-		} else if err == sql.ErrNoRows {
-			event.Remains++
-			event.Sheets[sheet.Rank].Remains++
-		} else {
-			return nil, err
-		}
-
-		event.Sheets[sheet.Rank].Detail = append(event.Sheets[sheet.Rank].Detail, &sheet)
-	}
+	event.setScheduleUnix()
+	availability.fillSheets(&event, loginUserID)
 
 	return &event, nil
 }
@@ -272,6 +287,8 @@ func sanitizeEvent(e *Event) *Event {
 	sanitized.Price = 0
 	sanitized.PublicFg = false
 	sanitized.ClosedFg = false
+	sanitized.SalesOpenAtUnix = 0
+	sanitized.SalesCloseAtUnix = 0
 	return &sanitized
 }
 
@@ -293,10 +310,226 @@ func fillinAdministrator(next echo.HandlerFunc) echo.HandlerFunc {
 	}
 }
 
-func validateRank(rank string) bool {
-	var count int
-	db.QueryRow("SELECT COUNT(*) FROM sheets WHERE `rank` = ?", rank).Scan(&count)
-	return count > 0
+func validateRank(venueID int64, rank string) bool {
+	return availability.validRank(venueID, rank)
+}
+
+type sheetRequest struct {
+	Rank     string `json:"sheet_rank"`
+	Quantity int    `json:"quantity"`
+}
+
+const maxReserveQuantity = 10
+
+var (
+	errSoldOut         = errors.New("sold out")
+	errAlreadyReserved = errors.New("already reserved")
+)
+
+// normalizeSheetRequests merges requests for the same rank and validates them.
+// It returns an error code for resError if the requests are invalid.
+func normalizeSheetRequests(venueID int64, requests []sheetRequest) ([]sheetRequest, string) {
+	var normalized []sheetRequest
+	indices := map[string]int{}
+	total := 0
+	for _, req := range requests {
+		if !validateRank(venueID, req.Rank) {
+			return nil, "invalid_rank"
+		}
+		if req.Quantity <= 0 {
+			return nil, "invalid_quantity"
+		}
+		total += req.Quantity
+
+		if i, ok := indices[req.Rank]; ok {
+			normalized[i].Quantity += req.Quantity
+			continue
+		}
+		indices[req.Rank] = len(normalized)
+		normalized = append(normalized, req)
+	}
+	if total == 0 || total > maxReserveQuantity {
+		return nil, "invalid_quantity"
+	}
+	return normalized, ""
+}
+
+// reserveSheets randomly picks the requested number of sheets for every rank
+// and orders all of them in a single transaction, so that either all or none
+// of them are reserved. It returns errSoldOut if any rank runs short.
+func reserveSheets(event *Event, userID int64, requests []sheetRequest, couponCode string) (*Order, error) {
+	for {
+		var sheets []Sheet
+		for _, req := range requests {
+			picked, err := pickFreeSheets(event.ID, event.VenueID, req.Rank, req.Quantity)
+			if err != nil {
+				return nil, err
+			}
+			sheets = append(sheets, picked...)
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return nil, err
+		}
+
+		free, err := lockFreeSheets(tx, event.ID, sheets)
+		if err != nil {
+			tx.Rollback()
+			log.Println("re-try: rollback by", err)
+			continue
+		}
+		if !free {
+			tx.Rollback()
+			log.Println("re-try: sheets have been taken")
+			continue
+		}
+
+		if err := checkPurchaseLimits(tx, event.ID, userID, len(sheets)); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+
+		var coupon *Coupon
+		if couponCode != "" {
+			coupon, err = lockCoupon(tx, couponCode, userID, len(sheets))
+			if err != nil {
+				tx.Rollback()
+				return nil, err
+			}
+		}
+
+		order, err := insertOrder(tx, event, userID, sheets, coupon)
+		if err != nil {
+			tx.Rollback()
+			log.Println("re-try: rollback by", err)
+			continue
+		}
+		if err := tx.Commit(); err != nil {
+			tx.Rollback()
+			log.Println("re-try: rollback by", err)
+			continue
+		}
+
+		for _, r := range order.Reservations {
+			availability.reserve(r.EventID, r.SheetID, r.ID, r.UserID, *r.ReservedAt)
+		}
+		if err := payOrder(order); err != nil {
+			return nil, err
+		}
+		return order, nil
+	}
+}
+
+// pickFreeSheets randomly picks sheets of the rank which are neither reserved
+// nor held. It returns errSoldOut if there are not enough of them.
+func pickFreeSheets(eventID, venueID int64, rank string, quantity int) ([]Sheet, error) {
+	now := time.Now().UTC().Format("2006-01-02 15:04:05.000000")
+	rows, err := db.Query("SELECT * FROM sheets WHERE id NOT IN (SELECT sheet_id FROM reservations WHERE event_id = ? AND canceled_at IS NULL FOR UPDATE) AND id NOT IN (SELECT sheet_id FROM holds WHERE event_id = ? AND released_at IS NULL AND expires_at > ?) AND venue_id = ? AND `rank` = ? ORDER BY RAND() LIMIT ?", eventID, eventID, now, venueID, rank, quantity)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sheets []Sheet
+	for rows.Next() {
+		var sheet Sheet
+		if err := rows.Scan(&sheet.ID, &sheet.Rank, &sheet.Num, &sheet.Price, &sheet.VenueID, &sheet.Row, &sheet.Column); err != nil {
+			return nil, err
+		}
+		sheets = append(sheets, sheet)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(sheets) < quantity {
+		return nil, errSoldOut
+	}
+	return sheets, nil
+}
+
+// reserveSheetAt orders the given sheet. It returns errAlreadyReserved if
+// somebody holds the sheet.
+func reserveSheetAt(event *Event, userID int64, sheet Sheet, couponCode string) (*Order, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	free, err := lockFreeSheets(tx, event.ID, []Sheet{sheet})
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if !free {
+		tx.Rollback()
+		return nil, errAlreadyReserved
+	}
+
+	if err := checkPurchaseLimits(tx, event.ID, userID, 1); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	var coupon *Coupon
+	if couponCode != "" {
+		coupon, err = lockCoupon(tx, couponCode, userID, 1)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+
+	order, err := insertOrder(tx, event, userID, []Sheet{sheet}, coupon)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	r := order.Reservations[0]
+	availability.reserve(r.EventID, r.SheetID, r.ID, r.UserID, *r.ReservedAt)
+	if err := payOrder(order); err != nil {
+		return nil, err
+	}
+	return order, nil
+}
+
+// lockFreeSheets locks the sheet rows in id order, so that reservations of the
+// same sheet are serialized, and reports whether none of them is reserved or
+// held for the event.
+func lockFreeSheets(tx *sql.Tx, eventID int64, sheets []Sheet) (bool, error) {
+	now := time.Now().UTC().Format("2006-01-02 15:04:05.000000")
+
+	ids := make([]int64, 0, len(sheets))
+	for _, sheet := range sheets {
+		ids = append(ids, sheet.ID)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	for _, id := range ids {
+		var sheetID int64
+		if err := tx.QueryRow("SELECT id FROM sheets WHERE id = ? FOR UPDATE", id).Scan(&sheetID); err != nil {
+			return false, err
+		}
+		var reserved bool
+		if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM reservations WHERE event_id = ? AND sheet_id = ? AND canceled_at IS NULL)", eventID, id).Scan(&reserved); err != nil {
+			return false, err
+		}
+		if reserved {
+			return false, nil
+		}
+		var held bool
+		if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM holds WHERE event_id = ? AND sheet_id = ? AND released_at IS NULL AND expires_at > ?)", eventID, id, now).Scan(&held); err != nil {
+			return false, err
+		}
+		if held {
+			return false, nil
+		}
+	}
+	return true, nil
 }
 
 type Renderer struct {
@@ -321,6 +554,21 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	if err := availability.load(); err != nil {
+		log.Fatal(err)
+	}
+	payment = newPaymentGateway()
+	paymentFeePercent = loadPaymentFeePercent()
+	sessionBackend = newSessionBackend()
+	ticketKey = newTicketKey()
+	notifier = newNotifier()
+	outbox = &mysqlOutbox{}
+	go sweepExpiredSessions()
+	go reapExpiredHolds()
+	go retryRefunds()
+	go runScheduler()
+	go dispatchNotifications()
+	go dispatchWebhooks()
 
 	e := echo.New()
 	funcs := template.FuncMap{
@@ -332,8 +580,9 @@ func main() {
 	e.Renderer = &Renderer{
 		templates: template.Must(template.New("").Delims("[[", "]]").Funcs(funcs).ParseGlob("views/*.tmpl")),
 	}
-	e.Use(session.Middleware(sessions.NewCookieStore([]byte("secret"))))
+	e.Use(session.Middleware(newServerSessionStore(sessionBackend, sessionKeys())))
 	e.Use(middleware.LoggerWithConfig(middleware.LoggerConfig{Output: os.Stderr}))
+	e.Use(auditAdminActions)
 	e.Static("/", "public")
 	e.GET("/", func(c echo.Context) error {
 		events, err := getEvents(false)
@@ -357,6 +606,9 @@ func main() {
 		if err != nil {
 			return nil
 		}
+		if err := availability.load(); err != nil {
+			return err
+		}
 
 		return c.NoContent(204)
 	})
@@ -368,6 +620,14 @@ func main() {
 		}
 		c.Bind(&params)
 
+		if len(params.Password) > maxPasswordLength {
+			return resError(c, "invalid_password", 400)
+		}
+		passHash, err := hashPassword(params.Password)
+		if err != nil {
+			return err
+		}
+
 		tx, err := db.Begin()
 		if err != nil {
 			return err
@@ -382,7 +642,7 @@ func main() {
 			return err
 		}
 
-		res, err := tx.Exec("INSERT INTO users (login_name, pass_hash, nickname) VALUES (?, SHA2(?, 256), ?)", params.LoginName, params.Password, params.Nickname)
+		res, err := tx.Exec("INSERT INTO users (login_name, pass_hash, nickname) VALUES (?, ?, ?)", params.LoginName, passHash, params.Nickname)
 		if err != nil {
 			tx.Rollback()
 			return resError(c, "", 0)
@@ -415,45 +675,19 @@ func main() {
 			return resError(c, "forbidden", 403)
 		}
 
-		rows, err := db.Query("SELECT r.*, s.rank AS sheet_rank, s.num AS sheet_num FROM reservations r INNER JOIN sheets s ON s.id = r.sheet_id WHERE r.user_id = ? ORDER BY IFNULL(r.canceled_at, r.reserved_at) DESC LIMIT 5", user.ID)
+		rows, err := db.Query(userReservationSQL+" WHERE r.user_id = ? ORDER BY IFNULL(r.canceled_at, r.reserved_at) DESC LIMIT 5", user.ID)
 		if err != nil {
 			return err
 		}
 		defer rows.Close()
 
-		var recentReservations []Reservation
-		for rows.Next() {
-			var reservation Reservation
-			var sheet Sheet
-			if err := rows.Scan(&reservation.ID, &reservation.EventID, &reservation.SheetID, &reservation.UserID, &reservation.ReservedAt, &reservation.CanceledAt, &sheet.Rank, &sheet.Num); err != nil {
-				return err
-			}
-
-			event, err := getEvent(reservation.EventID, -1)
-			if err != nil {
-				return err
-			}
-			price := event.Sheets[sheet.Rank].Price
-			event.Sheets = nil
-			event.Total = 0
-			event.Remains = 0
-
-			reservation.Event = event
-			reservation.SheetRank = sheet.Rank
-			reservation.SheetNum = sheet.Num
-			reservation.Price = price
-			reservation.ReservedAtUnix = reservation.ReservedAt.Unix()
-			if reservation.CanceledAt != nil {
-				reservation.CanceledAtUnix = reservation.CanceledAt.Unix()
-			}
-			recentReservations = append(recentReservations, reservation)
-		}
-		if recentReservations == nil {
-			recentReservations = make([]Reservation, 0)
+		recentReservations, err := scanUserReservations(rows)
+		if err != nil {
+			return err
 		}
 
 		var totalPrice int
-		if err := db.QueryRow("SELECT IFNULL(SUM(e.price + s.price), 0) FROM reservations r INNER JOIN sheets s ON s.id = r.sheet_id INNER JOIN events e ON e.id = r.event_id WHERE r.user_id = ? AND r.canceled_at IS NULL", user.ID).Scan(&totalPrice); err != nil {
+		if err := db.QueryRow("SELECT IFNULL(SUM("+sheetPriceSQL+"), 0) FROM reservations r INNER JOIN sheets s ON s.id = r.sheet_id INNER JOIN events e ON e.id = r.event_id "+sheetPriceJoinSQL+" WHERE r.user_id = ? AND r.canceled_at IS NULL", user.ID).Scan(&totalPrice); err != nil {
 			return err
 		}
 
@@ -482,12 +716,78 @@ func main() {
 			recentEvents = make([]*Event, 0)
 		}
 
+		waitlist, err := getUserWaitlist(user.ID)
+		if err != nil {
+			return err
+		}
+
+		recentTransfers, err := getRecentTransfers(user.ID, 5)
+		if err != nil {
+			return err
+		}
+
 		return c.JSON(200, echo.Map{
 			"id":                  user.ID,
 			"nickname":            user.Nickname,
 			"recent_reservations": recentReservations,
 			"total_price":         totalPrice,
 			"recent_events":       recentEvents,
+			"waitlist":            waitlist,
+			"recent_transfers":    recentTransfers,
+		})
+	}, loginRequired)
+	e.GET("/api/users/:id/reservations", func(c echo.Context) error {
+		userID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return resError(c, "forbidden", 403)
+		}
+		loginUser, err := getLoginUser(c)
+		if err != nil {
+			return err
+		}
+		if userID != loginUser.ID {
+			return resError(c, "forbidden", 403)
+		}
+
+		page, code := parseHistoryPage(c)
+		if code != "" {
+			return resError(c, code, 400)
+		}
+		reservations, next, err := getUserReservations(userID, page)
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(200, echo.Map{
+			"reservations": reservations,
+			"next_cursor":  next,
+		})
+	}, loginRequired)
+	e.GET("/api/users/:id/events", func(c echo.Context) error {
+		userID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return resError(c, "forbidden", 403)
+		}
+		loginUser, err := getLoginUser(c)
+		if err != nil {
+			return err
+		}
+		if userID != loginUser.ID {
+			return resError(c, "forbidden", 403)
+		}
+
+		page, code := parseHistoryPage(c)
+		if code != "" {
+			return resError(c, code, 400)
+		}
+		events, next, err := getUserEvents(userID, page)
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(200, echo.Map{
+			"events":      events,
+			"next_cursor": next,
 		})
 	}, loginRequired)
 	e.POST("/api/actions/login", func(c echo.Context) error {
@@ -505,15 +805,14 @@ func main() {
 			return err
 		}
 
-		var passHash string
-		if err := db.QueryRow("SELECT SHA2(?, 256)", params.Password).Scan(&passHash); err != nil {
-			return err
-		}
-		if user.PassHash != passHash {
+		if !verifyPassword(user.PassHash, params.Password) {
 			return resError(c, "authentication_failed", 401)
 		}
+		if err := upgradePassHash("users", user.ID, user.PassHash, params.Password); err != nil {
+			return err
+		}
 
-		sessSetUserID(c, user.ID)
+		sessSetUserID(c, user.ID, user.Nickname)
 		user, err = getLoginUser(c)
 		if err != nil {
 			return err
@@ -524,6 +823,13 @@ func main() {
 		sessDeleteUserID(c)
 		return c.NoContent(204)
 	}, loginRequired)
+	e.POST("/api/actions/logout_all", func(c echo.Context) error {
+		if err := sessionBackend.RevokeUser(sessUserID(c)); err != nil {
+			return err
+		}
+		sessDeleteUserID(c)
+		return c.NoContent(204)
+	}, loginRequired)
 	e.GET("/api/events", func(c echo.Context) error {
 		events, err := getEvents(true)
 		if err != nil {
@@ -556,13 +862,67 @@ func main() {
 		}
 		return c.JSON(200, sanitizeEvent(event))
 	})
+	e.GET("/api/events/:id/stream", func(c echo.Context) error {
+		eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return resError(c, "not_found", 404)
+		}
+
+		event, err := getEvent(eventID, -1)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return resError(c, "not_found", 404)
+			}
+			return err
+		} else if !event.PublicFg {
+			return resError(c, "not_found", 404)
+		}
+
+		backlog, messages := availability.subscribe(event, c.Request().Header.Get("Last-Event-ID"))
+		defer streams.unsubscribe(event.ID, messages)
+
+		res := c.Response()
+		res.Header().Set(echo.HeaderContentType, "text/event-stream")
+		res.Header().Set("Cache-Control", "no-cache")
+		res.WriteHeader(200)
+		for _, msg := range backlog {
+			if err := msg.writeTo(res); err != nil {
+				return nil
+			}
+		}
+		res.Flush()
+
+		heartbeat := time.NewTicker(streamHeartbeatInterval)
+		defer heartbeat.Stop()
+		for {
+			select {
+			case msg, ok := <-messages:
+				if !ok {
+					return nil
+				}
+				if err := msg.writeTo(res); err != nil {
+					return nil
+				}
+			case <-heartbeat.C:
+				if _, err := io.WriteString(res, ": heartbeat\n\n"); err != nil {
+					return nil
+				}
+			case <-c.Request().Context().Done():
+				return nil
+			}
+			res.Flush()
+		}
+	})
 	e.POST("/api/events/:id/actions/reserve", func(c echo.Context) error {
 		eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
 		if err != nil {
 			return resError(c, "not_found", 404)
 		}
 		var params struct {
-			Rank string `json:"sheet_rank"`
+			Rank       string         `json:"sheet_rank"`
+			Quantity   int            `json:"quantity"`
+			Sheets     []sheetRequest `json:"sheets"`
+			CouponCode string         `json:"coupon_code"`
 		}
 		c.Bind(&params)
 
@@ -580,192 +940,1100 @@ func main() {
 		} else if !event.PublicFg {
 			return resError(c, "invalid_event", 404)
 		}
-
-		if !validateRank(params.Rank) {
-			return resError(c, "invalid_rank", 400)
+		if errCode := event.salesError(time.Now()); errCode != "" {
+			return resError(c, errCode, 403)
 		}
 
-		var sheet Sheet
-		var reservationID int64
-		for {
-			if err := db.QueryRow("SELECT * FROM sheets WHERE id NOT IN (SELECT sheet_id FROM reservations WHERE event_id = ? AND canceled_at IS NULL FOR UPDATE) AND `rank` = ? ORDER BY RAND() LIMIT 1", event.ID, params.Rank).Scan(&sheet.ID, &sheet.Rank, &sheet.Num, &sheet.Price); err != nil {
-				if err == sql.ErrNoRows {
-					return resError(c, "sold_out", 409)
-				}
-				return err
+		group := params.Quantity != 0 || params.Sheets != nil
+		requests := params.Sheets
+		if requests == nil {
+			quantity := params.Quantity
+			if quantity == 0 {
+				quantity = 1
 			}
+			requests = []sheetRequest{{Rank: params.Rank, Quantity: quantity}}
+		}
 
-			tx, err := db.Begin()
-			if err != nil {
-				return err
-			}
+		requests, errCode := normalizeSheetRequests(event.VenueID, requests)
+		if errCode != "" {
+			return resError(c, errCode, 400)
+		}
 
-			res, err := tx.Exec("INSERT INTO reservations (event_id, sheet_id, user_id, reserved_at) VALUES (?, ?, ?, ?)", event.ID, sheet.ID, user.ID, time.Now().UTC().Format("2006-01-02 15:04:05.000000"))
-			if err != nil {
-				tx.Rollback()
-				log.Println("re-try: rollback by", err)
-				continue
+		order, err := reserveSheets(event, user.ID, requests, params.CouponCode)
+		if err != nil {
+			switch err {
+			case errSoldOut:
+				return resError(c, "sold_out", 409)
+			case errPaymentFailed:
+				return resError(c, "payment_failed", 402)
+			case errInvalidCoupon:
+				return resError(c, "invalid_coupon", 400)
+			case errCouponExpired:
+				return resError(c, "coupon_expired", 400)
+			case errCouponLimitExceeded:
+				return resError(c, "coupon_limit_exceeded", 409)
+			case errSheetLimitExceeded:
+				return resError(c, "sheet_limit_exceeded", 409)
+			case errReservationRateLimited:
+				return resError(c, "reservation_rate_limited", 429)
+			case errCancelCooldown:
+				return resError(c, "cancel_cooldown", 429)
 			}
-			reservationID, err = res.LastInsertId()
-			if err != nil {
+			return err
+		}
+
+		if !group {
+			return c.JSON(202, echo.Map{
+				"id":           order.Reservations[0].ID,
+				"sheet_rank":   order.Reservations[0].SheetRank,
+				"sheet_num":    order.Reservations[0].SheetNum,
+				"order_id":     order.ID,
+				"order_status": order.Status,
+			})
+		}
+		return c.JSON(202, echo.Map{
+			"reservations": order.Reservations,
+			"order_id":     order.ID,
+			"order_status": order.Status,
+		})
+	}, loginRequired)
+	e.POST("/api/events/:id/sheets/:rank/:num/reservation", func(c echo.Context) error {
+		eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return resError(c, "not_found", 404)
+		}
+		rank := c.Param("rank")
+		num := c.Param("num")
+		var params struct {
+			CouponCode string `json:"coupon_code"`
+		}
+		c.Bind(&params)
+
+		user, err := getLoginUser(c)
+		if err != nil {
+			return err
+		}
+
+		event, err := getEvent(eventID, user.ID)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return resError(c, "invalid_event", 404)
+			}
+			return err
+		} else if !event.PublicFg {
+			return resError(c, "invalid_event", 404)
+		}
+		if errCode := event.salesError(time.Now()); errCode != "" {
+			return resError(c, errCode, 403)
+		}
+
+		if !validateRank(event.VenueID, rank) {
+			return resError(c, "invalid_rank", 404)
+		}
+
+		sheetNum, err := strconv.ParseInt(num, 10, 64)
+		if err != nil {
+			return resError(c, "invalid_sheet", 404)
+		}
+		sheet, ok := availability.sheetByRankNum(event.VenueID, rank, sheetNum)
+		if !ok {
+			return resError(c, "invalid_sheet", 404)
+		}
+
+		order, err := reserveSheetAt(event, user.ID, sheet, params.CouponCode)
+		if err != nil {
+			switch err {
+			case errAlreadyReserved:
+				return resError(c, "already_reserved", 409)
+			case errPaymentFailed:
+				return resError(c, "payment_failed", 402)
+			case errInvalidCoupon:
+				return resError(c, "invalid_coupon", 400)
+			case errCouponExpired:
+				return resError(c, "coupon_expired", 400)
+			case errCouponLimitExceeded:
+				return resError(c, "coupon_limit_exceeded", 409)
+			case errSheetLimitExceeded:
+				return resError(c, "sheet_limit_exceeded", 409)
+			case errReservationRateLimited:
+				return resError(c, "reservation_rate_limited", 429)
+			case errCancelCooldown:
+				return resError(c, "cancel_cooldown", 429)
+			}
+			return err
+		}
+
+		return c.JSON(202, echo.Map{
+			"id":           order.Reservations[0].ID,
+			"sheet_rank":   order.Reservations[0].SheetRank,
+			"sheet_num":    order.Reservations[0].SheetNum,
+			"order_id":     order.ID,
+			"order_status": order.Status,
+		})
+	}, loginRequired)
+	e.POST("/api/events/:id/actions/hold", func(c echo.Context) error {
+		eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return resError(c, "not_found", 404)
+		}
+		var params struct {
+			Rank    string `json:"sheet_rank"`
+			Num     int64  `json:"sheet_num"`
+			Minutes int    `json:"minutes"`
+		}
+		c.Bind(&params)
+
+		user, err := getLoginUser(c)
+		if err != nil {
+			return err
+		}
+
+		event, err := getEvent(eventID, user.ID)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return resError(c, "invalid_event", 404)
+			}
+			return err
+		} else if !event.PublicFg {
+			return resError(c, "invalid_event", 404)
+		}
+		if errCode := event.salesError(time.Now()); errCode != "" {
+			return resError(c, errCode, 403)
+		}
+
+		if !validateRank(event.VenueID, params.Rank) {
+			return resError(c, "invalid_rank", 400)
+		}
+
+		var selected *Sheet
+		if params.Num != 0 {
+			sheet, ok := availability.sheetByRankNum(event.VenueID, params.Rank, params.Num)
+			if !ok {
+				return resError(c, "invalid_sheet", 404)
+			}
+			selected = &sheet
+		}
+
+		minutes := params.Minutes
+		if minutes == 0 {
+			minutes = defaultHoldMinutes
+		}
+		if minutes < 0 || minutes > maxHoldMinutes {
+			return resError(c, "invalid_minutes", 400)
+		}
+
+		hold, err := holdSheet(event.ID, event.VenueID, user.ID, params.Rank, selected, time.Duration(minutes)*time.Minute)
+		if err != nil {
+			switch err {
+			case errSoldOut:
+				return resError(c, "sold_out", 409)
+			case errAlreadyReserved:
+				return resError(c, "already_reserved", 409)
+			case errSheetLimitExceeded:
+				return resError(c, "sheet_limit_exceeded", 409)
+			case errReservationRateLimited:
+				return resError(c, "reservation_rate_limited", 429)
+			case errCancelCooldown:
+				return resError(c, "cancel_cooldown", 429)
+			}
+			return err
+		}
+
+		return c.JSON(202, hold)
+	}, loginRequired)
+	e.POST("/api/events/:id/sheets/:rank/waitlist", func(c echo.Context) error {
+		eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return resError(c, "not_found", 404)
+		}
+		rank := c.Param("rank")
+
+		user, err := getLoginUser(c)
+		if err != nil {
+			return err
+		}
+
+		event, err := getEvent(eventID, user.ID)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return resError(c, "invalid_event", 404)
+			}
+			return err
+		} else if !event.PublicFg {
+			return resError(c, "invalid_event", 404)
+		}
+		if errCode := event.salesError(time.Now()); errCode != "" {
+			return resError(c, errCode, 403)
+		}
+
+		if !validateRank(event.VenueID, rank) {
+			return resError(c, "invalid_rank", 404)
+		}
+		if event.Sheets[rank].Remains > 0 {
+			return resError(c, "not_sold_out", 409)
+		}
+
+		entry, err := joinWaitlist(event.ID, user.ID, rank)
+		if err != nil {
+			if err == errAlreadyWaiting {
+				return resError(c, "already_waiting", 409)
+			}
+			return err
+		}
+
+		return c.JSON(202, entry)
+	}, loginRequired)
+	e.DELETE("/api/events/:id/sheets/:rank/waitlist", func(c echo.Context) error {
+		eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return resError(c, "not_found", 404)
+		}
+		rank := c.Param("rank")
+
+		user, err := getLoginUser(c)
+		if err != nil {
+			return err
+		}
+
+		event, err := getEvent(eventID, user.ID)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return resError(c, "invalid_event", 404)
+			}
+			return err
+		} else if !event.PublicFg {
+			return resError(c, "invalid_event", 404)
+		}
+
+		if !validateRank(event.VenueID, rank) {
+			return resError(c, "invalid_rank", 404)
+		}
+
+		if err := leaveWaitlist(event.ID, user.ID, rank); err != nil {
+			if err == errNotWaiting {
+				return resError(c, "not_waiting", 400)
+			}
+			return err
+		}
+
+		return c.NoContent(204)
+	}, loginRequired)
+	e.POST("/api/holds/:id/actions/confirm", func(c echo.Context) error {
+		holdID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return resError(c, "invalid_hold", 404)
+		}
+
+		user, err := getLoginUser(c)
+		if err != nil {
+			return err
+		}
+
+		order, err := confirmHold(holdID, user.ID)
+		if err != nil {
+			switch err {
+			case sql.ErrNoRows:
+				return resError(c, "invalid_hold", 404)
+			case errNotHolder:
+				return resError(c, "not_permitted", 403)
+			case errHoldExpired:
+				return resError(c, "hold_expired", 409)
+			case errInvalidEvent:
+				return resError(c, "invalid_event", 404)
+			case errSalesNotOpen:
+				return resError(c, "sales_not_open", 403)
+			case errSalesClosed:
+				return resError(c, "sales_closed", 403)
+			case errPaymentFailed:
+				return resError(c, "payment_failed", 402)
+			case errSheetLimitExceeded:
+				return resError(c, "sheet_limit_exceeded", 409)
+			case errReservationRateLimited:
+				return resError(c, "reservation_rate_limited", 429)
+			case errCancelCooldown:
+				return resError(c, "cancel_cooldown", 429)
+			}
+			return err
+		}
+
+		return c.JSON(202, echo.Map{
+			"id":           order.Reservations[0].ID,
+			"sheet_rank":   order.Reservations[0].SheetRank,
+			"sheet_num":    order.Reservations[0].SheetNum,
+			"order_id":     order.ID,
+			"order_status": order.Status,
+		})
+	}, loginRequired)
+	e.DELETE("/api/events/:id/sheets/:rank/:num/reservation", func(c echo.Context) error {
+		eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return resError(c, "not_found", 404)
+		}
+		rank := c.Param("rank")
+		num := c.Param("num")
+
+		user, err := getLoginUser(c)
+		if err != nil {
+			return err
+		}
+
+		event, err := getEvent(eventID, user.ID)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return resError(c, "invalid_event", 404)
+			}
+			return err
+		} else if !event.PublicFg {
+			return resError(c, "invalid_event", 404)
+		}
+
+		if !validateRank(event.VenueID, rank) {
+			return resError(c, "invalid_rank", 404)
+		}
+
+		sheetNum, err := strconv.ParseInt(num, 10, 64)
+		if err != nil {
+			return resError(c, "invalid_sheet", 404)
+		}
+		sheet, ok := availability.sheetByRankNum(event.VenueID, rank, sheetNum)
+		if !ok {
+			return resError(c, "invalid_sheet", 404)
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+
+		var reservation Reservation
+		if err := tx.QueryRow("SELECT id, event_id, sheet_id, user_id, reserved_at, canceled_at, checked_in_at, IFNULL(price, 0), order_id FROM reservations WHERE event_id = ? AND sheet_id = ? AND canceled_at IS NULL GROUP BY event_id HAVING reserved_at = MIN(reserved_at) FOR UPDATE", event.ID, sheet.ID).Scan(&reservation.ID, &reservation.EventID, &reservation.SheetID, &reservation.UserID, &reservation.ReservedAt, &reservation.CanceledAt, &reservation.CheckedInAt, &reservation.Price, &reservation.OrderID); err != nil {
+			tx.Rollback()
+			if err == sql.ErrNoRows {
+				return resError(c, "not_reserved", 400)
+			}
+			return err
+		}
+		if reservation.UserID != user.ID {
+			tx.Rollback()
+			return resError(c, "not_permitted", 403)
+		}
+		if reservation.CheckedInAt != nil {
+			tx.Rollback()
+			return resError(c, "already_checked_in", 409)
+		}
+
+		if _, err := tx.Exec("UPDATE reservations SET canceled_at = ? WHERE id = ?", time.Now().UTC().Format("2006-01-02 15:04:05.000000"), reservation.ID); err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		if err := cancelPendingTransfers(tx, reservation.ID); err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		refund, err := refundReservation(tx, &reservation)
+		if err != nil {
+			tx.Rollback()
+			if err == errPaymentPending {
+				return resError(c, "payment_pending", 409)
+			}
+			return err
+		}
+
+		offered, err := offerSheetToWaitlist(tx, event.ID, sheet)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		reservation.SheetRank, reservation.SheetNum = sheet.Rank, sheet.Num
+		if err := insertWebhookDeliveries(tx, webhookReservationCanceled, webhookReservationData(&reservation)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := insertNotification(tx, user.ID, notificationReservationCanceled, map[string]interface{}{
+			"reservation_id": reservation.ID,
+			"event_id":       event.ID,
+			"event_title":    event.Title,
+			"sheet_rank":     sheet.Rank,
+			"sheet_num":      sheet.Num,
+			"price":          reservation.Price,
+		}); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := touchReservations(tx, reservation.ID); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		availability.cancel(event.ID, sheet.ID, reservation.ID)
+		if offered != nil {
+			availability.hold(offered.EventID, offered.SheetID, offered.ID, offered.UserID, *offered.ExpiresAt)
+		}
+		if refund != nil {
+			payRefund(refund)
+		}
+
+		return c.NoContent(204)
+	}, loginRequired)
+	e.GET("/api/reservations/:id/ticket", func(c echo.Context) error {
+		ticket, errCode, status, err := getUserTicket(c)
+		if err != nil {
+			return err
+		}
+		if errCode != "" {
+			return resError(c, errCode, status)
+		}
+		return c.JSON(200, ticket)
+	}, loginRequired)
+	e.GET("/api/reservations/:id/ticket.png", func(c echo.Context) error {
+		ticket, errCode, status, err := getUserTicket(c)
+		if err != nil {
+			return err
+		}
+		if errCode != "" {
+			return resError(c, errCode, status)
+		}
+		code, err := qr.Encode(ticket.Token, qr.M)
+		if err != nil {
+			return err
+		}
+		return c.Blob(200, "image/png", code.PNG())
+	}, loginRequired)
+	e.POST("/api/reservations/:id/transfer", func(c echo.Context) error {
+		reservationID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return resError(c, "not_found", 404)
+		}
+
+		var params struct {
+			LoginName string `json:"login_name"`
+		}
+		c.Bind(&params)
+
+		user, err := getLoginUser(c)
+		if err != nil {
+			return err
+		}
+
+		transfer, err := createTransfer(reservationID, user.ID, params.LoginName)
+		if err != nil {
+			switch err {
+			case sql.ErrNoRows:
+				return resError(c, "not_found", 404)
+			case errNotTransferParty:
+				return resError(c, "forbidden", 403)
+			case errInvalidRecipient:
+				return resError(c, "invalid_recipient", 400)
+			case errNotTransferable:
+				return resError(c, "not_transferable", 409)
+			case errTransferPending:
+				return resError(c, "transfer_pending", 409)
+			}
+			return err
+		}
+		return c.JSON(200, transfer)
+	}, loginRequired)
+	e.POST("/api/transfers/:id/actions/accept", func(c echo.Context) error {
+		transferID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return resError(c, "not_found", 404)
+		}
+
+		user, err := getLoginUser(c)
+		if err != nil {
+			return err
+		}
+
+		transfer, err := acceptTransfer(transferID, user.ID)
+		if err != nil {
+			switch err {
+			case sql.ErrNoRows:
+				return resError(c, "not_found", 404)
+			case errNotTransferParty:
+				return resError(c, "forbidden", 403)
+			case errTransferClosed:
+				return resError(c, "transfer_closed", 409)
+			case errNotTransferable:
+				return resError(c, "not_transferable", 409)
+			case errSheetLimitExceeded:
+				return resError(c, "sheet_limit_exceeded", 409)
+			case errReservationRateLimited:
+				return resError(c, "reservation_rate_limited", 429)
+			case errCancelCooldown:
+				return resError(c, "cancel_cooldown", 429)
+			}
+			return err
+		}
+		return c.JSON(200, transfer)
+	}, loginRequired)
+	e.POST("/api/transfers/:id/actions/cancel", func(c echo.Context) error {
+		transferID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return resError(c, "not_found", 404)
+		}
+
+		user, err := getLoginUser(c)
+		if err != nil {
+			return err
+		}
+
+		transfer, err := closeTransfer(transferID, user.ID)
+		if err != nil {
+			switch err {
+			case sql.ErrNoRows:
+				return resError(c, "not_found", 404)
+			case errNotTransferParty:
+				return resError(c, "forbidden", 403)
+			case errTransferClosed:
+				return resError(c, "transfer_closed", 409)
+			}
+			return err
+		}
+		return c.JSON(200, transfer)
+	}, loginRequired)
+	e.GET("/api/orders/:id", func(c echo.Context) error {
+		orderID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return resError(c, "not_found", 404)
+		}
+
+		user, err := getLoginUser(c)
+		if err != nil {
+			return err
+		}
+
+		order, err := getOrder(orderID)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return resError(c, "not_found", 404)
+			}
+			return err
+		}
+		if order.UserID != user.ID {
+			return resError(c, "forbidden", 403)
+		}
+
+		return c.JSON(200, order)
+	}, loginRequired)
+	e.POST("/api/payments/webhook", func(c echo.Context) error {
+		result, err := payment.ParseWebhook(c.Request())
+		if err != nil {
+			if err == errInvalidWebhook {
+				return resError(c, "invalid_webhook", 400)
+			}
+			return err
+		}
+
+		orderID, err := getOrderIDByPaymentID(result.PaymentID)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return resError(c, "not_found", 404)
+			}
+			return err
+		}
+		if err := settleOrder(orderID, result.PaymentID, result.Status); err != nil {
+			return err
+		}
+
+		return c.NoContent(204)
+	})
+	e.GET("/admin/", func(c echo.Context) error {
+		var events []*Event
+		administrator := c.Get("administrator")
+		if administrator != nil {
+			var err error
+			if events, err = getEvents(true); err != nil {
+				return err
+			}
+		}
+		return c.Render(200, "admin.tmpl", echo.Map{
+			"events":        events,
+			"administrator": administrator,
+			"origin":        c.Scheme() + "://" + c.Request().Host,
+		})
+	}, fillinAdministrator)
+	e.POST("/admin/api/actions/login", func(c echo.Context) error {
+		var params struct {
+			LoginName string `json:"login_name"`
+			Password  string `json:"password"`
+		}
+		c.Bind(&params)
+
+		administrator := new(Administrator)
+		if err := db.QueryRow("SELECT id, login_name, nickname, pass_hash, role FROM administrators WHERE login_name = ?", params.LoginName).Scan(&administrator.ID, &administrator.LoginName, &administrator.Nickname, &administrator.PassHash, &administrator.Role); err != nil {
+			if err == sql.ErrNoRows {
+				return resError(c, "authentication_failed", 401)
+			}
+			return err
+		}
+
+		if !verifyPassword(administrator.PassHash, params.Password) {
+			return resError(c, "authentication_failed", 401)
+		}
+		if err := upgradePassHash("administrators", administrator.ID, administrator.PassHash, params.Password); err != nil {
+			return err
+		}
+
+		sessSetAdministratorID(c, administrator.ID, administrator.Nickname, administrator.Role)
+		administrator, err = getLoginAdministrator(c)
+		if err != nil {
+			return err
+		}
+		return c.JSON(200, administrator)
+	})
+	e.POST("/admin/api/actions/logout", func(c echo.Context) error {
+		sessDeleteAdministratorID(c)
+		return c.NoContent(204)
+	}, adminLoginRequired)
+	e.POST("/admin/api/actions/logout_all", func(c echo.Context) error {
+		if err := sessionBackend.RevokeAdministrator(sessAdministratorID(c)); err != nil {
+			return err
+		}
+		sessDeleteAdministratorID(c)
+		return c.NoContent(204)
+	}, adminLoginRequired)
+	e.GET("/admin/api/events", func(c echo.Context) error {
+		events, err := getEvents(true)
+		if err != nil {
+			return err
+		}
+		return c.JSON(200, events)
+	}, adminLoginRequired)
+	e.GET("/admin/api/dashboard", func(c echo.Context) error {
+		dashboard, err := getDashboard(time.Now())
+		if err != nil {
+			return err
+		}
+		return c.JSON(200, dashboard)
+	}, adminLoginRequired)
+	e.POST("/admin/api/events", func(c echo.Context) error {
+		var params struct {
+			Title        string `json:"title"`
+			Public       bool   `json:"public"`
+			Price        int    `json:"price"`
+			VenueID      int64  `json:"venue_id"`
+			StartAt      int64  `json:"start_at"`
+			SalesOpenAt  int64  `json:"sales_open_at"`
+			SalesCloseAt int64  `json:"sales_close_at"`
+		}
+		c.Bind(&params)
+
+		if params.VenueID == 0 {
+			params.VenueID = defaultVenueID
+		}
+		if !availability.hasVenue(params.VenueID) {
+			return resError(c, "invalid_venue", 400)
+		}
+		startAt, salesOpenAt, salesCloseAt, ok := parseSchedule(params.StartAt, params.SalesOpenAt, params.SalesCloseAt)
+		if !ok {
+			return resError(c, "invalid_schedule", 400)
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+
+		res, err := tx.Exec("INSERT INTO events (title, public_fg, closed_fg, price, venue_id, start_at, sales_open_at, sales_close_at) VALUES (?, ?, 0, ?, ?, ?, ?, ?)", params.Title, params.Public, params.Price, params.VenueID, formatScheduleTime(startAt), formatScheduleTime(salesOpenAt), formatScheduleTime(salesCloseAt))
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		eventID, err := res.LastInsertId()
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		created := &Event{ID: eventID, Title: params.Title, PublicFg: params.Public, Price: int64(params.Price), VenueID: params.VenueID, StartAtUnix: params.StartAt, SalesOpenAtUnix: params.SalesOpenAt, SalesCloseAtUnix: params.SalesCloseAt}
+		if err := insertWebhookDeliveries(tx, webhookEventCreated, webhookEventData(created)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if created.PublicFg {
+			if err := insertWebhookDeliveries(tx, webhookEventPublished, webhookEventData(created)); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+
+		event, err := getEvent(eventID, -1)
+		if err != nil {
+			return err
+		}
+		return c.JSON(200, event)
+	}, adminRoleRequired(adminRoleEventManager))
+	e.GET("/admin/api/venues", func(c echo.Context) error {
+		return c.JSON(200, availability.getVenues())
+	}, adminLoginRequired)
+	e.POST("/admin/api/venues", func(c echo.Context) error {
+		var params struct {
+			Name  string       `json:"name"`
+			Ranks []*VenueRank `json:"ranks"`
+		}
+		c.Bind(&params)
+
+		if errCode := validateVenue(params.Name, params.Ranks); errCode != "" {
+			return resError(c, errCode, 400)
+		}
+
+		layout, err := createVenue(params.Name, params.Ranks)
+		if err != nil {
+			return err
+		}
+		availability.addVenue(layout)
+
+		return c.JSON(201, layout.venue())
+	}, adminRoleRequired(adminRoleEventManager))
+	e.GET("/admin/api/coupons", func(c echo.Context) error {
+		coupons, err := getCoupons()
+		if err != nil {
+			return err
+		}
+		return c.JSON(200, coupons)
+	}, adminLoginRequired)
+	e.POST("/admin/api/coupons", func(c echo.Context) error {
+		var coupon Coupon
+		c.Bind(&coupon)
+		coupon.ID = 0
+
+		if errCode := validateCoupon(&coupon); errCode != "" {
+			return resError(c, errCode, 400)
+		}
+
+		if err := createCoupon(&coupon); err != nil {
+			if err == errCouponDuplicated {
+				return resError(c, "duplicated", 409)
+			}
+			return err
+		}
+
+		return c.JSON(201, coupon)
+	}, adminRoleRequired(adminRoleEventManager))
+	e.GET("/admin/api/events/:id", func(c echo.Context) error {
+		eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return resError(c, "not_found", 404)
+		}
+		event, err := getEvent(eventID, -1)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return resError(c, "not_found", 404)
+			}
+			return err
+		}
+		return c.JSON(200, event)
+	}, adminLoginRequired)
+	e.POST("/admin/api/events/:id/actions/edit", func(c echo.Context) error {
+		eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return resError(c, "not_found", 404)
+		}
+
+		// Omitted fields are left as they are.
+		var params struct {
+			Public       *bool   `json:"public"`
+			Closed       *bool   `json:"closed"`
+			Title        *string `json:"title"`
+			Price        *int64  `json:"price"`
+			StartAt      *int64  `json:"start_at"`
+			SalesOpenAt  *int64  `json:"sales_open_at"`
+			SalesCloseAt *int64  `json:"sales_close_at"`
+		}
+		c.Bind(&params)
+
+		event, err := getEvent(eventID, -1)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return resError(c, "not_found", 404)
+			}
+			return err
+		}
+
+		public, closed := event.PublicFg, false
+		if params.Public != nil {
+			public = *params.Public
+		}
+		if params.Closed != nil {
+			closed = *params.Closed
+		}
+		if closed {
+			public = false
+		}
+
+		if event.ClosedFg {
+			return resError(c, "cannot_edit_closed_event", 400)
+		} else if event.PublicFg && closed {
+			return resError(c, "cannot_close_public_event", 400)
+		}
+
+		detailsEdited := false
+		title, price := event.Title, event.Price
+		if params.Title != nil {
+			title = *params.Title
+			detailsEdited = true
+			if title == "" || utf8.RuneCountInString(title) > 128 {
+				return resError(c, "invalid_title", 400)
+			}
+		}
+		if params.Price != nil {
+			price = *params.Price
+			detailsEdited = true
+			if price < 0 {
+				return resError(c, "invalid_price", 400)
+			}
+		}
+
+		startUnix, salesOpenUnix, salesCloseUnix := event.StartAtUnix, event.SalesOpenAtUnix, event.SalesCloseAtUnix
+		if params.StartAt != nil {
+			startUnix = *params.StartAt
+			detailsEdited = true
+		}
+		if params.SalesOpenAt != nil {
+			salesOpenUnix = *params.SalesOpenAt
+			detailsEdited = true
+		}
+		if params.SalesCloseAt != nil {
+			salesCloseUnix = *params.SalesCloseAt
+			detailsEdited = true
+		}
+		startAt, salesOpenAt, salesCloseAt, ok := parseSchedule(startUnix, salesOpenUnix, salesCloseUnix)
+		if !ok {
+			return resError(c, "invalid_schedule", 400)
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		// Lock the event before the reservations, in the same order as
+		// orders do.
+		var lockedID int64
+		if err := tx.QueryRow("SELECT id FROM events WHERE id = ? FOR UPDATE", event.ID).Scan(&lockedID); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if detailsEdited {
+			// The price of sold sheets is computed from the event, so it must
+			// not change once sold.
+			var sold bool
+			if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM reservations WHERE event_id = ? FOR UPDATE)", event.ID).Scan(&sold); err != nil {
+				tx.Rollback()
+				return err
+			}
+			if sold {
+				tx.Rollback()
+				return resError(c, "cannot_edit_sold_event", 400)
+			}
+		}
+		if _, err := tx.Exec("UPDATE events SET title = ?, price = ?, public_fg = ?, closed_fg = ?, start_at = ?, sales_open_at = ?, sales_close_at = ? WHERE id = ?", title, price, public, closed, formatScheduleTime(startAt), formatScheduleTime(salesOpenAt), formatScheduleTime(salesCloseAt), event.ID); err != nil {
+			tx.Rollback()
+			return err
+		}
+		edited := *event
+		edited.Title, edited.Price, edited.PublicFg, edited.ClosedFg = title, price, public, closed
+		edited.StartAtUnix, edited.SalesOpenAtUnix, edited.SalesCloseAtUnix = startUnix, salesOpenUnix, salesCloseUnix
+		if public && !event.PublicFg {
+			if err := insertWebhookDeliveries(tx, webhookEventPublished, webhookEventData(&edited)); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+		if closed && !event.ClosedFg {
+			if err := insertWebhookDeliveries(tx, webhookEventClosed, webhookEventData(&edited)); err != nil {
 				tx.Rollback()
-				log.Println("re-try: rollback by", err)
-				continue
+				return err
 			}
-			if err := tx.Commit(); err != nil {
+		}
+		// Details can not be edited once sold, so holders are told of the
+		// changes in sales only.
+		if public != event.PublicFg || closed != event.ClosedFg {
+			if err := insertEventNotifications(tx, event.ID, notificationEventUpdated, map[string]interface{}{
+				"event_id":    event.ID,
+				"event_title": title,
+				"public":      public,
+				"closed":      closed,
+			}); err != nil {
 				tx.Rollback()
-				log.Println("re-try: rollback by", err)
-				continue
+				return err
 			}
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
 
-			break
+		e, err := getEvent(eventID, -1)
+		if err != nil {
+			return err
 		}
-		return c.JSON(202, echo.Map{
-			"id":         reservationID,
-			"sheet_rank": params.Rank,
-			"sheet_num":  sheet.Num,
-		})
-	}, loginRequired)
-	e.DELETE("/api/events/:id/sheets/:rank/:num/reservation", func(c echo.Context) error {
+		c.JSON(200, e)
+		return nil
+	}, adminRoleRequired(adminRoleEventManager))
+	e.PUT("/admin/api/events/:id/prices", func(c echo.Context) error {
 		eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
 		if err != nil {
 			return resError(c, "not_found", 404)
 		}
-		rank := c.Param("rank")
-		num := c.Param("num")
 
-		user, err := getLoginUser(c)
-		if err != nil {
-			return err
+		var params struct {
+			Ranks  []*PriceOverride `json:"ranks"`
+			Sheets []*PriceOverride `json:"sheets"`
 		}
+		c.Bind(&params)
 
-		event, err := getEvent(eventID, user.ID)
+		event, err := getEvent(eventID, -1)
 		if err != nil {
 			if err == sql.ErrNoRows {
-				return resError(c, "invalid_event", 404)
+				return resError(c, "not_found", 404)
 			}
 			return err
-		} else if !event.PublicFg {
-			return resError(c, "invalid_event", 404)
 		}
-
-		if !validateRank(rank) {
-			return resError(c, "invalid_rank", 404)
+		if event.ClosedFg {
+			return resError(c, "cannot_edit_closed_event", 400)
 		}
 
-		var sheet Sheet
-		if err := db.QueryRow("SELECT * FROM sheets WHERE `rank` = ? AND num = ?", rank, num).Scan(&sheet.ID, &sheet.Rank, &sheet.Num, &sheet.Price); err != nil {
-			if err == sql.ErrNoRows {
-				return resError(c, "invalid_sheet", 404)
+		prices, errCode := validatePriceOverrides(event, params.Ranks, params.Sheets)
+		if errCode != "" {
+			return resError(c, errCode, 400)
+		}
+		if err := replacePriceOverrides(event.ID, prices); err != nil {
+			if err == errEventSold {
+				return resError(c, "cannot_edit_sold_event", 400)
 			}
 			return err
 		}
 
-		tx, err := db.Begin()
+		e, err := getEvent(eventID, -1)
 		if err != nil {
 			return err
 		}
-
-		var reservation Reservation
-		if err := tx.QueryRow("SELECT * FROM reservations WHERE event_id = ? AND sheet_id = ? AND canceled_at IS NULL GROUP BY event_id HAVING reserved_at = MIN(reserved_at) FOR UPDATE", event.ID, sheet.ID).Scan(&reservation.ID, &reservation.EventID, &reservation.SheetID, &reservation.UserID, &reservation.ReservedAt, &reservation.CanceledAt); err != nil {
-			tx.Rollback()
+		return c.JSON(200, e)
+	}, adminRoleRequired(adminRoleEventManager))
+	e.GET("/admin/api/events/:id/limits", func(c echo.Context) error {
+		eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return resError(c, "not_found", 404)
+		}
+		if _, err := getEvent(eventID, -1); err != nil {
 			if err == sql.ErrNoRows {
-				return resError(c, "not_reserved", 400)
+				return resError(c, "not_found", 404)
 			}
 			return err
 		}
-		if reservation.UserID != user.ID {
-			tx.Rollback()
-			return resError(c, "not_permitted", 403)
-		}
 
-		if _, err := tx.Exec("UPDATE reservations SET canceled_at = ? WHERE id = ?", time.Now().UTC().Format("2006-01-02 15:04:05.000000"), reservation.ID); err != nil {
-			tx.Rollback()
+		limits, err := scanPurchaseLimits(db.QueryRow(purchaseLimitsSQL, eventID))
+		if err != nil {
 			return err
 		}
-
-		if err := tx.Commit(); err != nil {
-			return err
+		return c.JSON(200, limits)
+	}, adminLoginRequired)
+	e.PUT("/admin/api/events/:id/limits", func(c echo.Context) error {
+		eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return resError(c, "not_found", 404)
 		}
 
-		return c.NoContent(204)
-	}, loginRequired)
-	e.GET("/admin/", func(c echo.Context) error {
-		var events []*Event
-		administrator := c.Get("administrator")
-		if administrator != nil {
-			var err error
-			if events, err = getEvents(true); err != nil {
-				return err
+		var limits PurchaseLimits
+		c.Bind(&limits)
+
+		event, err := getEvent(eventID, -1)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return resError(c, "not_found", 404)
 			}
+			return err
 		}
-		return c.Render(200, "admin.tmpl", echo.Map{
-			"events":        events,
-			"administrator": administrator,
-			"origin":        c.Scheme() + "://" + c.Request().Host,
-		})
-	}, fillinAdministrator)
-	e.POST("/admin/api/actions/login", func(c echo.Context) error {
-		var params struct {
-			LoginName string `json:"login_name"`
-			Password  string `json:"password"`
+		if event.ClosedFg {
+			return resError(c, "cannot_edit_closed_event", 400)
+		}
+		if errCode := limits.validate(); errCode != "" {
+			return resError(c, errCode, 400)
 		}
-		c.Bind(&params)
 
-		administrator := new(Administrator)
-		if err := db.QueryRow("SELECT * FROM administrators WHERE login_name = ?", params.LoginName).Scan(&administrator.ID, &administrator.LoginName, &administrator.Nickname, &administrator.PassHash); err != nil {
+		if err := replacePurchaseLimits(event.ID, &limits); err != nil {
+			return err
+		}
+		return c.JSON(200, limits)
+	}, adminRoleRequired(adminRoleEventManager))
+	e.POST("/admin/api/events/:id/checkins", func(c echo.Context) error {
+		eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return resError(c, "not_found", 404)
+		}
+		if _, err := getEvent(eventID, -1); err != nil {
 			if err == sql.ErrNoRows {
-				return resError(c, "authentication_failed", 401)
+				return resError(c, "not_found", 404)
 			}
 			return err
 		}
 
-		var passHash string
-		if err := db.QueryRow("SELECT SHA2(?, 256)", params.Password).Scan(&passHash); err != nil {
-			return err
-		}
-		if administrator.PassHash != passHash {
-			return resError(c, "authentication_failed", 401)
+		var params struct {
+			Token string `json:"token"`
 		}
+		c.Bind(&params)
 
-		sessSetAdministratorID(c, administrator.ID)
-		administrator, err = getLoginAdministrator(c)
+		ticket, errCode, err := checkInTicket(eventID, params.Token)
 		if err != nil {
 			return err
 		}
-		return c.JSON(200, administrator)
-	})
-	e.POST("/admin/api/actions/logout", func(c echo.Context) error {
-		sessDeleteAdministratorID(c)
-		return c.NoContent(204)
-	}, adminLoginRequired)
-	e.GET("/admin/api/events", func(c echo.Context) error {
-		events, err := getEvents(true)
+		switch errCode {
+		case "":
+		case "invalid_ticket", "wrong_event":
+			return resError(c, errCode, 400)
+		default:
+			return resError(c, errCode, 409)
+		}
+		c.Set(auditStateKey, echo.Map{
+			"reservation_id": ticket.ReservationID,
+			"checked_in_at":  ticket.CheckedInAtUnix,
+		})
+		return c.JSON(200, ticket)
+	}, adminRoleRequired(adminRoleEventManager))
+	e.DELETE("/admin/api/events/:id", func(c echo.Context) error {
+		eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return resError(c, "not_found", 404)
+		}
+
+		event, err := getEvent(eventID, -1)
 		if err != nil {
+			if err == sql.ErrNoRows {
+				return resError(c, "not_found", 404)
+			}
 			return err
 		}
-		return c.JSON(200, events)
-	}, adminLoginRequired)
-	e.POST("/admin/api/events", func(c echo.Context) error {
-		var params struct {
-			Title  string `json:"title"`
-			Public bool   `json:"public"`
-			Price  int    `json:"price"`
+		if event.PublicFg {
+			return resError(c, "cannot_delete_public_event", 400)
 		}
-		c.Bind(&params)
 
 		tx, err := db.Begin()
 		if err != nil {
 			return err
 		}
-
-		res, err := tx.Exec("INSERT INTO events (title, public_fg, closed_fg, price) VALUES (?, ?, 0, ?)", params.Title, params.Public, params.Price)
-		if err != nil {
+		// Lock the event before the reservations, in the same order as
+		// orders do.
+		var lockedID int64
+		if err := tx.QueryRow("SELECT id FROM events WHERE id = ? FOR UPDATE", event.ID).Scan(&lockedID); err != nil {
 			tx.Rollback()
 			return err
 		}
-		eventID, err := res.LastInsertId()
-		if err != nil {
+		var sold bool
+		if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM reservations WHERE event_id = ? FOR UPDATE)", event.ID).Scan(&sold); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if sold {
+			tx.Rollback()
+			return resError(c, "cannot_delete_sold_event", 400)
+		}
+		if _, err := tx.Exec("UPDATE events SET public_fg = 0, deleted_at = ? WHERE id = ?", time.Now().UTC().Format("2006-01-02 15:04:05.000000"), event.ID); err != nil {
 			tx.Rollback()
 			return err
 		}
@@ -773,74 +2041,199 @@ func main() {
 			return err
 		}
 
-		event, err := getEvent(eventID, -1)
+		return c.NoContent(204)
+	}, adminRoleRequired(adminRoleEventManager))
+	e.GET("/admin/api/audit", func(c echo.Context) error {
+		cond, args, limit, errCode := auditQuery(c)
+		if errCode != "" {
+			return resError(c, errCode, 400)
+		}
+
+		logs, next, err := getAuditLogs(cond, args, limit)
 		if err != nil {
 			return err
 		}
-		return c.JSON(200, event)
-	}, adminLoginRequired)
-	e.GET("/admin/api/events/:id", func(c echo.Context) error {
-		eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+
+		return c.JSON(200, echo.Map{
+			"entries":     logs,
+			"next_cursor": next,
+		})
+	}, adminRoleRequired())
+	e.GET("/admin/api/administrators", func(c echo.Context) error {
+		administrators, err := getAdministrators()
+		if err != nil {
+			return err
+		}
+		return c.JSON(200, administrators)
+	}, adminRoleRequired())
+	e.POST("/admin/api/administrators", func(c echo.Context) error {
+		var params struct {
+			Nickname  string `json:"nickname"`
+			LoginName string `json:"login_name"`
+			Password  string `json:"password"`
+			Role      string `json:"role"`
+		}
+		c.Bind(&params)
+
+		if params.LoginName == "" {
+			return resError(c, "invalid_login_name", 400)
+		}
+		if params.Password == "" || len(params.Password) > maxPasswordLength {
+			return resError(c, "invalid_password", 400)
+		}
+		if !adminRoles[params.Role] {
+			return resError(c, "invalid_role", 400)
+		}
+
+		administrator := &Administrator{Nickname: params.Nickname, LoginName: params.LoginName, Role: params.Role}
+		if err := createAdministrator(administrator, params.Password); err != nil {
+			if err == errAdministratorDuplicated {
+				return resError(c, "duplicated", 409)
+			}
+			return err
+		}
+		return c.JSON(201, administrator)
+	}, adminRoleRequired())
+	e.POST("/admin/api/administrators/:id/actions/edit", func(c echo.Context) error {
+		administratorID, err := strconv.ParseInt(c.Param("id"), 10, 64)
 		if err != nil {
 			return resError(c, "not_found", 404)
 		}
-		event, err := getEvent(eventID, -1)
+
+		var params struct {
+			Nickname *string `json:"nickname"`
+			Role     *string `json:"role"`
+			Password *string `json:"password"`
+		}
+		c.Bind(&params)
+
+		if params.Role != nil && !adminRoles[*params.Role] {
+			return resError(c, "invalid_role", 400)
+		}
+		if params.Password != nil && (*params.Password == "" || len(*params.Password) > maxPasswordLength) {
+			return resError(c, "invalid_password", 400)
+		}
+		// Keep at least the superadmin who is editing.
+		if params.Role != nil && administratorID == sessAdministratorID(c) {
+			return resError(c, "cannot_edit_self", 400)
+		}
+
+		administrator, err := editAdministrator(administratorID, params.Nickname, params.Role, params.Password)
 		if err != nil {
-			if err == sql.ErrNoRows {
+			if err == errAdministratorNotFound {
 				return resError(c, "not_found", 404)
 			}
 			return err
 		}
-		return c.JSON(200, event)
-	}, adminLoginRequired)
-	e.POST("/admin/api/events/:id/actions/edit", func(c echo.Context) error {
-		eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		return c.JSON(200, administrator)
+	}, adminRoleRequired())
+	e.DELETE("/admin/api/administrators/:id", func(c echo.Context) error {
+		administratorID, err := strconv.ParseInt(c.Param("id"), 10, 64)
 		if err != nil {
 			return resError(c, "not_found", 404)
 		}
+		if administratorID == sessAdministratorID(c) {
+			return resError(c, "cannot_edit_self", 400)
+		}
 
+		if err := deleteAdministrator(administratorID); err != nil {
+			if err == errAdministratorNotFound {
+				return resError(c, "not_found", 404)
+			}
+			return err
+		}
+		return c.NoContent(204)
+	}, adminRoleRequired())
+	e.GET("/admin/api/webhooks", func(c echo.Context) error {
+		endpoints, err := getWebhookEndpoints()
+		if err != nil {
+			return err
+		}
+		return c.JSON(200, endpoints)
+	}, adminRoleRequired())
+	e.POST("/admin/api/webhooks", func(c echo.Context) error {
 		var params struct {
-			Public bool `json:"public"`
-			Closed bool `json:"closed"`
+			URL        string   `json:"url"`
+			Secret     string   `json:"secret"`
+			EventTypes []string `json:"event_types"`
 		}
 		c.Bind(&params)
-		if params.Closed {
-			params.Public = false
+
+		endpoint := WebhookEndpoint{URL: params.URL, Secret: params.Secret, EventTypes: params.EventTypes}
+		if endpoint.EventTypes == nil {
+			endpoint.EventTypes = []string{}
+		}
+		if errCode := validateWebhookEndpoint(&endpoint); errCode != "" {
+			return resError(c, errCode, 400)
 		}
 
-		event, err := getEvent(eventID, -1)
+		if err := createWebhookEndpoint(&endpoint); err != nil {
+			return err
+		}
+
+		return c.JSON(201, endpoint)
+	}, adminRoleRequired())
+	e.DELETE("/admin/api/webhooks/:id", func(c echo.Context) error {
+		endpointID, err := strconv.ParseInt(c.Param("id"), 10, 64)
 		if err != nil {
-			if err == sql.ErrNoRows {
+			return resError(c, "not_found", 404)
+		}
+
+		if err := deleteWebhookEndpoint(endpointID); err != nil {
+			if err == errWebhookNotFound {
 				return resError(c, "not_found", 404)
 			}
 			return err
 		}
 
-		if event.ClosedFg {
-			return resError(c, "cannot_edit_closed_event", 400)
-		} else if event.PublicFg && params.Closed {
-			return resError(c, "cannot_close_public_event", 400)
+		return c.NoContent(204)
+	}, adminRoleRequired())
+	e.GET("/admin/api/webhooks/:id/deliveries", func(c echo.Context) error {
+		endpointID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return resError(c, "not_found", 404)
+		}
+		cond, args, limit, errCode := webhookDeliveriesQuery(c)
+		if errCode != "" {
+			return resError(c, errCode, 400)
 		}
 
-		tx, err := db.Begin()
+		deliveries, next, err := getWebhookDeliveries(endpointID, cond, args, limit)
 		if err != nil {
+			if err == errWebhookNotFound {
+				return resError(c, "not_found", 404)
+			}
 			return err
 		}
-		if _, err := tx.Exec("UPDATE events SET public_fg = ?, closed_fg = ? WHERE id = ?", params.Public, params.Closed, event.ID); err != nil {
-			tx.Rollback()
-			return err
+
+		return c.JSON(200, echo.Map{
+			"deliveries":  deliveries,
+			"next_cursor": next,
+		})
+	}, adminRoleRequired())
+	e.POST("/admin/api/webhooks/:id/deliveries/:delivery_id/actions/replay", func(c echo.Context) error {
+		endpointID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return resError(c, "not_found", 404)
 		}
-		if err := tx.Commit(); err != nil {
-			return err
+		deliveryID, err := strconv.ParseInt(c.Param("delivery_id"), 10, 64)
+		if err != nil {
+			return resError(c, "not_found", 404)
 		}
 
-		e, err := getEvent(eventID, -1)
+		delivery, err := replayWebhookDelivery(endpointID, deliveryID)
 		if err != nil {
+			switch err {
+			case errDeliveryNotFound:
+				return resError(c, "not_found", 404)
+			case errDeliveryNotFailed:
+				return resError(c, "not_failed", 409)
+			}
 			return err
 		}
-		c.JSON(200, e)
-		return nil
-	}, adminLoginRequired)
+
+		return c.JSON(200, delivery)
+	}, adminRoleRequired())
 	e.GET("/admin/api/reports/events/:id/sales", func(c echo.Context) error {
 		eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
 		if err != nil {
@@ -852,94 +2245,84 @@ func main() {
 			return err
 		}
 
-		rows, err := db.Query("SELECT r.*, s.rank AS sheet_rank, s.num AS sheet_num, s.price AS sheet_price, e.price AS event_price FROM reservations r INNER JOIN sheets s ON s.id = r.sheet_id INNER JOIN events e ON e.id = r.event_id WHERE r.event_id = ? ORDER BY reserved_at ASC FOR UPDATE", event.ID)
+		cond, args, ok := reportRange(c)
+		if !ok {
+			return resError(c, "invalid_range", 400)
+		}
+		pageCond, pageArgs, limit, ok := reportPage(c)
+		if !ok {
+			return resError(c, "invalid_cursor", 400)
+		}
+
+		args = append(append([]interface{}{event.ID}, args...), pageArgs...)
+		rows, err := db.Query(reportSQL+" WHERE r.event_id = ?"+cond+pageCond+" ORDER BY r.id ASC"+limit, args...)
 		if err != nil {
 			return err
 		}
 		defer rows.Close()
 
-		var reports []Report
-		for rows.Next() {
-			var reservation Reservation
-			var sheet Sheet
-			if err := rows.Scan(&reservation.ID, &reservation.EventID, &reservation.SheetID, &reservation.UserID, &reservation.ReservedAt, &reservation.CanceledAt, &sheet.Rank, &sheet.Num, &sheet.Price, &event.Price); err != nil {
-				return err
-			}
-			report := Report{
-				ReservationID: reservation.ID,
-				EventID:       event.ID,
-				Rank:          sheet.Rank,
-				Num:           sheet.Num,
-				UserID:        reservation.UserID,
-				SoldAt:        reservation.ReservedAt.Format("2006-01-02T15:04:05.000000Z"),
-				Price:         event.Price + sheet.Price,
-			}
-			if reservation.CanceledAt != nil {
-				report.CanceledAt = reservation.CanceledAt.Format("2006-01-02T15:04:05.000000Z")
-			}
-			reports = append(reports, report)
-		}
-		return renderReportCSV(c, reports)
-	}, adminLoginRequired)
+		return renderReport(c, rows)
+	}, adminRoleRequired(adminRoleFinance))
 	e.GET("/admin/api/reports/sales", func(c echo.Context) error {
-		rows, err := db.Query("select r.*, s.rank as sheet_rank, s.num as sheet_num, s.price as sheet_price, e.id as event_id, e.price as event_price from reservations r inner join sheets s on s.id = r.sheet_id inner join events e on e.id = r.event_id order by reserved_at asc for update")
+		cond, args, ok := reportRange(c)
+		if !ok {
+			return resError(c, "invalid_range", 400)
+		}
+		pageCond, pageArgs, limit, ok := reportPage(c)
+		if !ok {
+			return resError(c, "invalid_cursor", 400)
+		}
+
+		// Rows are read in the primary key order without locks, since they
+		// are streamed to the client.
+		rows, err := db.Query(reportSQL+" WHERE 1 = 1"+cond+pageCond+" ORDER BY r.id ASC"+limit, append(args, pageArgs...)...)
 		if err != nil {
 			return err
 		}
 		defer rows.Close()
 
-		var reports []Report
-		for rows.Next() {
-			var reservation Reservation
-			var sheet Sheet
-			var event Event
-			if err := rows.Scan(&reservation.ID, &reservation.EventID, &reservation.SheetID, &reservation.UserID, &reservation.ReservedAt, &reservation.CanceledAt, &sheet.Rank, &sheet.Num, &sheet.Price, &event.ID, &event.Price); err != nil {
-				return err
-			}
-			report := Report{
-				ReservationID: reservation.ID,
-				EventID:       event.ID,
-				Rank:          sheet.Rank,
-				Num:           sheet.Num,
-				UserID:        reservation.UserID,
-				SoldAt:        reservation.ReservedAt.Format("2006-01-02T15:04:05.000000Z"),
-				Price:         event.Price + sheet.Price,
-			}
-			if reservation.CanceledAt != nil {
-				report.CanceledAt = reservation.CanceledAt.Format("2006-01-02T15:04:05.000000Z")
+		return renderReport(c, rows)
+	}, adminRoleRequired(adminRoleFinance))
+	e.GET("/admin/api/reports/sales/changes", func(c echo.Context) error {
+		since, ok := parseChangeCursor(c.QueryParam("since"))
+		if !ok {
+			return resError(c, "invalid_cursor", 400)
+		}
+		limit := defaultChangesLimit
+		if s := c.QueryParam("limit"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n <= 0 || n > maxChangesLimit {
+				return resError(c, "invalid_limit", 400)
 			}
-			reports = append(reports, report)
+			limit = n
 		}
-		return renderReportCSV(c, reports)
-	}, adminLoginRequired)
 
-	e.Start(":8080")
-}
+		changes, next, err := getReservationChanges(since, limit)
+		if err != nil {
+			return err
+		}
 
-type Report struct {
-	ReservationID int64
-	EventID       int64
-	Rank          string
-	Num           int64
-	UserID        int64
-	SoldAt        string
-	CanceledAt    string
-	Price         int64
-}
+		return c.JSON(200, echo.Map{
+			"changes":     changes,
+			"next_cursor": next.String(),
+		})
+	}, adminRoleRequired(adminRoleFinance))
+	e.GET("/admin/api/reports/sales/summary", func(c echo.Context) error {
+		cond, args, ok := reportRange(c)
+		if !ok {
+			return resError(c, "invalid_range", 400)
+		}
 
-func renderReportCSV(c echo.Context, reports []Report) error {
-	sort.Slice(reports, func(i, j int) bool { return strings.Compare(reports[i].SoldAt, reports[j].SoldAt) < 0 })
+		rows, err := db.Query("SELECT r.event_id, s.rank, COUNT(*), SUM(r.canceled_at IS NOT NULL), SUM(IF("+reportChargedSQL+", "+sheetPriceSQL+", 0)), SUM(IF("+reportChargedSQL+" AND r.canceled_at IS NOT NULL, "+sheetPriceSQL+", 0)), SUM(IF("+reportChargedSQL+" AND r.canceled_at IS NULL, "+reportFeeSQL()+", 0))"+reportFromSQL+" WHERE 1 = 1"+cond+" GROUP BY r.event_id, s.rank ORDER BY r.event_id, s.rank", args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
 
-	body := bytes.NewBufferString("reservation_id,event_id,rank,num,price,user_id,sold_at,canceled_at\n")
-	for _, v := range reports {
-		body.WriteString(fmt.Sprintf("%d,%d,%s,%d,%d,%d,%s,%s\n",
-			v.ReservationID, v.EventID, v.Rank, v.Num, v.Price, v.UserID, v.SoldAt, v.CanceledAt))
-	}
+		return renderReportSummaryCSV(c, rows)
+	}, adminRoleRequired(adminRoleFinance))
 
-	c.Response().Header().Set("Content-Type", `text/csv; charset=UTF-8`)
-	c.Response().Header().Set("Content-Disposition", `attachment; filename="report.csv"`)
-	_, err := io.Copy(c.Response(), body)
-	return err
+	e.Start(":8080")
 }
 
 func resError(c echo.Context, e string, status int) error {
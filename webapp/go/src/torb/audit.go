@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+
+	// auditMaxBody bounds the response body kept as the state after an
+	// action which has no snapshot.
+	auditMaxBody = 64 * 1024
+
+	// auditStateKey is where a handler without a snapshot may put the state
+	// after the action, to be recorded instead of the response body.
+	auditStateKey = "audit_state"
+)
+
+// auditSnapshots take the state of what the admin endpoints under the route
+// prefix change, as a JSON object, or nil if it does not exist. The first
+// prefix matching is taken, and a nil snapshot means there is none.
+var auditSnapshots = []struct {
+	prefix   string
+	snapshot func(c echo.Context) (interface{}, error)
+}{
+	// Check-ins change a reservation, which the handler tells.
+	{"/admin/api/events/:id/checkins", nil},
+	{"/admin/api/events/:id", snapshotAuditEvent},
+}
+
+func snapshotAuditEvent(c echo.Context) (interface{}, error) {
+	eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return nil, nil
+	}
+	event, err := getEvent(eventID, -1)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	limits, err := scanPurchaseLimits(db.QueryRow(purchaseLimitsSQL, eventID))
+	if err != nil {
+		return nil, err
+	}
+
+	prices := map[string]int64{}
+	for rank, sheets := range event.Sheets {
+		prices[rank] = sheets.Price
+	}
+	return echo.Map{
+		"title":          event.Title,
+		"public":         event.PublicFg,
+		"closed":         event.ClosedFg,
+		"price":          event.Price,
+		"venue_id":       event.VenueID,
+		"start_at":       event.StartAtUnix,
+		"sales_open_at":  event.SalesOpenAtUnix,
+		"sales_close_at": event.SalesCloseAtUnix,
+		"prices":         prices,
+		"limits":         limits,
+	}, nil
+}
+
+func auditSnapshot(c echo.Context) func(c echo.Context) (interface{}, error) {
+	for _, s := range auditSnapshots {
+		if c.Path() == s.prefix || strings.HasPrefix(c.Path(), s.prefix+"/") {
+			return s.snapshot
+		}
+	}
+	return nil
+}
+
+// auditRecorder keeps the head of the response body.
+type auditRecorder struct {
+	http.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *auditRecorder) Write(b []byte) (int, error) {
+	if n := auditMaxBody - w.body.Len(); n > 0 {
+		if n > len(b) {
+			n = len(b)
+		}
+		w.body.Write(b[:n])
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// auditAdminActions records every request to the admin API but reads, failed
+// or not, with the administrator, the fields changed and the client IP. The
+// actor of a login is the administrator logged in. Request bodies are never
+// recorded, since they may hold passwords.
+func auditAdminActions(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+		if req.Method == "GET" || req.Method == "HEAD" || !strings.HasPrefix(c.Path(), "/admin/api/") {
+			return next(c)
+		}
+
+		administratorID := sessAdministratorID(c)
+		snapshot := auditSnapshot(c)
+		var before interface{}
+		if snapshot != nil {
+			var serr error
+			if before, serr = snapshot(c); serr != nil {
+				log.Println("failed to snapshot for audit:", serr)
+			}
+		}
+
+		res := c.Response()
+		recorder := &auditRecorder{ResponseWriter: res.Writer}
+		res.Writer = recorder
+		// The error is handled here, so that its response is recorded.
+		if err := next(c); err != nil {
+			c.Error(err)
+		}
+		res.Writer = recorder.ResponseWriter
+
+		var after interface{}
+		if snapshot != nil {
+			var serr error
+			if after, serr = snapshot(c); serr != nil {
+				log.Println("failed to snapshot for audit:", serr)
+			}
+		} else if state := c.Get(auditStateKey); state != nil {
+			after = state
+		} else if res.Status < 300 && json.Valid(recorder.body.Bytes()) {
+			after = json.RawMessage(recorder.body.Bytes())
+		}
+		if administratorID == 0 {
+			administratorID = sessAdministratorID(c)
+		}
+
+		diff, derr := auditDiff(before, after)
+		if derr != nil {
+			log.Println("failed to diff for audit:", derr)
+		}
+		if aerr := insertAuditLog(administratorID, req.Method+" "+c.Path(), req.URL.Path, res.Status, diff, c.RealIP()); aerr != nil {
+			log.Println("failed to record audit log:", aerr)
+		}
+		return nil
+	}
+}
+
+type auditChange struct {
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// auditDiff returns the top-level fields of the JSON objects that differ.
+func auditDiff(before, after interface{}) (map[string]*auditChange, error) {
+	b, err := auditFields(before)
+	if err != nil {
+		return nil, err
+	}
+	a, err := auditFields(after)
+	if err != nil {
+		return nil, err
+	}
+
+	diff := map[string]*auditChange{}
+	for k, v := range b {
+		if !reflect.DeepEqual(v, a[k]) {
+			diff[k] = &auditChange{Before: v, After: a[k]}
+		}
+	}
+	for k, v := range a {
+		if _, ok := b[k]; !ok {
+			diff[k] = &auditChange{After: v}
+		}
+	}
+	return diff, nil
+}
+
+func auditFields(v interface{}) (map[string]interface{}, error) {
+	fields := map[string]interface{}{}
+	if v == nil {
+		return fields, nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &fields); err != nil {
+		// not an object
+		return map[string]interface{}{}, nil
+	}
+	return fields, nil
+}
+
+// insertAuditLog appends an entry. Entries are never updated nor deleted.
+func insertAuditLog(administratorID int64, action, path string, status int, diff map[string]*auditChange, remoteIP string) error {
+	if diff == nil {
+		diff = map[string]*auditChange{}
+	}
+	b, err := json.Marshal(diff)
+	if err != nil {
+		return err
+	}
+	var actor interface{}
+	if administratorID != 0 {
+		actor = administratorID
+	}
+	_, err = db.Exec("INSERT INTO audit_logs (administrator_id, action, path, status, diff, remote_ip, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		actor, action, path, status, string(b), remoteIP, time.Now().UTC().Format("2006-01-02 15:04:05.000000"))
+	return err
+}
+
+type AuditLog struct {
+	ID              int64           `json:"id"`
+	AdministratorID *int64          `json:"administrator_id"`
+	Action          string          `json:"action"`
+	Path            string          `json:"path"`
+	Status          int             `json:"status"`
+	Diff            json.RawMessage `json:"diff"`
+	RemoteIP        string          `json:"remote_ip"`
+	CreatedAt       int64           `json:"created_at"`
+}
+
+// auditQuery parses the administrator_id, action, path (a prefix), from and
+// to (unix times) filters and the cursor and limit query parameters of the
+// audit log, which goes back from the latest. It returns the error code for
+// resError if they are invalid.
+func auditQuery(c echo.Context) (string, []interface{}, int, string) {
+	var cond string
+	var args []interface{}
+	if s := c.QueryParam("administrator_id"); s != "" {
+		id, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || id <= 0 {
+			return "", nil, 0, "invalid_administrator_id"
+		}
+		cond += " AND administrator_id = ?"
+		args = append(args, id)
+	}
+	if s := c.QueryParam("action"); s != "" {
+		cond += " AND action = ?"
+		args = append(args, s)
+	}
+	if s := c.QueryParam("path"); s != "" {
+		cond += " AND path LIKE ?"
+		args = append(args, strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)+"%")
+	}
+	var from, to int64
+	for _, p := range []struct {
+		name string
+		op   string
+		v    *int64
+	}{{"from", ">=", &from}, {"to", "<", &to}} {
+		s := c.QueryParam(p.name)
+		if s == "" {
+			continue
+		}
+		v, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || v <= 0 {
+			return "", nil, 0, "invalid_range"
+		}
+		*p.v = v
+		cond += " AND created_at " + p.op + " ?"
+		args = append(args, time.Unix(v, 0).UTC().Format("2006-01-02 15:04:05.000000"))
+	}
+	if from != 0 && to != 0 && from >= to {
+		return "", nil, 0, "invalid_range"
+	}
+	if s := c.QueryParam("cursor"); s != "" {
+		cursor, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || cursor <= 0 {
+			return "", nil, 0, "invalid_cursor"
+		}
+		cond += " AND id < ?"
+		args = append(args, cursor)
+	}
+	limit := defaultAuditLimit
+	if s := c.QueryParam("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 || n > maxAuditLimit {
+			return "", nil, 0, "invalid_limit"
+		}
+		limit = n
+	}
+	return cond, args, limit, ""
+}
+
+// getAuditLogs returns the entries matching cond from the latest, and the
+// cursor to the next page if any.
+func getAuditLogs(cond string, args []interface{}, limit int) ([]*AuditLog, *int64, error) {
+	rows, err := db.Query("SELECT id, administrator_id, action, path, status, diff, remote_ip, created_at FROM audit_logs WHERE 1 = 1"+cond+" ORDER BY id DESC LIMIT ?", append(args, limit+1)...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	logs := []*AuditLog{}
+	for rows.Next() {
+		var entry AuditLog
+		var diff string
+		var createdAt time.Time
+		if err := rows.Scan(&entry.ID, &entry.AdministratorID, &entry.Action, &entry.Path, &entry.Status, &diff, &entry.RemoteIP, &createdAt); err != nil {
+			return nil, nil, err
+		}
+		entry.Diff = json.RawMessage(diff)
+		entry.CreatedAt = createdAt.Unix()
+		logs = append(logs, &entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+	if len(logs) <= limit {
+		return logs, nil, nil
+	}
+	logs = logs[:limit]
+	return logs, &logs[limit-1].ID, nil
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+type sheetReservation struct {
+	ReservationID int64
+	UserID        int64
+	ReservedAt    time.Time
+}
+
+type sheetHold struct {
+	HoldID    int64
+	UserID    int64
+	ExpiresAt time.Time
+}
+
+type sheetKey struct {
+	VenueID int64
+	Rank    string
+	Num     int64
+}
+
+// availabilityIndex keeps the sheet layout of every venue, the price overrides
+// of every event and the active reservation and hold of every (event, sheet)
+// pair in memory, so that reading an event does not need to query reservations
+// sheet by sheet.
+type availabilityIndex struct {
+	mu sync.RWMutex
+
+	venues          map[int64]*venueLayout
+	sheetsByID      map[int64]*Sheet
+	sheetsByRankNum map[sheetKey]*Sheet
+
+	reserved map[int64]map[int64]*sheetReservation // event_id => sheet_id => reservation
+	held     map[int64]map[int64]*sheetHold        // event_id => sheet_id => hold
+	prices   map[int64]*eventPrices                // event_id => price overrides
+}
+
+var availability = &availabilityIndex{}
+
+func (idx *availabilityIndex) load() error {
+	rows, err := db.Query("SELECT id, name FROM venues")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	venues := map[int64]*venueLayout{}
+	for rows.Next() {
+		layout := &venueLayout{}
+		if err := rows.Scan(&layout.ID, &layout.Name); err != nil {
+			return err
+		}
+		venues[layout.ID] = layout
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	rows, err = db.Query("SELECT * FROM sheets ORDER BY venue_id, `rank`, num")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	sheetsByID := map[int64]*Sheet{}
+	sheetsByRankNum := map[sheetKey]*Sheet{}
+	for rows.Next() {
+		var sheet Sheet
+		if err := rows.Scan(&sheet.ID, &sheet.Rank, &sheet.Num, &sheet.Price, &sheet.VenueID, &sheet.Row, &sheet.Column); err != nil {
+			return err
+		}
+		layout, ok := venues[sheet.VenueID]
+		if !ok {
+			continue
+		}
+		layout.sheets = append(layout.sheets, &sheet)
+		sheetsByID[sheet.ID] = &sheet
+		sheetsByRankNum[sheetKey{sheet.VenueID, sheet.Rank, sheet.Num}] = &sheet
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, layout := range venues {
+		layout.sortSheets()
+	}
+
+	rows, err = db.Query("SELECT id, event_id, sheet_id, user_id, reserved_at FROM reservations WHERE canceled_at IS NULL")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	reserved := map[int64]map[int64]*sheetReservation{}
+	for rows.Next() {
+		var eventID, sheetID int64
+		var r sheetReservation
+		if err := rows.Scan(&r.ReservationID, &eventID, &sheetID, &r.UserID, &r.ReservedAt); err != nil {
+			return err
+		}
+		putSheetReservation(reserved, eventID, sheetID, &r)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	rows, err = db.Query("SELECT id, event_id, sheet_id, user_id, expires_at FROM holds WHERE released_at IS NULL")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	held := map[int64]map[int64]*sheetHold{}
+	for rows.Next() {
+		var eventID, sheetID int64
+		var h sheetHold
+		if err := rows.Scan(&h.HoldID, &eventID, &sheetID, &h.UserID, &h.ExpiresAt); err != nil {
+			return err
+		}
+		putSheetHold(held, eventID, sheetID, &h)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	rows, err = db.Query("SELECT event_id, sheet_rank, sheet_id, price FROM event_price_overrides")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	prices := map[int64]*eventPrices{}
+	for rows.Next() {
+		var eventID, sheetID, price int64
+		var rank string
+		if err := rows.Scan(&eventID, &rank, &sheetID, &price); err != nil {
+			return err
+		}
+		p, ok := prices[eventID]
+		if !ok {
+			p = newEventPrices()
+			prices[eventID] = p
+		}
+		if sheetID == 0 {
+			p.ranks[rank] = price
+		} else {
+			p.sheets[sheetID] = price
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.venues = venues
+	idx.sheetsByID = sheetsByID
+	idx.sheetsByRankNum = sheetsByRankNum
+	idx.reserved = reserved
+	idx.held = held
+	idx.prices = prices
+	streams.reset()
+	return nil
+}
+
+// putSheetReservation keeps the earliest active reservation of a sheet, which
+// is the one that owns the sheet.
+func putSheetReservation(reserved map[int64]map[int64]*sheetReservation, eventID, sheetID int64, r *sheetReservation) {
+	sheets, ok := reserved[eventID]
+	if !ok {
+		sheets = map[int64]*sheetReservation{}
+		reserved[eventID] = sheets
+	}
+	if current, ok := sheets[sheetID]; ok && !r.ReservedAt.Before(current.ReservedAt) {
+		return
+	}
+	sheets[sheetID] = r
+}
+
+func (idx *availabilityIndex) reserve(eventID, sheetID, reservationID, userID int64, reservedAt time.Time) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	before := idx.remainsLocked(eventID, idx.venueOfSheetLocked(sheetID))
+	putSheetReservation(idx.reserved, eventID, sheetID, &sheetReservation{
+		ReservationID: reservationID,
+		UserID:        userID,
+		ReservedAt:    reservedAt,
+	})
+	idx.publishLocked(eventID, sheetID, before)
+}
+
+func (idx *availabilityIndex) cancel(eventID, sheetID, reservationID int64) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	before := idx.remainsLocked(eventID, idx.venueOfSheetLocked(sheetID))
+	if r, ok := idx.reserved[eventID][sheetID]; ok && r.ReservationID == reservationID {
+		delete(idx.reserved[eventID], sheetID)
+	}
+	idx.publishLocked(eventID, sheetID, before)
+}
+
+// transfer changes the owner of the reservation, leaving the remains as they
+// are.
+func (idx *availabilityIndex) transfer(eventID, sheetID, reservationID, userID int64) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if r, ok := idx.reserved[eventID][sheetID]; ok && r.ReservationID == reservationID {
+		r.UserID = userID
+	}
+}
+
+// putSheetHold keeps the hold that expires last, since an expired hold no
+// longer blocks the sheet.
+func putSheetHold(held map[int64]map[int64]*sheetHold, eventID, sheetID int64, h *sheetHold) {
+	sheets, ok := held[eventID]
+	if !ok {
+		sheets = map[int64]*sheetHold{}
+		held[eventID] = sheets
+	}
+	if current, ok := sheets[sheetID]; ok && !h.ExpiresAt.After(current.ExpiresAt) {
+		return
+	}
+	sheets[sheetID] = h
+}
+
+func (idx *availabilityIndex) hold(eventID, sheetID, holdID, userID int64, expiresAt time.Time) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	before := idx.remainsLocked(eventID, idx.venueOfSheetLocked(sheetID))
+	putSheetHold(idx.held, eventID, sheetID, &sheetHold{
+		HoldID:    holdID,
+		UserID:    userID,
+		ExpiresAt: expiresAt,
+	})
+	idx.publishLocked(eventID, sheetID, before)
+}
+
+func (idx *availabilityIndex) release(eventID, sheetID, holdID int64) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	before := idx.remainsLocked(eventID, idx.venueOfSheetLocked(sheetID))
+	if h, ok := idx.held[eventID][sheetID]; ok && h.HoldID == holdID {
+		delete(idx.held[eventID], sheetID)
+	}
+	idx.publishLocked(eventID, sheetID, before)
+}
+
+func (idx *availabilityIndex) venueOfSheetLocked(sheetID int64) int64 {
+	if sheet, ok := idx.sheetsByID[sheetID]; ok {
+		return sheet.VenueID
+	}
+	return 0
+}
+
+// publishLocked pushes the remains of the sheet's rank to the event stream.
+func (idx *availabilityIndex) publishLocked(eventID, sheetID int64, before map[string]int) {
+	sheet, ok := idx.sheetsByID[sheetID]
+	if !ok {
+		return
+	}
+	streams.publish(eventID, sheet.Rank, before[sheet.Rank], idx.remainsLocked(eventID, sheet.VenueID)[sheet.Rank])
+}
+
+func (idx *availabilityIndex) remainsLocked(eventID, venueID int64) map[string]int {
+	now := time.Now()
+	reserved := idx.reserved[eventID]
+	held := idx.held[eventID]
+
+	remains := map[string]int{}
+	layout, ok := idx.venues[venueID]
+	if !ok {
+		return remains
+	}
+	for _, rank := range layout.ranks {
+		remains[rank.Rank] = 0
+	}
+	for _, sheet := range layout.sheets {
+		if _, ok := reserved[sheet.ID]; ok {
+			continue
+		}
+		if h, ok := held[sheet.ID]; ok && now.Before(h.ExpiresAt) {
+			continue
+		}
+		remains[sheet.Rank]++
+	}
+	return remains
+}
+
+// subscribe starts streaming remains changes of the event. See
+// streamBroker.subscribe.
+func (idx *availabilityIndex) subscribe(event *Event, lastEventID string) ([]*streamMessage, chan *streamMessage) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	return streams.subscribe(event.ID, lastEventID, idx.remainsLocked(event.ID, event.VenueID))
+}
+
+func (idx *availabilityIndex) validRank(venueID int64, rank string) bool {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	layout, ok := idx.venues[venueID]
+	return ok && layout.rank(rank) != nil
+}
+
+func (idx *availabilityIndex) sheetByID(id int64) (Sheet, bool) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	if sheet, ok := idx.sheetsByID[id]; ok {
+		return *sheet, true
+	}
+	return Sheet{}, false
+}
+
+func (idx *availabilityIndex) sheetByRankNum(venueID int64, rank string, num int64) (Sheet, bool) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	if sheet, ok := idx.sheetsByRankNum[sheetKey{venueID, rank, num}]; ok {
+		return *sheet, true
+	}
+	return Sheet{}, false
+}
+
+// fillSheets sets Total, Remains, Held and Sheets of the event from the index.
+// Held sheets are neither sold nor remaining. Overridden seat prices are set
+// to the sheets in Detail.
+func (idx *availabilityIndex) fillSheets(event *Event, loginUserID int64) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	event.Total = 0
+	event.Remains = 0
+	event.Held = 0
+	event.Sheets = map[string]*Sheets{}
+	layout, ok := idx.venues[event.VenueID]
+	if !ok {
+		return
+	}
+	for _, rank := range layout.ranks {
+		event.Sheets[rank.Rank] = &Sheets{}
+	}
+
+	now := time.Now()
+	reserved := idx.reserved[event.ID]
+	held := idx.held[event.ID]
+	prices := idx.prices[event.ID]
+	for _, s := range layout.sheets {
+		sheet := *s
+		event.Sheets[sheet.Rank].Price = event.Price + sheet.Price
+		if prices != nil {
+			if price, ok := prices.ranks[sheet.Rank]; ok {
+				event.Sheets[sheet.Rank].Price = price
+			}
+			if price, ok := prices.sheets[sheet.ID]; ok {
+				sheet.SeatPrice = &price
+			}
+		}
+		event.Total++
+		event.Sheets[sheet.Rank].Total++
+
+		if r, ok := reserved[sheet.ID]; ok {
+			sheet.Mine = r.UserID == loginUserID
+			sheet.Reserved = true
+			sheet.ReservedAtUnix = r.ReservedAt.Unix()
+		} else if h, ok := held[sheet.ID]; ok && now.Before(h.ExpiresAt) {
+			sheet.Held = true
+			event.Held++
+			event.Sheets[sheet.Rank].Held++
+		} else {
+			event.Remains++
+			event.Sheets[sheet.Rank].Remains++
+		}
+
+		event.Sheets[sheet.Rank].Detail = append(event.Sheets[sheet.Rank].Detail, &sheet)
+	}
+}
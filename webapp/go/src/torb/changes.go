@@ -0,0 +1,139 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	defaultChangesLimit = 1000
+	maxChangesLimit     = 10000
+)
+
+// changeCursor points at a reservation in the order of the changes feed.
+// Reservations never changed since the initial load all have seq 0, so the id
+// breaks ties.
+type changeCursor struct {
+	seq int64
+	id  int64
+}
+
+func (c changeCursor) String() string {
+	return fmt.Sprintf("%d-%d", c.seq, c.id)
+}
+
+func parseChangeCursor(s string) (changeCursor, bool) {
+	var cursor changeCursor
+	if s == "" {
+		return cursor, true
+	}
+	if n, err := fmt.Sscanf(s, "%d-%d", &cursor.seq, &cursor.id); err != nil || n != 2 || cursor.seq < 0 || cursor.id < 0 {
+		return changeCursor{}, false
+	}
+	if cursor.String() != s {
+		return changeCursor{}, false
+	}
+	return cursor, true
+}
+
+// touchReservations stamps the reservations created, canceled or transferred
+// within tx with a new change sequence, which is taken from reservation_changes
+// so that transactions never wait for each other. Sequences may be committed
+// out of order, so the changes feed stops at a sequence not committed yet.
+func touchReservations(tx *sql.Tx, ids ...int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	res, err := tx.Exec("INSERT INTO reservation_changes (changed_at) VALUES (?)", time.Now().UTC().Format("2006-01-02 15:04:05.000000"))
+	if err != nil {
+		return err
+	}
+	seq, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	args := []interface{}{seq}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	_, err = tx.Exec("UPDATE reservations SET change_seq = ? WHERE id IN (?"+strings.Repeat(", ?", len(ids)-1)+")", args...)
+	return err
+}
+
+// committedChangeSeq returns the sequence up to which every change after seq
+// has been committed or rolled back. A missing sequence has been taken by a
+// transaction which began before the sequences were read, so it is still in
+// progress as long as any transaction that old is open, and rolled back
+// otherwise.
+func committedChangeSeq(seq int64) (int64, error) {
+	rows, err := db.Query("SELECT id FROM reservation_changes WHERE id > ? ORDER BY id LIMIT ?", seq, maxChangesLimit)
+	if err != nil {
+		return seq, err
+	}
+	defer rows.Close()
+
+	committed, last := seq, seq
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return seq, err
+		}
+		if committed == last && id == last+1 {
+			committed = id
+		}
+		last = id
+	}
+	if err := rows.Err(); err != nil {
+		return seq, err
+	}
+	if committed == last {
+		return committed, nil
+	}
+
+	// Compare in the clock and the time zone of the server.
+	var readAt time.Time
+	if err := db.QueryRow("SELECT NOW(6)").Scan(&readAt); err != nil {
+		return seq, err
+	}
+	var inProgress bool
+	if err := db.QueryRow("SELECT EXISTS (SELECT * FROM information_schema.innodb_trx WHERE trx_started <= ? AND trx_mysql_thread_id <> CONNECTION_ID())", readAt.Format("2006-01-02 15:04:05.000000")).Scan(&inProgress); err != nil {
+		return seq, err
+	}
+	if inProgress {
+		return committed, nil
+	}
+	return last, nil
+}
+
+// getReservationChanges returns the current state of the reservations created
+// or canceled after the cursor, and the cursor to continue from.
+func getReservationChanges(since changeCursor, limit int) ([]*Report, changeCursor, error) {
+	committed, err := committedChangeSeq(since.seq)
+	if err != nil {
+		return nil, since, err
+	}
+	rows, err := db.Query("SELECT "+reportColumnsSQL+", r.change_seq"+reportFromSQL+" WHERE (r.change_seq > ? OR (r.change_seq = ? AND r.id > ?)) AND r.change_seq <= ? ORDER BY r.change_seq, r.id LIMIT ?", since.seq, since.seq, since.id, committed, limit)
+	if err != nil {
+		return nil, since, err
+	}
+	defer rows.Close()
+
+	next := since
+	changes := []*Report{}
+	for rows.Next() {
+		report, err := scanReport(rows, &next.seq)
+		if err != nil {
+			return nil, since, err
+		}
+		next.id = report.ReservationID
+		changes = append(changes, report)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, since, err
+	}
+	return changes, next, nil
+}
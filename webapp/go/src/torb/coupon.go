@@ -0,0 +1,153 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"regexp"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+const (
+	couponKindPercent = "percent"
+	couponKindFixed   = "fixed"
+)
+
+var (
+	errInvalidCoupon       = errors.New("invalid coupon")
+	errCouponExpired       = errors.New("coupon expired")
+	errCouponLimitExceeded = errors.New("coupon limit exceeded")
+	errCouponDuplicated    = errors.New("coupon duplicated")
+)
+
+var couponCodeRegexp = regexp.MustCompile(`^[0-9A-Za-z_-]{1,64}$`)
+
+type Coupon struct {
+	ID           int64      `json:"id"`
+	Code         string     `json:"code"`
+	Kind         string     `json:"kind"`
+	Amount       int64      `json:"amount"`
+	PerUserLimit int        `json:"per_user_limit"`
+	ExpiresAt    *time.Time `json:"-"`
+	CreatedAt    *time.Time `json:"-"`
+
+	ExpiresAtUnix int64 `json:"expires_at,omitempty"`
+}
+
+// apply returns the discounted price, which is never negative.
+func (c *Coupon) apply(price int64) int64 {
+	switch c.Kind {
+	case couponKindPercent:
+		return price * (100 - c.Amount) / 100
+	case couponKindFixed:
+		if price < c.Amount {
+			return 0
+		}
+		return price - c.Amount
+	}
+	return price
+}
+
+// validateCoupon returns the error code for resError if the coupon definition
+// is invalid.
+func validateCoupon(coupon *Coupon) string {
+	if !couponCodeRegexp.MatchString(coupon.Code) {
+		return "invalid_code"
+	}
+	switch coupon.Kind {
+	case couponKindPercent:
+		if coupon.Amount <= 0 || coupon.Amount > 100 {
+			return "invalid_amount"
+		}
+	case couponKindFixed:
+		if coupon.Amount <= 0 {
+			return "invalid_amount"
+		}
+	default:
+		return "invalid_kind"
+	}
+	if coupon.PerUserLimit < 0 {
+		return "invalid_limit"
+	}
+	if coupon.ExpiresAtUnix < 0 {
+		return "invalid_expires_at"
+	}
+	return ""
+}
+
+// createCoupon returns errCouponDuplicated if the code is already taken.
+func createCoupon(coupon *Coupon) error {
+	createdAt := time.Now().UTC().Truncate(time.Microsecond)
+	var expiresAt interface{}
+	if coupon.ExpiresAtUnix != 0 {
+		t := time.Unix(coupon.ExpiresAtUnix, 0).UTC()
+		coupon.ExpiresAt = &t
+		expiresAt = t.Format("2006-01-02 15:04:05.000000")
+	}
+
+	res, err := db.Exec("INSERT INTO coupons (code, kind, amount, per_user_limit, expires_at, created_at) VALUES (?, ?, ?, ?, ?, ?)", coupon.Code, coupon.Kind, coupon.Amount, coupon.PerUserLimit, expiresAt, createdAt.Format("2006-01-02 15:04:05.000000"))
+	if err != nil {
+		// The unique key on code decides, so that concurrent creations race
+		// safely.
+		if merr, ok := err.(*mysql.MySQLError); ok && merr.Number == 1062 {
+			return errCouponDuplicated
+		}
+		return err
+	}
+	coupon.ID, err = res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	coupon.CreatedAt = &createdAt
+	return nil
+}
+
+func getCoupons() ([]*Coupon, error) {
+	rows, err := db.Query("SELECT id, code, kind, amount, per_user_limit, expires_at, created_at FROM coupons ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	coupons := []*Coupon{}
+	for rows.Next() {
+		var coupon Coupon
+		if err := rows.Scan(&coupon.ID, &coupon.Code, &coupon.Kind, &coupon.Amount, &coupon.PerUserLimit, &coupon.ExpiresAt, &coupon.CreatedAt); err != nil {
+			return nil, err
+		}
+		if coupon.ExpiresAt != nil {
+			coupon.ExpiresAtUnix = coupon.ExpiresAt.Unix()
+		}
+		coupons = append(coupons, &coupon)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return coupons, nil
+}
+
+// lockCoupon locks the coupon of the code within tx and checks that the user
+// can use it for uses more sheets. Canceled reservations do not count.
+func lockCoupon(tx *sql.Tx, code string, userID int64, uses int) (*Coupon, error) {
+	var coupon Coupon
+	if err := tx.QueryRow("SELECT id, code, kind, amount, per_user_limit, expires_at FROM coupons WHERE code = ? FOR UPDATE", code).Scan(&coupon.ID, &coupon.Code, &coupon.Kind, &coupon.Amount, &coupon.PerUserLimit, &coupon.ExpiresAt); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errInvalidCoupon
+		}
+		return nil, err
+	}
+	if coupon.ExpiresAt != nil && !time.Now().Before(*coupon.ExpiresAt) {
+		return nil, errCouponExpired
+	}
+	if coupon.PerUserLimit > 0 {
+		var used int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM reservations WHERE coupon_id = ? AND user_id = ? AND canceled_at IS NULL", coupon.ID, userID).Scan(&used); err != nil {
+			return nil, err
+		}
+		if used+uses > coupon.PerUserLimit {
+			return nil, errCouponLimitExceeded
+		}
+	}
+	return &coupon, nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+const dashboardTopBuyers = 5
+
+// dashboardWindows are the periods over which the sales velocity is counted.
+var dashboardWindows = []struct {
+	name     string
+	duration time.Duration
+}{
+	{"1m", time.Minute},
+	{"5m", 5 * time.Minute},
+	{"1h", time.Hour},
+}
+
+// DashboardSales counts the reservations made, including those canceled
+// later. Revenue is the price of those not canceled.
+type DashboardSales struct {
+	Sold     int   `json:"sold"`
+	Canceled int   `json:"canceled"`
+	Remains  int   `json:"remains"`
+	Revenue  int64 `json:"revenue"`
+}
+
+type DashboardBuyer struct {
+	UserID   int64  `json:"user_id"`
+	Nickname string `json:"nickname"`
+	Sheets   int    `json:"sheets"`
+	Amount   int64  `json:"amount"`
+}
+
+type DashboardEvent struct {
+	ID       int64  `json:"id"`
+	Title    string `json:"title"`
+	PublicFg bool   `json:"public"`
+	ClosedFg bool   `json:"closed"`
+
+	DashboardSales
+	Ranks     map[string]*DashboardSales `json:"ranks"`
+	Velocity  map[string]int             `json:"velocity"`
+	TopBuyers []*DashboardBuyer          `json:"top_buyers"`
+}
+
+// getDashboard aggregates the sales of the events not closed as of now. Closed
+// events are left to the reports, so that only the reservations of the events
+// on sale are scanned.
+func getDashboard(now time.Time) ([]*DashboardEvent, error) {
+	events, err := getEvents(true)
+	if err != nil {
+		return nil, err
+	}
+
+	dashboard := []*DashboardEvent{}
+	eventsByID := map[int64]*DashboardEvent{}
+	var eventIDs []interface{}
+	for _, event := range events {
+		if event.ClosedFg {
+			continue
+		}
+		de := &DashboardEvent{
+			ID:        event.ID,
+			Title:     event.Title,
+			PublicFg:  event.PublicFg,
+			ClosedFg:  event.ClosedFg,
+			Ranks:     map[string]*DashboardSales{},
+			Velocity:  map[string]int{},
+			TopBuyers: []*DashboardBuyer{},
+		}
+		de.Remains = event.Remains
+		for rank, sheets := range event.Sheets {
+			de.Ranks[rank] = &DashboardSales{Remains: sheets.Remains}
+		}
+		for _, w := range dashboardWindows {
+			de.Velocity[w.name] = 0
+		}
+		dashboard = append(dashboard, de)
+		eventsByID[event.ID] = de
+		eventIDs = append(eventIDs, event.ID)
+	}
+	if len(eventIDs) == 0 {
+		return dashboard, nil
+	}
+	inEvents := "(?" + strings.Repeat(", ?", len(eventIDs)-1) + ")"
+
+	rows, err := db.Query("SELECT r.event_id, s.rank, COUNT(*), SUM(r.canceled_at IS NOT NULL), IFNULL(SUM(IF(r.canceled_at IS NULL, "+sheetPriceSQL+", 0)), 0)"+reportFromSQL+" WHERE r.event_id IN "+inEvents+" GROUP BY r.event_id, s.rank", eventIDs...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var eventID int64
+		var rank string
+		var sales DashboardSales
+		if err := rows.Scan(&eventID, &rank, &sales.Sold, &sales.Canceled, &sales.Revenue); err != nil {
+			return nil, err
+		}
+		de, ok := eventsByID[eventID]
+		if !ok {
+			continue
+		}
+		if rs, ok := de.Ranks[rank]; ok {
+			sales.Remains = rs.Remains
+		}
+		de.Ranks[rank] = &sales
+		de.Sold += sales.Sold
+		de.Canceled += sales.Canceled
+		de.Revenue += sales.Revenue
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// The windows are given from the shortest, so the last one bounds the scan.
+	var cols string
+	var args []interface{}
+	for _, w := range dashboardWindows {
+		cols += ", SUM(reserved_at >= ?)"
+		args = append(args, now.Add(-w.duration).UTC().Format("2006-01-02 15:04:05.000000"))
+	}
+	args = append(append(args, args[len(args)-1]), eventIDs...)
+	rows, err = db.Query("SELECT event_id"+cols+" FROM reservations WHERE reserved_at >= ? AND event_id IN "+inEvents+" GROUP BY event_id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var eventID int64
+		counts := make([]int, len(dashboardWindows))
+		dest := []interface{}{&eventID}
+		for i := range counts {
+			dest = append(dest, &counts[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		de, ok := eventsByID[eventID]
+		if !ok {
+			continue
+		}
+		for i, w := range dashboardWindows {
+			de.Velocity[w.name] = counts[i]
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = db.Query("SELECT r.event_id, r.user_id, u.nickname, COUNT(*), SUM("+sheetPriceSQL+")"+reportFromSQL+" INNER JOIN users u ON u.id = r.user_id WHERE r.event_id IN "+inEvents+" AND r.canceled_at IS NULL GROUP BY r.event_id, r.user_id", eventIDs...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var eventID int64
+		var buyer DashboardBuyer
+		if err := rows.Scan(&eventID, &buyer.UserID, &buyer.Nickname, &buyer.Sheets, &buyer.Amount); err != nil {
+			return nil, err
+		}
+		de, ok := eventsByID[eventID]
+		if !ok {
+			continue
+		}
+		de.TopBuyers = append(de.TopBuyers, &buyer)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, de := range dashboard {
+		buyers := de.TopBuyers
+		sort.Slice(buyers, func(i, j int) bool {
+			if buyers[i].Sheets != buyers[j].Sheets {
+				return buyers[i].Sheets > buyers[j].Sheets
+			}
+			if buyers[i].Amount != buyers[j].Amount {
+				return buyers[i].Amount > buyers[j].Amount
+			}
+			return buyers[i].UserID < buyers[j].UserID
+		})
+		if len(buyers) > dashboardTopBuyers {
+			de.TopBuyers = buyers[:dashboardTopBuyers]
+		}
+	}
+	return dashboard, nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"database/sql"
+	"strconv"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	defaultHistoryLimit = 20
+	maxHistoryLimit     = 100
+)
+
+// userReservationSQL selects the rows scanned by scanUserReservations, given
+// reservations r.
+const userReservationSQL = "SELECT r.id, r.event_id, r.sheet_id, r.user_id, r.reserved_at, r.canceled_at, s.rank AS sheet_rank, s.num AS sheet_num, " + sheetPriceSQL + " AS price FROM reservations r INNER JOIN sheets s ON s.id = r.sheet_id INNER JOIN events e ON e.id = r.event_id " + sheetPriceJoinSQL
+
+// historyPage is a page of the history of a user, which goes back from the
+// latest. Cursor is the id to go back from, exclusive, or 0 for the latest.
+type historyPage struct {
+	cursor int64
+	limit  int
+	cond   string
+}
+
+// parseHistoryPage parses the cursor, limit and status query parameters. It
+// returns the error code for resError if they are invalid.
+func parseHistoryPage(c echo.Context) (*historyPage, string) {
+	page := &historyPage{limit: defaultHistoryLimit}
+	if s := c.QueryParam("cursor"); s != "" {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || n <= 0 {
+			return nil, "invalid_cursor"
+		}
+		page.cursor = n
+	}
+	if s := c.QueryParam("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 || n > maxHistoryLimit {
+			return nil, "invalid_limit"
+		}
+		page.limit = n
+	}
+	switch c.QueryParam("status") {
+	case "":
+	case "active":
+		page.cond = " AND r.canceled_at IS NULL"
+	case "canceled":
+		page.cond = " AND r.canceled_at IS NOT NULL"
+	default:
+		return nil, "invalid_status"
+	}
+	return page, ""
+}
+
+// where returns the condition on the column the page goes back by.
+func (p *historyPage) where(column string) (string, []interface{}) {
+	if p.cursor == 0 {
+		return p.cond, nil
+	}
+	return " AND " + column + " < ?" + p.cond, []interface{}{p.cursor}
+}
+
+// scanUserReservations scans rows of userReservationSQL with their events,
+// leaving out the sheets of the events.
+func scanUserReservations(rows *sql.Rows) ([]Reservation, error) {
+	events := map[int64]*Event{}
+	reservations := []Reservation{}
+	for rows.Next() {
+		var reservation Reservation
+		if err := rows.Scan(&reservation.ID, &reservation.EventID, &reservation.SheetID, &reservation.UserID, &reservation.ReservedAt, &reservation.CanceledAt, &reservation.SheetRank, &reservation.SheetNum, &reservation.Price); err != nil {
+			return nil, err
+		}
+
+		event, ok := events[reservation.EventID]
+		if !ok {
+			var err error
+			event, err = getEvent(reservation.EventID, -1)
+			if err != nil {
+				return nil, err
+			}
+			event.Sheets = nil
+			event.Total = 0
+			event.Remains = 0
+			event.Held = 0
+			events[reservation.EventID] = event
+		}
+
+		reservation.Event = event
+		reservation.ReservedAtUnix = reservation.ReservedAt.Unix()
+		if reservation.CanceledAt != nil {
+			reservation.CanceledAtUnix = reservation.CanceledAt.Unix()
+		}
+		reservations = append(reservations, reservation)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return reservations, nil
+}
+
+// getUserReservations returns a page of the reservations of the user from the
+// latest made, and the cursor to the next page if any.
+func getUserReservations(userID int64, page *historyPage) ([]Reservation, *int64, error) {
+	cond, args := page.where("r.id")
+	rows, err := db.Query(userReservationSQL+" WHERE r.user_id = ?"+cond+" ORDER BY r.id DESC LIMIT ?", append(append([]interface{}{userID}, args...), page.limit+1)...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	reservations, err := scanUserReservations(rows)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(reservations) <= page.limit {
+		return reservations, nil, nil
+	}
+	reservations = reservations[:page.limit]
+	return reservations, &reservations[page.limit-1].ID, nil
+}
+
+// getUserEvents returns a page of the events the user has reserved in, from
+// the latest id, and the cursor to the next page if any. The status filters
+// the reservations the events are picked by.
+func getUserEvents(userID int64, page *historyPage) ([]*Event, *int64, error) {
+	cond, args := page.where("r.event_id")
+	rows, err := db.Query("SELECT r.event_id FROM reservations r WHERE r.user_id = ?"+cond+" GROUP BY r.event_id ORDER BY r.event_id DESC LIMIT ?", append(append([]interface{}{userID}, args...), page.limit+1)...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	var eventIDs []int64
+	for rows.Next() {
+		var eventID int64
+		if err := rows.Scan(&eventID); err != nil {
+			return nil, nil, err
+		}
+		eventIDs = append(eventIDs, eventID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	var next *int64
+	if len(eventIDs) > page.limit {
+		eventIDs = eventIDs[:page.limit]
+		next = &eventIDs[page.limit-1]
+	}
+
+	events := make([]*Event, 0, len(eventIDs))
+	for _, eventID := range eventIDs {
+		event, err := getEvent(eventID, -1)
+		if err != nil {
+			return nil, nil, err
+		}
+		for k := range event.Sheets {
+			event.Sheets[k].Detail = nil
+		}
+		events = append(events, event)
+	}
+	return events, next, nil
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	defaultHoldMinutes = 10
+	maxHoldMinutes     = 30
+
+	holdReapInterval = 5 * time.Second
+)
+
+var (
+	errHoldExpired  = errors.New("hold expired")
+	errNotHolder    = errors.New("not holder")
+	errInvalidEvent = errors.New("invalid event")
+	errSalesNotOpen = errors.New("sales not open")
+	errSalesClosed  = errors.New("sales closed")
+)
+
+type Hold struct {
+	ID        int64      `json:"id"`
+	EventID   int64      `json:"-"`
+	SheetID   int64      `json:"-"`
+	UserID    int64      `json:"-"`
+	HeldAt    *time.Time `json:"-"`
+	ExpiresAt *time.Time `json:"-"`
+
+	SheetRank     string `json:"sheet_rank"`
+	SheetNum      int64  `json:"sheet_num"`
+	ExpiresAtUnix int64  `json:"expires_at"`
+}
+
+// holdSheet holds a sheet of the rank for the duration. If selected is nil a
+// free sheet is picked randomly, otherwise it returns errAlreadyReserved when
+// the selected sheet is taken. Holds are subject to the purchase limits of the
+// event, as reservations are.
+func holdSheet(eventID, venueID, userID int64, rank string, selected *Sheet, duration time.Duration) (*Hold, error) {
+	for {
+		var sheet Sheet
+		if selected != nil {
+			sheet = *selected
+		} else {
+			sheets, err := pickFreeSheets(eventID, venueID, rank, 1)
+			if err != nil {
+				return nil, err
+			}
+			sheet = sheets[0]
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return nil, err
+		}
+
+		free, err := lockFreeSheets(tx, eventID, []Sheet{sheet})
+		if err != nil {
+			tx.Rollback()
+			if selected != nil {
+				return nil, err
+			}
+			log.Println("re-try: rollback by", err)
+			continue
+		}
+		if !free {
+			tx.Rollback()
+			if selected != nil {
+				return nil, errAlreadyReserved
+			}
+			log.Println("re-try: sheets have been taken")
+			continue
+		}
+
+		if err := checkPurchaseLimits(tx, eventID, userID, 1); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		hold, err := insertHold(tx, eventID, userID, sheet, duration)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		if err := tx.Commit(); err != nil {
+			return nil, err
+		}
+
+		availability.hold(hold.EventID, hold.SheetID, hold.ID, hold.UserID, *hold.ExpiresAt)
+		return hold, nil
+	}
+}
+
+func insertHold(tx *sql.Tx, eventID, userID int64, sheet Sheet, duration time.Duration) (*Hold, error) {
+	heldAt := time.Now().UTC().Truncate(time.Microsecond)
+	expiresAt := heldAt.Add(duration)
+	res, err := tx.Exec("INSERT INTO holds (event_id, sheet_id, user_id, held_at, expires_at) VALUES (?, ?, ?, ?, ?)", eventID, sheet.ID, userID, heldAt.Format("2006-01-02 15:04:05.000000"), expiresAt.Format("2006-01-02 15:04:05.000000"))
+	if err != nil {
+		return nil, err
+	}
+	holdID, err := res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	return &Hold{
+		ID:            holdID,
+		EventID:       eventID,
+		SheetID:       sheet.ID,
+		UserID:        userID,
+		HeldAt:        &heldAt,
+		ExpiresAt:     &expiresAt,
+		SheetRank:     sheet.Rank,
+		SheetNum:      sheet.Num,
+		ExpiresAtUnix: expiresAt.Unix(),
+	}, nil
+}
+
+// confirmHold turns an active hold of the user into an order. It returns
+// sql.ErrNoRows for an unknown hold, errNotHolder if somebody else holds it and
+// errHoldExpired if it has been expired or released. As reservations do, it
+// returns errInvalidEvent if the event is no longer public, and
+// errSalesNotOpen or errSalesClosed outside its sales window. It returns
+// errPaymentFailed if the payment is declined.
+func confirmHold(holdID, userID int64) (*Order, error) {
+	var sheetID int64
+	if err := db.QueryRow("SELECT sheet_id FROM holds WHERE id = ?", holdID).Scan(&sheetID); err != nil {
+		return nil, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	// Lock the sheet before the hold, in the same order as reservations do,
+	// so that the sheet can not be reserved by others just after expiry.
+	var sheet Sheet
+	if err := tx.QueryRow("SELECT * FROM sheets WHERE id = ? FOR UPDATE", sheetID).Scan(&sheet.ID, &sheet.Rank, &sheet.Num, &sheet.Price, &sheet.VenueID, &sheet.Row, &sheet.Column); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	var hold Hold
+	var releasedAt *time.Time
+	if err := tx.QueryRow("SELECT id, event_id, user_id, expires_at, released_at FROM holds WHERE id = ? FOR UPDATE", holdID).Scan(&hold.ID, &hold.EventID, &hold.UserID, &hold.ExpiresAt, &releasedAt); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if hold.UserID != userID {
+		tx.Rollback()
+		return nil, errNotHolder
+	}
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	if releasedAt != nil || !now.Before(*hold.ExpiresAt) {
+		tx.Rollback()
+		return nil, errHoldExpired
+	}
+
+	event := &Event{}
+	if err := tx.QueryRow("SELECT * FROM events WHERE id = ? AND deleted_at IS NULL", hold.EventID).Scan(&event.ID, &event.Title, &event.PublicFg, &event.ClosedFg, &event.Price, &event.VenueID, &event.StartAt, &event.SalesOpenAt, &event.SalesCloseAt, &event.DeletedAt); err != nil {
+		tx.Rollback()
+		if err == sql.ErrNoRows {
+			return nil, errInvalidEvent
+		}
+		return nil, err
+	}
+	if !event.PublicFg {
+		tx.Rollback()
+		return nil, errInvalidEvent
+	}
+	switch event.salesError(now) {
+	case "sales_not_open":
+		tx.Rollback()
+		return nil, errSalesNotOpen
+	case "sales_closed":
+		tx.Rollback()
+		return nil, errSalesClosed
+	}
+
+	// Release the hold first, so that it is not counted besides its own
+	// reservation by the purchase limits.
+	if _, err := tx.Exec("UPDATE holds SET released_at = ? WHERE id = ?", now.Format("2006-01-02 15:04:05.000000"), hold.ID); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := checkPurchaseLimits(tx, hold.EventID, userID, 1); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	order, err := insertOrder(tx, event, userID, []Sheet{sheet}, nil)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	r := order.Reservations[0]
+	if _, err := tx.Exec("UPDATE holds SET reservation_id = ? WHERE id = ?", r.ID, hold.ID); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	availability.reserve(r.EventID, r.SheetID, r.ID, r.UserID, *r.ReservedAt)
+	availability.release(hold.EventID, sheet.ID, hold.ID)
+	if err := payOrder(order); err != nil {
+		return nil, err
+	}
+	return order, nil
+}
+
+// releaseExpiredHolds marks expired holds as released, drops them from the
+// availability index and offers the sheets to the waitlist.
+func releaseExpiredHolds() error {
+	now := time.Now().UTC().Format("2006-01-02 15:04:05.000000")
+	rows, err := db.Query("SELECT id, event_id, sheet_id FROM holds WHERE released_at IS NULL AND expires_at <= ?", now)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var holds []Hold
+	for rows.Next() {
+		var hold Hold
+		if err := rows.Scan(&hold.ID, &hold.EventID, &hold.SheetID); err != nil {
+			return err
+		}
+		holds = append(holds, hold)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, hold := range holds {
+		if err := releaseExpiredHold(hold, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func releaseExpiredHold(hold Hold, now string) error {
+	sheet, ok := availability.sheetByID(hold.SheetID)
+	if !ok {
+		return fmt.Errorf("unknown sheet %d of hold %d", hold.SheetID, hold.ID)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	var sheetID int64
+	if err := tx.QueryRow("SELECT id FROM sheets WHERE id = ? FOR UPDATE", sheet.ID).Scan(&sheetID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	res, err := tx.Exec("UPDATE holds SET released_at = ? WHERE id = ? AND released_at IS NULL", now, hold.ID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		// confirmed in the meantime
+		tx.Rollback()
+		return err
+	}
+
+	offered, err := offerSheetToWaitlist(tx, hold.EventID, sheet)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	availability.release(hold.EventID, hold.SheetID, hold.ID)
+	if offered != nil {
+		availability.hold(offered.EventID, offered.SheetID, offered.ID, offered.UserID, *offered.ExpiresAt)
+	}
+	return nil
+}
+
+func reapExpiredHolds() {
+	for range time.Tick(holdReapInterval) {
+		if err := releaseExpiredHolds(); err != nil {
+			log.Println("failed to release expired holds:", err)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+var (
+	errSheetLimitExceeded     = errors.New("sheet limit exceeded")
+	errReservationRateLimited = errors.New("reservation rate limited")
+	errCancelCooldown         = errors.New("cancel cooldown")
+)
+
+// PurchaseLimits restricts what a user can buy in an event. Zero means
+// unlimited. Windows and cooldowns are in seconds.
+type PurchaseLimits struct {
+	MaxSheets         int64 `json:"max_sheets"`
+	MaxReservations   int64 `json:"max_reservations"`
+	ReservationWindow int64 `json:"reservation_window"`
+	MaxCancels        int64 `json:"max_cancels"`
+	CancelCooldown    int64 `json:"cancel_cooldown"`
+}
+
+func (l *PurchaseLimits) unlimited() bool {
+	return l.MaxSheets == 0 && l.MaxReservations == 0 && l.MaxCancels == 0
+}
+
+// validate returns the error code for resError if the limits are invalid.
+func (l *PurchaseLimits) validate() string {
+	if l.MaxSheets < 0 || l.MaxReservations < 0 || l.ReservationWindow < 0 || l.MaxCancels < 0 || l.CancelCooldown < 0 {
+		return "invalid_limits"
+	}
+	if (l.MaxReservations > 0) != (l.ReservationWindow > 0) {
+		return "invalid_limits"
+	}
+	if (l.MaxCancels > 0) != (l.CancelCooldown > 0) {
+		return "invalid_limits"
+	}
+	return ""
+}
+
+const purchaseLimitsSQL = "SELECT max_sheets, max_reservations, reservation_window, max_cancels, cancel_cooldown FROM event_purchase_limits WHERE event_id = ?"
+
+// scanPurchaseLimits scans a row of purchaseLimitsSQL. An event without the
+// row is unlimited.
+func scanPurchaseLimits(row *sql.Row) (*PurchaseLimits, error) {
+	var l PurchaseLimits
+	if err := row.Scan(&l.MaxSheets, &l.MaxReservations, &l.ReservationWindow, &l.MaxCancels, &l.CancelCooldown); err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	return &l, nil
+}
+
+func replacePurchaseLimits(eventID int64, l *PurchaseLimits) error {
+	if l.unlimited() {
+		_, err := db.Exec("DELETE FROM event_purchase_limits WHERE event_id = ?", eventID)
+		return err
+	}
+	_, err := db.Exec("INSERT INTO event_purchase_limits (event_id, max_sheets, max_reservations, reservation_window, max_cancels, cancel_cooldown) VALUES (?, ?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE max_sheets = VALUES(max_sheets), max_reservations = VALUES(max_reservations), reservation_window = VALUES(reservation_window), max_cancels = VALUES(max_cancels), cancel_cooldown = VALUES(cancel_cooldown)",
+		eventID, l.MaxSheets, l.MaxReservations, l.ReservationWindow, l.MaxCancels, l.CancelCooldown)
+	return err
+}
+
+// checkPurchaseLimits reports whether the user may reserve or hold n more
+// sheets of the event within tx. Active holds count toward MaxSheets as
+// reservations do. It locks the user after the sheets, so that reservations
+// and holds of the same user are serialized, and counts with a locking read
+// to see those committed meanwhile. A user who has canceled MaxCancels times
+// within the last CancelCooldown seconds is in cooldown, which is told before
+// the other limits.
+func checkPurchaseLimits(tx *sql.Tx, eventID, userID int64, n int) error {
+	limits, err := scanPurchaseLimits(tx.QueryRow(purchaseLimitsSQL, eventID))
+	if err != nil {
+		return err
+	}
+	if limits.unlimited() {
+		return nil
+	}
+
+	var id int64
+	if err := tx.QueryRow("SELECT id FROM users WHERE id = ? FOR UPDATE", userID).Scan(&id); err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	var sheets, recent, canceled int64
+	if err := tx.QueryRow("SELECT IFNULL(SUM(canceled_at IS NULL), 0), IFNULL(SUM(reserved_at >= ?), 0), IFNULL(SUM(canceled_at >= ?), 0) FROM reservations WHERE user_id = ? AND event_id = ? LOCK IN SHARE MODE",
+		now.Add(-time.Duration(limits.ReservationWindow)*time.Second).Format("2006-01-02 15:04:05.000000"),
+		now.Add(-time.Duration(limits.CancelCooldown)*time.Second).Format("2006-01-02 15:04:05.000000"),
+		userID, eventID).Scan(&sheets, &recent, &canceled); err != nil {
+		return err
+	}
+	var held int64
+	if err := tx.QueryRow("SELECT COUNT(*) FROM holds WHERE user_id = ? AND event_id = ? AND released_at IS NULL AND expires_at > ? LOCK IN SHARE MODE", userID, eventID, now.Format("2006-01-02 15:04:05.000000")).Scan(&held); err != nil {
+		return err
+	}
+
+	if limits.MaxCancels > 0 && canceled >= limits.MaxCancels {
+		return errCancelCooldown
+	}
+	if limits.MaxReservations > 0 && recent+int64(n) > limits.MaxReservations {
+		return errReservationRateLimited
+	}
+	if limits.MaxSheets > 0 && sheets+held+int64(n) > limits.MaxSheets {
+		return errSheetLimitExceeded
+	}
+	return nil
+}
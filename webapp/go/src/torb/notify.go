@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	notificationReservationCreated  = "reservation_created"
+	notificationReservationCanceled = "reservation_canceled"
+	notificationOrderFailed         = "order_failed"
+	notificationEventUpdated        = "event_updated"
+
+	notifyInterval    = time.Second
+	notifyBatchSize   = 100
+	notifyMaxAttempts = 10
+	// notifyLease is how long a notification being delivered is left to the
+	// server which took it, so that servers sharing the outbox deliver it once.
+	notifyLease      = time.Minute
+	notifyMinBackoff = time.Second
+	notifyMaxBackoff = time.Hour
+
+	notifyWebhookSignatureHeader = "X-Torb-Signature"
+)
+
+var notificationSubjects = map[string]string{
+	notificationReservationCreated:  "予約を受け付けました",
+	notificationReservationCanceled: "予約をキャンセルしました",
+	notificationOrderFailed:         "お支払いができなかったため予約を取り消しました",
+	notificationEventUpdated:        "ご予約のイベントが変更されました",
+}
+
+// Notification is a message to a user in the outbox. Payload is a JSON object
+// whose fields depend on the kind.
+type Notification struct {
+	ID        int64           `json:"id"`
+	UserID    int64           `json:"user_id"`
+	Kind      string          `json:"kind"`
+	Payload   json.RawMessage `json:"payload"`
+	CreatedAt time.Time       `json:"-"`
+	Attempts  int             `json:"-"`
+
+	NextAttemptAt time.Time `json:"-"`
+
+	LoginName     string `json:"-"`
+	Nickname      string `json:"-"`
+	CreatedAtUnix int64  `json:"created_at"`
+}
+
+// Notifier delivers notifications. A notification may be delivered more than
+// once if the server stops right after delivering it, so receivers should
+// dedupe by id.
+type Notifier interface {
+	Notify(n *Notification) error
+}
+
+var notifier Notifier
+
+// Outbox keeps the notifications to deliver and the results of deliveries.
+type Outbox interface {
+	// Due returns up to limit notifications to be sent at now.
+	Due(now time.Time, limit int) ([]*Notification, error)
+	// Lease takes the notification until the time. It returns false if the
+	// notification has been taken by another server since returned by Due.
+	Lease(n *Notification, until time.Time) (bool, error)
+	Delivered(n *Notification, at time.Time) error
+	// Retry records the failed attempt and schedules the next one.
+	Retry(n *Notification, nextAttemptAt time.Time, err error) error
+	// GiveUp records the failed attempt as the last one.
+	GiveUp(n *Notification, at time.Time, err error) error
+}
+
+var outbox Outbox
+
+// newNotifier returns the notifier selected by NOTIFIER.
+func newNotifier() Notifier {
+	switch mode := os.Getenv("NOTIFIER"); mode {
+	case "", "none":
+		return discardNotifier{}
+	case "file":
+		path := os.Getenv("NOTIFY_FILE")
+		if path == "" {
+			path = "notifications.log"
+		}
+		return &fileNotifier{path: path}
+	case "smtp":
+		n := &smtpNotifier{
+			addr:   os.Getenv("NOTIFY_SMTP_ADDR"),
+			from:   os.Getenv("NOTIFY_MAIL_FROM"),
+			domain: os.Getenv("NOTIFY_MAIL_DOMAIN"),
+		}
+		if n.addr == "" {
+			n.addr = "127.0.0.1:25"
+		}
+		if n.from == "" {
+			n.from = "noreply@torb.example"
+		}
+		if n.domain == "" {
+			n.domain = "torb.example"
+		}
+		return n
+	case "webhook":
+		url := os.Getenv("NOTIFY_WEBHOOK_URL")
+		if url == "" {
+			log.Fatal("NOTIFY_WEBHOOK_URL is required for the webhook notifier")
+		}
+		return &webhookNotifier{
+			url:    url,
+			secret: []byte(os.Getenv("NOTIFY_WEBHOOK_SECRET")),
+			client: &http.Client{Timeout: 5 * time.Second},
+		}
+	default:
+		log.Fatalf("unknown notifier: %s", mode)
+	}
+	return nil
+}
+
+// insertNotification puts a notification to the user into the outbox within
+// tx, so that it is sent if and only if tx commits.
+func insertNotification(tx *sql.Tx, userID int64, kind string, payload interface{}) error {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC().Format("2006-01-02 15:04:05.000000")
+	_, err = tx.Exec("INSERT INTO notifications (user_id, kind, payload, created_at, next_attempt_at) VALUES (?, ?, ?, ?, ?)", userID, kind, string(b), now, now)
+	return err
+}
+
+// insertEventNotifications puts a notification into the outbox within tx for
+// every user who holds a sheet of the event.
+func insertEventNotifications(tx *sql.Tx, eventID int64, kind string, payload interface{}) error {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC().Format("2006-01-02 15:04:05.000000")
+	_, err = tx.Exec("INSERT INTO notifications (user_id, kind, payload, created_at, next_attempt_at) SELECT DISTINCT user_id, ?, ?, ?, ? FROM reservations WHERE event_id = ? AND canceled_at IS NULL", kind, string(b), now, now, eventID)
+	return err
+}
+
+func dispatchNotifications() {
+	for range time.Tick(notifyInterval) {
+		if err := deliverNotifications(); err != nil {
+			log.Println("failed to deliver notifications:", err)
+		}
+	}
+}
+
+// retryBackoff returns the delay before the next attempt, which doubles on
+// every failure.
+func retryBackoff(attempts int) time.Duration {
+	backoff := notifyMinBackoff
+	for i := 1; i < attempts && backoff < notifyMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > notifyMaxBackoff {
+		backoff = notifyMaxBackoff
+	}
+	return backoff
+}
+
+// deliverNotifications sends the notifications due. A notification which
+// keeps failing is given up after notifyMaxAttempts.
+func deliverNotifications() error {
+	notifications, err := outbox.Due(time.Now().UTC(), notifyBatchSize)
+	if err != nil {
+		return err
+	}
+
+	// Each notification is taken right before it is sent, so that the lease
+	// outlives the delivery however long the batch takes.
+	for _, n := range notifications {
+		taken, err := outbox.Lease(n, time.Now().UTC().Add(notifyLease))
+		if err != nil {
+			return err
+		}
+		if !taken {
+			// taken by another server
+			continue
+		}
+
+		n.Attempts++
+		nerr := notifier.Notify(n)
+		done := time.Now().UTC()
+		switch {
+		case nerr == nil:
+			err = outbox.Delivered(n, done)
+		case n.Attempts >= notifyMaxAttempts:
+			log.Printf("gave up notification %d: %v\n", n.ID, nerr)
+			err = outbox.GiveUp(n, done, nerr)
+		default:
+			err = outbox.Retry(n, done.Add(retryBackoff(n.Attempts)), nerr)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mysqlOutbox keeps notifications in the notifications table.
+type mysqlOutbox struct{}
+
+func (o *mysqlOutbox) Due(now time.Time, limit int) ([]*Notification, error) {
+	rows, err := db.Query("SELECT n.id, n.user_id, n.kind, n.payload, n.created_at, n.attempts, n.next_attempt_at, u.login_name, u.nickname FROM notifications n INNER JOIN users u ON u.id = n.user_id WHERE n.delivered_at IS NULL AND n.failed_at IS NULL AND n.next_attempt_at <= ? ORDER BY n.next_attempt_at LIMIT ?", now.Format("2006-01-02 15:04:05.000000"), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var notifications []*Notification
+	for rows.Next() {
+		var n Notification
+		var payload string
+		if err := rows.Scan(&n.ID, &n.UserID, &n.Kind, &payload, &n.CreatedAt, &n.Attempts, &n.NextAttemptAt, &n.LoginName, &n.Nickname); err != nil {
+			return nil, err
+		}
+		n.Payload = json.RawMessage(payload)
+		n.CreatedAtUnix = n.CreatedAt.Unix()
+		notifications = append(notifications, &n)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return notifications, nil
+}
+
+func (o *mysqlOutbox) Lease(n *Notification, until time.Time) (bool, error) {
+	res, err := db.Exec("UPDATE notifications SET next_attempt_at = ? WHERE id = ? AND next_attempt_at = ? AND delivered_at IS NULL", until.Format("2006-01-02 15:04:05.000000"), n.ID, n.NextAttemptAt.Format("2006-01-02 15:04:05.000000"))
+	if err != nil {
+		return false, err
+	}
+	taken, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return taken > 0, nil
+}
+
+func (o *mysqlOutbox) Delivered(n *Notification, at time.Time) error {
+	_, err := db.Exec("UPDATE notifications SET attempts = ?, delivered_at = ?, last_error = NULL WHERE id = ?", n.Attempts, at.Format("2006-01-02 15:04:05.000000"), n.ID)
+	return err
+}
+
+func (o *mysqlOutbox) Retry(n *Notification, nextAttemptAt time.Time, nerr error) error {
+	_, err := db.Exec("UPDATE notifications SET attempts = ?, next_attempt_at = ?, last_error = ? WHERE id = ?", n.Attempts, nextAttemptAt.Format("2006-01-02 15:04:05.000000"), truncateError(nerr), n.ID)
+	return err
+}
+
+func (o *mysqlOutbox) GiveUp(n *Notification, at time.Time, nerr error) error {
+	_, err := db.Exec("UPDATE notifications SET attempts = ?, failed_at = ?, last_error = ? WHERE id = ?", n.Attempts, at.Format("2006-01-02 15:04:05.000000"), truncateError(nerr), n.ID)
+	return err
+}
+
+// text renders the notification as a plain text mail.
+func (n *Notification) text() (string, string) {
+	subject, ok := notificationSubjects[n.Kind]
+	if !ok {
+		subject = n.Kind
+	}
+	var payload bytes.Buffer
+	if err := json.Indent(&payload, n.Payload, "", "  "); err != nil {
+		payload.Write(n.Payload)
+	}
+	return subject, fmt.Sprintf("%s 様\r\n\r\n%s\r\n\r\n%s\r\n", n.Nickname, subject, strings.Replace(payload.String(), "\n", "\r\n", -1))
+}
+
+// discardNotifier drops notifications, while the outbox still records them.
+type discardNotifier struct{}
+
+func (discardNotifier) Notify(n *Notification) error {
+	return nil
+}
+
+// fileNotifier appends notifications to a file as JSON lines.
+type fileNotifier struct {
+	mu   sync.Mutex
+	path string
+}
+
+func (f *fileNotifier) Notify(n *Notification) error {
+	b, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(b, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// smtpNotifier mails notifications through an SMTP server, such as the MTA on
+// localhost, which relays them. A user is addressed by the login name at the
+// domain.
+type smtpNotifier struct {
+	addr   string
+	from   string
+	domain string
+}
+
+func (s *smtpNotifier) Notify(n *Notification) error {
+	to := n.LoginName + "@" + s.domain
+	subject, body := n.text()
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", s.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: =?UTF-8?B?%s?=\r\n", base64.StdEncoding.EncodeToString([]byte(subject)))
+	fmt.Fprintf(&msg, "Message-ID: <notification-%d@%s>\r\n", n.ID, s.domain)
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	msg.WriteString("Content-Transfer-Encoding: base64\r\n\r\n")
+	encoded := base64.StdEncoding.EncodeToString([]byte(body))
+	for len(encoded) > 76 {
+		msg.WriteString(encoded[:76] + "\r\n")
+		encoded = encoded[76:]
+	}
+	msg.WriteString(encoded + "\r\n")
+	return smtp.SendMail(s.addr, nil, s.from, []string{to}, msg.Bytes())
+}
+
+// webhookNotifier posts notifications as JSON, signed with the secret if any.
+type webhookNotifier struct {
+	url    string
+	secret []byte
+	client *http.Client
+}
+
+func (w *webhookNotifier) Notify(n *Notification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(w.secret) > 0 {
+		mac := hmac.New(sha256.New, w.secret)
+		mac.Write(body)
+		req.Header.Set(notifyWebhookSignatureHeader, hex.EncodeToString(mac.Sum(nil)))
+	}
+	res, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook responded %d", res.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+// fakeOutbox keeps notifications in memory, and takes and settles them as the
+// notifications table does.
+type fakeOutbox struct {
+	mu      sync.Mutex
+	entries []*fakeOutboxEntry
+}
+
+type fakeOutboxEntry struct {
+	n           Notification
+	deliveredAt *time.Time
+	failedAt    *time.Time
+	lastError   string
+}
+
+// useFakeOutbox points outbox at a fake holding a notification to alice, due
+// now, and returns its entry.
+func useFakeOutbox() (*fakeOutbox, *fakeOutboxEntry) {
+	now := time.Now().UTC()
+	o := &fakeOutbox{}
+	e := &fakeOutboxEntry{n: Notification{
+		ID:            1,
+		UserID:        1,
+		Kind:          notificationReservationCreated,
+		Payload:       json.RawMessage(`{"reservation_id":10}`),
+		CreatedAt:     now,
+		NextAttemptAt: now,
+		LoginName:     "alice",
+		Nickname:      "Alice",
+		CreatedAtUnix: now.Unix(),
+	}}
+	o.entries = append(o.entries, e)
+	outbox = o
+	return o, e
+}
+
+func (o *fakeOutbox) entry(id int64) *fakeOutboxEntry {
+	for _, e := range o.entries {
+		if e.n.ID == id {
+			return e
+		}
+	}
+	return nil
+}
+
+// get returns a copy of the entry, safe to read while deliveries run.
+func (o *fakeOutbox) get(id int64) fakeOutboxEntry {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return *o.entry(id)
+}
+
+func (o *fakeOutbox) Due(now time.Time, limit int) ([]*Notification, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var notifications []*Notification
+	for _, e := range o.entries {
+		if e.deliveredAt == nil && e.failedAt == nil && !e.n.NextAttemptAt.After(now) && len(notifications) < limit {
+			n := e.n
+			notifications = append(notifications, &n)
+		}
+	}
+	return notifications, nil
+}
+
+func (o *fakeOutbox) Lease(n *Notification, until time.Time) (bool, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	e := o.entry(n.ID)
+	if e.deliveredAt != nil || !e.n.NextAttemptAt.Equal(n.NextAttemptAt) {
+		return false, nil
+	}
+	e.n.NextAttemptAt = until
+	return true, nil
+}
+
+func (o *fakeOutbox) Delivered(n *Notification, at time.Time) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	e := o.entry(n.ID)
+	e.n.Attempts, e.deliveredAt, e.lastError = n.Attempts, &at, ""
+	return nil
+}
+
+func (o *fakeOutbox) Retry(n *Notification, nextAttemptAt time.Time, err error) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	e := o.entry(n.ID)
+	e.n.Attempts, e.n.NextAttemptAt, e.lastError = n.Attempts, nextAttemptAt, truncateError(err)
+	return nil
+}
+
+func (o *fakeOutbox) GiveUp(n *Notification, at time.Time, err error) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	e := o.entry(n.ID)
+	e.n.Attempts, e.failedAt, e.lastError = n.Attempts, &at, truncateError(err)
+	return nil
+}
+
+func TestRetryBackoff(t *testing.T) {
+	for _, c := range []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{12, 2048 * time.Second},
+		{13, time.Hour},
+		{100, time.Hour},
+	} {
+		if got := retryBackoff(c.attempts); got != c.want {
+			t.Errorf("retryBackoff(%d) = %v, want %v", c.attempts, got, c.want)
+		}
+	}
+}
+
+func TestTruncateError(t *testing.T) {
+	short := "配信に失敗しました"
+	if got := truncateError(errors.New(short)); got != short {
+		t.Errorf("got %q, want %q", got, short)
+	}
+
+	long := strings.Repeat("あ", 300)
+	got := truncateError(errors.New(long))
+	if !utf8.ValidString(got) || utf8.RuneCountInString(got) != 255 {
+		t.Errorf("got %d runes, valid %v, want 255 valid runes", utf8.RuneCountInString(got), utf8.ValidString(got))
+	}
+}
+
+func TestDeliverNotificationsWebhook(t *testing.T) {
+	o, _ := useFakeOutbox()
+	secret := []byte("secret")
+
+	var mu sync.Mutex
+	var bodies [][]byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(body)
+		if r.Header.Get(notifyWebhookSignatureHeader) != hex.EncodeToString(mac.Sum(nil)) {
+			t.Errorf("bad signature: %s", r.Header.Get(notifyWebhookSignatureHeader))
+		}
+
+		mu.Lock()
+		bodies = append(bodies, body)
+		first := len(bodies) == 1
+		mu.Unlock()
+		if first {
+			w.WriteHeader(503)
+			return
+		}
+		w.WriteHeader(204)
+	}))
+	defer server.Close()
+	notifier = &webhookNotifier{url: server.URL, secret: secret, client: server.Client()}
+
+	// The first attempt fails and is retried after the backoff.
+	before := time.Now().UTC()
+	if err := deliverNotifications(); err != nil {
+		t.Fatal(err)
+	}
+	e := o.get(1)
+	if e.deliveredAt != nil || e.n.Attempts != 1 || e.lastError != "webhook responded 503" {
+		t.Fatalf("got delivered_at=%v attempts=%d last_error=%q after a failure", e.deliveredAt, e.n.Attempts, e.lastError)
+	}
+	if e.n.NextAttemptAt.Before(before.Add(retryBackoff(1))) {
+		t.Fatalf("next attempt at %v is earlier than the backoff", e.n.NextAttemptAt)
+	}
+
+	// It is not due yet.
+	if err := deliverNotifications(); err != nil {
+		t.Fatal(err)
+	}
+	if len(bodies) != 1 {
+		t.Fatalf("got %d requests before the backoff, want 1", len(bodies))
+	}
+
+	o.mu.Lock()
+	o.entry(1).n.NextAttemptAt = before
+	o.mu.Unlock()
+	if err := deliverNotifications(); err != nil {
+		t.Fatal(err)
+	}
+	e = o.get(1)
+	if e.deliveredAt == nil || e.n.Attempts != 2 || e.lastError != "" {
+		t.Fatalf("got delivered_at=%v attempts=%d last_error=%q after a success", e.deliveredAt, e.n.Attempts, e.lastError)
+	}
+
+	var n struct {
+		ID      int64           `json:"id"`
+		UserID  int64           `json:"user_id"`
+		Kind    string          `json:"kind"`
+		Payload json.RawMessage `json:"payload"`
+	}
+	if err := json.Unmarshal(bodies[1], &n); err != nil {
+		t.Fatal(err)
+	}
+	if n.ID != 1 || n.UserID != 1 || n.Kind != notificationReservationCreated || string(n.Payload) != `{"reservation_id":10}` {
+		t.Fatalf("got %s", bodies[1])
+	}
+
+	// Delivered notifications are never sent again.
+	if err := deliverNotifications(); err != nil {
+		t.Fatal(err)
+	}
+	if len(bodies) != 2 {
+		t.Fatalf("got %d requests after delivery, want 2", len(bodies))
+	}
+}
+
+func TestDeliverNotificationsGivesUp(t *testing.T) {
+	o, e := useFakeOutbox()
+	e.n.Attempts = notifyMaxAttempts - 1
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(500)
+	}))
+	defer server.Close()
+	notifier = &webhookNotifier{url: server.URL, client: server.Client()}
+
+	if err := deliverNotifications(); err != nil {
+		t.Fatal(err)
+	}
+	got := o.get(1)
+	if got.failedAt == nil || got.deliveredAt != nil || got.n.Attempts != notifyMaxAttempts {
+		t.Fatalf("got failed_at=%v delivered_at=%v attempts=%d", got.failedAt, got.deliveredAt, got.n.Attempts)
+	}
+	if got.lastError != "webhook responded 500" {
+		t.Fatalf("got last_error=%q", got.lastError)
+	}
+}
+
+func TestDeliverNotificationsLeased(t *testing.T) {
+	o, _ := useFakeOutbox()
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(204)
+	}))
+	defer server.Close()
+	notifier = &webhookNotifier{url: server.URL, client: server.Client()}
+
+	// Another server takes the notification between Due and Lease.
+	notifications, err := o.Due(time.Now().UTC(), notifyBatchSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if taken, err := o.Lease(notifications[0], time.Now().UTC().Add(notifyLease)); err != nil || !taken {
+		t.Fatalf("got taken=%v err=%v", taken, err)
+	}
+	outbox = &stalledOutbox{fakeOutbox: o, due: notifications}
+
+	if err := deliverNotifications(); err != nil {
+		t.Fatal(err)
+	}
+	if requests != 0 {
+		t.Fatalf("got %d requests for a notification taken by another server, want 0", requests)
+	}
+}
+
+// stalledOutbox returns the notifications read before, as a server which has
+// been slow to lease them would see them.
+type stalledOutbox struct {
+	*fakeOutbox
+	due []*Notification
+}
+
+func (o *stalledOutbox) Due(now time.Time, limit int) ([]*Notification, error) {
+	return o.due, nil
+}
+
+type smtpMessage struct {
+	from string
+	to   []string
+	data string
+}
+
+// serveSMTP accepts one session on l, enough for smtp.SendMail without TLS
+// nor authentication, and sends the message received.
+func serveSMTP(t *testing.T, l net.Listener, messages chan<- *smtpMessage) {
+	conn, err := l.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	text := textproto.NewConn(conn)
+	reply := func(format string, args ...interface{}) {
+		if err := text.PrintfLine(format, args...); err != nil {
+			t.Error(err)
+		}
+	}
+	msg := &smtpMessage{}
+	reply("220 localhost ESMTP")
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch {
+		case verb == "EHLO" || verb == "HELO":
+			reply("250 localhost")
+		case strings.HasPrefix(strings.ToUpper(line), "MAIL FROM:"):
+			msg.from = line[len("MAIL FROM:"):]
+			reply("250 OK")
+		case strings.HasPrefix(strings.ToUpper(line), "RCPT TO:"):
+			msg.to = append(msg.to, line[len("RCPT TO:"):])
+			reply("250 OK")
+		case verb == "DATA":
+			reply("354 Go ahead")
+			data, err := text.ReadDotBytes()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			msg.data = string(data)
+			reply("250 OK")
+			messages <- msg
+		case verb == "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("250 OK")
+		}
+	}
+}
+
+func TestDeliverNotificationsSMTP(t *testing.T) {
+	o, _ := useFakeOutbox()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	messages := make(chan *smtpMessage, 1)
+	go serveSMTP(t, l, messages)
+	notifier = &smtpNotifier{addr: l.Addr().String(), from: "noreply@torb.test", domain: "torb.test"}
+
+	if err := deliverNotifications(); err != nil {
+		t.Fatal(err)
+	}
+	if e := o.get(1); e.deliveredAt == nil || e.n.Attempts != 1 {
+		t.Fatalf("got delivered_at=%v attempts=%d", e.deliveredAt, e.n.Attempts)
+	}
+
+	var msg *smtpMessage
+	select {
+	case msg = <-messages:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no mail received")
+	}
+	if !strings.HasPrefix(msg.from, "<noreply@torb.test>") || len(msg.to) != 1 || msg.to[0] != "<alice@torb.test>" {
+		t.Fatalf("got from=%s to=%v", msg.from, msg.to)
+	}
+
+	header, body := msg.data, ""
+	if i := strings.Index(msg.data, "\n\n"); i >= 0 {
+		header, body = msg.data[:i], msg.data[i+2:]
+	}
+	reader := textproto.NewReader(bufio.NewReader(strings.NewReader(header + "\n\n")))
+	mime, err := reader.ReadMIMEHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mime.Get("Message-Id") != "<notification-1@torb.test>" {
+		t.Errorf("got Message-ID %q", mime.Get("Message-Id"))
+	}
+	subject := base64.StdEncoding.EncodeToString([]byte(notificationSubjects[notificationReservationCreated]))
+	if mime.Get("Subject") != "=?UTF-8?B?"+subject+"?=" {
+		t.Errorf("got Subject %q", mime.Get("Subject"))
+	}
+	text, err := base64.StdEncoding.DecodeString(strings.Replace(body, "\n", "", -1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(text), "Alice 様") || !strings.Contains(string(text), `"reservation_id": 10`) {
+		t.Errorf("got body %q", text)
+	}
+}
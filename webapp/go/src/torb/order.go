@@ -0,0 +1,438 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+)
+
+const (
+	orderStatusPending  = "pending"
+	orderStatusPaid     = "paid"
+	orderStatusRefunded = "refunded"
+	orderStatusFailed   = "failed"
+
+	refundStatusPending   = "pending"
+	refundStatusSucceeded = "succeeded"
+
+	refundRetryInterval  = time.Minute
+	refundRetryBatchSize = 100
+)
+
+var (
+	errPaymentFailed  = errors.New("payment failed")
+	errPaymentPending = errors.New("payment pending")
+)
+
+// Order wraps the reservations paid at once.
+type Order struct {
+	ID             int64   `json:"id"`
+	UserID         int64   `json:"-"`
+	Status         string  `json:"status"`
+	Amount         int64   `json:"amount"`
+	RefundedAmount int64   `json:"refunded_amount"`
+	PaymentID      *string `json:"-"`
+
+	Reservations []*Reservation `json:"reservations"`
+}
+
+func (o *Order) paymentID() string {
+	if o.PaymentID == nil {
+		return ""
+	}
+	return *o.PaymentID
+}
+
+// insertOrder inserts a pending order of the sheets within tx, and notifies
+// the user of it. Each sheet is charged its list price, discounted by the
+// coupon if any.
+func insertOrder(tx *sql.Tx, event *Event, userID int64, sheets []Sheet, coupon *Coupon) (*Order, error) {
+	now := time.Now().UTC().Truncate(time.Microsecond)
+
+	var couponID interface{}
+	if coupon != nil {
+		couponID = coupon.ID
+	}
+
+	// Lock the event, so that the orders of the event are serialized from here
+	// on and insertRankSoldOutDeliveries counts the reservations of the others.
+	var eventID int64
+	if err := tx.QueryRow("SELECT id FROM events WHERE id = ? FOR UPDATE", event.ID).Scan(&eventID); err != nil {
+		return nil, err
+	}
+
+	order := &Order{UserID: userID, Status: orderStatusPending}
+	prices := make([]int64, 0, len(sheets))
+	for _, sheet := range sheets {
+		price := availability.sheetPrice(event, sheet)
+		if coupon != nil {
+			price = coupon.apply(price)
+		}
+		prices = append(prices, price)
+		order.Amount += price
+	}
+
+	res, err := tx.Exec("INSERT INTO orders (user_id, status, amount, created_at, updated_at) VALUES (?, ?, ?, ?, ?)", userID, order.Status, order.Amount, now.Format("2006-01-02 15:04:05.000000"), now.Format("2006-01-02 15:04:05.000000"))
+	if err != nil {
+		return nil, err
+	}
+	order.ID, err = res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	order.Reservations = make([]*Reservation, 0, len(sheets))
+	for i, sheet := range sheets {
+		res, err := tx.Exec("INSERT INTO reservations (event_id, sheet_id, user_id, reserved_at, price, coupon_id, order_id) VALUES (?, ?, ?, ?, ?, ?, ?)", event.ID, sheet.ID, userID, now.Format("2006-01-02 15:04:05.000000"), prices[i], couponID, order.ID)
+		if err != nil {
+			return nil, err
+		}
+		reservationID, err := res.LastInsertId()
+		if err != nil {
+			return nil, err
+		}
+		order.Reservations = append(order.Reservations, &Reservation{
+			ID:         reservationID,
+			EventID:    event.ID,
+			SheetID:    sheet.ID,
+			UserID:     userID,
+			ReservedAt: &now,
+			SheetRank:  sheet.Rank,
+			SheetNum:   sheet.Num,
+			Price:      prices[i],
+			OrderID:    &order.ID,
+		})
+	}
+
+	ids := make([]int64, 0, len(order.Reservations))
+	for _, r := range order.Reservations {
+		ids = append(ids, r.ID)
+	}
+	for _, r := range order.Reservations {
+		if err := insertWebhookDeliveries(tx, webhookReservationCreated, webhookReservationData(r)); err != nil {
+			return nil, err
+		}
+	}
+	if err := insertRankSoldOutDeliveries(tx, event, sheets); err != nil {
+		return nil, err
+	}
+	if err := insertNotification(tx, userID, notificationReservationCreated, map[string]interface{}{
+		"order_id":     order.ID,
+		"event_id":     event.ID,
+		"event_title":  event.Title,
+		"amount":       order.Amount,
+		"reservations": order.Reservations,
+	}); err != nil {
+		return nil, err
+	}
+	if err := touchReservations(tx, ids...); err != nil {
+		return nil, err
+	}
+	return order, nil
+}
+
+// payOrder charges the committed order through the payment gateway. It returns
+// errPaymentFailed if the payment is declined, in which case the reservations
+// have been canceled. A pending order is left to the webhook.
+func payOrder(order *Order) error {
+	result, err := payment.Charge(order)
+	if err != nil {
+		log.Println("failed to charge order", order.ID, err)
+		result = &PaymentResult{Status: orderStatusFailed}
+	}
+	if err := settleOrder(order.ID, result.PaymentID, result.Status); err != nil {
+		return err
+	}
+	if result.Status == orderStatusFailed {
+		return errPaymentFailed
+	}
+	order.Status = result.Status
+	if result.PaymentID != "" {
+		order.PaymentID = &result.PaymentID
+	}
+	return nil
+}
+
+// settleOrder records the payment result of a pending order. A failed order
+// releases its sheets to the waitlist or to others, and the user is notified.
+// Orders which have been settled are left as they are, so that webhooks can
+// be delivered twice.
+func settleOrder(orderID int64, paymentID, status string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	// Lock the reservations before the order, in the same order as
+	// cancellations do.
+	rows, err := tx.Query("SELECT id, event_id, sheet_id, IFNULL(price, 0) FROM reservations WHERE order_id = ? AND canceled_at IS NULL ORDER BY id FOR UPDATE", orderID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	var reservations []*Reservation
+	for rows.Next() {
+		var reservation Reservation
+		if err := rows.Scan(&reservation.ID, &reservation.EventID, &reservation.SheetID, &reservation.Price); err != nil {
+			rows.Close()
+			tx.Rollback()
+			return err
+		}
+		reservations = append(reservations, &reservation)
+	}
+	if err := rows.Err(); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	var current string
+	var userID int64
+	if err := tx.QueryRow("SELECT status, user_id FROM orders WHERE id = ? FOR UPDATE", orderID).Scan(&current, &userID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if current != orderStatusPending {
+		tx.Rollback()
+		return nil
+	}
+
+	now := time.Now().UTC().Format("2006-01-02 15:04:05.000000")
+	var paymentIDValue interface{}
+	if paymentID != "" {
+		paymentIDValue = paymentID
+	}
+	if _, err := tx.Exec("UPDATE orders SET status = ?, payment_id = IFNULL(?, payment_id), updated_at = ? WHERE id = ?", status, paymentIDValue, now, orderID); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	// The reservations are touched either way, as their report changes when
+	// they are paid.
+	ids := make([]int64, 0, len(reservations))
+	for _, reservation := range reservations {
+		ids = append(ids, reservation.ID)
+	}
+	var offers []*Hold
+	if status == orderStatusFailed {
+		for _, reservation := range reservations {
+			if _, err := tx.Exec("UPDATE reservations SET canceled_at = ? WHERE id = ?", now, reservation.ID); err != nil {
+				tx.Rollback()
+				return err
+			}
+			sheet, _ := availability.sheetByID(reservation.SheetID)
+			reservation.SheetRank, reservation.SheetNum = sheet.Rank, sheet.Num
+			if err := insertWebhookDeliveries(tx, webhookReservationCanceled, webhookReservationData(reservation)); err != nil {
+				tx.Rollback()
+				return err
+			}
+			offered, err := offerSheetToWaitlist(tx, reservation.EventID, sheet)
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+			if offered != nil {
+				offers = append(offers, offered)
+			}
+		}
+		if err := insertNotification(tx, userID, notificationOrderFailed, map[string]interface{}{
+			"order_id":        orderID,
+			"reservation_ids": ids,
+		}); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := touchReservations(tx, ids...); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	if status == orderStatusFailed {
+		for _, reservation := range reservations {
+			availability.cancel(reservation.EventID, reservation.SheetID, reservation.ID)
+		}
+		for _, offered := range offers {
+			availability.hold(offered.EventID, offered.SheetID, offered.ID, offered.UserID, *offered.ExpiresAt)
+		}
+	}
+	return nil
+}
+
+// Refund is a refund recorded on a cancellation, which is sent to the gateway
+// after the cancellation commits.
+type Refund struct {
+	ID        int64
+	OrderID   int64
+	Amount    int64
+	UpdatedAt time.Time
+
+	order *Order
+}
+
+// refundReservation records the refund of the price of the reservation, which
+// has just been canceled within tx, if its order has been paid. The order
+// becomes refunded once all of its reservations are canceled. The refund is
+// left pending for payRefund to send after tx commits, and nil is returned if
+// there is nothing to refund. It returns errPaymentPending if the order has
+// not been settled yet. Reservations made before orders are not refunded.
+func refundReservation(tx *sql.Tx, reservation *Reservation) (*Refund, error) {
+	if reservation.OrderID == nil {
+		return nil, nil
+	}
+
+	var order Order
+	if err := tx.QueryRow("SELECT id, user_id, status, amount, refunded_amount, payment_id FROM orders WHERE id = ? FOR UPDATE", *reservation.OrderID).Scan(&order.ID, &order.UserID, &order.Status, &order.Amount, &order.RefundedAmount, &order.PaymentID); err != nil {
+		return nil, err
+	}
+	switch order.Status {
+	case orderStatusPending:
+		return nil, errPaymentPending
+	case orderStatusPaid:
+	default:
+		return nil, nil
+	}
+
+	var remains int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM reservations WHERE order_id = ? AND canceled_at IS NULL", order.ID).Scan(&remains); err != nil {
+		return nil, err
+	}
+	status := orderStatusPaid
+	if remains == 0 {
+		status = orderStatusRefunded
+	}
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	if _, err := tx.Exec("UPDATE orders SET status = ?, refunded_amount = refunded_amount + ?, updated_at = ? WHERE id = ?", status, reservation.Price, now.Format("2006-01-02 15:04:05.000000"), order.ID); err != nil {
+		return nil, err
+	}
+	if reservation.Price == 0 {
+		return nil, nil
+	}
+
+	refund := &Refund{OrderID: order.ID, Amount: reservation.Price, UpdatedAt: now, order: &order}
+	res, err := tx.Exec("INSERT INTO refunds (order_id, reservation_id, amount, status, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?)", order.ID, reservation.ID, refund.Amount, refundStatusPending, now.Format("2006-01-02 15:04:05.000000"), now.Format("2006-01-02 15:04:05.000000"))
+	if err != nil {
+		return nil, err
+	}
+	refund.ID, err = res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	return refund, nil
+}
+
+// payRefund sends the pending refund to the gateway and records the result.
+// A refund the gateway refuses is left pending, so that retryRefunds sends it
+// again later.
+func payRefund(refund *Refund) {
+	// Take the refund, so that it is never sent twice at once.
+	res, err := db.Exec("UPDATE refunds SET updated_at = ? WHERE id = ? AND updated_at = ? AND status = ?", time.Now().UTC().Format("2006-01-02 15:04:05.000000"), refund.ID, refund.UpdatedAt.Format("2006-01-02 15:04:05.000000"), refundStatusPending)
+	if err != nil {
+		log.Println("failed to take refund", refund.ID, err)
+		return
+	}
+	if taken, err := res.RowsAffected(); err != nil || taken == 0 {
+		return
+	}
+
+	if rerr := payment.Refund(refund.order, refund.Amount); rerr != nil {
+		log.Println("failed to refund order", refund.OrderID, rerr)
+		if _, err := db.Exec("UPDATE refunds SET attempts = attempts + 1, last_error = ? WHERE id = ?", truncateError(rerr), refund.ID); err != nil {
+			log.Println("failed to record refund", refund.ID, err)
+		}
+		return
+	}
+	if _, err := db.Exec("UPDATE refunds SET status = ?, attempts = attempts + 1, last_error = NULL, updated_at = ? WHERE id = ?", refundStatusSucceeded, time.Now().UTC().Format("2006-01-02 15:04:05.000000"), refund.ID); err != nil {
+		log.Println("failed to record refund", refund.ID, err)
+	}
+}
+
+// truncateError fits the error into a VARCHAR(255) column, which counts
+// characters rather than bytes.
+func truncateError(err error) string {
+	s := err.Error()
+	if r := []rune(s); len(r) > 255 {
+		s = string(r[:255])
+	}
+	return s
+}
+
+func retryRefunds() {
+	for range time.Tick(refundRetryInterval) {
+		if err := retryPendingRefunds(); err != nil {
+			log.Println("failed to retry refunds:", err)
+		}
+	}
+}
+
+// retryPendingRefunds sends again the refunds which have been left pending
+// for a while, by failures or by servers stopped before sending them.
+func retryPendingRefunds() error {
+	before := time.Now().UTC().Add(-refundRetryInterval).Format("2006-01-02 15:04:05.000000")
+	rows, err := db.Query("SELECT f.id, f.order_id, f.amount, f.updated_at, o.user_id, o.payment_id FROM refunds f INNER JOIN orders o ON o.id = f.order_id WHERE f.status = ? AND f.updated_at < ? ORDER BY f.id LIMIT ?", refundStatusPending, before, refundRetryBatchSize)
+	if err != nil {
+		return err
+	}
+	var refunds []*Refund
+	for rows.Next() {
+		refund := &Refund{order: &Order{}}
+		if err := rows.Scan(&refund.ID, &refund.OrderID, &refund.Amount, &refund.UpdatedAt, &refund.order.UserID, &refund.order.PaymentID); err != nil {
+			rows.Close()
+			return err
+		}
+		refund.order.ID = refund.OrderID
+		refunds = append(refunds, refund)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, refund := range refunds {
+		payRefund(refund)
+	}
+	return nil
+}
+
+// getOrder returns the order with its reservations.
+func getOrder(orderID int64) (*Order, error) {
+	var order Order
+	if err := db.QueryRow("SELECT id, user_id, status, amount, refunded_amount, payment_id FROM orders WHERE id = ?", orderID).Scan(&order.ID, &order.UserID, &order.Status, &order.Amount, &order.RefundedAmount, &order.PaymentID); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query("SELECT r.id, r.event_id, r.sheet_id, r.user_id, r.reserved_at, r.canceled_at, IFNULL(r.price, 0), s.rank, s.num FROM reservations r INNER JOIN sheets s ON s.id = r.sheet_id WHERE r.order_id = ? ORDER BY r.id", order.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	order.Reservations = []*Reservation{}
+	for rows.Next() {
+		var reservation Reservation
+		if err := rows.Scan(&reservation.ID, &reservation.EventID, &reservation.SheetID, &reservation.UserID, &reservation.ReservedAt, &reservation.CanceledAt, &reservation.Price, &reservation.SheetRank, &reservation.SheetNum); err != nil {
+			return nil, err
+		}
+		reservation.OrderID = &order.ID
+		reservation.ReservedAtUnix = reservation.ReservedAt.Unix()
+		if reservation.CanceledAt != nil {
+			reservation.CanceledAtUnix = reservation.CanceledAt.Unix()
+		}
+		order.Reservations = append(order.Reservations, &reservation)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return &order, nil
+}
+
+// getOrderIDByPaymentID returns sql.ErrNoRows if the payment has not been
+// recorded yet.
+func getOrderIDByPaymentID(paymentID string) (int64, error) {
+	var orderID int64
+	err := db.QueryRow("SELECT id FROM orders WHERE payment_id = ?", paymentID).Scan(&orderID)
+	return orderID, err
+}
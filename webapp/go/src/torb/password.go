@@ -0,0 +1,53 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// bcrypt ignores the bytes after the 72nd.
+const maxPasswordLength = 72
+
+// hashPassword hashes the password with bcrypt, whose hash is prefixed with
+// its format, like "$2a$10$".
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// isLegacyPassHash reports whether passHash is a hex SHA2-256 digest stored
+// before passwords were hashed with bcrypt. Such digests have no prefix.
+func isLegacyPassHash(passHash string) bool {
+	return !strings.HasPrefix(passHash, "$")
+}
+
+func verifyPassword(passHash, password string) bool {
+	if isLegacyPassHash(passHash) {
+		digest := sha256.Sum256([]byte(password))
+		return subtle.ConstantTimeCompare([]byte(hex.EncodeToString(digest[:])), []byte(passHash)) == 1
+	}
+	return bcrypt.CompareHashAndPassword([]byte(passHash), []byte(password)) == nil
+}
+
+// upgradePassHash re-hashes the legacy hash of a user or an administrator in
+// table, once the password has been verified. Passwords too long for bcrypt
+// are left as they are. The hash is replaced only if nobody has replaced it
+// in the meantime.
+func upgradePassHash(table string, id int64, passHash, password string) error {
+	if !isLegacyPassHash(passHash) || len(password) > maxPasswordLength {
+		return nil
+	}
+	newPassHash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("UPDATE "+table+" SET pass_hash = ? WHERE id = ? AND pass_hash = ?", newPassHash, id, passHash)
+	return err
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+var errInvalidWebhook = errors.New("invalid webhook")
+
+// PaymentGateway is the interface to a payment provider.
+type PaymentGateway interface {
+	// Charge charges the amount of the order. The status of the result is
+	// pending if the provider confirms the payment later through the webhook.
+	Charge(order *Order) (*PaymentResult, error)
+	// Refund refunds the amount of the paid order.
+	Refund(order *Order, amount int64) error
+	// ParseWebhook verifies a webhook request of the provider and returns the
+	// result it notifies. It returns errInvalidWebhook if the request is forged.
+	ParseWebhook(req *http.Request) (*PaymentResult, error)
+}
+
+type PaymentResult struct {
+	PaymentID string `json:"payment_id"`
+	Status    string `json:"status"`
+}
+
+var payment PaymentGateway
+
+// newPaymentGateway returns the gateway selected by PAYMENT_GATEWAY.
+func newPaymentGateway() PaymentGateway {
+	switch mode := os.Getenv("PAYMENT_GATEWAY"); mode {
+	case "", "fake":
+		return newFakePaymentGateway(false)
+	case "fake-async":
+		return newFakePaymentGateway(true)
+	default:
+		log.Fatalf("unknown payment gateway: %s", mode)
+	}
+	return nil
+}
+
+// loadPaymentFeePercent returns the fee percentage set by PAYMENT_FEE_PERCENT.
+// No fee is taken by default.
+func loadPaymentFeePercent() int64 {
+	s := os.Getenv("PAYMENT_FEE_PERCENT")
+	if s == "" {
+		return 0
+	}
+	percent, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || percent < 0 || percent > 100 {
+		log.Fatalf("invalid payment fee percent: %s", s)
+	}
+	return percent
+}
+
+const (
+	fakePaymentSignatureHeader = "X-Fake-Payment-Signature"
+	fakePaymentNotifyDelay     = 100 * time.Millisecond
+	fakePaymentNotifyRetries   = 5
+)
+
+// fakePaymentGateway accepts every payment without talking to any provider.
+// In async mode it confirms payments by calling the webhook of this app, as a
+// real provider would.
+type fakePaymentGateway struct {
+	async      bool
+	webhookURL string
+	secret     []byte
+}
+
+func newFakePaymentGateway(async bool) *fakePaymentGateway {
+	webhookURL := os.Getenv("PAYMENT_WEBHOOK_URL")
+	if webhookURL == "" {
+		webhookURL = "http://127.0.0.1:8080/api/payments/webhook"
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		log.Fatal(err)
+	}
+	return &fakePaymentGateway{async: async, webhookURL: webhookURL, secret: secret}
+}
+
+func (g *fakePaymentGateway) Charge(order *Order) (*PaymentResult, error) {
+	result := &PaymentResult{PaymentID: fmt.Sprintf("fake-%d", order.ID), Status: orderStatusPaid}
+	if !g.async {
+		return result, nil
+	}
+	go g.notify(*result)
+	return &PaymentResult{PaymentID: result.PaymentID, Status: orderStatusPending}, nil
+}
+
+func (g *fakePaymentGateway) Refund(order *Order, amount int64) error {
+	log.Printf("fake payment: refund %d of %s\n", amount, order.paymentID())
+	return nil
+}
+
+func (g *fakePaymentGateway) sign(body []byte) string {
+	mac := hmac.New(sha256.New, g.secret)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// notify delivers the result to the webhook, retrying while the order has not
+// recorded the payment yet.
+func (g *fakePaymentGateway) notify(result PaymentResult) {
+	body, _ := json.Marshal(result)
+	for i := 1; i <= fakePaymentNotifyRetries; i++ {
+		time.Sleep(time.Duration(i) * fakePaymentNotifyDelay)
+
+		req, err := http.NewRequest("POST", g.webhookURL, bytes.NewReader(body))
+		if err != nil {
+			log.Println("fake payment: failed to notify:", err)
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(fakePaymentSignatureHeader, g.sign(body))
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			log.Println("fake payment: failed to notify:", err)
+			continue
+		}
+		res.Body.Close()
+		if res.StatusCode/100 == 2 {
+			return
+		}
+	}
+	log.Println("fake payment: gave up notifying", result.PaymentID)
+}
+
+func (g *fakePaymentGateway) ParseWebhook(req *http.Request) (*PaymentResult, error) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal([]byte(req.Header.Get(fakePaymentSignatureHeader)), []byte(g.sign(body))) {
+		return nil, errInvalidWebhook
+	}
+	var result PaymentResult
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, errInvalidWebhook
+	}
+	if result.Status != orderStatusPaid && result.Status != orderStatusFailed {
+		return nil, errInvalidWebhook
+	}
+	return &result, nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+)
+
+// sheetPriceJoinSQL and sheetPriceSQL compute the price of a reserved sheet,
+// given reservations r, sheets s and events e. The price charged at
+// reservation wins; reservations made before it was recorded fall back to the
+// list price, where a seat override wins over a rank override, which wins over
+// events.price + sheets.price.
+const (
+	sheetPriceJoinSQL = "LEFT JOIN event_price_overrides pr ON pr.event_id = r.event_id AND pr.sheet_rank = s.rank AND pr.sheet_id = 0 LEFT JOIN event_price_overrides ps ON ps.event_id = r.event_id AND ps.sheet_rank = s.rank AND ps.sheet_id = r.sheet_id"
+	sheetPriceSQL     = "COALESCE(r.price, ps.price, pr.price, e.price + s.price)"
+)
+
+var errEventSold = errors.New("event sold")
+
+// PriceOverride overrides the price of a rank, or of a seat if Num is given.
+type PriceOverride struct {
+	Rank  string `json:"sheet_rank"`
+	Num   int64  `json:"sheet_num,omitempty"`
+	Price int64  `json:"price"`
+}
+
+type eventPrices struct {
+	ranks  map[string]int64 // rank => price
+	sheets map[int64]int64  // sheet_id => price
+}
+
+func newEventPrices() *eventPrices {
+	return &eventPrices{ranks: map[string]int64{}, sheets: map[int64]int64{}}
+}
+
+func (idx *availabilityIndex) setPrices(eventID int64, prices *eventPrices) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.prices[eventID] = prices
+}
+
+// sheetPrice returns the list price of the sheet for the event.
+func (idx *availabilityIndex) sheetPrice(event *Event, sheet Sheet) int64 {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	if prices := idx.prices[event.ID]; prices != nil {
+		if price, ok := prices.sheets[sheet.ID]; ok {
+			return price
+		}
+		if price, ok := prices.ranks[sheet.Rank]; ok {
+			return price
+		}
+	}
+	return event.Price + sheet.Price
+}
+
+// validatePriceOverrides resolves the overrides against the venue of the
+// event. It returns the error code for resError if any of them is invalid.
+func validatePriceOverrides(event *Event, ranks, sheets []*PriceOverride) (*eventPrices, string) {
+	prices := newEventPrices()
+	for _, o := range ranks {
+		if o == nil || !validateRank(event.VenueID, o.Rank) {
+			return nil, "invalid_rank"
+		}
+		if _, ok := prices.ranks[o.Rank]; ok {
+			return nil, "invalid_rank"
+		}
+		if o.Price < 0 {
+			return nil, "invalid_price"
+		}
+		prices.ranks[o.Rank] = o.Price
+	}
+	for _, o := range sheets {
+		if o == nil {
+			return nil, "invalid_sheet"
+		}
+		sheet, ok := availability.sheetByRankNum(event.VenueID, o.Rank, o.Num)
+		if !ok {
+			return nil, "invalid_sheet"
+		}
+		if _, ok := prices.sheets[sheet.ID]; ok {
+			return nil, "invalid_sheet"
+		}
+		if o.Price < 0 {
+			return nil, "invalid_price"
+		}
+		prices.sheets[sheet.ID] = o.Price
+	}
+	return prices, ""
+}
+
+// replacePriceOverrides replaces all the overrides of the event. It returns
+// errEventSold if the event has any reservation, since sold sheets must keep
+// their price.
+func replacePriceOverrides(eventID int64, prices *eventPrices) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	var sold bool
+	if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM reservations WHERE event_id = ? FOR UPDATE)", eventID).Scan(&sold); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if sold {
+		tx.Rollback()
+		return errEventSold
+	}
+
+	if _, err := tx.Exec("DELETE FROM event_price_overrides WHERE event_id = ?", eventID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	for rank, price := range prices.ranks {
+		if err := insertPriceOverride(tx, eventID, rank, 0, price); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	for sheetID, price := range prices.sheets {
+		sheet, _ := availability.sheetByID(sheetID)
+		if err := insertPriceOverride(tx, eventID, sheet.Rank, sheetID, price); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	availability.setPrices(eventID, prices)
+	return nil
+}
+
+func insertPriceOverride(tx *sql.Tx, eventID int64, rank string, sheetID, price int64) error {
+	_, err := tx.Exec("INSERT INTO event_price_overrides (event_id, sheet_rank, sheet_id, price) VALUES (?, ?, ?, ?)", eventID, rank, sheetID, price)
+	return err
+}
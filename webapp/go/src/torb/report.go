@@ -0,0 +1,211 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// paymentFeePercent is the share of a sale the payment gateway keeps, set by
+// PAYMENT_FEE_PERCENT. The fee is returned along with a refund.
+var paymentFeePercent int64
+
+// reportSQL selects the rows scanned by scanReport, given reservations r,
+// sheets s, events e and orders o. reportChargedSQL tells if a reservation has
+// been charged, that is, it was made before orders or its order has been paid.
+const (
+	reportColumnsSQL = "r.id, r.event_id, r.user_id, r.reserved_at, r.canceled_at, s.rank, s.num, " + sheetPriceSQL + ", o.status"
+	reportFromSQL    = " FROM reservations r INNER JOIN sheets s ON s.id = r.sheet_id INNER JOIN events e ON e.id = r.event_id " + sheetPriceJoinSQL + " LEFT JOIN orders o ON o.id = r.order_id"
+	reportSQL        = "SELECT " + reportColumnsSQL + reportFromSQL
+	reportChargedSQL = "(r.order_id IS NULL OR o.status IN ('" + orderStatusPaid + "', '" + orderStatusRefunded + "'))"
+)
+
+// reportFeeSQL computes the fee on a sale, as Report.settle does.
+func reportFeeSQL() string {
+	return "FLOOR(" + sheetPriceSQL + " * " + strconv.FormatInt(paymentFeePercent, 10) + " / 100)"
+}
+
+const mimeNDJSON = "application/x-ndjson"
+
+type Report struct {
+	ReservationID int64  `json:"reservation_id"`
+	EventID       int64  `json:"event_id"`
+	Rank          string `json:"rank"`
+	Num           int64  `json:"num"`
+	Price         int64  `json:"price"`
+	UserID        int64  `json:"user_id"`
+	SoldAt        string `json:"sold_at"`
+	CanceledAt    string `json:"canceled_at,omitempty"`
+	Refund        int64  `json:"refund"`
+	Fee           int64  `json:"fee"`
+	Net           int64  `json:"net"`
+}
+
+// settle fills the refund, the fee and the net of the report, given the status
+// of the order if any. A reservation whose order has not been paid yields
+// nothing, and a canceled one which has been charged is refunded in full.
+func (r *Report) settle(orderStatus *string) {
+	if orderStatus != nil && *orderStatus != orderStatusPaid && *orderStatus != orderStatusRefunded {
+		return
+	}
+	if r.CanceledAt != "" {
+		r.Refund = r.Price
+		return
+	}
+	r.Fee = r.Price * paymentFeePercent / 100
+	r.Net = r.Price - r.Fee
+}
+
+// reportRange parses the from and to query parameters, unix times where 0
+// means unbounded, into a condition on r.reserved_at. It returns false if they
+// are invalid.
+func reportRange(c echo.Context) (string, []interface{}, bool) {
+	var cond string
+	var args []interface{}
+	var from, to int64
+	for _, p := range []struct {
+		name string
+		op   string
+		v    *int64
+	}{{"from", ">=", &from}, {"to", "<", &to}} {
+		s := c.QueryParam(p.name)
+		if s == "" {
+			continue
+		}
+		v, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || v < 0 {
+			return "", nil, false
+		}
+		*p.v = v
+		if v == 0 {
+			continue
+		}
+		cond += " AND r.reserved_at " + p.op + " ?"
+		args = append(args, time.Unix(v, 0).UTC().Format("2006-01-02 15:04:05.000000"))
+	}
+	if from != 0 && to != 0 && from >= to {
+		return "", nil, false
+	}
+	return cond, args, true
+}
+
+// reportPage parses the cursor and limit query parameters into a condition on
+// r.id and a LIMIT clause, for the rows to be read in keyset order. The cursor
+// is the last reservation_id the client has got, so an incremental export
+// fetches the reservations made since then. It returns false if they are
+// invalid.
+func reportPage(c echo.Context) (string, []interface{}, string, bool) {
+	var cond, limit string
+	var args []interface{}
+	if s := c.QueryParam("cursor"); s != "" {
+		cursor, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || cursor < 0 {
+			return "", nil, "", false
+		}
+		cond = " AND r.id > ?"
+		args = append(args, cursor)
+	}
+	if s := c.QueryParam("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			return "", nil, "", false
+		}
+		limit = " LIMIT " + strconv.Itoa(n)
+	}
+	return cond, args, limit, true
+}
+
+// scanReport scans a row of reportColumnsSQL, followed by the extra columns
+// given by dest.
+func scanReport(rows *sql.Rows, dest ...interface{}) (*Report, error) {
+	var reservation Reservation
+	var sheet Sheet
+	var orderStatus *string
+	if err := rows.Scan(append([]interface{}{&reservation.ID, &reservation.EventID, &reservation.UserID, &reservation.ReservedAt, &reservation.CanceledAt, &sheet.Rank, &sheet.Num, &reservation.Price, &orderStatus}, dest...)...); err != nil {
+		return nil, err
+	}
+	report := &Report{
+		ReservationID: reservation.ID,
+		EventID:       reservation.EventID,
+		Rank:          sheet.Rank,
+		Num:           sheet.Num,
+		UserID:        reservation.UserID,
+		SoldAt:        reservation.ReservedAt.Format("2006-01-02T15:04:05.000000Z"),
+		Price:         reservation.Price,
+	}
+	if reservation.CanceledAt != nil {
+		report.CanceledAt = reservation.CanceledAt.Format("2006-01-02T15:04:05.000000Z")
+	}
+	report.settle(orderStatus)
+	return report, nil
+}
+
+// renderReport writes the rows of reportSQL as they are read, without loading
+// all of them, in JSON Lines if the client accepts it and in CSV otherwise.
+func renderReport(c echo.Context, rows *sql.Rows) error {
+	ndjson := strings.Contains(c.Request().Header.Get("Accept"), mimeNDJSON)
+	if ndjson {
+		c.Response().Header().Set("Content-Type", mimeNDJSON)
+	} else {
+		c.Response().Header().Set("Content-Type", `text/csv; charset=UTF-8`)
+		c.Response().Header().Set("Content-Disposition", `attachment; filename="report.csv"`)
+	}
+	c.Response().WriteHeader(200)
+
+	enc := json.NewEncoder(c.Response())
+	if !ndjson {
+		if _, err := io.WriteString(c.Response(), "reservation_id,event_id,rank,num,price,user_id,sold_at,canceled_at,refund,fee,net\n"); err != nil {
+			return err
+		}
+	}
+
+	for rows.Next() {
+		report, err := scanReport(rows)
+		if err != nil {
+			return err
+		}
+
+		if ndjson {
+			// Encode terminates every value with a newline.
+			if err := enc.Encode(report); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err := fmt.Fprintf(c.Response(), "%d,%d,%s,%d,%d,%d,%s,%s,%d,%d,%d\n",
+			report.ReservationID, report.EventID, report.Rank, report.Num, report.Price, report.UserID, report.SoldAt, report.CanceledAt, report.Refund, report.Fee, report.Net); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// renderReportSummaryCSV writes the totals of the reservations grouped by
+// event and rank, where gross is the amount charged, which is the sum of
+// refund, fee and net.
+func renderReportSummaryCSV(c echo.Context, rows *sql.Rows) error {
+	c.Response().Header().Set("Content-Type", `text/csv; charset=UTF-8`)
+	c.Response().Header().Set("Content-Disposition", `attachment; filename="summary.csv"`)
+	c.Response().WriteHeader(200)
+	if _, err := io.WriteString(c.Response(), "event_id,rank,sold,canceled,gross,refund,fee,net\n"); err != nil {
+		return err
+	}
+
+	for rows.Next() {
+		var eventID, sold, canceled, gross, refund, fee int64
+		var rank string
+		if err := rows.Scan(&eventID, &rank, &sold, &canceled, &gross, &refund, &fee); err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(c.Response(), "%d,%s,%d,%d,%d,%d,%d,%d\n", eventID, rank, sold, canceled, gross, refund, fee, gross-refund-fee); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"time"
+)
+
+const scheduleInterval = 1 * time.Second
+
+// setScheduleUnix fills the unix time fields of the schedule for JSON.
+func (e *Event) setScheduleUnix() {
+	e.StartAtUnix, e.SalesOpenAtUnix, e.SalesCloseAtUnix = 0, 0, 0
+	if e.StartAt != nil {
+		e.StartAtUnix = e.StartAt.Unix()
+	}
+	if e.SalesOpenAt != nil {
+		e.SalesOpenAtUnix = e.SalesOpenAt.Unix()
+	}
+	if e.SalesCloseAt != nil {
+		e.SalesCloseAtUnix = e.SalesCloseAt.Unix()
+	}
+}
+
+// salesError returns the error code for resError if the sheets of the event
+// can not be sold at now.
+func (e *Event) salesError(now time.Time) string {
+	if e.SalesOpenAt != nil && now.Before(*e.SalesOpenAt) {
+		return "sales_not_open"
+	}
+	if e.SalesCloseAt != nil && !now.Before(*e.SalesCloseAt) {
+		return "sales_closed"
+	}
+	return ""
+}
+
+// parseSchedule converts the unix times of a request, where 0 means unset. It
+// returns false if the sales window is empty or ends after the event starts.
+func parseSchedule(startUnix, salesOpenUnix, salesCloseUnix int64) (startAt, salesOpenAt, salesCloseAt *time.Time, ok bool) {
+	toTime := func(unix int64) *time.Time {
+		if unix == 0 {
+			return nil
+		}
+		t := time.Unix(unix, 0).UTC()
+		return &t
+	}
+	if startUnix < 0 || salesOpenUnix < 0 || salesCloseUnix < 0 {
+		return nil, nil, nil, false
+	}
+	startAt, salesOpenAt, salesCloseAt = toTime(startUnix), toTime(salesOpenUnix), toTime(salesCloseUnix)
+	if salesOpenAt != nil && salesCloseAt != nil && !salesOpenAt.Before(*salesCloseAt) {
+		return nil, nil, nil, false
+	}
+	if startAt != nil && salesCloseAt != nil && salesCloseAt.After(*startAt) {
+		return nil, nil, nil, false
+	}
+	return startAt, salesOpenAt, salesCloseAt, true
+}
+
+func formatScheduleTime(t *time.Time) interface{} {
+	if t == nil {
+		return nil
+	}
+	return t.UTC().Format("2006-01-02 15:04:05.000000")
+}
+
+// applySchedules publishes the events when their sales open and closes the
+// ones whose sales have ended. A closed event is never reopened.
+func applySchedules() error {
+	now := time.Now().UTC().Format("2006-01-02 15:04:05.000000")
+	if err := openSales(now); err != nil {
+		return err
+	}
+	return applySchedule(webhookEventClosed, "public_fg = 0, closed_fg = 1", "closed_fg = 0 AND deleted_at IS NULL AND sales_close_at <= ?", now)
+}
+
+const salesOpenCond = "closed_fg = 0 AND deleted_at IS NULL AND sales_open_at <= ? AND (sales_close_at IS NULL OR sales_close_at > ?)"
+
+// openSales publishes the events whose sales have opened since the last run.
+// Each opening is recorded in event_sales_openings and applied once, so that
+// an event unpublished by hand after its sales opened is left so, until its
+// sales are scheduled to open again.
+func openSales(now string) error {
+	rows, err := db.Query("SELECT id FROM events WHERE "+salesOpenCond+" AND NOT EXISTS (SELECT * FROM event_sales_openings o WHERE o.event_id = events.id AND o.sales_open_at = events.sales_open_at)", now, now)
+	if err != nil {
+		return err
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		if err := openEventSales(id, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func openEventSales(eventID int64, now string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	// The event may have been edited, or opened by another server, since
+	// selected.
+	var salesOpenAt time.Time
+	var public bool
+	if err := tx.QueryRow("SELECT sales_open_at, public_fg FROM events WHERE id = ? AND "+salesOpenCond+" FOR UPDATE", eventID, now, now).Scan(&salesOpenAt, &public); err != nil {
+		tx.Rollback()
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		return err
+	}
+	var opened time.Time
+	if err := tx.QueryRow("SELECT sales_open_at FROM event_sales_openings WHERE event_id = ?", eventID).Scan(&opened); err != nil && err != sql.ErrNoRows {
+		tx.Rollback()
+		return err
+	}
+	if opened.Equal(salesOpenAt) {
+		tx.Rollback()
+		return nil
+	}
+	if _, err := tx.Exec("INSERT INTO event_sales_openings (event_id, sales_open_at) VALUES (?, ?) ON DUPLICATE KEY UPDATE sales_open_at = VALUES(sales_open_at)", eventID, salesOpenAt.Format("2006-01-02 15:04:05.000000")); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if !public {
+		if _, err := tx.Exec("UPDATE events SET public_fg = 1 WHERE id = ?", eventID); err != nil {
+			tx.Rollback()
+			return err
+		}
+		var event Event
+		if err := tx.QueryRow("SELECT * FROM events WHERE id = ?", eventID).Scan(&event.ID, &event.Title, &event.PublicFg, &event.ClosedFg, &event.Price, &event.VenueID, &event.StartAt, &event.SalesOpenAt, &event.SalesCloseAt, &event.DeletedAt); err != nil {
+			tx.Rollback()
+			return err
+		}
+		event.setScheduleUnix()
+		if err := insertWebhookDeliveries(tx, webhookEventPublished, webhookEventData(&event)); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// applySchedule sets the events matching cond one by one, queueing the
+// webhook of the event type along with each of them.
+func applySchedule(eventType, set, cond string, args ...interface{}) error {
+	rows, err := db.Query("SELECT id FROM events WHERE "+cond, args...)
+	if err != nil {
+		return err
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		// The event may have been edited since selected.
+		res, err := tx.Exec("UPDATE events SET "+set+" WHERE id = ? AND "+cond, append([]interface{}{id}, args...)...)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil || n == 0 {
+			tx.Rollback()
+			continue
+		}
+		var event Event
+		if err := tx.QueryRow("SELECT * FROM events WHERE id = ?", id).Scan(&event.ID, &event.Title, &event.PublicFg, &event.ClosedFg, &event.Price, &event.VenueID, &event.StartAt, &event.SalesOpenAt, &event.SalesCloseAt, &event.DeletedAt); err != nil {
+			tx.Rollback()
+			return err
+		}
+		event.setScheduleUnix()
+		if err := insertWebhookDeliveries(tx, eventType, webhookEventData(&event)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runScheduler() {
+	for range time.Tick(scheduleInterval) {
+		if err := applySchedules(); err != nil {
+			log.Println("failed to apply event schedules:", err)
+		}
+	}
+}
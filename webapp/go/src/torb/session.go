@@ -0,0 +1,348 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+const (
+	sessionMaxAge        = 3600
+	sessionSweepInterval = time.Minute
+)
+
+// SessionData is what a session holds on the server. Zero ids mean logged out.
+type SessionData struct {
+	UserID                int64
+	UserNickname          string
+	AdministratorID       int64
+	AdministratorNickname string
+	AdministratorRole     string
+}
+
+func (d *SessionData) empty() bool {
+	return d.UserID == 0 && d.AdministratorID == 0
+}
+
+// SessionBackend stores sessions by their ids.
+type SessionBackend interface {
+	// Load returns nil if the session does not exist or has expired.
+	Load(id string) (*SessionData, error)
+	Save(id string, data *SessionData, expiresAt time.Time) error
+	Delete(id string) error
+	// RevokeUser logs the user out of every session, leaving any
+	// administrator logged in with the user as it is.
+	RevokeUser(userID int64) error
+	RevokeAdministrator(administratorID int64) error
+	DeleteExpired(now time.Time) error
+}
+
+var sessionBackend SessionBackend
+
+// newSessionBackend returns the backend selected by SESSION_BACKEND.
+func newSessionBackend() SessionBackend {
+	switch mode := os.Getenv("SESSION_BACKEND"); mode {
+	case "", "memory":
+		return newMemorySessionBackend()
+	case "mysql":
+		return &mysqlSessionBackend{}
+	default:
+		log.Fatalf("unknown session backend: %s", mode)
+	}
+	return nil
+}
+
+func sweepExpiredSessions() {
+	for range time.Tick(sessionSweepInterval) {
+		if err := sessionBackend.DeleteExpired(time.Now()); err != nil {
+			log.Println("failed to delete expired sessions:", err)
+		}
+	}
+}
+
+// sessionKeys returns the keys to sign session cookies with, given by
+// SESSION_KEYS separated by commas. Cookies are signed with the first key and
+// verified with any of them, so that a new key can be prepended and the old
+// one dropped once the cookies signed with it have expired.
+func sessionKeys() [][]byte {
+	var keys [][]byte
+	for _, key := range strings.Split(os.Getenv("SESSION_KEYS"), ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			keys = append(keys, []byte(key))
+		}
+	}
+	if len(keys) == 0 {
+		keys = append(keys, []byte("secret"))
+	}
+	return keys
+}
+
+// serverSessionStore is a sessions.Store whose cookies carry only the signed
+// session id. It keeps the values of SessionData only.
+type serverSessionStore struct {
+	backend SessionBackend
+	codecs  []securecookie.Codec
+	options *sessions.Options
+}
+
+func newServerSessionStore(backend SessionBackend, keys [][]byte) *serverSessionStore {
+	var pairs [][]byte
+	for _, key := range keys {
+		pairs = append(pairs, key, nil)
+	}
+	codecs := securecookie.CodecsFromPairs(pairs...)
+	for _, codec := range codecs {
+		if sc, ok := codec.(*securecookie.SecureCookie); ok {
+			sc.MaxAge(sessionMaxAge)
+		}
+	}
+	return &serverSessionStore{
+		backend: backend,
+		codecs:  codecs,
+		options: &sessions.Options{
+			Path:     "/",
+			MaxAge:   sessionMaxAge,
+			HttpOnly: true,
+		},
+	}
+}
+
+func (s *serverSessionStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+// New loads the session of the request. A cookie which is forged, signed with
+// a dropped key or pointing at a revoked session starts a new one.
+func (s *serverSessionStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	options := *s.options
+	session.Options = &options
+	session.IsNew = true
+
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+	var id string
+	if err := securecookie.DecodeMulti(name, cookie.Value, &id, s.codecs...); err != nil {
+		return session, nil
+	}
+	data, err := s.backend.Load(id)
+	if err != nil {
+		return session, err
+	}
+	if data == nil {
+		return session, nil
+	}
+
+	session.ID = id
+	session.IsNew = false
+	if data.UserID != 0 {
+		session.Values["user_id"] = data.UserID
+		session.Values["user_nickname"] = data.UserNickname
+	}
+	if data.AdministratorID != 0 {
+		session.Values["administrator_id"] = data.AdministratorID
+		session.Values["administrator_nickname"] = data.AdministratorNickname
+		session.Values["administrator_role"] = data.AdministratorRole
+	}
+	return session, nil
+}
+
+// Save stores the session, or deletes it once nobody is logged in.
+func (s *serverSessionStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	var data SessionData
+	data.UserID, _ = session.Values["user_id"].(int64)
+	data.UserNickname, _ = session.Values["user_nickname"].(string)
+	data.AdministratorID, _ = session.Values["administrator_id"].(int64)
+	data.AdministratorNickname, _ = session.Values["administrator_nickname"].(string)
+	data.AdministratorRole, _ = session.Values["administrator_role"].(string)
+
+	if session.Options.MaxAge <= 0 || data.empty() {
+		if session.ID != "" {
+			if err := s.backend.Delete(session.ID); err != nil {
+				return err
+			}
+		}
+		options := *session.Options
+		options.MaxAge = -1
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", &options))
+		return nil
+	}
+
+	if session.ID == "" {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			return err
+		}
+		session.ID = hex.EncodeToString(b)
+	}
+	expiresAt := time.Now().Add(time.Duration(session.Options.MaxAge) * time.Second)
+	if err := s.backend.Save(session.ID, &data, expiresAt); err != nil {
+		return err
+	}
+
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, s.codecs...)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
+
+type memorySession struct {
+	SessionData
+	expiresAt time.Time
+}
+
+// memorySessionBackend keeps sessions in this process, so that they are lost
+// on restart and not shared between servers.
+type memorySessionBackend struct {
+	mu       sync.Mutex
+	sessions map[string]*memorySession
+}
+
+func newMemorySessionBackend() *memorySessionBackend {
+	return &memorySessionBackend{sessions: map[string]*memorySession{}}
+}
+
+func (b *memorySessionBackend) Load(id string) (*SessionData, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	session, ok := b.sessions[id]
+	if !ok || !time.Now().Before(session.expiresAt) {
+		return nil, nil
+	}
+	data := session.SessionData
+	return &data, nil
+}
+
+func (b *memorySessionBackend) Save(id string, data *SessionData, expiresAt time.Time) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.sessions[id] = &memorySession{SessionData: *data, expiresAt: expiresAt}
+	return nil
+}
+
+func (b *memorySessionBackend) Delete(id string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.sessions, id)
+	return nil
+}
+
+func (b *memorySessionBackend) RevokeUser(userID int64) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for id, session := range b.sessions {
+		if session.UserID != userID {
+			continue
+		}
+		session.UserID = 0
+		session.UserNickname = ""
+		if session.empty() {
+			delete(b.sessions, id)
+		}
+	}
+	return nil
+}
+
+func (b *memorySessionBackend) RevokeAdministrator(administratorID int64) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for id, session := range b.sessions {
+		if session.AdministratorID != administratorID {
+			continue
+		}
+		session.AdministratorID = 0
+		session.AdministratorNickname = ""
+		session.AdministratorRole = ""
+		if session.empty() {
+			delete(b.sessions, id)
+		}
+	}
+	return nil
+}
+
+func (b *memorySessionBackend) DeleteExpired(now time.Time) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for id, session := range b.sessions {
+		if !now.Before(session.expiresAt) {
+			delete(b.sessions, id)
+		}
+	}
+	return nil
+}
+
+// mysqlSessionBackend keeps sessions in the sessions table, so that they are
+// shared between servers.
+type mysqlSessionBackend struct{}
+
+func (b *mysqlSessionBackend) Load(id string) (*SessionData, error) {
+	var data SessionData
+	var userNickname, administratorNickname, administratorRole sql.NullString
+	err := db.QueryRow("SELECT IFNULL(user_id, 0), user_nickname, IFNULL(administrator_id, 0), administrator_nickname, administrator_role FROM sessions WHERE id = ? AND expires_at > ?", id, time.Now().UTC().Format("2006-01-02 15:04:05.000000")).Scan(&data.UserID, &userNickname, &data.AdministratorID, &administratorNickname, &administratorRole)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	data.UserNickname = userNickname.String
+	data.AdministratorNickname = administratorNickname.String
+	data.AdministratorRole = administratorRole.String
+	if data.empty() {
+		return nil, nil
+	}
+	return &data, nil
+}
+
+func (b *mysqlSessionBackend) Save(id string, data *SessionData, expiresAt time.Time) error {
+	var userID, userNickname, administratorID, administratorNickname, administratorRole interface{}
+	if data.UserID != 0 {
+		userID, userNickname = data.UserID, data.UserNickname
+	}
+	if data.AdministratorID != 0 {
+		administratorID, administratorNickname, administratorRole = data.AdministratorID, data.AdministratorNickname, data.AdministratorRole
+	}
+	_, err := db.Exec("INSERT INTO sessions (id, user_id, user_nickname, administrator_id, administrator_nickname, administrator_role, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE user_id = VALUES(user_id), user_nickname = VALUES(user_nickname), administrator_id = VALUES(administrator_id), administrator_nickname = VALUES(administrator_nickname), administrator_role = VALUES(administrator_role), expires_at = VALUES(expires_at)",
+		id, userID, userNickname, administratorID, administratorNickname, administratorRole, expiresAt.UTC().Format("2006-01-02 15:04:05.000000"))
+	return err
+}
+
+func (b *mysqlSessionBackend) Delete(id string) error {
+	_, err := db.Exec("DELETE FROM sessions WHERE id = ?", id)
+	return err
+}
+
+// Sessions left with nobody logged in are never loaded, and swept on expiry.
+func (b *mysqlSessionBackend) RevokeUser(userID int64) error {
+	_, err := db.Exec("UPDATE sessions SET user_id = NULL, user_nickname = NULL WHERE user_id = ?", userID)
+	return err
+}
+
+func (b *mysqlSessionBackend) RevokeAdministrator(administratorID int64) error {
+	_, err := db.Exec("UPDATE sessions SET administrator_id = NULL, administrator_nickname = NULL, administrator_role = NULL WHERE administrator_id = ?", administratorID)
+	return err
+}
+
+func (b *mysqlSessionBackend) DeleteExpired(now time.Time) error {
+	_, err := db.Exec("DELETE FROM sessions WHERE expires_at <= ?", now.UTC().Format("2006-01-02 15:04:05.000000"))
+	return err
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	streamHistorySize       = 256 // messages kept per event for Last-Event-ID resume
+	streamSubscriberBuffer  = 64
+	streamHeartbeatInterval = 15 * time.Second
+)
+
+type streamMessage struct {
+	Seq   int64
+	ID    string
+	Event string
+	Data  []byte
+}
+
+func (m *streamMessage) writeTo(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", m.ID, m.Event, m.Data)
+	return err
+}
+
+type eventStream struct {
+	seq         int64
+	history     []*streamMessage
+	last        map[string]int // rank => last published remains
+	subscribers map[chan *streamMessage]bool
+}
+
+// streamBroker fans out remains changes of every event to the subscribers of
+// GET /api/events/:id/stream. Message ids are "<epoch>.<seq>"; the epoch
+// changes when the availability index is reloaded, so that ids of an old
+// epoch are never resumed.
+type streamBroker struct {
+	mu      sync.Mutex
+	epoch   int64
+	streams map[int64]*eventStream
+}
+
+var streams = &streamBroker{}
+
+func (b *streamBroker) reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, s := range b.streams {
+		for ch := range s.subscribers {
+			close(ch)
+		}
+	}
+	b.epoch = time.Now().UnixNano()
+	b.streams = map[int64]*eventStream{}
+}
+
+func (b *streamBroker) streamLocked(eventID int64) *eventStream {
+	s, ok := b.streams[eventID]
+	if !ok {
+		s = &eventStream{
+			last:        map[string]int{},
+			subscribers: map[chan *streamMessage]bool{},
+		}
+		b.streams[eventID] = s
+	}
+	return s
+}
+
+func (b *streamBroker) messageLocked(s *eventStream, event string, v interface{}) *streamMessage {
+	data, _ := json.Marshal(v)
+	return &streamMessage{
+		Seq:   s.seq,
+		ID:    fmt.Sprintf("%d.%d", b.epoch, s.seq),
+		Event: event,
+		Data:  data,
+	}
+}
+
+// publish pushes the remains of the rank if it differs from the last pushed
+// one. before is the remains prior to the change, used when nothing has been
+// pushed for the rank yet.
+func (b *streamBroker) publish(eventID int64, rank string, before, after int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s := b.streamLocked(eventID)
+	prev, ok := s.last[rank]
+	if !ok {
+		prev = before
+	}
+	if after == prev {
+		return
+	}
+	s.last[rank] = after
+
+	s.seq++
+	msg := b.messageLocked(s, "remains", map[string]interface{}{
+		"sheet_rank": rank,
+		"remains":    after,
+		"delta":      after - prev,
+	})
+	s.history = append(s.history, msg)
+	if len(s.history) > streamHistorySize {
+		s.history = s.history[len(s.history)-streamHistorySize:]
+	}
+
+	for ch := range s.subscribers {
+		select {
+		case ch <- msg:
+		default:
+			// Too slow to follow; the client resumes with Last-Event-ID.
+			close(ch)
+			delete(s.subscribers, ch)
+		}
+	}
+}
+
+// subscribe returns the messages to send first and the channel of the
+// following ones. The missed messages are replayed if lastEventID is still in
+// the history, otherwise a snapshot of remains is sent.
+func (b *streamBroker) subscribe(eventID int64, lastEventID string, remains map[string]int) ([]*streamMessage, chan *streamMessage) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s := b.streamLocked(eventID)
+	for rank, n := range remains {
+		if _, ok := s.last[rank]; !ok {
+			s.last[rank] = n
+		}
+	}
+
+	var backlog []*streamMessage
+	if seq, ok := b.parseIDLocked(lastEventID); ok && seq <= s.seq && (len(s.history) == 0 || s.history[0].Seq <= seq+1) {
+		for _, msg := range s.history {
+			if msg.Seq > seq {
+				backlog = append(backlog, msg)
+			}
+		}
+	} else {
+		backlog = append(backlog, b.messageLocked(s, "snapshot", map[string]interface{}{
+			"remains": remains,
+		}))
+	}
+
+	ch := make(chan *streamMessage, streamSubscriberBuffer)
+	s.subscribers[ch] = true
+	return backlog, ch
+}
+
+func (b *streamBroker) unsubscribe(eventID int64, ch chan *streamMessage) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if s, ok := b.streams[eventID]; ok && s.subscribers[ch] {
+		close(ch)
+		delete(s.subscribers, ch)
+	}
+}
+
+func (b *streamBroker) parseIDLocked(id string) (int64, bool) {
+	i := strings.IndexByte(id, '.')
+	if i < 0 {
+		return 0, false
+	}
+	epoch, err := strconv.ParseInt(id[:i], 10, 64)
+	if err != nil || epoch != b.epoch {
+		return 0, false
+	}
+	seq, err := strconv.ParseInt(id[i+1:], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return seq, true
+}
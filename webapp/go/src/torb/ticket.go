@@ -0,0 +1,201 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+var ticketKey []byte
+
+// newTicketKey returns the key to sign tickets with, given by TICKET_SECRET.
+// Without it, tickets are signed with a random key and become invalid on
+// restart.
+func newTicketKey() []byte {
+	if key := os.Getenv("TICKET_SECRET"); key != "" {
+		return []byte(key)
+	}
+	log.Println("TICKET_SECRET is not set; tickets are signed with a random key")
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		log.Fatal(err)
+	}
+	return key
+}
+
+// Ticket is the admission to the sheet of a reservation. It is issued to the
+// owner, so that the ticket of the sender becomes invalid on a transfer.
+type Ticket struct {
+	ReservationID int64      `json:"reservation_id"`
+	EventID       int64      `json:"event_id"`
+	SheetRank     string     `json:"sheet_rank"`
+	SheetNum      int64      `json:"sheet_num"`
+	UserID        int64      `json:"-"`
+	Token         string     `json:"token"`
+	CheckedInAt   *time.Time `json:"-"`
+
+	CheckedInAtUnix *int64 `json:"checked_in_at"`
+}
+
+func (t *Ticket) payload() string {
+	return fmt.Sprintf("%d.%d.%s.%d.%d", t.ReservationID, t.EventID, t.SheetRank, t.SheetNum, t.UserID)
+}
+
+func (t *Ticket) sign() {
+	mac := hmac.New(sha256.New, ticketKey)
+	mac.Write([]byte(t.payload()))
+	t.Token = t.payload() + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// parseTicket verifies the token without the database, so that it can be
+// checked offline with the key. It returns nil if the token is forged.
+func parseTicket(token string) *Ticket {
+	parts := strings.Split(token, ".")
+	if len(parts) != 6 {
+		return nil
+	}
+	sum, err := base64.RawURLEncoding.DecodeString(parts[5])
+	if err != nil {
+		return nil
+	}
+	mac := hmac.New(sha256.New, ticketKey)
+	mac.Write([]byte(strings.Join(parts[:5], ".")))
+	if !hmac.Equal(sum, mac.Sum(nil)) {
+		return nil
+	}
+
+	t := &Ticket{SheetRank: parts[2], Token: token}
+	if t.ReservationID, err = strconv.ParseInt(parts[0], 10, 64); err != nil {
+		return nil
+	}
+	if t.EventID, err = strconv.ParseInt(parts[1], 10, 64); err != nil {
+		return nil
+	}
+	if t.SheetNum, err = strconv.ParseInt(parts[3], 10, 64); err != nil {
+		return nil
+	}
+	if t.UserID, err = strconv.ParseInt(parts[4], 10, 64); err != nil {
+		return nil
+	}
+	return t
+}
+
+// ticketSQL selects the rows scanned by scanTicket, given reservations r.
+const ticketSQL = "SELECT r.id, r.event_id, r.user_id, s.rank, s.num, r.canceled_at, r.checked_in_at, o.status FROM reservations r INNER JOIN sheets s ON s.id = r.sheet_id LEFT JOIN orders o ON o.id = r.order_id"
+
+// scanTicket returns the ticket of the row, and the error code for resError if
+// the ticket is not issued.
+func scanTicket(row *sql.Row) (*Ticket, string, error) {
+	var t Ticket
+	var canceledAt *time.Time
+	var orderStatus sql.NullString
+	if err := row.Scan(&t.ReservationID, &t.EventID, &t.UserID, &t.SheetRank, &t.SheetNum, &canceledAt, &t.CheckedInAt, &orderStatus); err != nil {
+		return nil, "", err
+	}
+	if t.CheckedInAt != nil {
+		unix := t.CheckedInAt.Unix()
+		t.CheckedInAtUnix = &unix
+	}
+	t.sign()
+
+	if canceledAt != nil {
+		return &t, "ticket_canceled", nil
+	}
+	// Reservations made before orders were introduced have no order.
+	if orderStatus.Valid && orderStatus.String != orderStatusPaid {
+		return &t, "ticket_unavailable", nil
+	}
+	return &t, "", nil
+}
+
+// getUserTicket returns the ticket of the reservation in the path, which
+// only its owner can get. It returns the error code and status for resError
+// if the ticket is not issued.
+func getUserTicket(c echo.Context) (*Ticket, string, int, error) {
+	reservationID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return nil, "not_found", 404, nil
+	}
+	user, err := getLoginUser(c)
+	if err != nil {
+		return nil, "", 0, err
+	}
+
+	t, errCode, err := scanTicket(db.QueryRow(ticketSQL+" WHERE r.id = ?", reservationID))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, "not_found", 404, nil
+		}
+		return nil, "", 0, err
+	}
+	if t.UserID != user.ID {
+		return nil, "forbidden", 403, nil
+	}
+	if errCode != "" {
+		return nil, errCode, 409, nil
+	}
+	return t, "", 0, nil
+}
+
+// checkInTicket admits the holder of the token to the event. It returns the
+// error code for resError if the ticket is invalid or already used.
+func checkInTicket(eventID int64, token string) (*Ticket, string, error) {
+	parsed := parseTicket(token)
+	if parsed == nil {
+		return nil, "invalid_ticket", nil
+	}
+	if parsed.EventID != eventID {
+		return nil, "wrong_event", nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, "", err
+	}
+
+	t, errCode, err := scanTicket(tx.QueryRow(ticketSQL+" WHERE r.id = ? FOR UPDATE", parsed.ReservationID))
+	if err != nil {
+		tx.Rollback()
+		if err == sql.ErrNoRows {
+			return nil, "invalid_ticket", nil
+		}
+		return nil, "", err
+	}
+	// The seat and the owner in the token must be the current ones.
+	if t.Token != parsed.Token {
+		tx.Rollback()
+		return nil, "invalid_ticket", nil
+	}
+	if errCode != "" {
+		tx.Rollback()
+		return nil, errCode, nil
+	}
+	if t.CheckedInAt != nil {
+		tx.Rollback()
+		return t, "already_checked_in", nil
+	}
+
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	if _, err := tx.Exec("UPDATE reservations SET checked_in_at = ? WHERE id = ?", now.Format("2006-01-02 15:04:05.000000"), t.ReservationID); err != nil {
+		tx.Rollback()
+		return nil, "", err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, "", err
+	}
+
+	unix := now.Unix()
+	t.CheckedInAt = &now
+	t.CheckedInAtUnix = &unix
+	return t, "", nil
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+const (
+	transferStatusPending  = "pending"
+	transferStatusAccepted = "accepted"
+	transferStatusDeclined = "declined"
+	transferStatusCanceled = "canceled"
+)
+
+var (
+	errInvalidRecipient = errors.New("invalid recipient")
+	errNotTransferable  = errors.New("not transferable")
+	errTransferPending  = errors.New("transfer pending")
+	errTransferClosed   = errors.New("transfer closed")
+	errNotTransferParty = errors.New("not a party of the transfer")
+)
+
+// Transfer moves a reservation from a user to another, once the recipient
+// accepts it. The reservation keeps its id, reserved_at and order, so that it
+// is reported as it was sold, and a refund after the transfer goes back to the
+// payment of the sender.
+type Transfer struct {
+	ID            int64      `json:"id"`
+	ReservationID int64      `json:"reservation_id"`
+	FromUserID    int64      `json:"-"`
+	ToUserID      int64      `json:"-"`
+	Status        string     `json:"status"`
+	CreatedAt     *time.Time `json:"-"`
+	UpdatedAt     *time.Time `json:"-"`
+
+	Event         *Event `json:"event,omitempty"`
+	SheetRank     string `json:"sheet_rank"`
+	SheetNum      int64  `json:"sheet_num"`
+	From          *User  `json:"from"`
+	To            *User  `json:"to"`
+	CreatedAtUnix int64  `json:"created_at"`
+	UpdatedAtUnix int64  `json:"updated_at"`
+}
+
+// lockTransferableReservation locks the reservation within tx, in the same
+// order as cancellations do. It returns errNotTransferable if the ticket of
+// the reservation is not issued or has been used.
+func lockTransferableReservation(tx *sql.Tx, reservationID int64) (*Reservation, error) {
+	var r Reservation
+	var orderStatus sql.NullString
+	if err := tx.QueryRow("SELECT r.id, r.event_id, r.sheet_id, r.user_id, r.canceled_at, r.checked_in_at, o.status FROM reservations r LEFT JOIN orders o ON o.id = r.order_id WHERE r.id = ? FOR UPDATE", reservationID).Scan(&r.ID, &r.EventID, &r.SheetID, &r.UserID, &r.CanceledAt, &r.CheckedInAt, &orderStatus); err != nil {
+		return nil, err
+	}
+	if r.CanceledAt != nil || r.CheckedInAt != nil || (orderStatus.Valid && orderStatus.String != orderStatusPaid) {
+		return &r, errNotTransferable
+	}
+	return &r, nil
+}
+
+// createTransfer offers the reservation of the user to the user with the login
+// name. It returns sql.ErrNoRows for an unknown reservation,
+// errNotTransferParty if somebody else owns it, errInvalidRecipient if the
+// recipient does not exist or is the sender and errTransferPending if it has
+// been offered already.
+func createTransfer(reservationID, userID int64, loginName string) (*Transfer, error) {
+	var toUserID int64
+	if err := db.QueryRow("SELECT id FROM users WHERE login_name = ?", loginName).Scan(&toUserID); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errInvalidRecipient
+		}
+		return nil, err
+	}
+	if toUserID == userID {
+		return nil, errInvalidRecipient
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	reservation, err := lockTransferableReservation(tx, reservationID)
+	if reservation != nil && reservation.UserID != userID {
+		tx.Rollback()
+		return nil, errNotTransferParty
+	}
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	var pending bool
+	if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM reservation_transfers WHERE reservation_id = ? AND status = ? FOR UPDATE)", reservationID, transferStatusPending).Scan(&pending); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if pending {
+		tx.Rollback()
+		return nil, errTransferPending
+	}
+
+	now := time.Now().UTC().Format("2006-01-02 15:04:05.000000")
+	res, err := tx.Exec("INSERT INTO reservation_transfers (reservation_id, from_user_id, to_user_id, status, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?)", reservationID, userID, toUserID, transferStatusPending, now, now)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	transferID, err := res.LastInsertId()
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return getTransfer(transferID)
+}
+
+// lockTransfer locks the transfer and its reservation within tx, the
+// reservation first. It returns the reservation along with
+// errNotTransferable if it may no longer be transferred.
+func lockTransfer(tx *sql.Tx, transferID int64) (*Transfer, *Reservation, error) {
+	var reservationID int64
+	if err := tx.QueryRow("SELECT reservation_id FROM reservation_transfers WHERE id = ?", transferID).Scan(&reservationID); err != nil {
+		return nil, nil, err
+	}
+	reservation, rerr := lockTransferableReservation(tx, reservationID)
+	if rerr != nil && rerr != errNotTransferable {
+		return nil, nil, rerr
+	}
+
+	var t Transfer
+	if err := tx.QueryRow("SELECT id, reservation_id, from_user_id, to_user_id, status FROM reservation_transfers WHERE id = ? FOR UPDATE", transferID).Scan(&t.ID, &t.ReservationID, &t.FromUserID, &t.ToUserID, &t.Status); err != nil {
+		return nil, nil, err
+	}
+	if rerr == nil && reservation.UserID != t.FromUserID {
+		rerr = errNotTransferable
+	}
+	return &t, reservation, rerr
+}
+
+// acceptTransfer moves the reservation to the recipient, within the purchase
+// limits of the recipient. It returns sql.ErrNoRows for an unknown transfer,
+// errNotTransferParty if the user is not the recipient, errTransferClosed
+// if it is no longer pending and errNotTransferable if the reservation has
+// been canceled or used meanwhile.
+func acceptTransfer(transferID, userID int64) (*Transfer, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	t, reservation, err := lockTransfer(tx, transferID)
+	if t != nil && t.ToUserID != userID {
+		tx.Rollback()
+		return nil, errNotTransferParty
+	}
+	if t != nil && t.Status != transferStatusPending {
+		tx.Rollback()
+		return nil, errTransferClosed
+	}
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if err := checkPurchaseLimits(tx, reservation.EventID, userID, 1); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if _, err := tx.Exec("UPDATE reservations SET user_id = ? WHERE id = ?", userID, reservation.ID); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if _, err := tx.Exec("UPDATE reservation_transfers SET status = ?, updated_at = ? WHERE id = ?", transferStatusAccepted, time.Now().UTC().Format("2006-01-02 15:04:05.000000"), t.ID); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := touchReservations(tx, reservation.ID); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	availability.transfer(reservation.EventID, reservation.SheetID, reservation.ID, userID)
+	return getTransfer(t.ID)
+}
+
+// closeTransfer withdraws a pending transfer by the sender, or declines it by
+// the recipient.
+func closeTransfer(transferID, userID int64) (*Transfer, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	var t Transfer
+	if err := tx.QueryRow("SELECT id, from_user_id, to_user_id, status FROM reservation_transfers WHERE id = ? FOR UPDATE", transferID).Scan(&t.ID, &t.FromUserID, &t.ToUserID, &t.Status); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	var status string
+	switch userID {
+	case t.FromUserID:
+		status = transferStatusCanceled
+	case t.ToUserID:
+		status = transferStatusDeclined
+	default:
+		tx.Rollback()
+		return nil, errNotTransferParty
+	}
+	if t.Status != transferStatusPending {
+		tx.Rollback()
+		return nil, errTransferClosed
+	}
+
+	if _, err := tx.Exec("UPDATE reservation_transfers SET status = ?, updated_at = ? WHERE id = ?", status, time.Now().UTC().Format("2006-01-02 15:04:05.000000"), t.ID); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return getTransfer(t.ID)
+}
+
+// cancelPendingTransfers withdraws the transfers of the reservation, which has
+// just been canceled within tx.
+func cancelPendingTransfers(tx *sql.Tx, reservationID int64) error {
+	_, err := tx.Exec("UPDATE reservation_transfers SET status = ?, updated_at = ? WHERE reservation_id = ? AND status = ?", transferStatusCanceled, time.Now().UTC().Format("2006-01-02 15:04:05.000000"), reservationID, transferStatusPending)
+	return err
+}
+
+// transferSQL selects the rows scanned by scanTransfers, given
+// reservation_transfers t.
+const transferSQL = "SELECT t.id, t.reservation_id, t.status, t.created_at, t.updated_at, r.event_id, s.rank, s.num, f.id, f.nickname, u.id, u.nickname FROM reservation_transfers t INNER JOIN reservations r ON r.id = t.reservation_id INNER JOIN sheets s ON s.id = r.sheet_id INNER JOIN users f ON f.id = t.from_user_id INNER JOIN users u ON u.id = t.to_user_id"
+
+// scanTransfers scans rows of transferSQL with their events, leaving out the
+// sheets of the events.
+func scanTransfers(rows *sql.Rows) ([]*Transfer, error) {
+	events := map[int64]*Event{}
+	transfers := []*Transfer{}
+	for rows.Next() {
+		t := Transfer{From: &User{}, To: &User{}}
+		var eventID int64
+		if err := rows.Scan(&t.ID, &t.ReservationID, &t.Status, &t.CreatedAt, &t.UpdatedAt, &eventID, &t.SheetRank, &t.SheetNum, &t.From.ID, &t.From.Nickname, &t.To.ID, &t.To.Nickname); err != nil {
+			return nil, err
+		}
+		t.FromUserID = t.From.ID
+		t.ToUserID = t.To.ID
+
+		event, ok := events[eventID]
+		if !ok {
+			var err error
+			event, err = getEvent(eventID, -1)
+			if err != nil {
+				return nil, err
+			}
+			event.Sheets = nil
+			event.Total = 0
+			event.Remains = 0
+			event.Held = 0
+			events[eventID] = event
+		}
+
+		t.Event = event
+		t.CreatedAtUnix = t.CreatedAt.Unix()
+		t.UpdatedAtUnix = t.UpdatedAt.Unix()
+		transfers = append(transfers, &t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return transfers, nil
+}
+
+func getTransfer(transferID int64) (*Transfer, error) {
+	rows, err := db.Query(transferSQL+" WHERE t.id = ?", transferID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	transfers, err := scanTransfers(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(transfers) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return transfers[0], nil
+}
+
+// getRecentTransfers returns the latest transfers the user has sent or
+// received, in any status.
+func getRecentTransfers(userID int64, limit int) ([]*Transfer, error) {
+	rows, err := db.Query(transferSQL+" WHERE t.from_user_id = ? OR t.to_user_id = ? ORDER BY t.id DESC LIMIT ?", userID, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanTransfers(rows)
+}
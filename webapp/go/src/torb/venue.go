@@ -0,0 +1,222 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+)
+
+const (
+	defaultVenueID  = 1
+	maxVenueSheets  = 10000
+	maxVenueRankLen = 128
+)
+
+var venueRankRegexp = regexp.MustCompile(`^[0-9A-Za-z_-]+$`)
+
+type Venue struct {
+	ID    int64        `json:"id"`
+	Name  string       `json:"name"`
+	Ranks []*VenueRank `json:"ranks"`
+}
+
+// VenueRank defines the sheets of a rank. Count sheets are numbered from 1, or
+// they are laid out in Rows x Columns if both are given.
+type VenueRank struct {
+	Rank    string `json:"rank"`
+	Price   int64  `json:"price"`
+	Count   int    `json:"count"`
+	Rows    int    `json:"rows,omitempty"`
+	Columns int    `json:"columns,omitempty"`
+}
+
+type venueLayout struct {
+	ID     int64
+	Name   string
+	ranks  []*VenueRank // ordered by price desc, rank
+	sheets []*Sheet     // ordered as ranks, then by num
+}
+
+// sortSheets orders the ranks and the sheets, and derives the rank
+// definitions from the sheets.
+func (v *venueLayout) sortSheets() {
+	ranks := map[string]*VenueRank{}
+	minRows := map[string]int{}
+	v.ranks = v.ranks[:0]
+	for _, sheet := range v.sheets {
+		r, ok := ranks[sheet.Rank]
+		if !ok {
+			r = &VenueRank{Rank: sheet.Rank, Price: sheet.Price}
+			ranks[sheet.Rank] = r
+			v.ranks = append(v.ranks, r)
+		}
+		r.Count++
+		if sheet.Row > 0 {
+			if first, ok := minRows[sheet.Rank]; !ok || int(sheet.Row) < first {
+				minRows[sheet.Rank] = int(sheet.Row)
+			}
+			if rows := int(sheet.Row) - minRows[sheet.Rank] + 1; rows > r.Rows {
+				r.Rows = rows
+			}
+			if int(sheet.Column) > r.Columns {
+				r.Columns = int(sheet.Column)
+			}
+		}
+	}
+
+	sort.Slice(v.ranks, func(i, j int) bool {
+		if v.ranks[i].Price != v.ranks[j].Price {
+			return v.ranks[i].Price > v.ranks[j].Price
+		}
+		return v.ranks[i].Rank < v.ranks[j].Rank
+	})
+	order := map[string]int{}
+	for i, r := range v.ranks {
+		order[r.Rank] = i
+	}
+	sort.Slice(v.sheets, func(i, j int) bool {
+		a, b := v.sheets[i], v.sheets[j]
+		if a.Rank != b.Rank {
+			return order[a.Rank] < order[b.Rank]
+		}
+		return a.Num < b.Num
+	})
+}
+
+func (v *venueLayout) rank(rank string) *VenueRank {
+	for _, r := range v.ranks {
+		if r.Rank == rank {
+			return r
+		}
+	}
+	return nil
+}
+
+func (v *venueLayout) venue() *Venue {
+	venue := &Venue{ID: v.ID, Name: v.Name, Ranks: make([]*VenueRank, 0, len(v.ranks))}
+	for _, r := range v.ranks {
+		rank := *r
+		venue.Ranks = append(venue.Ranks, &rank)
+	}
+	return venue
+}
+
+func (idx *availabilityIndex) getVenues() []*Venue {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	venues := make([]*Venue, 0, len(idx.venues))
+	for _, layout := range idx.venues {
+		venues = append(venues, layout.venue())
+	}
+	sort.Slice(venues, func(i, j int) bool { return venues[i].ID < venues[j].ID })
+	return venues
+}
+
+func (idx *availabilityIndex) hasVenue(venueID int64) bool {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	_, ok := idx.venues[venueID]
+	return ok
+}
+
+func (idx *availabilityIndex) addVenue(layout *venueLayout) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	layout.sortSheets()
+	idx.venues[layout.ID] = layout
+	for _, sheet := range layout.sheets {
+		idx.sheetsByID[sheet.ID] = sheet
+		idx.sheetsByRankNum[sheetKey{sheet.VenueID, sheet.Rank, sheet.Num}] = sheet
+	}
+}
+
+// validateVenue returns the error code if the venue definition is invalid.
+func validateVenue(name string, ranks []*VenueRank) string {
+	if name == "" {
+		return "invalid_name"
+	}
+	if len(ranks) == 0 {
+		return "invalid_rank"
+	}
+
+	seen := map[string]bool{}
+	total := 0
+	for _, r := range ranks {
+		if r == nil || len(r.Rank) > maxVenueRankLen || !venueRankRegexp.MatchString(r.Rank) || seen[r.Rank] {
+			return "invalid_rank"
+		}
+		seen[r.Rank] = true
+		if r.Price < 0 {
+			return "invalid_price"
+		}
+		if r.Rows != 0 || r.Columns != 0 {
+			if r.Rows <= 0 || r.Columns <= 0 || (r.Count != 0 && r.Count != r.Rows*r.Columns) {
+				return "invalid_layout"
+			}
+			r.Count = r.Rows * r.Columns
+		}
+		if r.Count <= 0 {
+			return "invalid_count"
+		}
+		total += r.Count
+	}
+	if total > maxVenueSheets {
+		return "invalid_count"
+	}
+	return ""
+}
+
+// createVenue inserts the venue and its sheets. Ranks with a layout are placed
+// row by row, one rank after another.
+func createVenue(name string, ranks []*VenueRank) (*venueLayout, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := tx.Exec("INSERT INTO venues (name) VALUES (?)", name)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	venueID, err := res.LastInsertId()
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	layout := &venueLayout{ID: venueID, Name: name}
+	rowOffset := 0
+	for _, r := range ranks {
+		for i := 0; i < r.Count; i++ {
+			sheet := &Sheet{
+				VenueID: venueID,
+				Rank:    r.Rank,
+				Num:     int64(i + 1),
+				Price:   r.Price,
+			}
+			if r.Columns > 0 {
+				sheet.Row = int64(rowOffset + i/r.Columns + 1)
+				sheet.Column = int64(i%r.Columns + 1)
+			}
+			res, err := tx.Exec("INSERT INTO sheets (venue_id, `rank`, num, price, seat_row, seat_column) VALUES (?, ?, ?, ?, ?, ?)", sheet.VenueID, sheet.Rank, sheet.Num, sheet.Price, sheet.Row, sheet.Column)
+			if err != nil {
+				tx.Rollback()
+				return nil, err
+			}
+			if sheet.ID, err = res.LastInsertId(); err != nil {
+				tx.Rollback()
+				return nil, err
+			}
+			layout.sheets = append(layout.sheets, sheet)
+		}
+		rowOffset += r.Rows
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return layout, nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+var (
+	errAlreadyWaiting = errors.New("already waiting")
+	errNotWaiting     = errors.New("not waiting")
+)
+
+type WaitlistEntry struct {
+	ID        int64      `json:"id"`
+	EventID   int64      `json:"event_id"`
+	SheetRank string     `json:"sheet_rank"`
+	UserID    int64      `json:"-"`
+	CreatedAt *time.Time `json:"-"`
+
+	Position int   `json:"position,omitempty"`
+	Hold     *Hold `json:"hold,omitempty"`
+}
+
+// joinWaitlist appends the user to the waitlist of the event and rank. It
+// returns errAlreadyWaiting if the user is waiting there.
+func joinWaitlist(eventID, userID int64, rank string) (*WaitlistEntry, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	// Lock the user, so that concurrent joins of the user are serialized.
+	var id int64
+	if err := tx.QueryRow("SELECT id FROM users WHERE id = ? FOR UPDATE", userID).Scan(&id); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	var waiting bool
+	if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM waitlist_entries WHERE event_id = ? AND sheet_rank = ? AND user_id = ? AND offered_at IS NULL AND canceled_at IS NULL)", eventID, rank, userID).Scan(&waiting); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if waiting {
+		tx.Rollback()
+		return nil, errAlreadyWaiting
+	}
+
+	createdAt := time.Now().UTC().Truncate(time.Microsecond)
+	res, err := tx.Exec("INSERT INTO waitlist_entries (event_id, sheet_rank, user_id, created_at) VALUES (?, ?, ?, ?)", eventID, rank, userID, createdAt.Format("2006-01-02 15:04:05.000000"))
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	entryID, err := res.LastInsertId()
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	entry := &WaitlistEntry{
+		ID:        entryID,
+		EventID:   eventID,
+		SheetRank: rank,
+		UserID:    userID,
+		CreatedAt: &createdAt,
+	}
+	if err := tx.QueryRow("SELECT COUNT(*) FROM waitlist_entries WHERE event_id = ? AND sheet_rank = ? AND offered_at IS NULL AND canceled_at IS NULL AND id <= ?", eventID, rank, entryID).Scan(&entry.Position); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+func leaveWaitlist(eventID, userID int64, rank string) error {
+	res, err := db.Exec("UPDATE waitlist_entries SET canceled_at = ? WHERE event_id = ? AND sheet_rank = ? AND user_id = ? AND offered_at IS NULL AND canceled_at IS NULL", time.Now().UTC().Format("2006-01-02 15:04:05.000000"), eventID, rank, userID)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errNotWaiting
+	}
+	return nil
+}
+
+// offerSheetToWaitlist holds the sheet for the first user waiting for its rank
+// within tx. It returns nil if the sheet is not free or nobody is waiting.
+func offerSheetToWaitlist(tx *sql.Tx, eventID int64, sheet Sheet) (*Hold, error) {
+	free, err := lockFreeSheets(tx, eventID, []Sheet{sheet})
+	if err != nil || !free {
+		return nil, err
+	}
+
+	var entryID, userID int64
+	if err := tx.QueryRow("SELECT id, user_id FROM waitlist_entries WHERE event_id = ? AND sheet_rank = ? AND offered_at IS NULL AND canceled_at IS NULL ORDER BY id LIMIT 1 FOR UPDATE", eventID, sheet.Rank).Scan(&entryID, &userID); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	hold, err := insertHold(tx, eventID, userID, sheet, defaultHoldMinutes*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec("UPDATE waitlist_entries SET offered_at = ?, hold_id = ? WHERE id = ?", hold.HeldAt.Format("2006-01-02 15:04:05.000000"), hold.ID, entryID); err != nil {
+		return nil, err
+	}
+	return hold, nil
+}
+
+// getUserWaitlist returns the waiting entries of the user with their position,
+// and the offered entries whose hold is still active.
+func getUserWaitlist(userID int64) ([]*WaitlistEntry, error) {
+	rows, err := db.Query("SELECT w.id, w.event_id, w.sheet_rank, (SELECT COUNT(*) FROM waitlist_entries x WHERE x.event_id = w.event_id AND x.sheet_rank = w.sheet_rank AND x.offered_at IS NULL AND x.canceled_at IS NULL AND x.id <= w.id) FROM waitlist_entries w WHERE w.user_id = ? AND w.offered_at IS NULL AND w.canceled_at IS NULL ORDER BY w.id", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []*WaitlistEntry{}
+	for rows.Next() {
+		entry := WaitlistEntry{UserID: userID}
+		if err := rows.Scan(&entry.ID, &entry.EventID, &entry.SheetRank, &entry.Position); err != nil {
+			return nil, err
+		}
+		entries = append(entries, &entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC().Format("2006-01-02 15:04:05.000000")
+	rows, err = db.Query("SELECT w.id, w.event_id, w.sheet_rank, h.id, h.sheet_id, h.expires_at, s.num FROM waitlist_entries w INNER JOIN holds h ON h.id = w.hold_id INNER JOIN sheets s ON s.id = h.sheet_id WHERE w.user_id = ? AND h.released_at IS NULL AND h.expires_at > ? ORDER BY w.id", userID, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		entry := WaitlistEntry{UserID: userID}
+		hold := Hold{UserID: userID}
+		if err := rows.Scan(&entry.ID, &entry.EventID, &entry.SheetRank, &hold.ID, &hold.SheetID, &hold.ExpiresAt, &hold.SheetNum); err != nil {
+			return nil, err
+		}
+		hold.EventID = entry.EventID
+		hold.SheetRank = entry.SheetRank
+		hold.ExpiresAtUnix = hold.ExpiresAt.Unix()
+		entry.Hold = &hold
+		entries = append(entries, &entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
@@ -0,0 +1,663 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	webhookEventCreated        = "event.created"
+	webhookEventPublished      = "event.published"
+	webhookEventClosed         = "event.closed"
+	webhookReservationCreated  = "reservation.created"
+	webhookReservationCanceled = "reservation.canceled"
+	webhookRankSoldOut         = "rank.sold_out"
+
+	webhookDeliveryPending   = "pending"
+	webhookDeliveryDelivered = "delivered"
+	webhookDeliveryFailed    = "failed"
+
+	webhookInterval    = time.Second
+	webhookBatchSize   = 100
+	webhookMaxAttempts = 8
+	webhookLease       = time.Minute
+	webhookTimeout     = 5 * time.Second
+
+	defaultWebhookDeliveriesLimit = 100
+	maxWebhookDeliveriesLimit     = 1000
+
+	webhookEventHeader     = "X-Torb-Event"
+	webhookDeliveryHeader  = "X-Torb-Delivery"
+	webhookSignatureHeader = "X-Torb-Signature"
+)
+
+var webhookEventTypes = []string{
+	webhookEventCreated,
+	webhookEventPublished,
+	webhookEventClosed,
+	webhookReservationCreated,
+	webhookReservationCanceled,
+	webhookRankSoldOut,
+}
+
+var (
+	errWebhookNotFound   = errors.New("webhook not found")
+	errDeliveryNotFound  = errors.New("webhook delivery not found")
+	errDeliveryNotFailed = errors.New("webhook delivery not failed")
+	errWebhookAddrDenied = errors.New("webhook address denied")
+)
+
+// webhookClient connects only to the addresses webhookAddrAllowed allows,
+// whatever the host resolves to when sending, and never follows redirects.
+var webhookClient = &http.Client{
+	Timeout:   webhookTimeout,
+	Transport: &http.Transport{DialContext: dialWebhook},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// webhookDeniedNets are the private and shared address ranges, so that
+// endpoints never reach the hosts on our side.
+var webhookDeniedNets []*net.IPNet
+
+func init() {
+	for _, cidr := range []string{"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7"} {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		webhookDeniedNets = append(webhookDeniedNets, ipNet)
+	}
+}
+
+func webhookAddrAllowed(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return false
+	}
+	for _, ipNet := range webhookDeniedNets {
+		if ipNet.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// lookupWebhookHost resolves the host of an endpoint. It returns
+// errWebhookAddrDenied if any of the addresses is not allowed.
+func lookupWebhookHost(ctx context.Context, host string) ([]net.IP, error) {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		if !webhookAddrAllowed(addr.IP) {
+			return nil, errWebhookAddrDenied
+		}
+		ips = append(ips, addr.IP)
+	}
+	return ips, nil
+}
+
+func dialWebhook(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := lookupWebhookHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var dialer net.Dialer
+	for _, ip := range ips {
+		var conn net.Conn
+		if conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port)); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// WebhookEndpoint receives the event types it subscribes to, or all of them if
+// none. The secret is never shown once registered.
+type WebhookEndpoint struct {
+	ID         int64      `json:"id"`
+	URL        string     `json:"url"`
+	Secret     string     `json:"-"`
+	EventTypes []string   `json:"event_types"`
+	CreatedAt  *time.Time `json:"-"`
+
+	CreatedAtUnix int64 `json:"created_at"`
+}
+
+type WebhookDelivery struct {
+	ID          int64           `json:"id"`
+	EndpointID  int64           `json:"endpoint_id"`
+	EventType   string          `json:"type"`
+	Data        json.RawMessage `json:"data"`
+	Status      string          `json:"status"`
+	Attempts    int             `json:"attempts"`
+	LastError   *string         `json:"last_error"`
+	CreatedAt   *time.Time      `json:"-"`
+	DeliveredAt *time.Time      `json:"-"`
+
+	CreatedAtUnix   int64             `json:"created_at"`
+	DeliveredAtUnix *int64            `json:"delivered_at"`
+	History         []*WebhookAttempt `json:"history"`
+}
+
+// WebhookAttempt is a log entry of a delivery attempt. StatusCode is nil if no
+// response came back.
+type WebhookAttempt struct {
+	StatusCode  *int    `json:"status_code"`
+	Error       *string `json:"error"`
+	DurationMS  int64   `json:"duration_ms"`
+	AttemptedAt int64   `json:"attempted_at"`
+}
+
+// body is what the endpoint receives, signed with its secret.
+func (d *WebhookDelivery) body() ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"id":         d.ID,
+		"type":       d.EventType,
+		"created_at": d.CreatedAt.Unix(),
+		"data":       d.Data,
+	})
+}
+
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// validateWebhookEndpoint returns the error code for resError if the endpoint
+// definition is invalid. The host must resolve to public addresses only.
+func validateWebhookEndpoint(endpoint *WebhookEndpoint) string {
+	u, err := url.Parse(endpoint.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || len(endpoint.URL) > 255 {
+		return "invalid_url"
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+	if _, err := lookupWebhookHost(ctx, u.Hostname()); err != nil {
+		return "invalid_url"
+	}
+	if endpoint.Secret == "" || len(endpoint.Secret) > 255 {
+		return "invalid_secret"
+	}
+	seen := map[string]bool{}
+	for _, t := range endpoint.EventTypes {
+		valid := false
+		for _, known := range webhookEventTypes {
+			if t == known {
+				valid = true
+				break
+			}
+		}
+		if !valid || seen[t] {
+			return "invalid_event_type"
+		}
+		seen[t] = true
+	}
+	return ""
+}
+
+func createWebhookEndpoint(endpoint *WebhookEndpoint) error {
+	createdAt := time.Now().UTC().Truncate(time.Microsecond)
+	res, err := db.Exec("INSERT INTO webhook_endpoints (url, secret, event_types, created_at) VALUES (?, ?, ?, ?)", endpoint.URL, endpoint.Secret, strings.Join(endpoint.EventTypes, ","), createdAt.Format("2006-01-02 15:04:05.000000"))
+	if err != nil {
+		return err
+	}
+	endpoint.ID, err = res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	endpoint.CreatedAt = &createdAt
+	endpoint.CreatedAtUnix = createdAt.Unix()
+	return nil
+}
+
+func getWebhookEndpoints() ([]*WebhookEndpoint, error) {
+	rows, err := db.Query("SELECT id, url, event_types, created_at FROM webhook_endpoints WHERE deleted_at IS NULL ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	endpoints := []*WebhookEndpoint{}
+	for rows.Next() {
+		var endpoint WebhookEndpoint
+		var eventTypes string
+		if err := rows.Scan(&endpoint.ID, &endpoint.URL, &eventTypes, &endpoint.CreatedAt); err != nil {
+			return nil, err
+		}
+		endpoint.EventTypes = []string{}
+		if eventTypes != "" {
+			endpoint.EventTypes = strings.Split(eventTypes, ",")
+		}
+		endpoint.CreatedAtUnix = endpoint.CreatedAt.Unix()
+		endpoints = append(endpoints, &endpoint)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return endpoints, nil
+}
+
+// deleteWebhookEndpoint unregisters the endpoint, giving up its pending
+// deliveries. It returns errWebhookNotFound for an unknown endpoint.
+func deleteWebhookEndpoint(endpointID int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC().Format("2006-01-02 15:04:05.000000")
+	res, err := tx.Exec("UPDATE webhook_endpoints SET deleted_at = ? WHERE id = ? AND deleted_at IS NULL", now, endpointID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if deleted, err := res.RowsAffected(); err != nil || deleted == 0 {
+		tx.Rollback()
+		if err != nil {
+			return err
+		}
+		return errWebhookNotFound
+	}
+	if _, err := tx.Exec("UPDATE webhook_deliveries SET status = ?, last_error = ? WHERE endpoint_id = ? AND status = ?", webhookDeliveryFailed, "endpoint deleted", endpointID, webhookDeliveryPending); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// execer is either *sql.DB or *sql.Tx.
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// insertWebhookDeliveries queues the event to every endpoint subscribing to
+// it. Within a transaction, the event is sent if and only if it commits.
+func insertWebhookDeliveries(ex execer, eventType string, data interface{}) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC().Format("2006-01-02 15:04:05.000000")
+	_, err = ex.Exec("INSERT INTO webhook_deliveries (endpoint_id, event_type, payload, status, next_attempt_at, created_at) SELECT id, ?, ?, ?, ?, ? FROM webhook_endpoints WHERE deleted_at IS NULL AND (event_types = '' OR FIND_IN_SET(?, event_types))",
+		eventType, string(b), webhookDeliveryPending, now, now, eventType)
+	return err
+}
+
+// webhookEventData is the data of the event.* webhooks.
+func webhookEventData(event *Event) map[string]interface{} {
+	return map[string]interface{}{
+		"id":             event.ID,
+		"title":          event.Title,
+		"public":         event.PublicFg,
+		"closed":         event.ClosedFg,
+		"price":          event.Price,
+		"venue_id":       event.VenueID,
+		"start_at":       event.StartAtUnix,
+		"sales_open_at":  event.SalesOpenAtUnix,
+		"sales_close_at": event.SalesCloseAtUnix,
+	}
+}
+
+// webhookReservationData is the data of the reservation.* webhooks. Users are
+// left out, since they are not shared with partners.
+func webhookReservationData(r *Reservation) map[string]interface{} {
+	return map[string]interface{}{
+		"id":         r.ID,
+		"event_id":   r.EventID,
+		"sheet_rank": r.SheetRank,
+		"sheet_num":  r.SheetNum,
+		"price":      r.Price,
+	}
+}
+
+// insertRankSoldOutDeliveries queues rank.sold_out for the ranks of the sheets
+// which have no sheet left unreserved, held or not. The event must be locked
+// within tx before the sheets are reserved, so that exactly one of the orders
+// of the event sells out the rank.
+func insertRankSoldOutDeliveries(tx *sql.Tx, event *Event, sheets []Sheet) error {
+	counted := map[string]bool{}
+	for _, sheet := range sheets {
+		if counted[sheet.Rank] {
+			continue
+		}
+		counted[sheet.Rank] = true
+
+		var unreserved int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM sheets WHERE venue_id = ? AND `rank` = ? AND id NOT IN (SELECT sheet_id FROM reservations WHERE event_id = ? AND canceled_at IS NULL LOCK IN SHARE MODE)", event.VenueID, sheet.Rank, event.ID).Scan(&unreserved); err != nil {
+			return err
+		}
+		if unreserved > 0 {
+			continue
+		}
+		if err := insertWebhookDeliveries(tx, webhookRankSoldOut, map[string]interface{}{
+			"event_id": event.ID,
+			"rank":     sheet.Rank,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func dispatchWebhooks() {
+	for range time.Tick(webhookInterval) {
+		if err := deliverWebhooks(); err != nil {
+			log.Println("failed to deliver webhooks:", err)
+		}
+	}
+}
+
+// deliverWebhooks sends the deliveries due, and logs every attempt. A
+// delivery which keeps failing is given up after webhookMaxAttempts, until it
+// is replayed.
+func deliverWebhooks() error {
+	now := time.Now().UTC()
+	rows, err := db.Query("SELECT d.id, d.endpoint_id, d.event_type, d.payload, d.attempts, d.next_attempt_at, d.created_at, w.url, w.secret FROM webhook_deliveries d INNER JOIN webhook_endpoints w ON w.id = d.endpoint_id WHERE d.status = ? AND d.next_attempt_at <= ? ORDER BY d.next_attempt_at LIMIT ?", webhookDeliveryPending, now.Format("2006-01-02 15:04:05.000000"), webhookBatchSize)
+	if err != nil {
+		return err
+	}
+	type due struct {
+		delivery      WebhookDelivery
+		nextAttemptAt time.Time
+		url           string
+		secret        string
+	}
+	var dues []*due
+	for rows.Next() {
+		var d due
+		var payload string
+		if err := rows.Scan(&d.delivery.ID, &d.delivery.EndpointID, &d.delivery.EventType, &payload, &d.delivery.Attempts, &d.nextAttemptAt, &d.delivery.CreatedAt, &d.url, &d.secret); err != nil {
+			rows.Close()
+			return err
+		}
+		d.delivery.Data = json.RawMessage(payload)
+		dues = append(dues, &d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	// Each delivery is taken right before it is sent, so that the lease
+	// outlives the request however long the batch takes.
+	for _, d := range dues {
+		leased := time.Now().UTC().Add(webhookLease)
+		res, err := db.Exec("UPDATE webhook_deliveries SET next_attempt_at = ? WHERE id = ? AND next_attempt_at = ? AND status = ?", leased.Format("2006-01-02 15:04:05.000000"), d.delivery.ID, d.nextAttemptAt.Format("2006-01-02 15:04:05.000000"), webhookDeliveryPending)
+		if err != nil {
+			return err
+		}
+		if taken, err := res.RowsAffected(); err != nil || taken == 0 {
+			// taken by another server
+			continue
+		}
+
+		attempt, derr := postWebhook(&d.delivery, d.url, d.secret)
+		if err := recordWebhookAttempt(&d.delivery, attempt, derr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// postWebhook sends the delivery to the endpoint. Non-2xx responses are
+// errors.
+func postWebhook(d *WebhookDelivery, endpointURL, secret string) (*WebhookAttempt, error) {
+	attempt := &WebhookAttempt{AttemptedAt: time.Now().Unix()}
+	body, err := d.body()
+	if err != nil {
+		return attempt, err
+	}
+	req, err := http.NewRequest("POST", endpointURL, bytes.NewReader(body))
+	if err != nil {
+		return attempt, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookEventHeader, d.EventType)
+	req.Header.Set(webhookDeliveryHeader, strconv.FormatInt(d.ID, 10))
+	req.Header.Set(webhookSignatureHeader, signWebhook(secret, body))
+
+	start := time.Now()
+	res, err := webhookClient.Do(req)
+	attempt.DurationMS = int64(time.Since(start) / time.Millisecond)
+	if err != nil {
+		return attempt, err
+	}
+	res.Body.Close()
+	attempt.StatusCode = &res.StatusCode
+	if res.StatusCode/100 != 2 {
+		return attempt, fmt.Errorf("endpoint responded %d", res.StatusCode)
+	}
+	return attempt, nil
+}
+
+// recordWebhookAttempt logs the attempt and schedules the next one if it
+// failed.
+func recordWebhookAttempt(d *WebhookDelivery, attempt *WebhookAttempt, derr error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	var errValue interface{}
+	if derr != nil {
+		errValue = truncateError(derr)
+	}
+	if _, err := tx.Exec("INSERT INTO webhook_attempts (delivery_id, status_code, error, duration_ms, attempted_at) VALUES (?, ?, ?, ?, ?)", d.ID, attempt.StatusCode, errValue, attempt.DurationMS, time.Unix(attempt.AttemptedAt, 0).UTC().Format("2006-01-02 15:04:05.000000")); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	d.Attempts++
+	now := time.Now().UTC()
+	switch {
+	case derr == nil:
+		_, err = tx.Exec("UPDATE webhook_deliveries SET status = ?, attempts = ?, last_error = NULL, delivered_at = ? WHERE id = ?", webhookDeliveryDelivered, d.Attempts, now.Format("2006-01-02 15:04:05.000000"), d.ID)
+	case d.Attempts >= webhookMaxAttempts:
+		_, err = tx.Exec("UPDATE webhook_deliveries SET status = ?, attempts = ?, last_error = ? WHERE id = ?", webhookDeliveryFailed, d.Attempts, errValue, d.ID)
+	default:
+		_, err = tx.Exec("UPDATE webhook_deliveries SET attempts = ?, last_error = ?, next_attempt_at = ? WHERE id = ?", d.Attempts, errValue, now.Add(retryBackoff(d.Attempts)).Format("2006-01-02 15:04:05.000000"), d.ID)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// webhookDeliveriesQuery parses the status filter and the cursor and limit
+// query parameters of the deliveries, which go back from the latest. It
+// returns the error code for resError if they are invalid.
+func webhookDeliveriesQuery(c echo.Context) (string, []interface{}, int, string) {
+	var cond string
+	var args []interface{}
+	if status := c.QueryParam("status"); status != "" {
+		if status != webhookDeliveryPending && status != webhookDeliveryDelivered && status != webhookDeliveryFailed {
+			return "", nil, 0, "invalid_status"
+		}
+		cond += " AND status = ?"
+		args = append(args, status)
+	}
+	if s := c.QueryParam("cursor"); s != "" {
+		cursor, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || cursor <= 0 {
+			return "", nil, 0, "invalid_cursor"
+		}
+		cond += " AND id < ?"
+		args = append(args, cursor)
+	}
+	limit := defaultWebhookDeliveriesLimit
+	if s := c.QueryParam("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 || n > maxWebhookDeliveriesLimit {
+			return "", nil, 0, "invalid_limit"
+		}
+		limit = n
+	}
+	return cond, args, limit, ""
+}
+
+// getWebhookDeliveries returns the deliveries to the endpoint matching cond
+// from the latest with their attempts, and the cursor to the next page if any.
+// It returns errWebhookNotFound for an unknown endpoint.
+func getWebhookDeliveries(endpointID int64, cond string, args []interface{}, limit int) ([]*WebhookDelivery, *int64, error) {
+	var exists bool
+	if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM webhook_endpoints WHERE id = ? AND deleted_at IS NULL)", endpointID).Scan(&exists); err != nil {
+		return nil, nil, err
+	}
+	if !exists {
+		return nil, nil, errWebhookNotFound
+	}
+
+	rows, err := db.Query("SELECT id, endpoint_id, event_type, payload, status, attempts, last_error, created_at, delivered_at FROM webhook_deliveries WHERE endpoint_id = ?"+cond+" ORDER BY id DESC LIMIT ?", append(append([]interface{}{endpointID}, args...), limit+1)...)
+	if err != nil {
+		return nil, nil, err
+	}
+	deliveries, err := scanWebhookDeliveries(rows)
+	rows.Close()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var next *int64
+	if len(deliveries) > limit {
+		deliveries = deliveries[:limit]
+		next = &deliveries[limit-1].ID
+	}
+	if err := fillWebhookHistory(deliveries); err != nil {
+		return nil, nil, err
+	}
+	return deliveries, next, nil
+}
+
+func scanWebhookDeliveries(rows *sql.Rows) ([]*WebhookDelivery, error) {
+	deliveries := []*WebhookDelivery{}
+	for rows.Next() {
+		var d WebhookDelivery
+		var payload string
+		if err := rows.Scan(&d.ID, &d.EndpointID, &d.EventType, &payload, &d.Status, &d.Attempts, &d.LastError, &d.CreatedAt, &d.DeliveredAt); err != nil {
+			return nil, err
+		}
+		d.Data = json.RawMessage(payload)
+		d.CreatedAtUnix = d.CreatedAt.Unix()
+		if d.DeliveredAt != nil {
+			unix := d.DeliveredAt.Unix()
+			d.DeliveredAtUnix = &unix
+		}
+		d.History = []*WebhookAttempt{}
+		deliveries = append(deliveries, &d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+// fillWebhookHistory fills the attempts of the deliveries, the oldest first.
+func fillWebhookHistory(deliveries []*WebhookDelivery) error {
+	if len(deliveries) == 0 {
+		return nil
+	}
+	byID := map[int64]*WebhookDelivery{}
+	args := make([]interface{}, 0, len(deliveries))
+	for _, d := range deliveries {
+		byID[d.ID] = d
+		args = append(args, d.ID)
+	}
+
+	rows, err := db.Query("SELECT delivery_id, status_code, error, duration_ms, attempted_at FROM webhook_attempts WHERE delivery_id IN (?"+strings.Repeat(", ?", len(args)-1)+") ORDER BY id", args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var deliveryID int64
+		var attempt WebhookAttempt
+		var attemptedAt time.Time
+		if err := rows.Scan(&deliveryID, &attempt.StatusCode, &attempt.Error, &attempt.DurationMS, &attemptedAt); err != nil {
+			return err
+		}
+		attempt.AttemptedAt = attemptedAt.Unix()
+		byID[deliveryID].History = append(byID[deliveryID].History, &attempt)
+	}
+	return rows.Err()
+}
+
+// replayWebhookDelivery sends a failed delivery to the endpoint again, with
+// its retries. It returns errDeliveryNotFound for an unknown delivery of the
+// endpoint, or of an endpoint deleted, and errDeliveryNotFailed unless it has
+// failed.
+func replayWebhookDelivery(endpointID, deliveryID int64) (*WebhookDelivery, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	var status string
+	var deleted bool
+	if err := tx.QueryRow("SELECT d.status, w.deleted_at IS NOT NULL FROM webhook_deliveries d INNER JOIN webhook_endpoints w ON w.id = d.endpoint_id WHERE d.id = ? AND d.endpoint_id = ? FOR UPDATE", deliveryID, endpointID).Scan(&status, &deleted); err != nil {
+		tx.Rollback()
+		if err == sql.ErrNoRows {
+			return nil, errDeliveryNotFound
+		}
+		return nil, err
+	}
+	if deleted {
+		tx.Rollback()
+		return nil, errDeliveryNotFound
+	}
+	if status != webhookDeliveryFailed {
+		tx.Rollback()
+		return nil, errDeliveryNotFailed
+	}
+
+	if _, err := tx.Exec("UPDATE webhook_deliveries SET status = ?, attempts = 0, next_attempt_at = ? WHERE id = ?", webhookDeliveryPending, time.Now().UTC().Format("2006-01-02 15:04:05.000000"), deliveryID); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query("SELECT id, endpoint_id, event_type, payload, status, attempts, last_error, created_at, delivered_at FROM webhook_deliveries WHERE id = ?", deliveryID)
+	if err != nil {
+		return nil, err
+	}
+	deliveries, err := scanWebhookDeliveries(rows)
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+	if len(deliveries) == 0 {
+		return nil, errDeliveryNotFound
+	}
+	if err := fillWebhookHistory(deliveries); err != nil {
+		return nil, err
+	}
+	return deliveries[0], nil
+}
@@ -105,6 +105,14 @@ const API = (() => {
         }).then(handleJSON).then(handleJSONError);
       },
     },
+    Dashboard: {
+      get () {
+        return fetch('/admin/api/dashboard', {
+          method: 'GET',
+          credentials: 'same-origin',
+        }).then(handleJSON).then(handleJSONError);
+      },
+    },
     Report: {
       getEventSales (eventId) {
         window.open(`/admin/api/reports/events/${eventId}/sales`);
@@ -162,14 +170,45 @@ const EventList = new Vue({
   },
 });
 
+const Dashboard = new Vue({
+  el: '.dashboard',
+  data () {
+    const currentAdministrator = DOM.appWrapper.data('administrator');
+    return {
+      dashboard: [],
+      isAdmin: currentAdministrator !== null,
+    };
+  },
+  mounted () {
+    if (this.isAdmin) this.reload();
+  },
+  methods: {
+    ranks (event) {
+      return Object.keys(event.ranks).sort();
+    },
+    reload () {
+      API.Dashboard.get().then(dashboard => {
+        this.dashboard = dashboard;
+      }).catch(err => {
+        showError(err);
+      });
+    },
+  },
+});
+
 const EventModal = new Vue({
   el: '#event-modal .modal-dialog',
   data () {
     return {
       event: { sheets: { S:{}, A:{}, B:{}, C:{} } },
-      ranks: ['S', 'A', 'B', 'C'],
     };
   },
+  computed: {
+    ranks () {
+      const sheets = this.event.sheets;
+      return Object.keys(sheets).sort((a, b) => (sheets[b].price - sheets[a].price) || (a < b ? -1 : a > b ? 1 : 0));
+    },
+  },
   methods: {
     divRange (n ,d) {
       const max = Math.floor(n / d);
@@ -253,6 +292,8 @@ const MenuBar = new Vue({
         this.currentAdministrator = null;
         EventList.$data.isAdmin = false;
         EventList.$data.events = [];
+        Dashboard.$data.isAdmin = false;
+        Dashboard.$data.dashboard = [];
       });
     },
     downloadSalesReport () {
@@ -281,6 +322,8 @@ new Vue({
         hideWaitingDialog();
         EventList.$data.isAdmin = true;
         EventList.$data.events = events;
+        Dashboard.$data.isAdmin = true;
+        Dashboard.reload();
       }).catch(err => {
         hideWaitingDialog();
         showError(err);
@@ -170,9 +170,14 @@ const EventModal = new Vue({
   data () {
     return {
       event: { sheets: { S:{}, A:{}, B:{}, C:{} } },
-      ranks: ['S', 'A', 'B', 'C'],
     };
   },
+  computed: {
+    ranks () {
+      const sheets = this.event.sheets;
+      return Object.keys(sheets).sort((a, b) => (sheets[b].price - sheets[a].price) || (a < b ? -1 : a > b ? 1 : 0));
+    },
+  },
   methods: {
     divRange (n ,d) {
       const max = Math.floor(n / d);